@@ -25,6 +25,15 @@ if (-not (Test-Path "tailwindcss.exe")) {
 Write-Host "🔧 Generating Tailwind CSS file..."
 .\tailwindcss.exe -i ./static/css/input.css -o ./static/css/output.css --minify
 
+Write-Host "📥 Checking for vendored assets"
+if (-not (Test-Path "static/vendor/htmx.min.js")) {
+    New-Item -ItemType Directory -Force -Path "static/vendor/fontawesome" | Out-Null
+    Invoke-WebRequest -Uri "https://unpkg.com/htmx.org@1.9.6/dist/htmx.min.js" -OutFile "static/vendor/htmx.min.js"
+    Invoke-WebRequest -Uri "https://registry.npmjs.org/@fortawesome/fontawesome-free/-/fontawesome-free-6.0.0.tgz" -OutFile "fontawesome.tgz"
+    tar -xzf fontawesome.tgz -C static/vendor/fontawesome --strip-components=1 package/css/all.min.css package/webfonts
+    Remove-Item fontawesome.tgz
+}
+
 Write-Host "🔧 Generating templ files..."
 templ generate
 Write-Host ""
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"gopos/config"
+	"gopos/database"
+	"gopos/services"
+)
+
+const commandUsage = `Usage:
+  gopos [flags]                  Start the server
+  gopos [flags] backup           Write a backup of the database to the backup directory
+  gopos [flags] restore <file>   Replace the database with a backup (stop the server first)
+  gopos [flags] audit-verify     Check the hash chain of the audit log and its checkpoints
+  gopos [flags] audit-checkpoint Write a signed checkpoint of the audit log
+  gopos [flags] audit-archive [days]
+                                 Archive audit log entries older than the retention period
+
+Flags:
+  --config <file>     Configuration file, instead of searching the default locations
+  --listen <address>  Address to listen on, e.g. :8080 or 127.0.0.1:8080
+
+Every setting of the configuration file can also be set with an environment
+variable named after it, e.g. GOPOS_SESSION_KEY for session.key.`
+
+// openCurrentDatabase opens the database for commands that need the schema of this
+// version. They leave migrating to the server.
+func openCurrentDatabase(cfg *config.Config) (*sql.DB, error) {
+	db, err := database.Open(databaseSource(cfg), databaseOptions(cfg))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %v", err)
+	}
+	version, err := database.GetSchemaVersion(context.Background(), db)
+	if err == nil && version != database.SchemaVersion() {
+		err = fmt.Errorf("database has schema version %d, expected %d; start the server once to migrate it", version, database.SchemaVersion())
+	}
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// runCommand runs a maintenance command given on the command line instead of starting the server
+func runCommand(cfg *config.Config, args []string) error {
+	switch args[0] {
+	case "backup":
+		db, err := database.Open(databaseSource(cfg), databaseOptions(cfg))
+		if err != nil {
+			return fmt.Errorf("failed to open database: %v", err)
+		}
+		defer db.Close()
+
+		services.InitBackupService(cfg)
+		backup, err := services.CreateBackup(db)
+		if err != nil {
+			return fmt.Errorf("backup failed: %v", err)
+		}
+		fmt.Println(filepath.Join(services.BackupDirectory(), backup.Name))
+		return nil
+
+	case "restore":
+		if len(args) != 2 {
+			return fmt.Errorf("restore needs the backup file\n%s", commandUsage)
+		}
+		if cfg.Database.Driver == database.DriverPostgres {
+			return fmt.Errorf("restore is only supported for SQLite databases, use pg_restore for PostgreSQL")
+		}
+
+		// Names from the backup page are looked up in the backup directory
+		backupPath := args[1]
+		if _, err := os.Stat(backupPath); os.IsNotExist(err) {
+			services.InitBackupService(cfg)
+			if path, err := services.BackupPath(backupPath); err == nil {
+				backupPath = path
+			}
+		}
+
+		version, err := database.ValidateBackup(backupPath)
+		if err != nil {
+			return fmt.Errorf("cannot restore %s: %v", backupPath, err)
+		}
+		keptPath, err := database.Restore(cfg.Database.Path, backupPath)
+		if err != nil {
+			return fmt.Errorf("restore failed: %v", err)
+		}
+
+		fmt.Printf("Restored %s (schema version %d) to %s\n", backupPath, version, cfg.Database.Path)
+		if keptPath != "" {
+			fmt.Printf("The previous database was kept as %s\n", keptPath)
+		}
+		if version < database.SchemaVersion() {
+			fmt.Printf("The database will be migrated to schema version %d on the next start\n", database.SchemaVersion())
+		}
+		return nil
+
+	case "audit-verify":
+		db, err := openCurrentDatabase(cfg)
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+
+		services.InitAuditService(cfg)
+		report, err := services.VerifyAudit(db)
+		if err != nil {
+			return fmt.Errorf("verification failed: %v", err)
+		}
+		if report.BrokenID != 0 {
+			fmt.Printf("Hash chain broken at entry %d (%s), %d entries checked\n", report.BrokenID, report.Problem, report.Entries)
+		} else if report.LastID != 0 {
+			fmt.Printf("Hash chain intact, %d entries checked, head %d %s\n", report.Entries, report.LastID, report.LastHash)
+		} else {
+			fmt.Println("The audit log is empty")
+		}
+		for _, check := range report.Checkpoints {
+			result := "ok"
+			if check.Problem != "" {
+				result = check.Problem
+			}
+			fmt.Printf("Checkpoint %s (entry %d): %s\n", check.Checkpoint.Name, check.Checkpoint.LastID, result)
+		}
+		for _, check := range report.Archives {
+			result := "ok"
+			if check.Problem != "" {
+				result = check.Problem
+			}
+			if check.BrokenID != 0 {
+				result += fmt.Sprintf(" at entry %d", check.BrokenID)
+			}
+			fmt.Printf("Archive %s (entries %d to %d): %s\n", check.Archive.Name, check.Archive.FirstID, check.Archive.LastID, result)
+		}
+		if !report.Intact() {
+			return fmt.Errorf("the audit log does not match its hash chain, checkpoints or archives")
+		}
+		return nil
+
+	case "audit-checkpoint":
+		db, err := openCurrentDatabase(cfg)
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+
+		services.InitAuditService(cfg)
+		checkpoint, err := services.CreateAuditCheckpoint(db)
+		if err != nil {
+			return fmt.Errorf("checkpoint failed: %v", err)
+		}
+		fmt.Println(filepath.Join(services.CheckpointDirectory(), checkpoint.Name))
+		return nil
+
+	case "audit-archive":
+		services.InitAuditService(cfg)
+		days := services.AuditRetention()
+		if len(args) > 1 {
+			var err error
+			if days, err = strconv.Atoi(args[1]); err != nil || days <= 0 {
+				return fmt.Errorf("invalid number of days %q", args[1])
+			}
+		}
+		if days <= 0 {
+			return fmt.Errorf("audit.retention_days is not set, pass the number of days to keep")
+		}
+
+		db, err := openCurrentDatabase(cfg)
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+
+		archive, err := services.ArchiveAuditLog(db, time.Now().AddDate(0, 0, -days))
+		if err != nil {
+			return fmt.Errorf("archiving failed: %v", err)
+		}
+		if archive.Entries == 0 {
+			fmt.Printf("No entries older than %d days\n", days)
+			return nil
+		}
+		fmt.Printf("Archived entries %d to %d to %s\n", archive.FirstID, archive.LastID,
+			filepath.Join(services.ArchiveDirectory(), archive.Name))
+		return nil
+
+	case "help", "-h", "--help":
+		fmt.Println(commandUsage)
+		return nil
+
+	default:
+		return fmt.Errorf("unknown command %q\n%s", args[0], commandUsage)
+	}
+}
@@ -0,0 +1,34 @@
+package database
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+)
+
+// AuditRecord is the content of an audit log row that its hash covers. Every
+// row stores the hash of the row before it, so changing or deleting a row
+// breaks the chain at the next one.
+type AuditRecord struct {
+	UserID     int    `json:"user_id"`
+	Action     string `json:"action"`
+	EntityType string `json:"entity_type"`
+	EntityID   int    `json:"entity_id"`
+	Details    string `json:"details"`
+	Changes    string `json:"changes"` // JSON as stored
+	IP         string `json:"ip"`
+	UserAgent  string `json:"user_agent"`
+	CreatedAt  string `json:"created_at"` // In the canonical storage format
+}
+
+// Hash returns the SHA-256 hash of the record chained to the hash of the
+// previous row, which is "" for the first row
+func (r AuditRecord) Hash(prevHash string) string {
+	// A JSON array separates the fields unambiguously
+	content, _ := json.Marshal([]any{
+		prevHash, r.UserID, r.Action, r.EntityType, r.EntityID,
+		r.Details, r.Changes, r.IP, r.UserAgent, r.CreatedAt,
+	})
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
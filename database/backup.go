@@ -0,0 +1,151 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ErrBackupUnsupported is returned by Backup for PostgreSQL databases, which are
+// backed up with the tools of the database server like pg_dump
+var ErrBackupUnsupported = errors.New("backups are only supported for SQLite databases, use pg_dump for PostgreSQL")
+
+// requiredTables must exist in every database that can be restored
+var requiredTables = []string{"users", "products", "transactions", "transaction_items", "audit_log"}
+
+// Backup writes a consistent snapshot of the running database to path. VACUUM INTO
+// reads within a single transaction, so registers can keep writing meanwhile.
+func Backup(db *sql.DB, path string) error {
+	if DialectOf(db) != SQLite {
+		return ErrBackupUnsupported
+	}
+	if _, err := os.Stat(path); err == nil {
+		return fmt.Errorf("backup file %s already exists", path)
+	}
+	// VACUUM INTO does not accept parameters
+	_, err := db.Exec(fmt.Sprintf("VACUUM INTO '%s'", strings.ReplaceAll(path, "'", "''")))
+	return err
+}
+
+// ValidateBackup checks that the file at path is an intact GoPOS database this
+// build can use and returns its schema version
+func ValidateBackup(path string) (int, error) {
+	if _, err := os.Stat(path); err != nil {
+		return 0, err
+	}
+
+	db, err := sql.Open("sqlite", "file:"+path+"?mode=ro")
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+
+	var result string
+	if err := db.QueryRow("PRAGMA quick_check").Scan(&result); err != nil {
+		return 0, fmt.Errorf("not a readable SQLite database: %v", err)
+	}
+	if result != "ok" {
+		return 0, fmt.Errorf("database is damaged: %s", result)
+	}
+
+	for _, table := range requiredTables {
+		var exists bool
+		err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM sqlite_master WHERE type = 'table' AND name = ?)", table).Scan(&exists)
+		if err != nil {
+			return 0, err
+		}
+		if !exists {
+			return 0, fmt.Errorf("not a GoPOS database: table %s is missing", table)
+		}
+	}
+
+	version, err := GetSchemaVersion(context.Background(), db)
+	if err != nil {
+		return 0, err
+	}
+	if version > SchemaVersion() {
+		return version, fmt.Errorf("backup has schema version %d, this version of GoPOS supports up to %d", version, SchemaVersion())
+	}
+	return version, nil
+}
+
+// Restore replaces the database at dbPath with the backup at backupPath. The
+// server must not be running. The current database is kept next to it with the
+// suffix .before-restore-<time>; older backups are migrated on the next start.
+// It returns the path of the kept database, or "" if there was none.
+func Restore(dbPath, backupPath string) (string, error) {
+	if _, err := ValidateBackup(backupPath); err != nil {
+		return "", fmt.Errorf("invalid backup: %v", err)
+	}
+
+	// Copy next to the database first, so the final rename cannot leave a half written file
+	tmpPath := dbPath + ".restore"
+	if err := copyFile(backupPath, tmpPath); err != nil {
+		os.Remove(tmpPath)
+		return "", err
+	}
+
+	keptPath := ""
+	if _, err := os.Stat(dbPath); err == nil {
+		// Fold a pending write-ahead log into the database before keeping it
+		if db, err := sql.Open("sqlite", dbPath); err == nil {
+			db.Exec("PRAGMA wal_checkpoint(TRUNCATE)")
+			db.Close()
+		}
+		keptPath = fmt.Sprintf("%s.before-restore-%s", dbPath, time.Now().Format("20060102-150405"))
+		if err := os.Rename(dbPath, keptPath); err != nil {
+			os.Remove(tmpPath)
+			return "", err
+		}
+	}
+
+	// The write-ahead log of the old database belongs to the kept copy, it must not
+	// be applied to the restored one
+	for _, suffix := range []string{"-wal", "-shm"} {
+		var err error
+		if keptPath != "" {
+			err = os.Rename(dbPath+suffix, keptPath+suffix)
+		} else {
+			err = os.Remove(dbPath + suffix)
+		}
+		if err != nil && !os.IsNotExist(err) {
+			return keptPath, err
+		}
+	}
+
+	if err := os.Rename(tmpPath, dbPath); err != nil {
+		return keptPath, err
+	}
+	return keptPath, nil
+}
+
+func copyFile(from, to string) error {
+	source, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	if err := os.MkdirAll(filepath.Dir(to), 0755); err != nil {
+		return err
+	}
+	target, err := os.OpenFile(to, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(target, source); err != nil {
+		target.Close()
+		return err
+	}
+	if err := target.Sync(); err != nil {
+		target.Close()
+		return err
+	}
+	return target.Close()
+}
@@ -2,10 +2,12 @@ package database
 
 import (
 	"database/sql"
-	"log"
-	"time"
+
+	"gopos/logging"
 )
 
+var dbLog = logging.Component("database")
+
 func InitDB(db *sql.DB) error {
 	// Create tables
 	schema := `
@@ -56,6 +58,11 @@ func InitDB(db *sql.DB) error {
 		FOREIGN KEY (user_id) REFERENCES users(id)
 	);
 
+	CREATE TABLE IF NOT EXISTS settings (
+		key TEXT PRIMARY KEY,
+		value TEXT NOT NULL
+	);
+
 	CREATE INDEX IF NOT EXISTS idx_users_card_number ON users(card_number);
 	CREATE INDEX IF NOT EXISTS idx_products_barcode ON products(barcode);
 	CREATE INDEX IF NOT EXISTS idx_transactions_user_id ON transactions(user_id);
@@ -64,11 +71,25 @@ func InitDB(db *sql.DB) error {
 	CREATE INDEX IF NOT EXISTS idx_audit_log_created_at ON audit_log(created_at);
 	`
 
-	_, err := db.Exec(schema)
+	dialect := DialectOf(db)
+	if dialect == Postgres {
+		schema += `
+	CREATE TABLE IF NOT EXISTS schema_version (
+		version INTEGER NOT NULL
+	);
+	`
+	}
+
+	_, err := db.Exec(dialect.ddl(schema))
 	if err != nil {
 		return err
 	}
 
+	// Upgrade the schema of existing databases
+	if err := migrate(db); err != nil {
+		return err
+	}
+
 	// Check if admin user exists
 	var count int
 	err = db.QueryRow("SELECT COUNT(*) FROM users WHERE role = 'admin'").Scan(&count)
@@ -78,15 +99,14 @@ func InitDB(db *sql.DB) error {
 
 	// Create default admin user if none exists
 	if count == 0 {
-		now := time.Now()
 		_, err = db.Exec(`
 			INSERT INTO users (card_number, name, role, balance, created_at)
 			VALUES (?, ?, ?, ?, ?)
-		`, "ADMIN", "Administrator", "admin", 0.0, now)
+		`, "ADMIN", "Administrator", "admin", 0.0, Now())
 		if err != nil {
 			return err
 		}
-		log.Println("Created default admin user")
+		dbLog.Info("Created default admin user")
 	}
 
 	return nil
@@ -0,0 +1,53 @@
+package database
+
+import (
+	"database/sql"
+	"regexp"
+)
+
+// Dialect is the SQL dialect of a database. Queries are written for SQLite
+// and run unchanged on PostgreSQL; only the schema and the bookkeeping of
+// the schema version differ.
+type Dialect int
+
+const (
+	SQLite Dialect = iota
+	Postgres
+)
+
+func (d Dialect) String() string {
+	if d == Postgres {
+		return "PostgreSQL"
+	}
+	return "SQLite"
+}
+
+// DialectOf returns the dialect of a database opened with Open
+func DialectOf(db *sql.DB) Dialect {
+	if _, ok := db.Driver().(postgresDriver); ok {
+		return Postgres
+	}
+	return SQLite
+}
+
+// postgresTypes maps the SQLite column types of the schema to PostgreSQL. REAL
+// would only be single precision there.
+var postgresTypes = []struct {
+	pattern     *regexp.Regexp
+	replacement string
+}{
+	{regexp.MustCompile(`\bINTEGER PRIMARY KEY AUTOINCREMENT\b`), "BIGSERIAL PRIMARY KEY"},
+	{regexp.MustCompile(`\bREAL\b`), "DOUBLE PRECISION"},
+	{regexp.MustCompile(`\bDATETIME\b`), "TIMESTAMP"},
+}
+
+// ddl translates schema statements written for SQLite to the dialect
+func (d Dialect) ddl(statements string) string {
+	if d != Postgres {
+		return statements
+	}
+	for _, t := range postgresTypes {
+		statements = t.pattern.ReplaceAllString(statements, t.replacement)
+	}
+	return statements
+}
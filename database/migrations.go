@@ -0,0 +1,350 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+type migration struct {
+	description string
+	apply       func(tx *sql.Tx, dialect Dialect) error
+}
+
+// migrations upgrade existing databases step by step. The schema version is the
+// number of migrations that have been applied; SQLite stores it in PRAGMA
+// user_version, PostgreSQL in the schema_version table.
+var migrations = []migration{
+	{
+		description: "store balance after transaction and transaction description",
+		apply: execMigration(`
+			ALTER TABLE transactions ADD COLUMN balance_after REAL;
+			ALTER TABLE transactions ADD COLUMN description TEXT;
+		`),
+	},
+	{
+		description: "store all timestamps in UTC in the canonical format",
+		apply:       normalizeTimestamps("users", "products", "transactions", "audit_log"),
+	},
+	{
+		description: "server-side carts per register",
+		apply: execMigration(`
+			CREATE TABLE IF NOT EXISTS carts (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				register TEXT NOT NULL,
+				cashier_id INTEGER NOT NULL,
+				customer_id INTEGER,
+				status TEXT NOT NULL DEFAULT 'open' CHECK(status IN ('open', 'completed', 'discarded')),
+				transaction_id INTEGER,
+				created_at DATETIME NOT NULL,
+				updated_at DATETIME NOT NULL,
+				FOREIGN KEY (cashier_id) REFERENCES users(id),
+				FOREIGN KEY (customer_id) REFERENCES users(id),
+				FOREIGN KEY (transaction_id) REFERENCES transactions(id)
+			);
+
+			CREATE TABLE IF NOT EXISTS cart_items (
+				cart_id INTEGER NOT NULL,
+				product_id INTEGER NOT NULL,
+				quantity INTEGER NOT NULL CHECK(quantity > 0),
+				added_at DATETIME NOT NULL,
+				PRIMARY KEY (cart_id, product_id),
+				FOREIGN KEY (cart_id) REFERENCES carts(id),
+				FOREIGN KEY (product_id) REFERENCES products(id)
+			);
+
+			CREATE INDEX IF NOT EXISTS idx_carts_register_status ON carts(register, status);
+		`),
+	},
+	{
+		description: "idempotency keys for checkout submissions",
+		apply: func(tx *sql.Tx, dialect Dialect) error {
+			if err := addColumn(tx, dialect, "transactions", "idempotency_key", "TEXT"); err != nil {
+				return err
+			}
+			return execMigration(`
+				CREATE UNIQUE INDEX IF NOT EXISTS idx_transactions_idempotency_key
+				ON transactions(idempotency_key) WHERE idempotency_key IS NOT NULL;
+			`)(tx, dialect)
+		},
+	},
+	{
+		description: "keep cart items in the order they were scanned",
+		apply: func(tx *sql.Tx, dialect Dialect) error {
+			if err := addColumn(tx, dialect, "cart_items", "position", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+				return err
+			}
+			if dialect != SQLite {
+				return nil
+			}
+			// Items were ordered by rowid before
+			_, err := tx.Exec("UPDATE cart_items SET position = rowid WHERE position = 0")
+			return err
+		},
+	},
+	{
+		description: "structured audit events with affected record, changes and client",
+		apply: func(tx *sql.Tx, dialect Dialect) error {
+			for _, column := range []struct{ name, definition string }{
+				{"entity_type", "TEXT"},
+				{"entity_id", "INTEGER"},
+				{"changes", "TEXT"},
+				{"ip_address", "TEXT"},
+				{"user_agent", "TEXT"},
+			} {
+				if err := addColumn(tx, dialect, "audit_log", column.name, column.definition); err != nil {
+					return err
+				}
+			}
+			return execMigration(`
+				CREATE INDEX IF NOT EXISTS idx_audit_log_entity ON audit_log(entity_type, entity_id);
+			`)(tx, dialect)
+		},
+	},
+	{
+		description: "chain the audit log entries by hash",
+		apply: func(tx *sql.Tx, dialect Dialect) error {
+			if err := addColumn(tx, dialect, "audit_log", "prev_hash", "TEXT"); err != nil {
+				return err
+			}
+			if err := addColumn(tx, dialect, "audit_log", "hash", "TEXT"); err != nil {
+				return err
+			}
+			if err := hashAuditLog(tx); err != nil {
+				return err
+			}
+			// Two entries cannot follow the same one, even when written at once
+			return execMigration(`
+				CREATE UNIQUE INDEX IF NOT EXISTS idx_audit_log_prev_hash ON audit_log(prev_hash);
+			`)(tx, dialect)
+		},
+	},
+	{
+		description: "archives of audit log entries past the retention period",
+		apply: execMigration(`
+			CREATE TABLE IF NOT EXISTS audit_archives (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				name TEXT NOT NULL UNIQUE,
+				first_id INTEGER NOT NULL,
+				last_id INTEGER NOT NULL,
+				entries INTEGER NOT NULL,
+				first_prev_hash TEXT NOT NULL,
+				last_hash TEXT NOT NULL,
+				created_at DATETIME NOT NULL
+			);
+		`),
+	},
+	{
+		description: "deactivated and anonymized users",
+		apply: func(tx *sql.Tx, dialect Dialect) error {
+			if err := addColumn(tx, dialect, "users", "deactivated_at", "DATETIME"); err != nil {
+				return err
+			}
+			return addColumn(tx, dialect, "users", "anonymized_at", "DATETIME")
+		},
+	},
+	{
+		description: "kind of transaction: sale, top-up or manual booking",
+		apply: func(tx *sql.Tx, dialect Dialect) error {
+			if err := addColumn(tx, dialect, "transactions", "kind", "TEXT NOT NULL DEFAULT 'sale'"); err != nil {
+				return err
+			}
+			// Checkouts were the only transactions without a description
+			_, err := tx.Exec(`
+				UPDATE transactions
+				SET kind = CASE WHEN description = 'Guthaben aufgeladen' THEN 'topup' ELSE 'manual' END
+				WHERE description IS NOT NULL
+			`)
+			return err
+		},
+	},
+}
+
+// SchemaVersion returns the schema version this build of GoPOS expects
+func SchemaVersion() int {
+	return len(migrations)
+}
+
+// GetSchemaVersion returns the schema version of the given database. The query
+// is cancelled with ctx.
+func GetSchemaVersion(ctx context.Context, db *sql.DB) (int, error) {
+	var version int
+	var err error
+	if DialectOf(db) == Postgres {
+		err = db.QueryRowContext(ctx, "SELECT COALESCE(MAX(version), 0) FROM schema_version").Scan(&version)
+	} else {
+		err = db.QueryRowContext(ctx, "PRAGMA user_version").Scan(&version)
+	}
+	return version, err
+}
+
+func setSchemaVersion(tx *sql.Tx, dialect Dialect, version int) error {
+	if dialect == Postgres {
+		if _, err := tx.Exec("DELETE FROM schema_version"); err != nil {
+			return err
+		}
+		_, err := tx.Exec("INSERT INTO schema_version (version) VALUES (?)", version)
+		return err
+	}
+	// PRAGMA statements do not support parameters
+	_, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", version))
+	return err
+}
+
+// migrate applies all migrations the database has not seen yet
+func migrate(db *sql.DB) error {
+	dialect := DialectOf(db)
+	version, err := GetSchemaVersion(context.Background(), db)
+	if err != nil {
+		return err
+	}
+
+	if version > len(migrations) {
+		return fmt.Errorf("database schema version %d is newer than supported version %d", version, len(migrations))
+	}
+
+	for i := version; i < len(migrations); i++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+
+		if err := migrations[i].apply(tx, dialect); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d (%s) failed: %v", i+1, migrations[i].description, err)
+		}
+
+		if err := setSchemaVersion(tx, dialect, i+1); err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		dbLog.Info("Applied database migration", "version", i+1, "description", migrations[i].description)
+	}
+
+	return nil
+}
+
+func execMigration(statements string) func(tx *sql.Tx, dialect Dialect) error {
+	return func(tx *sql.Tx, dialect Dialect) error {
+		_, err := tx.Exec(dialect.ddl(statements))
+		return err
+	}
+}
+
+// addColumn adds a column unless the table already has it, so the migration can be
+// repeated on a database whose schema version was reset
+func addColumn(tx *sql.Tx, dialect Dialect, table, column, definition string) error {
+	if dialect == Postgres {
+		_, err := tx.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS %s %s", table, column, dialect.ddl(definition)))
+		return err
+	}
+
+	var exists int
+	err := tx.QueryRow("SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?", table, column).Scan(&exists)
+	if err != nil || exists > 0 {
+		return err
+	}
+	_, err = tx.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	return err
+}
+
+// normalizeTimestamps rewrites the created_at column of the given tables in the
+// canonical UTC format. Older versions stored time.Time.String() in server local time.
+func normalizeTimestamps(tables ...string) func(tx *sql.Tx, dialect Dialect) error {
+	return func(tx *sql.Tx, dialect Dialect) error {
+		if dialect != SQLite {
+			// Only SQLite databases have timestamps from older versions
+			return nil
+		}
+		for _, table := range tables {
+			// Casting keeps the driver from parsing the column into a time.Time
+			rows, err := tx.Query(fmt.Sprintf("SELECT id, CAST(created_at AS TEXT) FROM %s", table))
+			if err != nil {
+				return err
+			}
+
+			updates := make(map[int64]string)
+			for rows.Next() {
+				var id int64
+				var value string
+				if err := rows.Scan(&id, &value); err != nil {
+					rows.Close()
+					return err
+				}
+				t, err := ParseTime(value)
+				if err != nil {
+					rows.Close()
+					return fmt.Errorf("%s %d: %v", table, id, err)
+				}
+				if normalized := FormatTime(t); normalized != value {
+					updates[id] = normalized
+				}
+			}
+			if err := rows.Err(); err != nil {
+				rows.Close()
+				return err
+			}
+			rows.Close()
+
+			for id, value := range updates {
+				if _, err := tx.Exec(fmt.Sprintf("UPDATE %s SET created_at = ? WHERE id = ?", table), value, id); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+}
+
+// hashAuditLog chains the existing audit log entries in the order they were written
+func hashAuditLog(tx *sql.Tx) error {
+	rows, err := tx.Query(`
+		SELECT id, user_id, action, entity_type, entity_id, details, changes, ip_address, user_agent, created_at
+		FROM audit_log
+		ORDER BY id
+	`)
+	if err != nil {
+		return err
+	}
+	type hashed struct {
+		id             int
+		prevHash, hash string
+	}
+	var entries []hashed
+	prevHash := ""
+	for rows.Next() {
+		var id int
+		var record AuditRecord
+		var entityType, changes, ip, userAgent sql.NullString
+		var entityID sql.NullInt64
+		var createdAt time.Time
+		if err := rows.Scan(&id, &record.UserID, &record.Action, &entityType, &entityID, &record.Details,
+			&changes, &ip, &userAgent, &createdAt); err != nil {
+			rows.Close()
+			return err
+		}
+		record.EntityType, record.EntityID = entityType.String, int(entityID.Int64)
+		record.Changes, record.IP, record.UserAgent = changes.String, ip.String, userAgent.String
+		record.CreatedAt = FormatTime(createdAt)
+
+		hash := record.Hash(prevHash)
+		entries = append(entries, hashed{id, prevHash, hash})
+		prevHash = hash
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if _, err := tx.Exec("UPDATE audit_log SET prev_hash = ?, hash = ? WHERE id = ?", entry.prevHash, entry.hash, entry.id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,173 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	DriverSQLite   = "sqlite"
+	DriverPostgres = "postgres"
+)
+
+// Options are the connection settings of the database. Apart from ForeignKeys,
+// zero values are replaced by the defaults of DefaultOptions. The journal mode,
+// synchronous level, busy timeout and foreign keys only apply to SQLite;
+// PostgreSQL always enforces foreign keys.
+type Options struct {
+	Driver          string // DriverSQLite or DriverPostgres
+	JournalMode     string
+	Synchronous     string
+	BusyTimeout     time.Duration
+	ForeignKeys     bool
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+}
+
+// DefaultOptions returns settings suited for several registers working at once:
+// WAL lets readers continue while a checkout writes, and writers wait for each
+// other instead of failing with SQLITE_BUSY.
+func DefaultOptions() Options {
+	return Options{
+		Driver:       DriverSQLite,
+		JournalMode:  "WAL",
+		Synchronous:  "NORMAL",
+		BusyTimeout:  5 * time.Second,
+		ForeignKeys:  true,
+		MaxOpenConns: 10,
+		MaxIdleConns: 5,
+	}
+}
+
+// The journal modes and synchronous levels Options accept
+var (
+	JournalModes      = []string{"WAL", "DELETE", "TRUNCATE", "PERSIST", "MEMORY", "OFF"}
+	SynchronousLevels = []string{"NORMAL", "FULL", "EXTRA", "OFF"}
+)
+
+// Open opens the database with the given options. The source is the path of
+// the file for SQLite and the connection string for PostgreSQL. The SQLite
+// pragmas are part of the DSN, so the driver applies them to every connection
+// of the pool.
+func Open(source string, options Options) (*sql.DB, error) {
+	var db *sql.DB
+	var err error
+	switch options.Driver {
+	case "", DriverSQLite:
+		var dsn string
+		if dsn, err = DSN(source, &options); err != nil {
+			return nil, err
+		}
+		db, err = sql.Open("sqlite", dsn)
+	case DriverPostgres:
+		if err = poolDefaults(&options); err != nil {
+			return nil, err
+		}
+		db, err = openPostgres(source)
+	default:
+		return nil, fmt.Errorf("unknown database driver %q, expected %s or %s", options.Driver, DriverSQLite, DriverPostgres)
+	}
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(options.MaxOpenConns)
+	db.SetMaxIdleConns(options.MaxIdleConns)
+	db.SetConnMaxLifetime(options.ConnMaxLifetime)
+
+	// Open a connection right away, so invalid settings are reported at startup
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// DSN builds the data source name for the SQLite database at path. It fills in the
+// defaults of options and returns an error for unknown journal modes or
+// synchronous levels.
+func DSN(path string, options *Options) (string, error) {
+	defaults := DefaultOptions()
+	options.JournalMode = strings.ToUpper(options.JournalMode)
+	if options.JournalMode == "" {
+		options.JournalMode = defaults.JournalMode
+	}
+	if !contains(JournalModes, options.JournalMode) {
+		return "", fmt.Errorf("unknown journal mode %q, expected one of %s", options.JournalMode, strings.Join(JournalModes, ", "))
+	}
+	options.Synchronous = strings.ToUpper(options.Synchronous)
+	if options.Synchronous == "" {
+		options.Synchronous = defaults.Synchronous
+	}
+	if !contains(SynchronousLevels, options.Synchronous) {
+		return "", fmt.Errorf("unknown synchronous level %q, expected one of %s", options.Synchronous, strings.Join(SynchronousLevels, ", "))
+	}
+	if options.BusyTimeout < 0 {
+		return "", fmt.Errorf("database timeouts and connection limits must not be negative")
+	}
+	if options.BusyTimeout == 0 {
+		options.BusyTimeout = defaults.BusyTimeout
+	}
+	if err := poolDefaults(options); err != nil {
+		return "", err
+	}
+
+	foreignKeys := 0
+	if options.ForeignKeys {
+		foreignKeys = 1
+	}
+
+	// The busy timeout comes first, so switching the journal mode waits for other connections
+	query := url.Values{}
+	query.Add("_pragma", fmt.Sprintf("busy_timeout(%d)", options.BusyTimeout.Milliseconds()))
+	query.Add("_pragma", fmt.Sprintf("journal_mode(%s)", options.JournalMode))
+	query.Add("_pragma", fmt.Sprintf("synchronous(%s)", options.Synchronous))
+	query.Add("_pragma", fmt.Sprintf("foreign_keys(%d)", foreignKeys))
+	// Writing transactions take the write lock when they begin instead of failing
+	// halfway through when another connection wrote in between
+	query.Set("_txlock", "immediate")
+
+	return path + "?" + query.Encode(), nil
+}
+
+// poolDefaults fills in the connection pool limits of options
+func poolDefaults(options *Options) error {
+	defaults := DefaultOptions()
+	if options.MaxOpenConns < 0 || options.MaxIdleConns < 0 || options.ConnMaxLifetime < 0 {
+		return fmt.Errorf("database timeouts and connection limits must not be negative")
+	}
+	if options.MaxOpenConns == 0 {
+		options.MaxOpenConns = defaults.MaxOpenConns
+	}
+	if options.MaxIdleConns == 0 {
+		options.MaxIdleConns = defaults.MaxIdleConns
+	}
+	if options.MaxIdleConns > options.MaxOpenConns {
+		options.MaxIdleConns = options.MaxOpenConns
+	}
+	return nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// IsForeignKeyError reports whether err is a violated foreign key constraint
+func IsForeignKeyError(err error) bool {
+	return err != nil && (strings.Contains(err.Error(), "FOREIGN KEY constraint failed") ||
+		isPostgresError(err, postgresForeignKeyViolation))
+}
+
+// IsUniqueViolation reports whether err is a violated unique constraint
+func IsUniqueViolation(err error) bool {
+	return err != nil && (strings.Contains(err.Error(), "UNIQUE constraint failed") ||
+		isPostgresError(err, postgresUniqueViolation))
+}
@@ -0,0 +1,49 @@
+package database
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// TimeFormat is the canonical format of all stored timestamps. Timestamps are
+// always stored in UTC; converting them to the business timezone is up to the caller.
+const TimeFormat = "2006-01-02 15:04:05"
+
+// Now returns the current time in the canonical storage format
+func Now() string {
+	return FormatTime(time.Now())
+}
+
+// FormatTime converts a timestamp to the canonical storage format
+func FormatTime(t time.Time) string {
+	return t.UTC().Format(TimeFormat)
+}
+
+// legacyTimeFormats are the formats timestamps were stored in before they were normalised
+var legacyTimeFormats = []string{
+	"2006-01-02 15:04:05.999999999 -0700 MST", // time.Time.String() as written by the SQLite driver
+	"2006-01-02 15:04:05.999999999-07:00",
+	"2006-01-02T15:04:05.999999999-07:00",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02 15:04",
+	"2006-01-02",
+}
+
+// ParseTime parses a stored timestamp in the canonical or any legacy format.
+// Timestamps without timezone are taken as UTC, like SQLite does.
+func ParseTime(value string) (time.Time, error) {
+	// Drop the monotonic clock reading of time.Time.String()
+	if i := strings.Index(value, " m="); i > 0 {
+		value = value[:i]
+	}
+	value = strings.TrimSuffix(strings.TrimSpace(value), "Z")
+
+	for _, format := range legacyTimeFormats {
+		if t, err := time.Parse(format, value); err == nil {
+			return t.UTC(), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("unknown timestamp format: %q", value)
+}
@@ -1,86 +1,34 @@
 package handlers
 
 import (
-	"database/sql"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"gopos/components"
+	"gopos/logging"
+	"gopos/metrics"
+	"gopos/repository"
 	"gopos/services"
-	"log"
+	"math"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
-	"time"
 )
 
-// HandleAuditTrail displays the audit log
-func HandleAuditTrail(db *sql.DB) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		// Get user info from session
-		session, err := store.Get(r, sessionName)
-		if err != nil {
-			http.Error(w, "Session error", http.StatusInternalServerError)
-			return
-		}
-
-		userName, ok := session.Values["name"].(string)
-		if !ok {
-			http.Redirect(w, r, "/", http.StatusSeeOther)
-			return
-		}
+var adminLog = logging.Component("admin")
 
-		userRole, ok := session.Values["role"].(string)
-		if !ok {
-			http.Redirect(w, r, "/", http.StatusSeeOther)
-			return
-		}
+// errBalanceChanged is returned when a user's balance changed after the edit form was loaded
+var errBalanceChanged = errors.New("balance changed since the form was loaded")
 
-		// Parse pagination parameters
-		page := 1
-		pageSize := 10 // Number of items per page
-
-		// Parse page parameter if provided
-		pageParam := r.URL.Query().Get("page")
-		if pageParam != "" {
-			parsedPage, err := strconv.Atoi(pageParam)
-			if err == nil && parsedPage > 0 {
-				page = parsedPage
-			}
-		}
-
-		// Get total count of audit entries
-		totalCount, err := getAuditEntriesCount(db)
-		if err != nil {
-			http.Error(w, "Database error", http.StatusInternalServerError)
-			return
-		}
-
-		// Calculate total pages
-		totalPages := (totalCount + pageSize - 1) / pageSize // Ceiling division
-
-		// Get audit entries from database with pagination
-		entries, err := getAuditEntries(db, page, pageSize)
-		if err != nil {
-			http.Error(w, "Database error", http.StatusInternalServerError)
-			return
-		}
-
-		data := components.AuditData{
-			Title:       "Audit Log",
-			UserName:    userName,
-			Role:        userRole,
-			CSRFToken:   generateCSRFToken(),
-			Entries:     entries,
-			CurrentPage: page,
-			TotalPages:  totalPages,
-			PageSize:    pageSize,
-			TotalCount:  totalCount,
-		}
-		components.Audit(data).Render(r.Context(), w)
-	}
+// cents rounds an amount to whole cents, so amounts from forms and the database compare equal
+func cents(amount float64) int64 {
+	return int64(math.Round(amount * 100))
 }
 
 // HandleNewUser displays and processes the new user form
-func HandleNewUser(db *sql.DB) http.HandlerFunc {
+func HandleNewUser(stores repository.Stores) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method == "GET" {
 			data := components.UserFormData{
@@ -115,18 +63,8 @@ func HandleNewUser(db *sql.DB) http.HandlerFunc {
 				return
 			}
 
-			// Start transaction
-			tx, err := db.Begin()
-			if err != nil {
-				http.Error(w, "Database error", http.StatusInternalServerError)
-				return
-			}
-			defer tx.Rollback()
-
 			// Check if card number already exists
-			var existingID int
-			err = tx.QueryRow("SELECT id FROM users WHERE card_number = ?", cardNumber).Scan(&existingID)
-			if err != sql.ErrNoRows {
+			if _, err := stores.Users.GetByCardNumber(cardNumber); !errors.Is(err, repository.ErrNotFound) {
 				data := components.UserFormData{
 					Title:     "Neuer Benutzer",
 					Error:     "Diese Kartennummer existiert bereits",
@@ -136,38 +74,32 @@ func HandleNewUser(db *sql.DB) http.HandlerFunc {
 				return
 			}
 
-			// Insert new user
-			if _, err = tx.Exec(`
-				INSERT INTO users (card_number, name, role, email, created_at)
-				VALUES (?, ?, ?, ?, ?)
-			`, cardNumber, name, role, email, time.Now()); err != nil {
+			// Insert the user and log the action together
+			adminUser := r.Context().Value(contextUserKey).(components.User)
+			user := &components.User{CardNumber: cardNumber, Name: name, Role: role, Email: email}
+			err := stores.Atomic(func(tx repository.Stores) error {
+				if err := tx.Users.Create(user); err != nil {
+					return err
+				}
+				event := newAuditEvent(r, adminUser.ID, "create_user", fmt.Sprintf("Benutzer erstellt (Rolle: %s)", role))
+				event.EntityType, event.EntityID = "user", user.ID
+				event.Changes = userAuditChanges(nil, user)
+				return tx.Audit.Log(event)
+			})
+			if err != nil {
+				message := "Fehler beim Erstellen des Benutzers"
+				if errors.Is(err, repository.ErrDuplicate) {
+					message = "Diese Kartennummer existiert bereits"
+				}
 				data := components.UserFormData{
 					Title:     "Neuer Benutzer",
-					Error:     "Fehler beim Erstellen des Benutzers",
+					Error:     message,
 					CSRFToken: generateCSRFToken(),
 				}
 				components.UserForm(data).Render(r.Context(), w)
 				return
 			}
 
-			// Log the action
-			adminUser := r.Context().Value(contextUserKey).(components.User)
-			_, err = tx.Exec(`
-				INSERT INTO audit_log (user_id, action, details, created_at)
-				VALUES (?, ?, ?, ?)
-			`, adminUser.ID, "create_user", fmt.Sprintf("Benutzer erstellt: %s (Rolle: %s)", name, role), time.Now())
-
-			if err != nil {
-				http.Error(w, "Error logging action", http.StatusInternalServerError)
-				return
-			}
-
-			// Commit transaction
-			if err := tx.Commit(); err != nil {
-				http.Error(w, "Error committing transaction", http.StatusInternalServerError)
-				return
-			}
-
 			// Send email notification if user has an email
 			if email != "" {
 				// Build account details
@@ -186,13 +118,14 @@ func HandleNewUser(db *sql.DB) http.HandlerFunc {
 					},
 				}
 
-				go func() {
+				ctx := r.Context()
+				services.Go(func() {
 					if err := services.SendUserUpdatedEmail(email, name, true, accountDetails); err != nil {
-						log.Printf("[ADMIN] Error sending welcome email: %v", err)
+						adminLog.ErrorContext(ctx, "Failed to send welcome email", "email", email, "error", err)
 					} else {
-						log.Printf("[ADMIN] Welcome email sent successfully to %s", email)
+						adminLog.DebugContext(ctx, "Welcome email sent", "email", email)
 					}
-				}()
+				})
 			}
 
 			http.Redirect(w, r, fmt.Sprintf("/users?message=Benutzer %s erfolgreich erstellt", name), http.StatusSeeOther)
@@ -201,7 +134,7 @@ func HandleNewUser(db *sql.DB) http.HandlerFunc {
 }
 
 // HandleEditUser displays and processes the edit user form
-func HandleEditUser(db *sql.DB) http.HandlerFunc {
+func HandleEditUser(stores repository.Stores) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method == "GET" {
 			// Get user ID from query string
@@ -218,11 +151,15 @@ func HandleEditUser(db *sql.DB) http.HandlerFunc {
 			}
 
 			// Get user from database
-			user, err := services.GetUserByID(db, userID)
+			user, err := stores.Users.Get(userID)
 			if err != nil {
 				http.Error(w, "User not found", http.StatusNotFound)
 				return
 			}
+			if user.Anonymized() {
+				http.Redirect(w, r, "/users?status=inactive&error="+url.QueryEscape("Anonymisierte Benutzer können nicht bearbeitet werden"), http.StatusSeeOther)
+				return
+			}
 
 			data := components.UserFormData{
 				Title:     "Benutzer bearbeiten",
@@ -247,6 +184,7 @@ func HandleEditUser(db *sql.DB) http.HandlerFunc {
 			role := r.FormValue("role")
 			email := r.FormValue("email")
 			balanceStr := r.FormValue("balance")
+			var originalBalance float64
 
 			// Konvertiere Komma zu Punkt für deutsches Zahlenformat
 			balanceStr = strings.Replace(balanceStr, ",", ".", -1)
@@ -268,8 +206,11 @@ func HandleEditUser(db *sql.DB) http.HandlerFunc {
 				return
 			}
 
-			// Parse balance
+			// Parse balance and the balance the form was loaded with
 			balance, err := strconv.ParseFloat(balanceStr, 64)
+			if err == nil {
+				originalBalance, err = strconv.ParseFloat(strings.Replace(r.FormValue("original_balance"), ",", ".", -1), 64)
+			}
 			if err != nil {
 				data := components.UserFormData{
 					Title:     "Benutzer bearbeiten",
@@ -280,56 +221,9 @@ func HandleEditUser(db *sql.DB) http.HandlerFunc {
 				return
 			}
 
-			// Get previous user data to detect changes - BEFORE we update the database
-			oldUser, err := services.GetUserByID(db, userID)
-			changes := make(map[string]map[string]string)
-
-			if err == nil && oldUser != nil {
-				// Look for changes in the user data
-				if oldUser.Name != name {
-					changes["Name"] = map[string]string{
-						"old": oldUser.Name,
-						"new": name,
-					}
-				}
-				if oldUser.CardNumber != cardNumber {
-					changes["Kartennummer"] = map[string]string{
-						"old": oldUser.CardNumber,
-						"new": cardNumber,
-					}
-				}
-				if oldUser.Role != role {
-					changes["Rolle"] = map[string]string{
-						"old": oldUser.Role,
-						"new": role,
-					}
-				}
-				if oldUser.Email != email {
-					changes["E-Mail"] = map[string]string{
-						"old": oldUser.Email,
-						"new": email,
-					}
-				}
-				if oldUser.Balance != balance {
-					changes["Guthaben"] = map[string]string{
-						"old": fmt.Sprintf("%.2f €", oldUser.Balance),
-						"new": fmt.Sprintf("%.2f €", balance),
-					}
-				}
-			}
-
-			// Start transaction
-			tx, err := db.Begin()
-			if err != nil {
-				http.Error(w, "Database error", http.StatusInternalServerError)
-				return
-			}
-			defer tx.Rollback()
-
 			// Check if card number already exists for different user
-			var existingID int
-			err = tx.QueryRow("SELECT id FROM users WHERE card_number = ? AND id != ?", cardNumber, userID).Scan(&existingID)
-			if err != sql.ErrNoRows {
+			existing, err := stores.Users.GetByCardNumber(cardNumber)
+			if err == nil && existing.ID != userID || err != nil && !errors.Is(err, repository.ErrNotFound) {
 				data := components.UserFormData{
 					Title:     "Benutzer bearbeiten",
 					Error:     "Diese Kartennummer existiert bereits",
@@ -339,61 +233,84 @@ func HandleEditUser(db *sql.DB) http.HandlerFunc {
 				return
 			}
 
-			// Update user
-			result, err := tx.Exec(`
-				UPDATE users 
-				SET card_number = ?, name = ?, role = ?, email = ?, balance = ?
-				WHERE id = ?
-			`, cardNumber, name, role, email, balance, userID)
+			// Update the user and log the action together
+			adminUser := r.Context().Value(contextUserKey).(components.User)
+			user := &components.User{ID: userID, CardNumber: cardNumber, Name: name, Role: role, Email: email}
+			var changes map[string]components.AuditChange
+			err = stores.Atomic(func(tx repository.Stores) error {
+				// Compare with the stored user to record what changed
+				oldUser, err := tx.Users.Get(userID)
+				if err != nil {
+					return err
+				}
+				if oldUser.Anonymized() {
+					return repository.ErrAnonymized
+				}
+				if err := tx.Users.Update(user); err != nil {
+					return err
+				}
 
+				// A changed balance is applied as the difference, and only if no
+				// payment changed it since the form was loaded
+				user.Balance = oldUser.Balance
+				if cents(balance) != cents(originalBalance) {
+					if cents(oldUser.Balance) != cents(originalBalance) {
+						return errBalanceChanged
+					}
+					if user.Balance, err = tx.Users.AdjustBalance(userID, balance-oldUser.Balance); err != nil {
+						return err
+					}
+					_, err = tx.Transactions.Record(repository.Booking{
+						UserID:       userID,
+						CashierID:    adminUser.ID,
+						Total:        user.Balance - oldUser.Balance,
+						BalanceAfter: user.Balance,
+						Kind:         repository.TransactionAdjustment,
+						Description:  "Guthaben korrigiert",
+					})
+					if err != nil {
+						return err
+					}
+				}
+				changes = userAuditChanges(oldUser, user)
+				event := newAuditEvent(r, adminUser.ID, "edit_user", fmt.Sprintf("Benutzer bearbeitet (Rolle: %s)", role))
+				event.EntityType, event.EntityID = "user", user.ID
+				event.Changes = changes
+				return tx.Audit.Log(event)
+			})
 			if err != nil {
-				data := components.UserFormData{
-					Title:     "Benutzer bearbeiten",
-					Error:     "Fehler beim Aktualisieren des Benutzers",
-					CSRFToken: generateCSRFToken(),
+				message := "Fehler beim Aktualisieren des Benutzers"
+				switch {
+				case errors.Is(err, repository.ErrDuplicate):
+					message = "Diese Kartennummer existiert bereits"
+				case errors.Is(err, repository.ErrNotFound):
+					message = "Benutzer nicht gefunden"
+				case errors.Is(err, repository.ErrAnonymized):
+					message = "Anonymisierte Benutzer können nicht bearbeitet werden"
+				case errors.Is(err, errBalanceChanged):
+					message = "Das Guthaben wurde inzwischen durch eine Zahlung geändert. Bitte laden Sie den Benutzer neu und geben Sie das Guthaben erneut ein."
+				case errors.Is(err, repository.ErrInsufficientBalance):
+					message = "Das Guthaben darf nicht negativ sein"
 				}
-				components.UserForm(data).Render(r.Context(), w)
-				return
-			}
-
-			rowsAffected, err := result.RowsAffected()
-			if err != nil || rowsAffected != 1 {
 				data := components.UserFormData{
 					Title:     "Benutzer bearbeiten",
-					Error:     "Benutzer nicht gefunden",
+					Error:     message,
 					CSRFToken: generateCSRFToken(),
 				}
 				components.UserForm(data).Render(r.Context(), w)
 				return
 			}
 
-			// Log the action
-			adminUser := r.Context().Value(contextUserKey).(components.User)
-			_, err = tx.Exec(`
-				INSERT INTO audit_log (user_id, action, details, created_at)
-				VALUES (?, ?, ?, ?)
-			`, adminUser.ID, "edit_user", fmt.Sprintf("Benutzer bearbeitet: %s (Rolle: %s)", name, role), time.Now())
-
-			if err != nil {
-				http.Error(w, "Error logging action", http.StatusInternalServerError)
-				return
-			}
-
-			// Commit transaction
-			if err := tx.Commit(); err != nil {
-				http.Error(w, "Error committing transaction", http.StatusInternalServerError)
-				return
-			}
-
 			// Send email notification if user has an email
 			if email != "" && len(changes) > 0 {
-				go func() {
-					if err := services.SendUserUpdatedEmail(email, name, false, changes); err != nil {
-						log.Printf("[ADMIN] Error sending user update email: %v", err)
+				ctx := r.Context()
+				services.Go(func() {
+					if err := services.SendUserUpdatedEmail(email, name, false, emailChanges(changes)); err != nil {
+						adminLog.ErrorContext(ctx, "Failed to send user update email", "email", email, "error", err)
 					} else {
-						log.Printf("[ADMIN] User update email sent successfully to %s", email)
+						adminLog.DebugContext(ctx, "User update email sent", "email", email)
 					}
-				}()
+				})
 			}
 
 			http.Redirect(w, r, fmt.Sprintf("/users?message=Benutzer %s erfolgreich aktualisiert", name), http.StatusSeeOther)
@@ -401,8 +318,35 @@ func HandleEditUser(db *sql.DB) http.HandlerFunc {
 	}
 }
 
+// userFieldLabels names the fields of a user in emails
+var userFieldLabels = map[string]string{
+	"name":        "Name",
+	"card_number": "Kartennummer",
+	"role":        "Rolle",
+	"email":       "E-Mail",
+	"balance":     "Guthaben",
+}
+
+// emailChanges converts the changes of a user for the update email
+func emailChanges(changes map[string]components.AuditChange) map[string]map[string]string {
+	format := func(field string, value any) string {
+		if amount, ok := value.(float64); ok && field == "balance" {
+			return services.FormatMoney(amount)
+		}
+		return fmt.Sprint(value)
+	}
+	converted := make(map[string]map[string]string, len(changes))
+	for field, change := range changes {
+		converted[userFieldLabels[field]] = map[string]string{
+			"old": format(field, change.Before),
+			"new": format(field, change.After),
+		}
+	}
+	return converted
+}
+
 // HandleDeleteUser processes user deletion
-func HandleDeleteUser(db *sql.DB) http.HandlerFunc {
+func HandleDeleteUser(stores repository.Stores) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != "POST" {
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -412,16 +356,14 @@ func HandleDeleteUser(db *sql.DB) http.HandlerFunc {
 		userID, _ := strconv.ParseInt(r.FormValue("id"), 10, 64)
 
 		// Get user name for logging
-		var userName string
-		err := db.QueryRow("SELECT name FROM users WHERE id = ?", userID).Scan(&userName)
+		user, err := stores.Users.Get(int(userID))
 		if err != nil {
 			http.Error(w, "User not found", http.StatusNotFound)
 			return
 		}
 
 		// Check if user has any transactions
-		var transactionCount int
-		err = db.QueryRow("SELECT COUNT(*) FROM transactions WHERE user_id = ?", userID).Scan(&transactionCount)
+		transactionCount, err := stores.Transactions.CountForUser(user.ID)
 		if err != nil {
 			http.Error(w, "Database error", http.StatusInternalServerError)
 			return
@@ -432,30 +374,175 @@ func HandleDeleteUser(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
-		// Delete the user
-		_, err = db.Exec("DELETE FROM users WHERE id = ?", userID)
-		if err != nil {
+		// Delete the user and log the deletion together
+		adminUser := r.Context().Value(contextUserKey).(components.User)
+		err = stores.Atomic(func(tx repository.Stores) error {
+			if err := tx.Users.Delete(user.ID); err != nil {
+				return err
+			}
+			event := newAuditEvent(r, adminUser.ID, "delete_user", "Benutzer gelöscht")
+			event.EntityType, event.EntityID = "user", user.ID
+			event.Changes = userAuditChanges(user, nil)
+			return tx.Audit.Log(event)
+		})
+		if errors.Is(err, repository.ErrInUse) {
+			http.Error(w, "Cannot delete user that is still referenced by carts or audit log entries", http.StatusBadRequest)
+			return
+		} else if err != nil {
 			http.Error(w, "Error deleting user", http.StatusInternalServerError)
 			return
 		}
 
-		// Log the deletion
+		http.Redirect(w, r, "/users?message=Benutzer erfolgreich gelöscht", http.StatusSeeOther)
+	}
+}
+
+// userStatusRedirect returns to the user list with a message or error
+func userStatusRedirect(w http.ResponseWriter, r *http.Request, key, text string) {
+	http.Redirect(w, r, "/users?"+key+"="+url.QueryEscape(text), http.StatusSeeOther)
+}
+
+// changeUserStatus loads the user of the form for a status change. Admins
+// cannot change their own status, so they do not lock themselves out.
+func changeUserStatus(stores repository.Stores, w http.ResponseWriter, r *http.Request) (*components.User, bool) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return nil, false
+	}
+	if !verifyCSRFToken(r.FormValue("csrf_token")) {
+		userStatusRedirect(w, r, "error", "Ungültiger CSRF-Token")
+		return nil, false
+	}
+
+	userID, err := strconv.Atoi(r.FormValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return nil, false
+	}
+	user, err := stores.Users.Get(userID)
+	if errors.Is(err, repository.ErrNotFound) {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return nil, false
+	} else if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return nil, false
+	}
+
+	adminUser := r.Context().Value(contextUserKey).(components.User)
+	if user.ID == adminUser.ID {
+		userStatusRedirect(w, r, "error", "Sie können Ihr eigenes Konto nicht deaktivieren oder anonymisieren")
+		return nil, false
+	}
+	return user, true
+}
+
+// HandleDeactivateUser keeps a user from logging in and paying. The user and
+// its transactions stay, but are hidden from the user list by default.
+func HandleDeactivateUser(stores repository.Stores) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, ok := changeUserStatus(stores, w, r)
+		if !ok {
+			return
+		}
+
 		adminUser := r.Context().Value(contextUserKey).(components.User)
-		_, err = db.Exec(`
-			INSERT INTO audit_log (user_id, action, details, created_at)
-			VALUES (?, ?, ?, ?)
-		`, adminUser.ID, "delete_user", fmt.Sprintf("Benutzer gelöscht: %s", userName), time.Now())
+		err := stores.Atomic(func(tx repository.Stores) error {
+			if err := tx.Users.Deactivate(user.ID); err != nil {
+				return err
+			}
+			event := newAuditEvent(r, adminUser.ID, "deactivate_user", "Benutzer deaktiviert")
+			event.EntityType, event.EntityID = "user", user.ID
+			return tx.Audit.Log(event)
+		})
 		if err != nil {
-			http.Error(w, "Error logging action", http.StatusInternalServerError)
+			adminLog.ErrorContext(r.Context(), "Failed to deactivate user", "user_id", user.ID, "error", err)
+			userStatusRedirect(w, r, "error", "Fehler beim Deaktivieren des Benutzers")
 			return
 		}
 
-		http.Redirect(w, r, "/users?message=Benutzer erfolgreich gelöscht", http.StatusSeeOther)
+		userStatusRedirect(w, r, "message", fmt.Sprintf("Benutzer %s deaktiviert", user.Name))
+	}
+}
+
+// HandleReactivateUser lets a deactivated user log in and pay again
+func HandleReactivateUser(stores repository.Stores) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, ok := changeUserStatus(stores, w, r)
+		if !ok {
+			return
+		}
+
+		adminUser := r.Context().Value(contextUserKey).(components.User)
+		err := stores.Atomic(func(tx repository.Stores) error {
+			if err := tx.Users.Reactivate(user.ID); err != nil {
+				return err
+			}
+			event := newAuditEvent(r, adminUser.ID, "reactivate_user", "Benutzer reaktiviert")
+			event.EntityType, event.EntityID = "user", user.ID
+			return tx.Audit.Log(event)
+		})
+		if errors.Is(err, repository.ErrAnonymized) {
+			userStatusRedirect(w, r, "error", "Anonymisierte Benutzer können nicht reaktiviert werden")
+			return
+		} else if err != nil {
+			adminLog.ErrorContext(r.Context(), "Failed to reactivate user", "user_id", user.ID, "error", err)
+			userStatusRedirect(w, r, "error", "Fehler beim Reaktivieren des Benutzers")
+			return
+		}
+
+		userStatusRedirect(w, r, "message", fmt.Sprintf("Benutzer %s reaktiviert", user.Name))
+	}
+}
+
+// newPseudonym returns a random name for an anonymized user. It is stored as
+// card number too, so it must be unique.
+func newPseudonym() string {
+	b := make([]byte, 6)
+	rand.Read(b)
+	return "ANON-" + strings.ToUpper(hex.EncodeToString(b))
+}
+
+// HandleAnonymizeUser erases the personal fields of a user for an erasure
+// request. Transactions keep referring to the user, which is shown by a
+// pseudonym from then on. The balance must have been paid out first.
+func HandleAnonymizeUser(stores repository.Stores) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, ok := changeUserStatus(stores, w, r)
+		if !ok {
+			return
+		}
+		if user.Anonymized() {
+			userStatusRedirect(w, r, "error", "Der Benutzer ist bereits anonymisiert")
+			return
+		}
+		if user.Balance != 0 {
+			userStatusRedirect(w, r, "error", fmt.Sprintf("%s hat noch ein Guthaben von %s, bitte zuerst ausgleichen", user.Name, services.FormatMoney(user.Balance)))
+			return
+		}
+
+		// The audit entry must not copy the erased fields, so it names the pseudonym only
+		adminUser := r.Context().Value(contextUserKey).(components.User)
+		pseudonym := newPseudonym()
+		err := stores.Atomic(func(tx repository.Stores) error {
+			if err := tx.Users.Anonymize(user.ID, pseudonym); err != nil {
+				return err
+			}
+			event := newAuditEvent(r, adminUser.ID, "anonymize_user", "Benutzer anonymisiert: "+pseudonym)
+			event.EntityType, event.EntityID = "user", user.ID
+			return tx.Audit.Log(event)
+		})
+		if err != nil {
+			adminLog.ErrorContext(r.Context(), "Failed to anonymize user", "user_id", user.ID, "error", err)
+			userStatusRedirect(w, r, "error", "Fehler beim Anonymisieren des Benutzers")
+			return
+		}
+
+		userStatusRedirect(w, r, "message", "Benutzer als "+pseudonym+" anonymisiert")
 	}
 }
 
 // HandleTopupUser handles the balance top-up form
-func HandleTopupUser(db *sql.DB) http.HandlerFunc {
+func HandleTopupUser(stores repository.Stores) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		// Get user from session
 		session, _ := store.Get(r, "pos-session")
@@ -464,12 +551,12 @@ func HandleTopupUser(db *sql.DB) http.HandlerFunc {
 		userID := session.Values["user_id"].(int)
 
 		// Get user balance
-		var balance float64
-		err := db.QueryRow("SELECT balance FROM users WHERE id = ?", userID).Scan(&balance)
+		user, err := stores.Users.Get(userID)
 		if err != nil {
 			http.Error(w, "Error loading user balance", http.StatusInternalServerError)
 			return
 		}
+		balance := user.Balance
 
 		if r.Method == http.MethodGet {
 			// Get user ID from query parameter
@@ -485,7 +572,7 @@ func HandleTopupUser(db *sql.DB) http.HandlerFunc {
 				}
 
 				// Get user details
-				selectedUser, err = services.GetUserByID(db, preselectedUserID)
+				selectedUser, err = stores.Users.Get(preselectedUserID)
 				if err != nil {
 					http.Error(w, "User not found", http.StatusNotFound)
 					return
@@ -534,7 +621,7 @@ func HandleTopupUser(db *sql.DB) http.HandlerFunc {
 					http.Redirect(w, r, "/dashboard?error=Ungültige Benutzer-ID", http.StatusSeeOther)
 					return
 				}
-				selectedUser, err = services.GetUserByID(db, targetUserID)
+				selectedUser, err = stores.Users.Get(targetUserID)
 				if err != nil {
 					http.Redirect(w, r, "/dashboard?error=Benutzer nicht gefunden", http.StatusSeeOther)
 					return
@@ -547,108 +634,83 @@ func HandleTopupUser(db *sql.DB) http.HandlerFunc {
 					return
 				}
 
-				selectedUser, err = services.GetUserByCardNumber(db, cardNumber)
+				selectedUser, err = stores.Users.GetByCardNumber(cardNumber)
 				if err != nil {
 					http.Redirect(w, r, "/dashboard?error=Benutzer nicht gefunden", http.StatusSeeOther)
 					return
 				}
 				targetUserID = selectedUser.ID
 			}
-
-			// Start transaction
-			tx, err := db.Begin()
-			if err != nil {
-				http.Redirect(w, r, "/dashboard?error=Datenbankfehler", http.StatusSeeOther)
-				return
-			}
-			defer tx.Rollback()
-
-			// Update balance
-			result, err := tx.Exec("UPDATE users SET balance = balance + ? WHERE id = ?", amount, targetUserID)
-			if err != nil {
-				http.Redirect(w, r, "/dashboard?error=Fehler beim Aufladen des Guthabens", http.StatusSeeOther)
-				return
-			}
-
-			rowsAffected, err := result.RowsAffected()
-			if err != nil || rowsAffected != 1 {
-				http.Redirect(w, r, "/dashboard?error=Fehler beim Aufladen des Guthabens", http.StatusSeeOther)
+			if !selectedUser.Active() {
+				http.Redirect(w, r, "/dashboard?error=Benutzer ist deaktiviert", http.StatusSeeOther)
 				return
 			}
 
 			// Get cashier from context
 			cashierUser := r.Context().Value(contextUserKey).(components.User)
 
-			// Log the action
-			_, err = tx.Exec(`
-				INSERT INTO audit_log (user_id, action, details, created_at)
-				VALUES (?, ?, ?, ?)
-			`, cashierUser.ID, "balance_topup", fmt.Sprintf("Guthaben aufgeladen für %s: %.2f€", selectedUser.Name, amount), time.Now())
+			// Update balance, record the transaction and log the action together
+			var updatedBalance float64
+			err = stores.Atomic(func(tx repository.Stores) error {
+				newBalance, err := tx.Users.AdjustBalance(targetUserID, amount)
+				if err != nil {
+					return err
+				}
+				updatedBalance = newBalance
+				_, err = tx.Transactions.Record(repository.Booking{
+					UserID:       targetUserID,
+					CashierID:    cashierUser.ID,
+					Total:        amount,
+					BalanceAfter: newBalance,
+					Kind:         repository.TransactionTopup,
+					Description:  "Guthaben aufgeladen",
+				})
+				if err != nil {
+					return err
+				}
+				event := newAuditEvent(r, cashierUser.ID, "balance_topup", "Guthaben aufgeladen: "+services.FormatMoney(amount))
+				event.EntityType, event.EntityID = "user", targetUserID
+				event.Changes = map[string]components.AuditChange{"balance": {Before: newBalance - amount, After: newBalance}}
+				return tx.Audit.Log(event)
+			})
 			if err != nil {
-				http.Redirect(w, r, "/dashboard?error=Fehler beim Protokollieren", http.StatusSeeOther)
-				return
-			}
-
-			// Commit transaction
-			if err := tx.Commit(); err != nil {
-				http.Redirect(w, r, "/dashboard?error=Fehler beim Abschließen der Transaktion", http.StatusSeeOther)
+				http.Redirect(w, r, "/dashboard?error=Fehler beim Aufladen des Guthabens", http.StatusSeeOther)
 				return
 			}
-
-			// Get user's updated balance
-			var updatedBalance float64
-			if err := db.QueryRow("SELECT balance FROM users WHERE id = ?", selectedUser.ID).Scan(&updatedBalance); err != nil {
-				log.Printf("[ADMIN] Error getting updated balance: %v", err)
-			}
+			metrics.Topup(amount)
 
 			// Send email notification if user has an email
 			if selectedUser.Email != "" {
-				go func() {
+				ctx := r.Context()
+				services.Go(func() {
 					if err := services.SendTopupEmail(selectedUser.Email, selectedUser.Name, amount, updatedBalance); err != nil {
-						log.Printf("[ADMIN] Error sending top-up email: %v", err)
+						adminLog.ErrorContext(ctx, "Failed to send top-up email", "email", selectedUser.Email, "error", err)
 					} else {
-						log.Printf("[ADMIN] Top-up email notification sent successfully to %s", selectedUser.Email)
+						adminLog.DebugContext(ctx, "Top-up email sent", "email", selectedUser.Email)
 					}
-				}()
+				})
 			}
 
 			// Redirect with success message
-			http.Redirect(w, r, fmt.Sprintf("/dashboard?success=true&message=Guthaben von %.2f€ wurde erfolgreich für %s aufgeladen", amount, selectedUser.Name), http.StatusSeeOther)
+			http.Redirect(w, r, fmt.Sprintf("/dashboard?success=true&message=Guthaben von %s wurde erfolgreich für %s aufgeladen", services.FormatMoney(amount), selectedUser.Name), http.StatusSeeOther)
 			return
 		}
 	}
 }
 
 // HandleUserSearch handles the search functionality for users
-func HandleUserSearch(db *sql.DB) http.HandlerFunc {
+func HandleUserSearch(stores repository.Stores) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		query := r.URL.Query().Get("q")
-		query = "%" + query + "%"
-
-		rows, err := db.Query(`
-			SELECT id, name, card_number, role, balance, email, created_at 
-			FROM users 
-			WHERE name LIKE ? OR card_number LIKE ?
-			ORDER BY created_at DESC
-		`, query, query)
+		users, err := stores.Users.List(repository.UserFilter{
+			Search: r.URL.Query().Get("q"),
+			Role:   r.URL.Query().Get("role"),
+			Status: userStatus(r),
+			Sort:   r.URL.Query().Get("sort"),
+		})
 		if err != nil {
 			http.Error(w, "Database error", http.StatusInternalServerError)
 			return
 		}
-		defer rows.Close()
-
-		var users []components.User
-		for rows.Next() {
-			var user components.User
-			var email sql.NullString
-			err := rows.Scan(&user.ID, &user.Name, &user.CardNumber, &user.Role, &user.Balance, &email, &user.CreatedAt)
-			if err != nil {
-				http.Error(w, "Database error", http.StatusInternalServerError)
-				return
-			}
-			user.Email = email.String
-			users = append(users, user)
-		}
 
 		data := components.UsersData{
 			Title:     "Benutzerverwaltung",
@@ -660,53 +722,18 @@ func HandleUserSearch(db *sql.DB) http.HandlerFunc {
 }
 
 // HandleUserFilter handles the role filtering and sorting functionality for users
-func HandleUserFilter(db *sql.DB) http.HandlerFunc {
+func HandleUserFilter(stores repository.Stores) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		role := r.URL.Query().Get("role")
-		sort := r.URL.Query().Get("sort")
-
-		query := `
-			SELECT id, name, card_number, role, balance, email, created_at 
-			FROM users 
-			WHERE 1=1
-		`
-		args := []interface{}{}
-
-		if role != "" {
-			query += " AND role = ?"
-			args = append(args, role)
-		}
-
-		query += " ORDER BY "
-		switch sort {
-		case "name":
-			query += "name ASC"
-		case "balance":
-			query += "balance DESC"
-		default:
-			query += "created_at DESC"
-		}
-
-		rows, err := db.Query(query, args...)
+		users, err := stores.Users.List(repository.UserFilter{
+			Search: r.URL.Query().Get("q"),
+			Role:   r.URL.Query().Get("role"),
+			Status: userStatus(r),
+			Sort:   r.URL.Query().Get("sort"),
+		})
 		if err != nil {
 			http.Error(w, "Database error", http.StatusInternalServerError)
 			return
 		}
-		defer rows.Close()
-
-		var users []components.User
-		for rows.Next() {
-			var user components.User
-			var emailNull sql.NullString
-			err := rows.Scan(&user.ID, &user.Name, &user.CardNumber, &user.Role, &user.Balance, &emailNull, &user.CreatedAt)
-			if err != nil {
-				println("Error scanning user in filter:", err.Error())
-				http.Error(w, "Database error", http.StatusInternalServerError)
-				return
-			}
-			user.Email = emailNull.String
-			users = append(users, user)
-		}
 
 		data := components.UsersData{
 			Title:     "Benutzerverwaltung",
@@ -716,42 +743,3 @@ func HandleUserFilter(db *sql.DB) http.HandlerFunc {
 		components.UsersGrid(data).Render(r.Context(), w)
 	}
 }
-
-// getAuditEntries retrieves audit entries from the database with pagination
-func getAuditEntries(db *sql.DB, page, pageSize int) ([]components.AuditEntry, error) {
-	offset := (page - 1) * pageSize
-
-	rows, err := db.Query(`
-		SELECT a.created_at, u.name, a.user_id, a.action, a.details
-		FROM audit_log a
-		LEFT JOIN users u ON a.user_id = u.id
-		ORDER BY a.created_at DESC
-		LIMIT ? OFFSET ?
-	`, pageSize, offset)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-
-	var entries []components.AuditEntry
-	for rows.Next() {
-		var entry components.AuditEntry
-		err := rows.Scan(&entry.CreatedAt, &entry.UserName, &entry.UserID, &entry.Action, &entry.Details)
-		if err != nil {
-			return nil, err
-		}
-		entries = append(entries, entry)
-	}
-
-	return entries, nil
-}
-
-// getAuditEntriesCount returns the total count of audit entries
-func getAuditEntriesCount(db *sql.DB) (int, error) {
-	var count int
-	err := db.QueryRow("SELECT COUNT(*) FROM audit_log").Scan(&count)
-	if err != nil {
-		return 0, err
-	}
-	return count, nil
-}
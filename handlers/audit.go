@@ -0,0 +1,473 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gopos/components"
+	"gopos/repository"
+	"gopos/services"
+	"net"
+	"net/http"
+	"net/url"
+	"reflect"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// maxUserAgentLength limits the user agent stored with an audit entry
+const maxUserAgentLength = 256
+
+// newAuditEvent returns an audit event of the user with the client of the request
+func newAuditEvent(r *http.Request, userID int, action, details string) repository.AuditEvent {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	userAgent := r.UserAgent()
+	if len(userAgent) > maxUserAgentLength {
+		userAgent = userAgent[:maxUserAgentLength]
+	}
+	return repository.AuditEvent{UserID: userID, Action: action, Details: details, IP: ip, UserAgent: userAgent}
+}
+
+// userAuditFields returns the fields of a user that are compared in the audit log
+func userAuditFields(user components.User) map[string]any {
+	return map[string]any{
+		"name":        user.Name,
+		"card_number": user.CardNumber,
+		"role":        user.Role,
+		"email":       user.Email,
+		"balance":     user.Balance,
+	}
+}
+
+// personalAuditFields identify a user. The audit log cannot be changed afterwards,
+// so it only records that they changed and anonymizing a user leaves nothing behind.
+var personalAuditFields = []string{"name", "card_number", "email"}
+
+// auditHidden replaces a personal value in the audit log
+const auditHidden = "(verborgen)"
+
+// userAuditChanges returns the changed fields between two states of a user, nil
+// for a user that is created or deleted, without the personal values
+func userAuditChanges(before, after *components.User) map[string]components.AuditChange {
+	var beforeFields, afterFields map[string]any
+	if before != nil {
+		beforeFields = userAuditFields(*before)
+	}
+	if after != nil {
+		afterFields = userAuditFields(*after)
+	}
+	changes := auditChanges(beforeFields, afterFields)
+	for _, field := range personalAuditFields {
+		if change, ok := changes[field]; ok {
+			changes[field] = components.AuditChange{Before: hideAuditValue(change.Before), After: hideAuditValue(change.After)}
+		}
+	}
+	return changes
+}
+
+// hideAuditValue keeps whether a value was set, but not the value
+func hideAuditValue(value any) any {
+	if value == nil || value == "" {
+		return value
+	}
+	return auditHidden
+}
+
+// productAuditFields returns the fields of a product that are compared in the audit log
+func productAuditFields(product components.Product) map[string]any {
+	return map[string]any{
+		"name":    product.Name,
+		"barcode": product.Barcode,
+		"price":   product.Price,
+	}
+}
+
+// settingsAuditFields returns the store settings that are compared in the audit log
+func settingsAuditFields(settings components.Settings) map[string]any {
+	return map[string]any{
+		"store_name":     settings.StoreName,
+		"currency":       settings.Currency,
+		"timezone":       settings.Timezone,
+		"receipt_footer": settings.ReceiptFooter,
+	}
+}
+
+// auditChanges returns the fields that differ between before and after. Pass
+// nil as before for a created record and as after for a deleted one.
+func auditChanges(before, after map[string]any) map[string]components.AuditChange {
+	changes := map[string]components.AuditChange{}
+	for field, value := range after {
+		if old, ok := before[field]; !ok || !reflect.DeepEqual(old, value) {
+			changes[field] = components.AuditChange{Before: before[field], After: value}
+		}
+	}
+	for field, value := range before {
+		if _, ok := after[field]; !ok {
+			changes[field] = components.AuditChange{Before: value}
+		}
+	}
+	return changes
+}
+
+// auditPageSizes are the page sizes the audit log can be shown with, the first is the default
+var auditPageSizes = []int{10, 25, 50, 100}
+
+// HandleAuditTrail displays the audit log, filtered by user, action, date range and details
+func HandleAuditTrail(stores repository.Stores) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Get user info from session
+		session, err := store.Get(r, sessionName)
+		if err != nil {
+			http.Error(w, "Session error", http.StatusInternalServerError)
+			return
+		}
+
+		userName, ok := session.Values["name"].(string)
+		if !ok {
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		userRole, ok := session.Values["role"].(string)
+		if !ok {
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		filter, form, errMsg := parseAuditFilter(r)
+
+		// Parse pagination parameters
+		page := 1
+		if parsedPage, err := strconv.Atoi(r.URL.Query().Get("page")); err == nil && parsedPage > 0 {
+			page = parsedPage
+		}
+		pageSize := auditPageSizes[0]
+		if size, err := strconv.Atoi(r.URL.Query().Get("size")); err == nil && slices.Contains(auditPageSizes, size) {
+			pageSize = size
+		}
+
+		// Get total count of matching audit entries
+		totalCount, err := stores.Audit.Count(filter)
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+
+		// Calculate total pages
+		totalPages := (totalCount + pageSize - 1) / pageSize // Ceiling division
+
+		// Get audit entries from database with pagination
+		entries, err := stores.Audit.List(filter, page, pageSize)
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+
+		// Choices of the filter form
+		users, err := stores.Users.List(repository.UserFilter{Sort: "name"})
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		actions, err := stores.Audit.Actions()
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+
+		query := form.Query()
+		query.Set("size", strconv.Itoa(pageSize))
+
+		data := components.AuditData{
+			Title:       "Audit Log",
+			UserName:    userName,
+			Role:        userRole,
+			CSRFToken:   generateCSRFToken(),
+			Entries:     entries,
+			CurrentPage: page,
+			TotalPages:  totalPages,
+			PageSize:    pageSize,
+			PageSizes:   auditPageSizes,
+			TotalCount:  totalCount,
+			Filter:      form,
+			Query:       query.Encode(),
+			Users:       users,
+			Actions:     actions,
+			Error:       errMsg,
+		}
+		components.Audit(data).Render(r.Context(), w)
+	}
+}
+
+// HandleAuditExport exports the entries of the audit log that match the filter as CSV or JSON
+func HandleAuditExport(stores repository.Stores) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		filter, _, errMsg := parseAuditFilter(r)
+		if errMsg != "" {
+			http.Error(w, errMsg, http.StatusBadRequest)
+			return
+		}
+
+		format := r.URL.Query().Get("format")
+		if format != "json" {
+			format = "csv"
+		}
+
+		entries, err := stores.Audit.List(filter, 1, 0)
+		if err != nil {
+			adminLog.ErrorContext(r.Context(), "Failed to export audit log", "error", err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+
+		location := services.GetSettings().Location()
+		filename := fmt.Sprintf("audit-%s.%s", time.Now().In(location).Format(reportDateFormat), format)
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
+
+		if format == "json" {
+			type exportEntry struct {
+				ID         int                               `json:"id"`
+				CreatedAt  time.Time                         `json:"created_at"`
+				UserID     int                               `json:"user_id"`
+				UserName   string                            `json:"user_name"`
+				Action     string                            `json:"action"`
+				EntityType string                            `json:"entity_type,omitempty"`
+				EntityID   int                               `json:"entity_id,omitempty"`
+				Details    string                            `json:"details"`
+				Changes    map[string]components.AuditChange `json:"changes,omitempty"`
+				IP         string                            `json:"ip,omitempty"`
+				UserAgent  string                            `json:"user_agent,omitempty"`
+				PrevHash   string                            `json:"prev_hash"`
+				Hash       string                            `json:"hash"`
+			}
+			export := make([]exportEntry, 0, len(entries))
+			for _, entry := range entries {
+				export = append(export, exportEntry{
+					ID:         entry.ID,
+					CreatedAt:  entry.CreatedAt,
+					UserID:     entry.UserID,
+					UserName:   entry.UserName,
+					Action:     entry.Action,
+					EntityType: entry.EntityType,
+					EntityID:   entry.EntityID,
+					Details:    entry.Details,
+					Changes:    entry.Changes,
+					IP:         entry.IP,
+					UserAgent:  entry.UserAgent,
+					PrevHash:   entry.PrevHash,
+					Hash:       entry.Hash,
+				})
+			}
+			w.Header().Set("Content-Type", "application/json")
+			if err := json.NewEncoder(w).Encode(export); err != nil {
+				adminLog.ErrorContext(r.Context(), "Failed to write audit export", "error", err)
+			}
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		writer := csv.NewWriter(w)
+		writer.Write([]string{"ID", "Zeitpunkt", "Benutzer-ID", "Benutzer", "Aktion", "Objekt", "Objekt-ID", "Details", "Änderungen", "IP-Adresse", "User-Agent", "Vorheriger Hash", "Hash"})
+		for _, entry := range entries {
+			// Changes are written as JSON, so they can be compared
+			var changes []byte
+			if len(entry.Changes) > 0 {
+				changes, _ = json.Marshal(entry.Changes)
+			}
+			entityID := ""
+			if entry.EntityID != 0 {
+				entityID = strconv.Itoa(entry.EntityID)
+			}
+			writer.Write([]string{
+				strconv.Itoa(entry.ID),
+				entry.CreatedAt.In(location).Format("2006-01-02 15:04:05"),
+				strconv.Itoa(entry.UserID),
+				entry.UserName,
+				entry.Action,
+				entry.EntityType,
+				entityID,
+				entry.Details,
+				string(changes),
+				entry.IP,
+				entry.UserAgent,
+				entry.PrevHash,
+				entry.Hash,
+			})
+		}
+		writer.Flush()
+		if err := writer.Error(); err != nil {
+			adminLog.ErrorContext(r.Context(), "Failed to write audit export", "error", err)
+		}
+	}
+}
+
+// parseAuditFilter reads the filter of an audit log request. Dates are days in
+// the timezone of the store; the end date is included. If a date is invalid,
+// an error message is returned and the date is ignored.
+func parseAuditFilter(r *http.Request) (repository.AuditFilter, components.AuditFilterForm, string) {
+	query := r.URL.Query()
+	form := components.AuditFilterForm{
+		Action: query.Get("action"),
+		From:   query.Get("from"),
+		To:     query.Get("to"),
+		Search: query.Get("search"),
+	}
+	filter := repository.AuditFilter{Action: form.Action, Search: form.Search}
+	var errMsg string
+
+	if userID, err := strconv.Atoi(query.Get("user")); err == nil && userID > 0 {
+		form.UserID = userID
+		filter.UserID = userID
+	}
+
+	location := services.GetSettings().Location()
+	if form.From != "" {
+		if from, err := time.ParseInLocation(reportDateFormat, form.From, location); err != nil {
+			errMsg = "Ungültiges Startdatum"
+			form.From = ""
+		} else {
+			filter.From = from
+		}
+	}
+	if form.To != "" {
+		if to, err := time.ParseInLocation(reportDateFormat, form.To, location); err != nil {
+			errMsg = "Ungültiges Enddatum"
+			form.To = ""
+		} else {
+			filter.To = to.AddDate(0, 0, 1)
+		}
+	}
+	return filter, form, errMsg
+}
+
+// HandleAuditVerify checks the hash chain of the audit log and its checkpoints,
+// and writes a new checkpoint on POST
+func HandleAuditVerify(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Get user info from session
+		session, err := store.Get(r, sessionName)
+		if err != nil {
+			http.Error(w, "Session error", http.StatusInternalServerError)
+			return
+		}
+
+		userName, ok := session.Values["name"].(string)
+		if !ok {
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		userRole, ok := session.Values["role"].(string)
+		if !ok {
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		if r.Method == http.MethodPost {
+			if !verifyCSRFToken(r.FormValue("csrf_token")) {
+				http.Redirect(w, r, "/audit/verify?error="+url.QueryEscape("Ungültiger CSRF-Token"), http.StatusSeeOther)
+				return
+			}
+
+			checkpoint, err := services.CreateAuditCheckpoint(db)
+			if errors.Is(err, services.ErrNoCheckpointKey) {
+				http.Redirect(w, r, "/audit/verify?error="+url.QueryEscape("Für Prüfpunkte muss audit.checkpoint_key konfiguriert sein"), http.StatusSeeOther)
+				return
+			}
+			if err != nil {
+				adminLog.ErrorContext(r.Context(), "Failed to create audit checkpoint", "error", err)
+				http.Redirect(w, r, "/audit/verify?error="+url.QueryEscape("Fehler beim Erstellen des Prüfpunkts"), http.StatusSeeOther)
+				return
+			}
+
+			adminUser := r.Context().Value(contextUserKey).(components.User)
+			event := newAuditEvent(r, adminUser.ID, "create_audit_checkpoint", "Prüfpunkt erstellt: "+checkpoint.Name)
+			event.EntityType = "audit_checkpoint"
+			if err := repository.NewSQLAuditStore(db).Log(event); err != nil {
+				adminLog.ErrorContext(r.Context(), "Failed to write audit log", "error", err)
+			}
+
+			http.Redirect(w, r, "/audit/verify?message="+url.QueryEscape("Prüfpunkt "+checkpoint.Name+" erstellt"), http.StatusSeeOther)
+			return
+		}
+
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		report, err := services.VerifyAudit(db)
+		if err != nil {
+			adminLog.ErrorContext(r.Context(), "Failed to verify audit log", "error", err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		if !report.Intact() {
+			adminLog.WarnContext(r.Context(), "Audit log verification failed", "broken_id", report.BrokenID, "problem", report.Problem)
+		}
+
+		data := components.AuditVerifyData{
+			Title:            "Audit Log prüfen",
+			UserName:         userName,
+			Role:             userRole,
+			CSRFToken:        generateCSRFToken(),
+			Error:            r.URL.Query().Get("error"),
+			Message:          r.URL.Query().Get("message"),
+			Directory:        services.CheckpointDirectory(),
+			Schedule:         services.CheckpointSchedule(),
+			ArchiveDirectory: services.ArchiveDirectory(),
+			RetentionDays:    services.AuditRetention(),
+			Report:           report,
+		}
+		data.Success = data.Message != ""
+		components.AuditVerifyPage(data).Render(r.Context(), w)
+	}
+}
+
+// HandleAuditArchive moves the audit log entries older than the given number of days to an archive file
+func HandleAuditArchive(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !verifyCSRFToken(r.FormValue("csrf_token")) {
+			http.Redirect(w, r, "/audit/verify?error="+url.QueryEscape("Ungültiger CSRF-Token"), http.StatusSeeOther)
+			return
+		}
+
+		days, err := strconv.Atoi(r.FormValue("days"))
+		if err != nil || days <= 0 {
+			http.Redirect(w, r, "/audit/verify?error="+url.QueryEscape("Ungültige Anzahl Tage"), http.StatusSeeOther)
+			return
+		}
+
+		archive, err := services.ArchiveAuditLog(db, time.Now().AddDate(0, 0, -days))
+		if err != nil {
+			adminLog.ErrorContext(r.Context(), "Failed to archive audit log", "error", err)
+			http.Redirect(w, r, "/audit/verify?error="+url.QueryEscape("Fehler beim Archivieren des Audit Logs"), http.StatusSeeOther)
+			return
+		}
+		if archive.Entries == 0 {
+			http.Redirect(w, r, "/audit/verify?message="+url.QueryEscape(fmt.Sprintf("Keine Einträge älter als %d Tage", days)), http.StatusSeeOther)
+			return
+		}
+
+		adminUser := r.Context().Value(contextUserKey).(components.User)
+		event := newAuditEvent(r, adminUser.ID, "archive_audit_log",
+			fmt.Sprintf("Einträge #%d bis #%d archiviert: %s", archive.FirstID, archive.LastID, archive.Name))
+		event.EntityType = "audit_archive"
+		if err := repository.NewSQLAuditStore(db).Log(event); err != nil {
+			adminLog.ErrorContext(r.Context(), "Failed to write audit log", "error", err)
+		}
+
+		message := fmt.Sprintf("%d Einträge nach %s archiviert", archive.Entries, archive.Name)
+		http.Redirect(w, r, "/audit/verify?message="+url.QueryEscape(message), http.StatusSeeOther)
+	}
+}
@@ -4,10 +4,10 @@ import (
 	"database/sql"
 	"gopos/components"
 	"gopos/config"
+	"gopos/logging"
+	"gopos/repository"
 	"log"
 	"net/http"
-	"os"
-	"time"
 
 	"github.com/gorilla/sessions"
 )
@@ -16,6 +16,8 @@ var store *sessions.CookieStore
 
 const sessionName = "pos-session" // Consistent session name
 
+var authLog = logging.Component("auth")
+
 // InitSessionStore initializes the session store with the key from config
 func InitSessionStore(cfg *config.Config) {
 	// Get session key from config
@@ -30,7 +32,7 @@ func InitSessionStore(cfg *config.Config) {
 		Path:     "/",
 		MaxAge:   86400 * 7, // 7 days
 		HttpOnly: true,
-		Secure:   os.Getenv("ENV") == "production", // Only use HTTPS in production
+		Secure:   cfg.Server.SecureCookies, // Only send the cookie over HTTPS
 		SameSite: http.SameSiteStrictMode,
 	}
 }
@@ -69,7 +71,7 @@ func HandleLogin(db *sql.DB) http.HandlerFunc {
 }
 
 // HandleLoginPost processes the login form
-func HandleLoginPost(db *sql.DB) http.HandlerFunc {
+func HandleLoginPost(stores repository.Stores) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		// Check if user is already logged in
 		session, _ := store.Get(r, sessionName)
@@ -79,7 +81,7 @@ func HandleLoginPost(db *sql.DB) http.HandlerFunc {
 		}
 
 		if err := r.ParseForm(); err != nil {
-			log.Printf("Login error: Form parsing failed: %v", err)
+			authLog.WarnContext(r.Context(), "Invalid login form", "error", err)
 			data := components.LoginData{
 				CSRFToken: generateCSRFToken(),
 				Error:     "Ungültiges Formular",
@@ -90,7 +92,7 @@ func HandleLoginPost(db *sql.DB) http.HandlerFunc {
 
 		token := r.FormValue("csrf_token")
 		if !verifyCSRFToken(token) {
-			log.Printf("Login error: Invalid CSRF token")
+			authLog.WarnContext(r.Context(), "Login with invalid CSRF token")
 			data := components.LoginData{
 				CSRFToken: generateCSRFToken(),
 				Error:     "Ungültiger CSRF-Token",
@@ -101,7 +103,7 @@ func HandleLoginPost(db *sql.DB) http.HandlerFunc {
 
 		cardNumber := r.FormValue("card_number")
 		if cardNumber == "" {
-			log.Printf("Login error: Empty card number")
+			authLog.InfoContext(r.Context(), "Login without card number")
 			data := components.LoginData{
 				CSRFToken: generateCSRFToken(),
 				Error:     "Kartennummer erforderlich",
@@ -110,17 +112,9 @@ func HandleLoginPost(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
-		var user struct {
-			ID    int
-			Role  string
-			Name  string
-			Email sql.NullString
-		}
-
-		log.Printf("Login attempt with card number: %s", cardNumber)
-		err := db.QueryRow("SELECT id, role, name, email FROM users WHERE card_number = ?", cardNumber).Scan(&user.ID, &user.Role, &user.Name, &user.Email)
-		if err == sql.ErrNoRows {
-			log.Printf("Login failed: Invalid card number: %s", cardNumber)
+		user, err := stores.Users.GetByCardNumber(cardNumber)
+		if err == repository.ErrNotFound {
+			authLog.InfoContext(r.Context(), "Login failed, unknown card", "card_number", cardNumber)
 			data := components.LoginData{
 				CSRFToken: generateCSRFToken(),
 				Error:     "Ungültige Kartennummer",
@@ -128,7 +122,7 @@ func HandleLoginPost(db *sql.DB) http.HandlerFunc {
 			components.Login(data).Render(r.Context(), w)
 			return
 		} else if err != nil {
-			log.Printf("Login database error: %v", err)
+			authLog.ErrorContext(r.Context(), "Failed to look up card for login", "error", err)
 			data := components.LoginData{
 				CSRFToken: generateCSRFToken(),
 				Error:     "Datenbankfehler",
@@ -137,16 +131,26 @@ func HandleLoginPost(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
-		log.Printf("Login successful: User %s (ID: %d) with role %s", user.Name, user.ID, user.Role)
+		if !user.Active() {
+			authLog.InfoContext(r.Context(), "Login failed, user is deactivated", "user_id", user.ID)
+			data := components.LoginData{
+				CSRFToken: generateCSRFToken(),
+				Error:     "Dieses Benutzerkonto ist deaktiviert",
+			}
+			components.Login(data).Render(r.Context(), w)
+			return
+		}
+
+		authLog.InfoContext(r.Context(), "Login successful", "user_id", user.ID, "role", user.Role)
 
 		// Create new session
 		session.Values["authenticated"] = true
 		session.Values["user_id"] = user.ID
 		session.Values["role"] = user.Role
 		session.Values["name"] = user.Name
-		session.Values["email"] = user.Email.String
+		session.Values["email"] = user.Email
 		if err := session.Save(r, w); err != nil {
-			log.Printf("Session error: %v", err)
+			authLog.ErrorContext(r.Context(), "Failed to save session", "error", err)
 			data := components.LoginData{
 				CSRFToken: generateCSRFToken(),
 				Error:     "Sitzungsfehler",
@@ -156,14 +160,11 @@ func HandleLoginPost(db *sql.DB) http.HandlerFunc {
 		}
 
 		// Log the login
-		now := time.Now()
-		_, err = db.Exec(`
-			INSERT INTO audit_log (user_id, action, details, created_at)
-			VALUES (?, ?, ?, ?)
-		`, user.ID, "login", "Benutzer eingeloggt: "+user.Name, now)
-
+		event := newAuditEvent(r, user.ID, "login", "Benutzer eingeloggt")
+		event.EntityType, event.EntityID = "user", user.ID
+		err = stores.Audit.Log(event)
 		if err != nil {
-			log.Printf("Audit log error: %v", err)
+			authLog.ErrorContext(r.Context(), "Failed to write audit log", "error", err)
 		}
 
 		http.Redirect(w, r, "/dashboard", http.StatusSeeOther)
@@ -176,27 +177,19 @@ func HandleLogout(w http.ResponseWriter, r *http.Request) {
 
 	// Get user info for logging before clearing the session
 	userID, ok := session.Values["user_id"].(int)
-	userName, _ := session.Values["name"].(string)
 
-	// Clear session
-	session.Values["authenticated"] = false
-	delete(session.Values, "user_id")
-	delete(session.Values, "role")
-	delete(session.Values, "name")
+	clearSession(session)
 	session.Save(r, w)
 
 	// Log the logout if we have the user info
 	if ok {
 		db, ok := r.Context().Value(DbKey).(*sql.DB)
 		if ok {
-			now := time.Now()
-			_, err := db.Exec(`
-				INSERT INTO audit_log (user_id, action, details, created_at)
-				VALUES (?, ?, ?, ?)
-			`, userID, "logout", "Benutzer ausgeloggt: "+userName, now)
-
+			event := newAuditEvent(r, userID, "logout", "Benutzer ausgeloggt")
+			event.EntityType, event.EntityID = "user", userID
+			err := repository.NewSQLAuditStore(db).Log(event)
 			if err != nil {
-				log.Printf("Audit log error: %v", err)
+				authLog.ErrorContext(r.Context(), "Failed to write audit log", "error", err)
 			}
 		}
 	}
@@ -204,6 +197,15 @@ func HandleLogout(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, "/", http.StatusSeeOther)
 }
 
+// clearSession logs the user of a session out
+func clearSession(session *sessions.Session) {
+	session.Values["authenticated"] = false
+	delete(session.Values, "user_id")
+	delete(session.Values, "role")
+	delete(session.Values, "name")
+	delete(session.Values, "email")
+}
+
 // RequireRole middleware checks if user has required role
 func RequireRole(roles []string, next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
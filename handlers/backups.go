@@ -0,0 +1,127 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"gopos/components"
+	"gopos/database"
+	"gopos/logging"
+	"gopos/repository"
+	"gopos/services"
+	"net/http"
+	"net/url"
+	"os"
+)
+
+var backupLog = logging.Component("backup")
+
+const backupUnsupportedMessage = "Datensicherungen sind nur mit SQLite möglich, PostgreSQL-Datenbanken bitte mit pg_dump sichern"
+
+// HandleBackups lists the database backups and creates a new one on POST
+func HandleBackups(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Get user info from session
+		session, err := store.Get(r, sessionName)
+		if err != nil {
+			backupLog.ErrorContext(r.Context(), "Failed to get session", "error", err)
+			http.Error(w, "Session error", http.StatusInternalServerError)
+			return
+		}
+
+		userName, ok := session.Values["name"].(string)
+		if !ok {
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		userRole, ok := session.Values["role"].(string)
+		if !ok {
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		if r.Method == http.MethodPost {
+			if !verifyCSRFToken(r.FormValue("csrf_token")) {
+				http.Redirect(w, r, "/backups?error="+url.QueryEscape("Ungültiger CSRF-Token"), http.StatusSeeOther)
+				return
+			}
+
+			backup, err := services.CreateBackup(db)
+			if errors.Is(err, database.ErrBackupUnsupported) {
+				http.Redirect(w, r, "/backups?error="+url.QueryEscape(backupUnsupportedMessage), http.StatusSeeOther)
+				return
+			}
+			if err != nil {
+				backupLog.ErrorContext(r.Context(), "Failed to create backup", "error", err)
+				http.Redirect(w, r, "/backups?error="+url.QueryEscape("Fehler beim Erstellen der Sicherung"), http.StatusSeeOther)
+				return
+			}
+
+			adminUser := r.Context().Value(contextUserKey).(components.User)
+			event := newAuditEvent(r, adminUser.ID, "create_backup", "Datensicherung erstellt: "+backup.Name)
+			event.EntityType = "backup"
+			err = repository.NewSQLAuditStore(db).Log(event)
+			if err != nil {
+				backupLog.ErrorContext(r.Context(), "Failed to write audit log", "error", err)
+			}
+
+			http.Redirect(w, r, "/backups?message="+url.QueryEscape("Sicherung "+backup.Name+" erstellt"), http.StatusSeeOther)
+			return
+		}
+
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		backups, err := services.ListBackups()
+		if err != nil {
+			backupLog.ErrorContext(r.Context(), "Failed to list backups", "error", err)
+		}
+
+		data := components.BackupsData{
+			Title:     "Datensicherung",
+			UserName:  userName,
+			Role:      userRole,
+			CSRFToken: generateCSRFToken(),
+			Error:     r.URL.Query().Get("error"),
+			Message:   r.URL.Query().Get("message"),
+			Directory: services.BackupDirectory(),
+			Schedule:  services.BackupSchedule(),
+			Backups:   backups,
+		}
+		data.Success = data.Message != ""
+		if err != nil && data.Error == "" {
+			data.Error = "Fehler beim Lesen des Sicherungsverzeichnisses"
+		}
+		if database.DialectOf(db) != database.SQLite && data.Error == "" {
+			data.Error = backupUnsupportedMessage
+		}
+
+		if err := components.BackupsPage(data).Render(r.Context(), w); err != nil {
+			backupLog.ErrorContext(r.Context(), "Failed to render template", "error", err)
+			http.Error(w, "Error rendering backups", http.StatusInternalServerError)
+		}
+	}
+}
+
+// HandleBackupDownload sends a backup file to the browser
+func HandleBackupDownload(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := r.URL.Query().Get("name")
+		path, err := services.BackupPath(name)
+		if os.IsNotExist(err) {
+			http.Error(w, "Sicherung nicht gefunden", http.StatusNotFound)
+			return
+		} else if err != nil {
+			backupLog.ErrorContext(r.Context(), "Failed to open backup", "backup", name, "error", err)
+			http.Error(w, "Fehler beim Lesen der Sicherung", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/vnd.sqlite3")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, name))
+		http.ServeFile(w, r, path)
+	}
+}
@@ -1,19 +1,21 @@
 package handlers
 
 import (
-	"database/sql"
-	"fmt"
+	"errors"
 	"gopos/components"
+	"gopos/logging"
+	"gopos/metrics"
+	"gopos/repository"
 	"gopos/services"
-	"log"
 	"net/http"
 	"strconv"
 	"strings"
-	"time"
 )
 
+var balanceLog = logging.Component("balance")
+
 // HandleBalanceTopup handles the balance top-up functionality
-func HandleBalanceTopup(db *sql.DB) http.HandlerFunc {
+func HandleBalanceTopup(stores repository.Stores) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method == "GET" {
 			data := components.BalanceTopupData{
@@ -39,8 +41,6 @@ func HandleBalanceTopup(db *sql.DB) http.HandlerFunc {
 		}
 
 		if r.Method == "POST" {
-			log.Printf("[TRANSACTION] Starting balance top-up process")
-
 			// Parse form values
 			cardNumber := r.FormValue("card_number")
 			amountStr := r.FormValue("amount")
@@ -65,117 +65,69 @@ func HandleBalanceTopup(db *sql.DB) http.HandlerFunc {
 				return
 			}
 
-			// Start transaction
-			tx, err := db.Begin()
-			if err != nil {
-				log.Printf("[TRANSACTION] Error starting database transaction: %v", err)
-				http.Redirect(w, r, "/balance/topup?error=Datenbankfehler beim Starten der Transaktion", http.StatusSeeOther)
-				return
+			// Get user; deactivated users cannot be topped up
+			user, err := stores.Users.GetByCardNumber(cardNumber)
+			if err == nil && !user.Active() {
+				err = repository.ErrNotFound
 			}
-			defer tx.Rollback()
-
-			// Get user and current balance
-			var userID int64
-			var currentBalance float64
-			var userName string
-			err = tx.QueryRow(`
-				SELECT id, balance, name 
-				FROM users 
-				WHERE card_number = ?`, cardNumber).Scan(&userID, &currentBalance, &userName)
-
-			if err == sql.ErrNoRows {
-				log.Printf("[TRANSACTION] User not found for card number: %s", cardNumber)
+			if errors.Is(err, repository.ErrNotFound) {
+				balanceLog.InfoContext(r.Context(), "Customer not found", "card_number", cardNumber)
 				http.Redirect(w, r, "/balance/topup?error=Benutzer nicht gefunden", http.StatusSeeOther)
 				return
 			} else if err != nil {
-				log.Printf("[TRANSACTION] Error loading user data: %v", err)
+				balanceLog.ErrorContext(r.Context(), "Failed to load customer", "error", err)
 				http.Redirect(w, r, "/balance/topup?error=Fehler beim Laden des Benutzers", http.StatusSeeOther)
 				return
 			}
 
-			log.Printf("[TRANSACTION] User found: ID=%d, Name=%s, Current Balance=%.2f", userID, userName, currentBalance)
-
-			// Calculate new balance
-			newBalance := currentBalance + amount
-
-			// Update user balance
-			result, err := tx.Exec(`
-				UPDATE users 
-				SET balance = ? 
-				WHERE id = ?`, newBalance, userID)
-
-			if err != nil {
-				log.Printf("[TRANSACTION] Error updating balance: %v", err)
-				http.Redirect(w, r, "/balance/topup?error=Fehler beim Aktualisieren des Guthabens", http.StatusSeeOther)
-				return
-			}
-
-			rowsAffected, err := result.RowsAffected()
-			if err != nil || rowsAffected != 1 {
-				log.Printf("[TRANSACTION] Error with affected rows: err=%v, rows=%d", err, rowsAffected)
-				http.Redirect(w, r, "/balance/topup?error=Fehler beim Aktualisieren des Guthabens", http.StatusSeeOther)
-				return
-			}
-
-			log.Printf("[TRANSACTION] Balance updated successfully: New Balance=%.2f", newBalance)
-
-			// Record transaction
+			// Update the balance, record the transaction and log the action together
 			cashierUser := r.Context().Value(userKey).(components.User)
-			log.Printf("[TRANSACTION] Recording transaction: Amount=%.2f, Cashier=%s (ID=%d)", amount, cashierUser.Name, cashierUser.ID)
-
-			result, err = tx.Exec(`
-				INSERT INTO transactions (user_id, cashier_id, total, description, created_at)
-				VALUES (?, ?, ?, ?, ?)
-			`, userID, cashierUser.ID, amount, "Guthaben aufgeladen", time.Now())
-
-			if err != nil {
-				log.Printf("[TRANSACTION] Error recording transaction: %v", err)
-				http.Redirect(w, r, "/balance/topup?error=Fehler beim Speichern der Transaktion", http.StatusSeeOther)
-				return
-			}
-
-			transactionID, err := result.LastInsertId()
-			if err == nil {
-				log.Printf("[TRANSACTION] Transaction recorded successfully: ID=%d", transactionID)
-			}
-
-			// Log the action
-			_, err = tx.Exec(`
-				INSERT INTO audit_log (user_id, action, details, created_at)
-				VALUES (?, ?, ?, ?)
-			`, cashierUser.ID, "balance_topup", fmt.Sprintf("Guthaben aufgeladen für %s: %.2f €", userName, amount), time.Now())
+			var transactionID int
+			var newBalance float64
+			err = stores.Atomic(func(tx repository.Stores) error {
+				newBalance, err = tx.Users.AdjustBalance(user.ID, amount)
+				if err != nil {
+					return err
+				}
+				transactionID, err = tx.Transactions.Record(repository.Booking{
+					UserID:       user.ID,
+					CashierID:    cashierUser.ID,
+					Total:        amount,
+					BalanceAfter: newBalance,
+					Kind:         repository.TransactionTopup,
+					Description:  "Guthaben aufgeladen",
+				})
+				if err != nil {
+					return err
+				}
+				event := newAuditEvent(r, cashierUser.ID, "balance_topup", "Guthaben aufgeladen: "+services.FormatMoney(amount))
+				event.EntityType, event.EntityID = "user", user.ID
+				event.Changes = map[string]components.AuditChange{"balance": {Before: newBalance - amount, After: newBalance}}
+				return tx.Audit.Log(event)
+			})
 			if err != nil {
-				http.Redirect(w, r, "/balance/topup?error=Fehler beim Speichern des Audit-Logs", http.StatusSeeOther)
+				balanceLog.ErrorContext(r.Context(), "Failed to top up balance", "user_id", user.ID, "error", err)
+				http.Redirect(w, r, "/balance/topup?error=Fehler beim Aufladen des Guthabens", http.StatusSeeOther)
 				return
 			}
-
-			// Commit transaction
-			log.Printf("[TRANSACTION] Attempting to commit transaction...")
-			if err := tx.Commit(); err != nil {
-				log.Printf("[TRANSACTION] ERROR: Failed to commit transaction: %v", err)
-				http.Redirect(w, r, "/balance/topup?error=Fehler beim Abschließen der Transaktion", http.StatusSeeOther)
-				return
-			}
-			log.Printf("[TRANSACTION] SUCCESS: Transaction committed successfully!")
-			log.Printf("[TRANSACTION] ====== SUMMARY ======")
-			log.Printf("[TRANSACTION] User: %s (ID: %d)", userName, userID)
-			log.Printf("[TRANSACTION] Amount: %.2f €", amount)
-			log.Printf("[TRANSACTION] New Balance: %.2f €", newBalance)
-			log.Printf("[TRANSACTION] Cashier: %s", cashierUser.Name)
-			log.Printf("[TRANSACTION] ====================")
-
-			// Get user email
-			var userEmail string
-			err = db.QueryRow("SELECT email FROM users WHERE id = ?", userID).Scan(&userEmail)
-			if err == nil && userEmail != "" {
-				// Send email notification
-				go func() {
-					if err := services.SendTopupEmail(userEmail, userName, amount, newBalance); err != nil {
-						log.Printf("[BALANCE] Error sending top-up email: %v", err)
+			metrics.Topup(amount)
+			balanceLog.InfoContext(r.Context(), "Balance topped up",
+				"transaction_id", transactionID,
+				"user_id", user.ID,
+				"cashier_id", cashierUser.ID,
+				"amount", amount,
+				"balance", newBalance)
+
+			// Send email notification if the user has an email
+			if user.Email != "" {
+				ctx := r.Context()
+				services.Go(func() {
+					if err := services.SendTopupEmail(user.Email, user.Name, amount, newBalance); err != nil {
+						balanceLog.ErrorContext(ctx, "Failed to send top-up email", "email", user.Email, "error", err)
 					} else {
-						log.Printf("[BALANCE] Email notification sent successfully")
+						balanceLog.DebugContext(ctx, "Top-up email sent", "transaction_id", transactionID)
 					}
-				}()
+				})
 			}
 
 			// Show success message with amount and new balance
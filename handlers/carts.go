@@ -0,0 +1,361 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"gopos/logging"
+	"gopos/repository"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var cartLog = logging.Component("cart")
+
+// registerCookieName is the cookie that identifies the register a browser belongs to
+const registerCookieName = "gopos_register"
+
+// registerName returns the name of the register the request comes from. A register
+// can be named with the register query parameter on the checkout page; otherwise
+// a name is generated once and kept in a cookie, so a reload resumes the same cart.
+func registerName(w http.ResponseWriter, r *http.Request) string {
+	name := strings.TrimSpace(r.URL.Query().Get("register"))
+	if name == "" {
+		if cookie, err := r.Cookie(registerCookieName); err == nil {
+			name = cookie.Value
+		}
+	}
+	if name == "" {
+		suffix := make([]byte, 2)
+		rand.Read(suffix)
+		name = "Kasse-" + strings.ToUpper(hex.EncodeToString(suffix))
+	}
+	if len(name) > 64 {
+		name = name[:64]
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     registerCookieName,
+		Value:    name,
+		Path:     "/",
+		MaxAge:   int((365 * 24 * time.Hour).Seconds()),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return name
+}
+
+// HandleListCarts returns all open carts, so a cart can be resumed at another register
+func HandleListCarts(stores repository.Stores) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		carts, err := stores.Carts.ListOpen()
+		if err != nil {
+			cartLog.ErrorContext(r.Context(), "Failed to list carts", "error", err)
+			http.Error(w, "Datenbankfehler", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(carts)
+	}
+}
+
+// HandleOpenCart returns the open cart of the requesting register, creating it if needed
+func HandleOpenCart(stores repository.Stores) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !verifyCartRequest(w, r) {
+			return
+		}
+
+		cashierID, ok := sessionUserID(r)
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		cart, err := stores.Carts.Open(registerName(w, r), cashierID)
+		if err != nil {
+			cartLog.ErrorContext(r.Context(), "Failed to open cart", "error", err)
+			http.Error(w, "Datenbankfehler", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(cart)
+	}
+}
+
+// HandleGetCart returns a single cart
+func HandleGetCart(stores repository.Stores) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cartID, ok := cartIDParam(w, r)
+		if !ok {
+			return
+		}
+		writeCart(stores, w, r, cartID)
+	}
+}
+
+// HandleAddCartItem adds a product to a cart by its barcode
+func HandleAddCartItem(stores repository.Stores) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var request struct {
+			Barcode string `json:"barcode"`
+		}
+		changeCart(stores, w, r, &request, func(carts repository.CartStore, cartID int64) error {
+			if request.Barcode == "" {
+				return errBadCartRequest("Barcode erforderlich")
+			}
+			err := carts.AddItem(cartID, request.Barcode)
+			if err == repository.ErrNotFound {
+				return errCartNotFound("Produkt nicht gefunden")
+			}
+			return err
+		})
+	}
+}
+
+// HandleSetCartQuantity changes the quantity of a product in a cart
+func HandleSetCartQuantity(stores repository.Stores) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var request struct {
+			ProductID int64 `json:"product_id"`
+			Quantity  int   `json:"quantity"`
+		}
+		changeCart(stores, w, r, &request, func(carts repository.CartStore, cartID int64) error {
+			if request.Quantity > 1000 {
+				return errBadCartRequest("Ungültige Anzahl")
+			}
+			return carts.SetQuantity(cartID, request.ProductID, request.Quantity)
+		})
+	}
+}
+
+// HandleRemoveCartItem removes a product from a cart
+func HandleRemoveCartItem(stores repository.Stores) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var request struct {
+			ProductID int64 `json:"product_id"`
+		}
+		changeCart(stores, w, r, &request, func(carts repository.CartStore, cartID int64) error {
+			return carts.SetQuantity(cartID, request.ProductID, 0)
+		})
+	}
+}
+
+// HandleSetCartCustomer attaches a customer to a cart by card number, or detaches it
+func HandleSetCartCustomer(stores repository.Stores) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var request struct {
+			CardNumber string `json:"card_number"`
+		}
+		changeCart(stores, w, r, &request, func(carts repository.CartStore, cartID int64) error {
+			err := carts.SetCustomer(cartID, strings.TrimSpace(request.CardNumber))
+			if err == repository.ErrNotFound {
+				return errCartNotFound("Keine Karte mit dieser Nummer gefunden")
+			}
+			return err
+		})
+	}
+}
+
+// HandleTakeOverCart moves a cart to the requesting register and cashier
+func HandleTakeOverCart(stores repository.Stores) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cashierID, ok := sessionUserID(r)
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		register := registerName(w, r)
+		changeCart(stores, w, r, nil, func(carts repository.CartStore, cartID int64) error {
+			err := carts.TakeOver(cartID, register, cashierID)
+			if err == repository.ErrRegisterBusy {
+				return &cartError{http.StatusConflict, "An dieser Kasse ist bereits ein Warenkorb offen"}
+			}
+			return err
+		})
+	}
+}
+
+// HandleDiscardCart closes a cart without checking it out
+func HandleDiscardCart(stores repository.Stores) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		changeCart(stores, w, r, nil, func(carts repository.CartStore, cartID int64) error {
+			return carts.Discard(cartID)
+		})
+	}
+}
+
+// HandleCompleteCart checks out a cart at the current product prices. The database
+// is used for the receipt that is printed and mailed afterwards.
+func HandleCompleteCart(stores repository.Stores, db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !verifyCartRequest(w, r) {
+			return
+		}
+
+		session, err := store.Get(r, sessionName)
+		if err != nil {
+			http.Error(w, "Session error", http.StatusInternalServerError)
+			return
+		}
+		cashierID, ok := session.Values["user_id"].(int)
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		cashierName, _ := session.Values["name"].(string)
+
+		cartID, ok := cartIDParam(w, r)
+		if !ok {
+			return
+		}
+
+		cart, err := stores.Carts.Get(cartID)
+		if err == repository.ErrNotFound {
+			http.Error(w, "Warenkorb nicht gefunden", http.StatusNotFound)
+			return
+		} else if err != nil {
+			cartLog.ErrorContext(r.Context(), "Failed to load cart", "cart_id", cartID, "error", err)
+			http.Error(w, "Datenbankfehler", http.StatusInternalServerError)
+			return
+		}
+		// A completed cart is answered with its original result by the idempotency key
+		if cart.Status == "discarded" {
+			http.Error(w, "Der Warenkorb wurde verworfen", http.StatusConflict)
+			return
+		}
+		if cart.Customer == nil || len(cart.Items) == 0 {
+			http.Error(w, "Kunde und mindestens ein Produkt erforderlich", http.StatusBadRequest)
+			return
+		}
+
+		request := CheckoutRequest{
+			CardNumber:     cart.Customer.CardNumber,
+			Total:          cart.Total,
+			IdempotencyKey: fmt.Sprintf("cart-%d", cart.ID),
+		}
+		for _, item := range cart.Items {
+			request.Items = append(request.Items, CartItem{
+				ProductID: item.ProductID,
+				Name:      item.Name,
+				Price:     item.Price,
+				Quantity:  item.Quantity,
+			})
+		}
+
+		cartLog.DebugContext(r.Context(), "Completing cart", "cart_id", cart.ID, "register", cart.Register)
+		processCheckout(r.Context(), stores, db, w, cashierID, cashierName, request, func(tx repository.Stores, transactionID int) error {
+			return tx.Carts.Complete(cart, transactionID)
+		})
+	}
+}
+
+// cartError is an error with a message that is shown to the cashier
+type cartError struct {
+	status  int
+	message string
+}
+
+func (e *cartError) Error() string {
+	return e.message
+}
+
+func errBadCartRequest(message string) error {
+	return &cartError{http.StatusBadRequest, message}
+}
+
+func errCartNotFound(message string) error {
+	return &cartError{http.StatusNotFound, message}
+}
+
+// changeCart decodes the request body into request (if given), applies change to
+// the cart named by the id query parameter and responds with the updated cart. The
+// change runs within Atomic, so it is undone if it fails halfway.
+func changeCart(stores repository.Stores, w http.ResponseWriter, r *http.Request, request interface{}, change func(carts repository.CartStore, cartID int64) error) {
+	if !verifyCartRequest(w, r) {
+		return
+	}
+
+	cartID, ok := cartIDParam(w, r)
+	if !ok {
+		return
+	}
+
+	if request != nil {
+		if err := json.NewDecoder(r.Body).Decode(request); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+	}
+
+	err := stores.Atomic(func(tx repository.Stores) error {
+		return change(tx.Carts, cartID)
+	})
+	if err != nil {
+		if cartErr, ok := err.(*cartError); ok {
+			http.Error(w, cartErr.message, cartErr.status)
+		} else if err == repository.ErrCartNotFound {
+			http.Error(w, "Warenkorb nicht gefunden", http.StatusNotFound)
+		} else if err == repository.ErrCartNotOpen {
+			http.Error(w, "Der Warenkorb ist nicht mehr offen", http.StatusConflict)
+		} else {
+			cartLog.ErrorContext(r.Context(), "Failed to change cart", "cart_id", cartID, "error", err)
+			http.Error(w, "Datenbankfehler", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	writeCart(stores, w, r, cartID)
+}
+
+// verifyCartRequest checks that a cart change is a POST with a valid CSRF token
+func verifyCartRequest(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return false
+	}
+	if !verifyCSRFToken(r.Header.Get("X-CSRF-Token")) {
+		http.Error(w, "Invalid CSRF token", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+func cartIDParam(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	cartID, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Ungültige Warenkorb-ID", http.StatusBadRequest)
+		return 0, false
+	}
+	return cartID, true
+}
+
+func sessionUserID(r *http.Request) (int, bool) {
+	session, err := store.Get(r, sessionName)
+	if err != nil {
+		return 0, false
+	}
+	userID, ok := session.Values["user_id"].(int)
+	return userID, ok
+}
+
+func writeCart(stores repository.Stores, w http.ResponseWriter, r *http.Request, cartID int64) {
+	cart, err := stores.Carts.Get(cartID)
+	if err == repository.ErrNotFound {
+		http.Error(w, "Warenkorb nicht gefunden", http.StatusNotFound)
+		return
+	} else if err != nil {
+		cartLog.ErrorContext(r.Context(), "Failed to load cart", "cart_id", cartID, "error", err)
+		http.Error(w, "Datenbankfehler", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(cart)
+}
@@ -1,13 +1,16 @@
 package handlers
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
+	"fmt"
 	"gopos/components"
+	"gopos/logging"
+	"gopos/metrics"
+	"gopos/repository"
 	"gopos/services"
-	"log"
 	"net/http"
-	"time"
 )
 
 type CartItem struct {
@@ -21,29 +24,36 @@ type CheckoutRequest struct {
 	CardNumber string     `json:"card_number"`
 	Total      float64    `json:"total"`
 	Items      []CartItem `json:"items"`
+	// IdempotencyKey identifies a checkout across retries; it may also be sent in the Idempotency-Key header
+	IdempotencyKey string `json:"idempotency_key"`
 }
 
+var checkoutLog = logging.Component("checkout")
+
+// maxIdempotencyKeyLength limits the size of client supplied idempotency keys
+const maxIdempotencyKeyLength = 200
+
 // HandleCheckout renders the checkout page
 func HandleCheckout(db *sql.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		// Get user info from session
 		session, err := store.Get(r, sessionName)
 		if err != nil {
-			log.Printf("Checkout error: failed to get session: %v", err)
+			checkoutLog.ErrorContext(r.Context(), "Failed to get session", "error", err)
 			http.Error(w, "Session error", http.StatusInternalServerError)
 			return
 		}
 
 		userName, ok := session.Values["name"].(string)
 		if !ok {
-			log.Printf("Checkout error: name not found in session or wrong type")
+			checkoutLog.WarnContext(r.Context(), "Name not found in session")
 			http.Redirect(w, r, "/", http.StatusSeeOther)
 			return
 		}
 
 		userRole, ok := session.Values["role"].(string)
 		if !ok {
-			log.Printf("Checkout error: role not found in session or wrong type")
+			checkoutLog.WarnContext(r.Context(), "Role not found in session")
 			http.Redirect(w, r, "/", http.StatusSeeOther)
 			return
 		}
@@ -53,10 +63,12 @@ func HandleCheckout(db *sql.DB) http.HandlerFunc {
 			UserName:  userName,
 			Role:      userRole,
 			CSRFToken: generateCSRFToken(),
+			Printer:   services.PrinterConfigured(),
+			Register:  registerName(w, r),
 		}
 
 		if err := components.Checkout(data).Render(r.Context(), w); err != nil {
-			log.Printf("Checkout error: failed to render template: %v", err)
+			checkoutLog.ErrorContext(r.Context(), "Failed to render checkout", "error", err)
 			http.Error(w, "Error rendering checkout", http.StatusInternalServerError)
 			return
 		}
@@ -64,35 +76,39 @@ func HandleCheckout(db *sql.DB) http.HandlerFunc {
 }
 
 // HandleCustomerLookup looks up a customer by card number
-func HandleCustomerLookup(db *sql.DB) http.HandlerFunc {
+func HandleCustomerLookup(stores repository.Stores) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		cardNumber := r.URL.Query().Get("card_number")
-		log.Printf("[DEBUG] Looking up customer with card number: %s", cardNumber)
 
 		if cardNumber == "" {
 			http.Error(w, "Kartennummer erforderlich", http.StatusBadRequest)
 			return
 		}
 
-		user, err := services.GetUserByCardNumber(db, cardNumber)
-		if err == sql.ErrNoRows {
-			log.Printf("[DEBUG] No user found with card number: %s", cardNumber)
+		user, err := stores.Users.GetByCardNumber(cardNumber)
+		if err == repository.ErrNotFound {
+			checkoutLog.DebugContext(r.Context(), "No customer found", "card_number", cardNumber)
 			http.Error(w, "Keine Karte mit dieser Nummer gefunden", http.StatusNotFound)
 			return
 		} else if err != nil {
-			log.Printf("[DEBUG] Database error looking up card number %s: %v", cardNumber, err)
+			checkoutLog.ErrorContext(r.Context(), "Failed to look up customer", "card_number", cardNumber, "error", err)
 			http.Error(w, "Datenbankfehler beim Suchen der Karte", http.StatusInternalServerError)
 			return
 		}
+		if !user.Active() {
+			checkoutLog.InfoContext(r.Context(), "Customer is deactivated", "user_id", user.ID)
+			http.Error(w, "Diese Karte ist deaktiviert", http.StatusForbidden)
+			return
+		}
 
-		log.Printf("[DEBUG] Found user: %+v", user)
+		checkoutLog.DebugContext(r.Context(), "Customer found", "user_id", user.ID, "card_number", cardNumber)
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(user)
 	}
 }
 
 // HandleProductScan looks up a product by barcode
-func HandleProductScan(db *sql.DB) http.HandlerFunc {
+func HandleProductScan(stores repository.Stores) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		barcode := r.URL.Query().Get("barcode")
 		if barcode == "" {
@@ -100,14 +116,8 @@ func HandleProductScan(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
-		var product components.Product
-		err := db.QueryRow(`
-			SELECT id, barcode, name, price 
-			FROM products 
-			WHERE barcode = ?
-		`, barcode).Scan(&product.ID, &product.Barcode, &product.Name, &product.Price)
-
-		if err == sql.ErrNoRows {
+		product, err := stores.Products.GetByBarcode(barcode)
+		if err == repository.ErrNotFound {
 			http.Error(w, "Produkt nicht gefunden", http.StatusNotFound)
 			return
 		} else if err != nil {
@@ -128,184 +138,271 @@ func HandleProductScan(db *sql.DB) http.HandlerFunc {
 	}
 }
 
-// HandleCompleteCheckout processes the checkout
-func HandleCompleteCheckout(db *sql.DB) http.HandlerFunc {
+// HandleCompleteCheckout processes the checkout. The database is used for the
+// receipt that is printed and mailed afterwards.
+func HandleCompleteCheckout(stores repository.Stores, db *sql.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		log.Printf("[CHECKOUT] Starting checkout process...")
-
 		// Get cashier info from session
 		session, err := store.Get(r, sessionName)
 		if err != nil {
-			log.Printf("[CHECKOUT] Session error: %v", err)
+			checkoutLog.ErrorContext(r.Context(), "Failed to get session", "error", err)
 			http.Error(w, "Session error", http.StatusInternalServerError)
 			return
 		}
 
 		cashierID, ok := session.Values["user_id"].(int)
 		if !ok {
-			log.Printf("[CHECKOUT] Cashier ID not found in session")
+			checkoutLog.WarnContext(r.Context(), "Cashier ID not found in session")
 			http.Error(w, "Unauthorized", http.StatusUnauthorized)
 			return
 		}
 
 		cashierName, ok := session.Values["name"].(string)
 		if !ok {
-			log.Printf("[CHECKOUT] Cashier name not found in session")
+			checkoutLog.WarnContext(r.Context(), "Cashier name not found in session")
 			http.Error(w, "Unauthorized", http.StatusUnauthorized)
 			return
 		}
 
 		var request CheckoutRequest
 		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
-			log.Printf("[CHECKOUT] Error decoding request: %v", err)
+			checkoutLog.WarnContext(r.Context(), "Invalid checkout request", "error", err)
 			http.Error(w, "Invalid request", http.StatusBadRequest)
 			return
 		}
-
-		log.Printf("[CHECKOUT] Processing checkout for user card: %s, Total: %.2f €", request.CardNumber, request.Total)
-
-		tx, err := db.Begin()
-		if err != nil {
-			log.Printf("[CHECKOUT] Error starting transaction: %v", err)
-			http.Error(w, "Database error", http.StatusInternalServerError)
-			return
+		if key := r.Header.Get("Idempotency-Key"); key != "" {
+			request.IdempotencyKey = key
 		}
-		defer tx.Rollback()
-
-		// Get user and check balance
-		var user struct {
-			ID      int64
-			Name    string
-			Balance float64
-			Email   sql.NullString
-		}
-		err = tx.QueryRow(`
-			SELECT id, name, balance, email 
-			FROM users 
-			WHERE card_number = ?`, request.CardNumber).Scan(&user.ID, &user.Name, &user.Balance, &user.Email)
-
-		if err == sql.ErrNoRows {
-			log.Printf("[CHECKOUT] User not found for card: %s", request.CardNumber)
-			http.Error(w, "User not found", http.StatusNotFound)
-			return
-		} else if err != nil {
-			log.Printf("[CHECKOUT] Error fetching user: %v", err)
-			http.Error(w, "Database error", http.StatusInternalServerError)
+		if len(request.IdempotencyKey) > maxIdempotencyKeyLength {
+			http.Error(w, "Idempotency key too long", http.StatusBadRequest)
 			return
 		}
-
-		log.Printf("[CHECKOUT] User found: %s (ID: %d), Current Balance: %.2f €", user.Name, user.ID, user.Balance)
-
-		if user.Balance < request.Total {
-			log.Printf("[CHECKOUT] Insufficient balance: Balance=%.2f €, Required=%.2f €", user.Balance, request.Total)
-			http.Error(w, "Insufficient balance", http.StatusBadRequest)
-			return
+		if request.IdempotencyKey != "" {
+			// Keep client keys apart from the keys of server-side carts
+			request.IdempotencyKey = "checkout-" + request.IdempotencyKey
 		}
 
-		// Update balance
-		newBalance := user.Balance - request.Total
-		log.Printf("[CHECKOUT] Updating balance: %.2f € -> %.2f €", user.Balance, newBalance)
+		processCheckout(r.Context(), stores, db, w, cashierID, cashierName, request, nil)
+	}
+}
 
-		result, err := tx.Exec(`
-			UPDATE users 
-			SET balance = ? 
-			WHERE id = ?`, newBalance, user.ID)
+// processCheckout debits the customer, records the transaction and writes the JSON
+// result. beforeCommit, if given, runs with the stores of the transaction, so that
+// related changes are committed together with the sale. A request whose
+// idempotency key was already used is answered with the original result.
+func processCheckout(ctx context.Context, stores repository.Stores, db *sql.DB, w http.ResponseWriter, cashierID int, cashierName string, request CheckoutRequest, beforeCommit func(tx repository.Stores, transactionID int) error) {
+	checkoutLog.DebugContext(ctx, "Processing checkout", "card_number", request.CardNumber, "total", request.Total)
 
-		if err != nil {
-			log.Printf("[CHECKOUT] Error updating balance: %v", err)
-			http.Error(w, "Error updating balance", http.StatusInternalServerError)
-			return
-		}
-
-		if rows, _ := result.RowsAffected(); rows != 1 {
-			log.Printf("[CHECKOUT] Expected 1 row affected, got %d", rows)
-			http.Error(w, "Error updating balance", http.StatusInternalServerError)
-			return
-		}
+	if replayCheckout(ctx, stores, w, request) {
+		return
+	}
 
-		// Record transaction
-		log.Printf("[CHECKOUT] Recording transaction by cashier: %s (ID: %d)", cashierName, cashierID)
+	if request.Total < 0 {
+		checkoutLog.WarnContext(ctx, "Rejecting negative total", "total", request.Total)
+		http.Error(w, "Invalid total", http.StatusBadRequest)
+		return
+	}
 
-		// Get current time and log it for debugging
-		now := time.Now()
-		log.Printf("[CHECKOUT] Transaction timestamp: %s", now.Format(time.RFC3339))
+	// Get user; the balance is only checked by the conditional update below
+	user, err := stores.Users.GetByCardNumber(request.CardNumber)
+	if err == nil && !user.Active() {
+		err = repository.ErrNotFound
+	}
+	if err == repository.ErrNotFound {
+		checkoutLog.InfoContext(ctx, "Customer not found", "card_number", request.CardNumber)
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		checkoutLog.ErrorContext(ctx, "Failed to load customer", "error", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
 
-		result, err = tx.Exec(`
-			INSERT INTO transactions (user_id, cashier_id, total, created_at)
-			VALUES (?, ?, ?, ?)
-		`, user.ID, cashierID, request.Total, now)
+	sale := repository.Sale{
+		UserID:         user.ID,
+		CashierID:      cashierID,
+		Total:          request.Total,
+		IdempotencyKey: request.IdempotencyKey,
+	}
+	for _, item := range request.Items {
+		sale.Items = append(sale.Items, repository.SaleItem{ProductID: int(item.ProductID), Quantity: item.Quantity, Price: item.Price})
+	}
 
-		if err != nil {
-			log.Printf("[CHECKOUT] Error recording transaction: %v", err)
-			http.Error(w, "Error recording transaction", http.StatusInternalServerError)
-			return
+	var transactionID int
+	var newBalance float64
+	err = stores.Atomic(func(tx repository.Stores) error {
+		// Debit the balance first, so the transaction holds the write lock from the start
+		var err error
+		if newBalance, err = tx.Users.AdjustBalance(user.ID, -request.Total); err != nil {
+			return err
 		}
-
-		transactionID, _ := result.LastInsertId()
-		log.Printf("[CHECKOUT] Transaction recorded with ID: %d", transactionID)
-
-		// Check how the date was stored by retrieving it
-		var storedDate string
-		err = tx.QueryRow("SELECT created_at FROM transactions WHERE id = ?", transactionID).Scan(&storedDate)
-		if err == nil {
-			log.Printf("[CHECKOUT] Transaction date stored as: %s", storedDate)
+		sale.BalanceAfter = newBalance
+		if transactionID, err = tx.Transactions.RecordSale(sale); err != nil {
+			return err
 		}
+		if beforeCommit != nil {
+			return beforeCommit(tx, transactionID)
+		}
+		return nil
+	})
+	switch {
+	case err == repository.ErrInsufficientBalance:
+		checkoutLog.InfoContext(ctx, "Insufficient balance", "user_id", user.ID, "total", request.Total)
+		http.Error(w, "Insufficient balance", http.StatusBadRequest)
+		return
+	case err == repository.ErrDuplicate:
+		// A concurrent submission with the same key won the race
+		if !replayCheckout(ctx, stores, w, request) {
+			http.Error(w, "Error recording transaction", http.StatusInternalServerError)
+		}
+		return
+	case err == repository.ErrCartNotOpen:
+		http.Error(w, "Der Warenkorb wurde bereits abgeschlossen", http.StatusConflict)
+		return
+	case err == repository.ErrCartChanged:
+		checkoutLog.InfoContext(ctx, "Cart changed during the checkout", "user_id", user.ID)
+		http.Error(w, "Der Warenkorb wurde während des Bezahlens geändert, bitte erneut prüfen", http.StatusConflict)
+		return
+	case err != nil:
+		checkoutLog.ErrorContext(ctx, "Failed to record transaction", "user_id", user.ID, "error", err)
+		http.Error(w, "Error recording transaction", http.StatusInternalServerError)
+		return
+	}
 
-		// Record transaction items
-		for _, item := range request.Items {
-			_, err = tx.Exec(`
-				INSERT INTO transaction_items (transaction_id, product_id, quantity, price)
-				VALUES (?, ?, ?, ?)
-			`, transactionID, item.ProductID, item.Quantity, item.Price)
-
+	metrics.Checkout(request.Total)
+	checkoutLog.InfoContext(ctx, "Transaction recorded",
+		"transaction_id", transactionID,
+		"user_id", user.ID,
+		"cashier_id", cashierID,
+		"cashier", cashierName,
+		"total", request.Total,
+		"balance", newBalance,
+		"items", len(request.Items))
+
+	// Print the receipt in the background so a slow printer does not block the checkout
+	if services.AutoPrintEnabled() {
+		services.Go(func() {
+			receipt, err := services.GetReceipt(db, transactionID)
+			if err == nil {
+				err = services.PrintReceipt(receipt)
+			}
 			if err != nil {
-				log.Printf("[CHECKOUT] Error recording transaction item: %v", err)
-				http.Error(w, "Error recording transaction items", http.StatusInternalServerError)
-				return
+				checkoutLog.ErrorContext(ctx, "Failed to print receipt", "transaction_id", transactionID, "error", err)
 			}
-		}
-
-		// Commit transaction
-		log.Printf("[CHECKOUT] Attempting to commit transaction...")
-		if err := tx.Commit(); err != nil {
-			log.Printf("[CHECKOUT] Error committing transaction: %v", err)
-			http.Error(w, "Error completing transaction", http.StatusInternalServerError)
-			return
-		}
+		})
+	}
 
-		log.Printf("[CHECKOUT] ====== TRANSACTION SUMMARY ======")
-		log.Printf("[CHECKOUT] Customer: %s (ID: %d)", user.Name, user.ID)
-		log.Printf("[CHECKOUT] Total Amount: %.2f €", request.Total)
-		log.Printf("[CHECKOUT] New Balance: %.2f €", newBalance)
-		log.Printf("[CHECKOUT] Items Count: %d", len(request.Items))
-		log.Printf("[CHECKOUT] Cashier: %s (ID: %d)", cashierName, cashierID)
-		log.Printf("[CHECKOUT] Transaction ID: %d", transactionID)
-		log.Printf("[CHECKOUT] ================================")
-
-		// Convert cart items to email products
-		var emailProducts []services.Product
-		for _, item := range request.Items {
-			emailProducts = append(emailProducts, services.Product{
-				Name:     item.Name,
-				Price:    item.Price,
-				Quantity: item.Quantity,
-			})
-		}
+	// Convert cart items to email products
+	var emailProducts []services.Product
+	for _, item := range request.Items {
+		emailProducts = append(emailProducts, services.Product{
+			Name:     item.Name,
+			Price:    item.Price,
+			Quantity: item.Quantity,
+		})
+	}
 
-		// Send email notification if user has email
-		if user.Email.Valid {
-			if err := services.SendTransactionEmail(user.Email.String, user.Name, -request.Total, newBalance, emailProducts); err != nil {
-				log.Printf("[CHECKOUT] Error sending email notification: %v", err)
+	// Send email notification with the receipt attached if user has email, in the
+	// background like the printout, so a slow email service does not block the till
+	if user.Email != "" {
+		services.Go(func() {
+			var attachments []services.Attachment
+			if receipt, err := services.GetReceipt(db, transactionID); err != nil {
+				checkoutLog.ErrorContext(ctx, "Failed to load receipt", "transaction_id", transactionID, "error", err)
+			} else if pdf, err := services.RenderReceiptPDF(db, receipt); err != nil {
+				checkoutLog.ErrorContext(ctx, "Failed to render receipt PDF", "transaction_id", transactionID, "error", err)
 			} else {
-				log.Printf("[CHECKOUT] Transaction email notification sent successfully")
+				attachments = append(attachments, services.Attachment{
+					Name:        fmt.Sprintf("beleg-%d.pdf", transactionID),
+					ContentType: "application/pdf",
+					Content:     pdf,
+				})
 			}
-		}
 
-		// Return success response
-		w.WriteHeader(http.StatusOK)
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"success": true,
-			"balance": newBalance,
+			if err := services.SendTransactionEmail(user.Email, user.Name, -request.Total, newBalance, emailProducts, attachments...); err != nil {
+				checkoutLog.ErrorContext(ctx, "Failed to send transaction email", "transaction_id", transactionID, "email", user.Email, "error", err)
+			} else {
+				checkoutLog.DebugContext(ctx, "Transaction email sent", "transaction_id", transactionID)
+			}
 		})
 	}
+
+	// Return success response
+	writeCheckoutResult(w, transactionID, newBalance, services.AutoPrintEnabled())
+}
+
+// replayCheckout answers a checkout whose idempotency key was already used with the
+// result of the original transaction. A request with another card, total or items
+// than the original is refused with 422. It returns false if the key is new.
+func replayCheckout(ctx context.Context, stores repository.Stores, w http.ResponseWriter, request CheckoutRequest) bool {
+	if request.IdempotencyKey == "" {
+		return false
+	}
+
+	transactionID, sale, err := stores.Transactions.SaleByKey(request.IdempotencyKey)
+	if err == repository.ErrNotFound {
+		return false
+	} else if err != nil {
+		checkoutLog.ErrorContext(ctx, "Failed to look up idempotency key", "error", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return true
+	}
+
+	customer, err := stores.Users.GetByCardNumber(request.CardNumber)
+	if err != nil && err != repository.ErrNotFound {
+		checkoutLog.ErrorContext(ctx, "Failed to load customer", "error", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return true
+	}
+	if err != nil || customer.ID != sale.UserID || sale.Total != request.Total || !sameCheckoutItems(sale.Items, request.Items) {
+		checkoutLog.WarnContext(ctx, "Idempotency key reused for another checkout", "transaction_id", transactionID)
+		http.Error(w, "Idempotency key already used for another checkout", http.StatusUnprocessableEntity)
+		return true
+	}
+
+	checkoutLog.InfoContext(ctx, "Repeated checkout submission, returning the original result", "transaction_id", transactionID)
+	w.Header().Set("Idempotent-Replayed", "true")
+	writeCheckoutResult(w, transactionID, sale.BalanceAfter, services.AutoPrintEnabled())
+	return true
+}
+
+// sameCheckoutItems reports whether the items of a sale are the requested ones, in any order
+func sameCheckoutItems(recorded []repository.SaleItem, requested []CartItem) bool {
+	type line struct {
+		quantity int
+		price    float64
+	}
+	want := make(map[int]line)
+	for _, item := range requested {
+		id := int(item.ProductID)
+		want[id] = line{want[id].quantity + item.Quantity, item.Price}
+	}
+	got := make(map[int]line)
+	for _, item := range recorded {
+		got[item.ProductID] = line{got[item.ProductID].quantity + item.Quantity, item.Price}
+	}
+
+	if len(got) != len(want) {
+		return false
+	}
+	for productID, l := range want {
+		if got[productID] != l {
+			return false
+		}
+	}
+	return true
+}
+
+// writeCheckoutResult writes the result of a checkout. A repeated submission gets
+// the same body as the first one, marked by the Idempotent-Replayed header only.
+func writeCheckoutResult(w http.ResponseWriter, transactionID int, balance float64, printed bool) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":        true,
+		"balance":        balance,
+		"transaction_id": transactionID,
+		"receipt_url":    fmt.Sprintf("/transactions/receipt?id=%d&print=1", transactionID),
+		"printed":        printed,
+	})
 }
@@ -3,17 +3,19 @@ package handlers
 import (
 	"database/sql"
 	"gopos/components"
-	"log"
+	"gopos/logging"
 	"net/http"
 )
 
+var dashboardLog = logging.Component("dashboard")
+
 // HandleDashboard renders the dashboard page
 func HandleDashboard(db *sql.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		// Get user info from session
 		session, err := store.Get(r, sessionName)
 		if err != nil {
-			log.Printf("Dashboard error: failed to get session: %v", err)
+			dashboardLog.ErrorContext(r.Context(), "Failed to get session", "error", err)
 			http.Error(w, "Session error", http.StatusInternalServerError)
 			return
 		}
@@ -21,21 +23,21 @@ func HandleDashboard(db *sql.DB) http.HandlerFunc {
 		// Type assert session values with proper error checking
 		userID, ok := session.Values["user_id"].(int)
 		if !ok {
-			log.Printf("Dashboard error: user_id not found in session or wrong type")
+			dashboardLog.WarnContext(r.Context(), "User ID not found in session")
 			http.Redirect(w, r, "/", http.StatusSeeOther)
 			return
 		}
 
 		userName, ok := session.Values["name"].(string)
 		if !ok {
-			log.Printf("Dashboard error: name not found in session or wrong type")
+			dashboardLog.WarnContext(r.Context(), "Name not found in session")
 			http.Redirect(w, r, "/", http.StatusSeeOther)
 			return
 		}
 
 		userRole, ok := session.Values["role"].(string)
 		if !ok {
-			log.Printf("Dashboard error: role not found in session or wrong type")
+			dashboardLog.WarnContext(r.Context(), "Role not found in session")
 			http.Redirect(w, r, "/", http.StatusSeeOther)
 			return
 		}
@@ -44,7 +46,7 @@ func HandleDashboard(db *sql.DB) http.HandlerFunc {
 		var balance float64
 		err = db.QueryRow("SELECT balance FROM users WHERE id = ?", userID).Scan(&balance)
 		if err != nil {
-			log.Printf("Dashboard error: failed to get user balance: %v", err)
+			dashboardLog.ErrorContext(r.Context(), "Failed to get user balance", "error", err)
 			http.Error(w, "Database error", http.StatusInternalServerError)
 			return
 		}
@@ -58,7 +60,7 @@ func HandleDashboard(db *sql.DB) http.HandlerFunc {
 		}
 
 		if err := components.Dashboard(data).Render(r.Context(), w); err != nil {
-			log.Printf("Dashboard error: failed to render template: %v", err)
+			dashboardLog.ErrorContext(r.Context(), "Failed to render template", "error", err)
 			http.Error(w, "Error rendering dashboard", http.StatusInternalServerError)
 			return
 		}
@@ -0,0 +1,94 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"gopos/database"
+	"gopos/services"
+)
+
+// HealthStatus is the JSON answer of /healthz and /readyz
+type HealthStatus struct {
+	Status     string                     `json:"status"` // ok or unavailable
+	Version    string                     `json:"version"`
+	Commit     string                     `json:"commit"`
+	Components map[string]ComponentStatus `json:"components,omitempty"`
+}
+
+// ComponentStatus is the state of a component GoPOS depends on
+type ComponentStatus struct {
+	Status        string `json:"status"` // ok or unavailable
+	Error         string `json:"error,omitempty"`
+	SchemaVersion *int   `json:"schema_version,omitempty"`
+}
+
+// readyCheckTimeout limits how long the database may take to answer /readyz
+const readyCheckTimeout = 2 * time.Second
+
+// HandleHealthz reports that the process is up, for liveness checks
+func HandleHealthz(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, r, nil)
+}
+
+// HandleReadyz reports whether GoPOS can serve requests: the database answers
+// with the schema this version expects and emails can be sent. It answers 503
+// if a component is unavailable.
+func HandleReadyz(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		components := map[string]ComponentStatus{
+			"database": checkDatabase(r.Context(), db),
+			"email":    componentStatus(services.CheckEmailTransport()),
+		}
+		writeHealth(w, r, components)
+	}
+}
+
+func checkDatabase(ctx context.Context, db *sql.DB) ComponentStatus {
+	ctx, cancel := context.WithTimeout(ctx, readyCheckTimeout)
+	defer cancel()
+	if err := db.PingContext(ctx); err != nil {
+		return componentStatus(err)
+	}
+
+	version, err := database.GetSchemaVersion(ctx, db)
+	if err != nil {
+		return componentStatus(err)
+	}
+	status := componentStatus(nil)
+	if version != database.SchemaVersion() {
+		status = componentStatus(fmt.Errorf("schema version %d, expected %d", version, database.SchemaVersion()))
+	}
+	status.SchemaVersion = &version
+	return status
+}
+
+func componentStatus(err error) ComponentStatus {
+	if err != nil {
+		return ComponentStatus{Status: "unavailable", Error: err.Error()}
+	}
+	return ComponentStatus{Status: "ok"}
+}
+
+func writeHealth(w http.ResponseWriter, r *http.Request, components map[string]ComponentStatus) {
+	version, _ := r.Context().Value("version").(string)
+	commitID, _ := r.Context().Value("commitID").(string)
+	health := HealthStatus{Status: "ok", Version: version, Commit: commitID, Components: components}
+
+	status := http.StatusOK
+	for _, component := range components {
+		if component.Status != "ok" {
+			health.Status = "unavailable"
+			status = http.StatusServiceUnavailable
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(health)
+}
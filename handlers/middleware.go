@@ -2,7 +2,10 @@ package handlers
 
 import (
 	"context"
+	"database/sql"
+	"errors"
 	"gopos/components"
+	"gopos/repository"
 	"net/http"
 )
 
@@ -39,6 +42,25 @@ func RequireAuth(next http.HandlerFunc) http.HandlerFunc {
 			return
 		}
 
+		// Sessions of users deactivated or deleted since they logged in end here
+		if db, ok := r.Context().Value(DbKey).(*sql.DB); ok {
+			current, err := repository.NewSQLUserStore(db).Get(userID)
+			if err == nil && !current.Active() {
+				err = repository.ErrNotFound
+			}
+			if errors.Is(err, repository.ErrNotFound) {
+				authLog.InfoContext(r.Context(), "Session ended, user is deactivated", "user_id", userID)
+				clearSession(session)
+				session.Save(r, w)
+				http.Redirect(w, r, "/", http.StatusSeeOther)
+				return
+			} else if err != nil {
+				authLog.ErrorContext(r.Context(), "Failed to load session user", "user_id", userID, "error", err)
+				http.Error(w, "Database error", http.StatusInternalServerError)
+				return
+			}
+		}
+
 		userName, ok := session.Values["name"].(string)
 		if !ok {
 			http.Redirect(w, r, "/", http.StatusSeeOther)
@@ -1,17 +1,17 @@
 package handlers
 
 import (
-	"database/sql"
+	"errors"
 	"fmt"
 	"gopos/components"
+	"gopos/repository"
 	"net/http"
 	"strconv"
 	"strings"
-	"time"
 )
 
 // HandleProducts displays all products
-func HandleProducts(db *sql.DB) http.HandlerFunc {
+func HandleProducts(stores repository.Stores) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		// Get user from session
 		session, err := store.Get(r, "pos-session")
@@ -39,34 +39,18 @@ func HandleProducts(db *sql.DB) http.HandlerFunc {
 		}
 
 		// Get user balance
-		var balance float64
-		err = db.QueryRow("SELECT balance FROM users WHERE id = ?", userID).Scan(&balance)
+		user, err := stores.Users.Get(userID)
 		if err != nil {
 			http.Error(w, "Error loading user balance", http.StatusInternalServerError)
 			return
 		}
+		balance := user.Balance
 
-		rows, err := db.Query(`
-            SELECT id, name, barcode, price, created_at 
-            FROM products 
-            ORDER BY created_at DESC
-        `)
+		products, err := stores.Products.List(repository.ProductFilter{})
 		if err != nil {
 			http.Error(w, "Database error", http.StatusInternalServerError)
 			return
 		}
-		defer rows.Close()
-
-		var products []components.Product
-		for rows.Next() {
-			var product components.Product
-			err := rows.Scan(&product.ID, &product.Name, &product.Barcode, &product.Price, &product.CreatedAt)
-			if err != nil {
-				http.Error(w, "Database error", http.StatusInternalServerError)
-				return
-			}
-			products = append(products, product)
-		}
 
 		data := components.ProductsData{
 			Title:     "Produktverwaltung",
@@ -81,7 +65,7 @@ func HandleProducts(db *sql.DB) http.HandlerFunc {
 }
 
 // HandleNewProduct handles the creation of new products
-func HandleNewProduct(db *sql.DB) http.HandlerFunc {
+func HandleNewProduct(stores repository.Stores) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method == "GET" {
 			data := components.ProductFormData{
@@ -154,91 +138,38 @@ func HandleNewProduct(db *sql.DB) http.HandlerFunc {
 		}
 
 		// Check if barcode already exists
-		var existingID int
-		err = db.QueryRow("SELECT id FROM products WHERE barcode = ?", barcode).Scan(&existingID)
-		if err != sql.ErrNoRows {
+		product := &components.Product{Barcode: barcode, Name: name, Price: price}
+		if _, err := stores.Products.GetByBarcode(barcode); !errors.Is(err, repository.ErrNotFound) {
 			data := components.ProductFormData{
 				Title:     "Neues Produkt",
 				Error:     "Dieser Barcode existiert bereits",
 				CSRFToken: generateCSRFToken(),
-				Product:   &components.Product{Barcode: barcode, Name: name, Price: price},
+				Product:   product,
 				Success:   false,
 			}
 			components.ProductForm(data).Render(r.Context(), w)
 			return
 		}
 
-		// Begin transaction
-		tx, err := db.Begin()
-		if err != nil {
-			data := components.ProductFormData{
-				Title:     "Neues Produkt",
-				Error:     "Datenbankfehler",
-				CSRFToken: generateCSRFToken(),
-				Product:   &components.Product{Barcode: barcode, Name: name, Price: price},
-				Success:   false,
-			}
-			components.ProductForm(data).Render(r.Context(), w)
-			return
-		}
-		defer tx.Rollback()
-
-		// Insert new product
-		result, err := tx.Exec(`
-            INSERT INTO products (barcode, name, price, created_at)
-            VALUES (?, ?, ?, ?)
-        `, barcode, name, price, time.Now())
-
-		if err != nil {
-			data := components.ProductFormData{
-				Title:     "Neues Produkt",
-				Error:     "Fehler beim Speichern des Produkts",
-				CSRFToken: generateCSRFToken(),
-				Product:   &components.Product{Barcode: barcode, Name: name, Price: price},
-				Success:   false,
-			}
-			components.ProductForm(data).Render(r.Context(), w)
-			return
-		}
-
-		// Get the new product's ID for audit log
-		productID, err := result.LastInsertId()
-		if err != nil {
-			data := components.ProductFormData{
-				Title:     "Neues Produkt",
-				Error:     "Fehler beim Speichern des Produkts",
-				CSRFToken: generateCSRFToken(),
-				Product:   &components.Product{Barcode: barcode, Name: name, Price: price},
-				Success:   false,
-			}
-			components.ProductForm(data).Render(r.Context(), w)
-			return
-		}
-
-		// Log the action
+		// Insert the product and log the action together
 		adminUser := r.Context().Value(userKey).(components.User)
-		_, err = tx.Exec(`
-            INSERT INTO audit_log (user_id, action, details, created_at)
-            VALUES (?, ?, ?, ?)
-        `, adminUser.ID, "create_product", fmt.Sprintf("Produkt (ID: %d) erstellt: %s (Barcode: %s)", productID, name, barcode), time.Now())
-
+		err = stores.Atomic(func(tx repository.Stores) error {
+			if err := tx.Products.Create(product); err != nil {
+				return err
+			}
+			event := newAuditEvent(r, adminUser.ID, "create_product", fmt.Sprintf("Produkt (ID: %d) erstellt: %s (Barcode: %s)", product.ID, name, barcode))
+			event.EntityType, event.EntityID = "product", product.ID
+			event.Changes = auditChanges(nil, productAuditFields(*product))
+			return tx.Audit.Log(event)
+		})
 		if err != nil {
-			data := components.ProductFormData{
-				Title:     "Neues Produkt",
-				Error:     "Fehler beim Speichern des Audit-Logs",
-				CSRFToken: generateCSRFToken(),
-				Product:   &components.Product{Barcode: barcode, Name: name, Price: price},
-				Success:   false,
+			message := "Fehler beim Speichern des Produkts"
+			if errors.Is(err, repository.ErrDuplicate) {
+				message = "Dieser Barcode existiert bereits"
 			}
-			components.ProductForm(data).Render(r.Context(), w)
-			return
-		}
-
-		// Commit transaction
-		if err := tx.Commit(); err != nil {
 			data := components.ProductFormData{
 				Title:     "Neues Produkt",
-				Error:     "Fehler beim Speichern des Produkts",
+				Error:     message,
 				CSRFToken: generateCSRFToken(),
 				Product:   &components.Product{Barcode: barcode, Name: name, Price: price},
 				Success:   false,
@@ -253,7 +184,7 @@ func HandleNewProduct(db *sql.DB) http.HandlerFunc {
 }
 
 // HandleEditProduct handles the editing of existing products
-func HandleEditProduct(db *sql.DB) http.HandlerFunc {
+func HandleEditProduct(stores repository.Stores) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method == "GET" {
 			// Get product ID from query parameters
@@ -270,12 +201,7 @@ func HandleEditProduct(db *sql.DB) http.HandlerFunc {
 			}
 
 			// Get product from database
-			var product components.Product
-			err = db.QueryRow(`
-                SELECT id, name, barcode, price, created_at
-                FROM products
-                WHERE id = ?
-            `, productID).Scan(&product.ID, &product.Name, &product.Barcode, &product.Price, &product.CreatedAt)
+			product, err := stores.Products.Get(int(productID))
 			if err != nil {
 				http.Error(w, "Product not found", http.StatusNotFound)
 				return
@@ -283,7 +209,7 @@ func HandleEditProduct(db *sql.DB) http.HandlerFunc {
 
 			data := components.ProductFormData{
 				Title:     "Produkt bearbeiten",
-				Product:   &product,
+				Product:   product,
 				CSRFToken: generateCSRFToken(),
 				Error:     "",
 				Success:   false,
@@ -362,9 +288,8 @@ func HandleEditProduct(db *sql.DB) http.HandlerFunc {
 			}
 
 			// Check if barcode already exists for other products
-			var existingID int
-			err = db.QueryRow("SELECT id FROM products WHERE barcode = ? AND id != ?", barcode, productID).Scan(&existingID)
-			if err != sql.ErrNoRows {
+			existing, err := stores.Products.GetByBarcode(barcode)
+			if err == nil && existing.ID != product.ID || err != nil && !errors.Is(err, repository.ErrNotFound) {
 				data := components.ProductFormData{
 					Title:     "Produkt bearbeiten",
 					Error:     "Dieser Barcode wird bereits von einem anderen Produkt verwendet",
@@ -376,64 +301,33 @@ func HandleEditProduct(db *sql.DB) http.HandlerFunc {
 				return
 			}
 
-			// Begin transaction
-			tx, err := db.Begin()
-			if err != nil {
-				data := components.ProductFormData{
-					Title:     "Produkt bearbeiten",
-					Error:     "Datenbankfehler",
-					CSRFToken: generateCSRFToken(),
-					Product:   product,
-					Success:   false,
+			// Update the product and log the action together
+			adminUser := r.Context().Value(userKey).(components.User)
+			err = stores.Atomic(func(tx repository.Stores) error {
+				// Compare with the stored product to record what changed
+				oldProduct, err := tx.Products.Get(product.ID)
+				if err != nil {
+					return err
 				}
-				components.ProductForm(data).Render(r.Context(), w)
-				return
-			}
-			defer tx.Rollback()
-
-			// Update product
-			_, err = tx.Exec(`
-                UPDATE products 
-                SET barcode = ?, name = ?, price = ?
-                WHERE id = ?
-            `, barcode, name, price, productID)
-
-			if err != nil {
-				data := components.ProductFormData{
-					Title:     "Produkt bearbeiten",
-					Error:     "Fehler beim Aktualisieren des Produkts",
-					CSRFToken: generateCSRFToken(),
-					Product:   product,
-					Success:   false,
+				if err := tx.Products.Update(product); err != nil {
+					return err
 				}
-				components.ProductForm(data).Render(r.Context(), w)
-				return
-			}
-
-			// Log the action
-			adminUser := r.Context().Value(userKey).(components.User)
-			_, err = tx.Exec(`
-                INSERT INTO audit_log (user_id, action, details, created_at)
-                VALUES (?, ?, ?, ?)
-            `, adminUser.ID, "edit_product", fmt.Sprintf("Produkt (ID: %d) bearbeitet: %s (Barcode: %s)", productID, name, barcode), time.Now())
-
+				event := newAuditEvent(r, adminUser.ID, "edit_product", fmt.Sprintf("Produkt (ID: %d) bearbeitet: %s (Barcode: %s)", productID, name, barcode))
+				event.EntityType, event.EntityID = "product", product.ID
+				event.Changes = auditChanges(productAuditFields(*oldProduct), productAuditFields(*product))
+				return tx.Audit.Log(event)
+			})
 			if err != nil {
-				data := components.ProductFormData{
-					Title:     "Produkt bearbeiten",
-					Error:     "Fehler beim Speichern des Audit-Logs",
-					CSRFToken: generateCSRFToken(),
-					Product:   product,
-					Success:   false,
+				message := "Fehler beim Aktualisieren des Produkts"
+				switch {
+				case errors.Is(err, repository.ErrDuplicate):
+					message = "Dieser Barcode wird bereits von einem anderen Produkt verwendet"
+				case errors.Is(err, repository.ErrNotFound):
+					message = "Produkt nicht gefunden"
 				}
-				components.ProductForm(data).Render(r.Context(), w)
-				return
-			}
-
-			// Commit transaction
-			if err := tx.Commit(); err != nil {
 				data := components.ProductFormData{
 					Title:     "Produkt bearbeiten",
-					Error:     "Fehler beim Aktualisieren des Produkts",
+					Error:     message,
 					CSRFToken: generateCSRFToken(),
 					Product:   product,
 					Success:   false,
@@ -451,7 +345,7 @@ func HandleEditProduct(db *sql.DB) http.HandlerFunc {
 }
 
 // HandleDeleteProduct processes product deletion
-func HandleDeleteProduct(db *sql.DB) http.HandlerFunc {
+func HandleDeleteProduct(stores repository.Stores) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -461,16 +355,14 @@ func HandleDeleteProduct(db *sql.DB) http.HandlerFunc {
 		productID, _ := strconv.ParseInt(r.FormValue("id"), 10, 64)
 
 		// Get product name for logging
-		var productName string
-		err := db.QueryRow("SELECT name FROM products WHERE id = ?", productID).Scan(&productName)
+		product, err := stores.Products.Get(int(productID))
 		if err != nil {
 			http.Error(w, "Product not found", http.StatusNotFound)
 			return
 		}
 
 		// Check if product has any transactions
-		var transactionCount int
-		err = db.QueryRow("SELECT COUNT(*) FROM transaction_items WHERE product_id = ?", productID).Scan(&transactionCount)
+		transactionCount, err := stores.Transactions.CountForProduct(product.ID)
 		if err != nil {
 			http.Error(w, "Database error", http.StatusInternalServerError)
 			return
@@ -481,21 +373,22 @@ func HandleDeleteProduct(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
-		// Delete the product
-		_, err = db.Exec("DELETE FROM products WHERE id = ?", productID)
-		if err != nil {
-			http.Error(w, "Error deleting product", http.StatusInternalServerError)
-			return
-		}
-
-		// Log the action
+		// Delete the product and log the action together
 		adminUser := r.Context().Value(userKey).(components.User)
-		_, err = db.Exec(`
-            INSERT INTO audit_log (user_id, action, details, created_at)
-            VALUES (?, ?, ?, ?)
-        `, adminUser.ID, "delete_product", "Produkt gelöscht: "+productName, time.Now())
-		if err != nil {
-			http.Error(w, "Error logging action", http.StatusInternalServerError)
+		err = stores.Atomic(func(tx repository.Stores) error {
+			if err := tx.Products.Delete(product.ID); err != nil {
+				return err
+			}
+			event := newAuditEvent(r, adminUser.ID, "delete_product", "Produkt gelöscht: "+product.Name)
+			event.EntityType, event.EntityID = "product", product.ID
+			event.Changes = auditChanges(productAuditFields(*product), nil)
+			return tx.Audit.Log(event)
+		})
+		if errors.Is(err, repository.ErrInUse) {
+			http.Error(w, "Cannot delete product that is in an open cart", http.StatusBadRequest)
+			return
+		} else if err != nil {
+			http.Error(w, "Error deleting product", http.StatusInternalServerError)
 			return
 		}
 
@@ -504,35 +397,17 @@ func HandleDeleteProduct(db *sql.DB) http.HandlerFunc {
 }
 
 // HandleProductSearch handles searching for products
-func HandleProductSearch(db *sql.DB) http.HandlerFunc {
+func HandleProductSearch(stores repository.Stores) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		// Get search query
 		query := strings.TrimSpace(r.URL.Query().Get("q"))
 
-		// Query the database for products matching the search term
-		rows, err := db.Query(`
-			SELECT id, name, barcode, price, created_at 
-			FROM products 
-			WHERE name LIKE ? OR barcode LIKE ?
-			ORDER BY created_at DESC
-		`, "%"+query+"%", "%"+query+"%")
-
+		// Get the products matching the search term, ignoring case
+		products, err := stores.Products.List(repository.ProductFilter{Search: query})
 		if err != nil {
 			http.Error(w, "Database error", http.StatusInternalServerError)
 			return
 		}
-		defer rows.Close()
-
-		var products []components.Product
-		for rows.Next() {
-			var product components.Product
-			err := rows.Scan(&product.ID, &product.Name, &product.Barcode, &product.Price, &product.CreatedAt)
-			if err != nil {
-				http.Error(w, "Database error", http.StatusInternalServerError)
-				return
-			}
-			products = append(products, product)
-		}
 
 		// Get user from session
 		session, err := store.Get(r, "pos-session")
@@ -568,7 +443,7 @@ func HandleProductSearch(db *sql.DB) http.HandlerFunc {
 }
 
 // HandleProductFilter handles the filtering and sorting of products
-func HandleProductFilter(db *sql.DB) http.HandlerFunc {
+func HandleProductFilter(stores repository.Stores) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		// Get user from session
 		session, err := store.Get(r, "pos-session")
@@ -596,56 +471,22 @@ func HandleProductFilter(db *sql.DB) http.HandlerFunc {
 		}
 
 		// Get user balance
-		var balance float64
-		err = db.QueryRow("SELECT balance FROM users WHERE id = ?", userID).Scan(&balance)
+		user, err := stores.Users.Get(userID)
 		if err != nil {
 			http.Error(w, "Error loading user balance", http.StatusInternalServerError)
 			return
 		}
+		balance := user.Balance
 
 		// Get sort parameter
 		sortBy := r.URL.Query().Get("sort")
 
-		// Query the database with correct sorting
-		var rows *sql.Rows
-
-		switch sortBy {
-		case "name":
-			rows, err = db.Query(`
-				SELECT id, name, barcode, price, created_at 
-				FROM products 
-				ORDER BY name ASC
-			`)
-		case "price":
-			rows, err = db.Query(`
-				SELECT id, name, barcode, price, created_at 
-				FROM products 
-				ORDER BY price ASC
-			`)
-		default: // "created" oder leer
-			rows, err = db.Query(`
-				SELECT id, name, barcode, price, created_at 
-				FROM products 
-				ORDER BY created_at DESC
-			`)
-		}
-
+		// "created" or empty sorts the newest first
+		products, err := stores.Products.List(repository.ProductFilter{Sort: sortBy})
 		if err != nil {
 			http.Error(w, "Database error", http.StatusInternalServerError)
 			return
 		}
-		defer rows.Close()
-
-		var products []components.Product
-		for rows.Next() {
-			var product components.Product
-			err := rows.Scan(&product.ID, &product.Name, &product.Barcode, &product.Price, &product.CreatedAt)
-			if err != nil {
-				http.Error(w, "Database error", http.StatusInternalServerError)
-				return
-			}
-			products = append(products, product)
-		}
 
 		// Create component with filtered results
 		data := components.ProductsData{
@@ -0,0 +1,125 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"gopos/components"
+	"gopos/logging"
+	"gopos/services"
+	"net/http"
+	"strconv"
+)
+
+var receiptLog = logging.Component("receipt")
+
+// HandleReceipt displays a printable receipt for a transaction
+func HandleReceipt(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		receipt, ok := loadReceipt(db, w, r)
+		if !ok {
+			return
+		}
+
+		autoPrint := r.URL.Query().Get("print") == "1"
+		if err := components.ReceiptView(*receipt, autoPrint).Render(r.Context(), w); err != nil {
+			http.Error(w, "Error rendering receipt", http.StatusInternalServerError)
+		}
+	}
+}
+
+// HandleReceiptPDF serves the receipt of a transaction as PDF download
+func HandleReceiptPDF(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		receipt, ok := loadReceipt(db, w, r)
+		if !ok {
+			return
+		}
+
+		pdf, err := services.RenderReceiptPDF(db, receipt)
+		if err != nil {
+			receiptLog.ErrorContext(r.Context(), "Failed to render receipt PDF", "transaction_id", receipt.TransactionID, "error", err)
+			http.Error(w, "Error rendering receipt", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/pdf")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="beleg-%d.pdf"`, receipt.TransactionID))
+		w.Write(pdf)
+	}
+}
+
+// HandlePrintReceipt sends the receipt of a transaction to the receipt printer
+func HandlePrintReceipt(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if !verifyCSRFToken(r.Header.Get("X-CSRF-Token")) {
+			http.Error(w, "Invalid CSRF token", http.StatusForbidden)
+			return
+		}
+
+		if !services.PrinterConfigured() {
+			http.Error(w, "Kein Bondrucker konfiguriert", http.StatusServiceUnavailable)
+			return
+		}
+
+		receipt, ok := loadReceipt(db, w, r)
+		if !ok {
+			return
+		}
+
+		if err := services.PrintReceipt(receipt); err != nil {
+			receiptLog.ErrorContext(r.Context(), "Failed to print receipt", "transaction_id", receipt.TransactionID, "error", err)
+			http.Error(w, "Fehler beim Drucken des Belegs", http.StatusBadGateway)
+			return
+		}
+		receiptLog.InfoContext(r.Context(), "Printed receipt", "transaction_id", receipt.TransactionID)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": true,
+		})
+	}
+}
+
+// loadReceipt loads the receipt requested by the id query parameter. Customers may
+// only see their own receipts, admins and cashiers may see all of them.
+func loadReceipt(db *sql.DB, w http.ResponseWriter, r *http.Request) (*components.Receipt, bool) {
+	transactionID, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		http.Error(w, "Invalid transaction ID", http.StatusBadRequest)
+		return nil, false
+	}
+
+	receipt, err := services.GetReceipt(db, transactionID)
+	if err == sql.ErrNoRows {
+		http.NotFound(w, r)
+		return nil, false
+	} else if err != nil {
+		receiptLog.ErrorContext(r.Context(), "Failed to load receipt", "transaction_id", transactionID, "error", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return nil, false
+	}
+
+	user := r.Context().Value(contextUserKey).(components.User)
+	if user.Role != "admin" && user.Role != "cashier" && receipt.UserID != user.ID {
+		http.NotFound(w, r)
+		return nil, false
+	}
+
+	return receipt, true
+}
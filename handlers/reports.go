@@ -0,0 +1,164 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"fmt"
+	"gopos/components"
+	"gopos/logging"
+	"gopos/services"
+	"net/http"
+	"time"
+)
+
+// reportDateFormat is the format of the date inputs on the reports page
+const reportDateFormat = "2006-01-02"
+
+var reportLog = logging.Component("report")
+
+// HandleReports displays the revenue reports page
+func HandleReports(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Get user info from session
+		session, err := store.Get(r, sessionName)
+		if err != nil {
+			reportLog.ErrorContext(r.Context(), "Failed to get session", "error", err)
+			http.Error(w, "Session error", http.StatusInternalServerError)
+			return
+		}
+
+		userName, ok := session.Values["name"].(string)
+		if !ok {
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		userRole, ok := session.Values["role"].(string)
+		if !ok {
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		from, to, group, errMsg := parseReportFilter(r)
+		data := components.ReportsData{
+			Title:     "Umsatzberichte",
+			UserName:  userName,
+			Role:      userRole,
+			CSRFToken: generateCSRFToken(),
+			From:      from.Format(reportDateFormat),
+			To:        to.Format(reportDateFormat),
+			Group:     group,
+			Error:     errMsg,
+		}
+
+		if errMsg == "" {
+			data.Report, err = services.BuildReport(db, from, to, group)
+			if err != nil {
+				reportLog.ErrorContext(r.Context(), "Failed to build report", "error", err)
+				http.Error(w, "Database error", http.StatusInternalServerError)
+				return
+			}
+		}
+
+		if err := components.Reports(data).Render(r.Context(), w); err != nil {
+			reportLog.ErrorContext(r.Context(), "Failed to render template", "error", err)
+			http.Error(w, "Error rendering reports", http.StatusInternalServerError)
+		}
+	}
+}
+
+// HandleReportsExport exports a revenue report as CSV, either by period or by cashier
+func HandleReportsExport(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		from, to, group, errMsg := parseReportFilter(r)
+		if errMsg != "" {
+			http.Error(w, errMsg, http.StatusBadRequest)
+			return
+		}
+
+		report, err := services.BuildReport(db, from, to, group)
+		if err != nil {
+			reportLog.ErrorContext(r.Context(), "Failed to build report", "error", err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+
+		breakdown := r.URL.Query().Get("breakdown")
+		if breakdown != "cashiers" {
+			breakdown = "periods"
+		}
+
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="umsatz-%s-%s-%s.csv"`,
+			breakdown, from.Format(reportDateFormat), to.Format(reportDateFormat)))
+
+		writer := csv.NewWriter(w)
+		if breakdown == "cashiers" {
+			writer.Write([]string{"Kassierer", "Umsatz", "Verkäufe", "Durchschnittlicher Bon", "Aufladungen"})
+			for _, cashier := range report.Cashiers {
+				writer.Write([]string{
+					cashier.Name,
+					fmt.Sprintf("%.2f", cashier.Revenue),
+					fmt.Sprint(cashier.Sales),
+					fmt.Sprintf("%.2f", cashier.AverageSale()),
+					fmt.Sprintf("%.2f", cashier.Topups),
+				})
+			}
+		} else {
+			writer.Write([]string{"Zeitraum", "Von", "Bis", "Umsatz", "Verkäufe", "Aufladungen"})
+			for _, period := range report.Periods {
+				writer.Write([]string{
+					period.Label,
+					period.Start.Format(reportDateFormat),
+					period.End.AddDate(0, 0, -1).Format(reportDateFormat),
+					fmt.Sprintf("%.2f", period.Revenue),
+					fmt.Sprint(period.Sales),
+					fmt.Sprintf("%.2f", period.Topups),
+				})
+			}
+		}
+		writer.Flush()
+		if err := writer.Error(); err != nil {
+			reportLog.ErrorContext(r.Context(), "Failed to write CSV", "error", err)
+		}
+	}
+}
+
+// parseReportFilter reads the date range and grouping of a report request. Without
+// a range the current month is shown. If the filter is invalid, an error message is
+// returned together with the default range.
+func parseReportFilter(r *http.Request) (from, to time.Time, group string, errMsg string) {
+	location := services.GetSettings().Location()
+	now := time.Now().In(location)
+	from = time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, location)
+	to = time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, location)
+
+	query := r.URL.Query()
+	group = query.Get("group")
+	switch group {
+	case components.ReportGroupDay, components.ReportGroupWeek, components.ReportGroupMonth:
+	default:
+		group = components.ReportGroupDay
+	}
+
+	if query.Get("from") == "" && query.Get("to") == "" {
+		return from, to, group, ""
+	}
+
+	parsedFrom, err := time.ParseInLocation(reportDateFormat, query.Get("from"), location)
+	if err != nil {
+		return from, to, group, "Ungültiges Startdatum"
+	}
+	parsedTo, err := time.ParseInLocation(reportDateFormat, query.Get("to"), location)
+	if err != nil {
+		return from, to, group, "Ungültiges Enddatum"
+	}
+	if parsedTo.Before(parsedFrom) {
+		return from, to, group, "Das Enddatum darf nicht vor dem Startdatum liegen"
+	}
+	if parsedTo.After(parsedFrom.AddDate(5, 0, 0)) {
+		return from, to, group, "Der Zeitraum darf höchstens fünf Jahre umfassen"
+	}
+
+	return parsedFrom, parsedTo, group, ""
+}
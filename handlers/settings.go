@@ -0,0 +1,184 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"gopos/components"
+	"gopos/logging"
+	"gopos/repository"
+	"gopos/services"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// maxLogoSize is the largest logo image accepted on the settings page
+const maxLogoSize = 512 * 1024
+
+var settingsLog = logging.Component("settings")
+
+// HandleSettings displays and processes the store settings form
+func HandleSettings(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Get user info from session
+		session, err := store.Get(r, sessionName)
+		if err != nil {
+			settingsLog.ErrorContext(r.Context(), "Failed to get session", "error", err)
+			http.Error(w, "Session error", http.StatusInternalServerError)
+			return
+		}
+
+		userName, ok := session.Values["name"].(string)
+		if !ok {
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		userRole, ok := session.Values["role"].(string)
+		if !ok {
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		data := components.SettingsData{
+			Title:     "Einstellungen",
+			UserName:  userName,
+			Role:      userRole,
+			CSRFToken: generateCSRFToken(),
+			Settings:  services.GetSettings(),
+		}
+
+		if r.Method == http.MethodGet {
+			data.Success = r.URL.Query().Get("success") == "true"
+			if data.Success {
+				data.Message = "Einstellungen gespeichert"
+			}
+			components.SettingsPage(data).Render(r.Context(), w)
+			return
+		}
+
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if err := r.ParseMultipartForm(maxLogoSize + 64*1024); err != nil {
+			data.Error = "Fehler beim Verarbeiten des Formulars"
+			components.SettingsPage(data).Render(r.Context(), w)
+			return
+		}
+
+		// Validate CSRF token
+		if !verifyCSRFToken(r.FormValue("csrf_token")) {
+			data.Error = "Ungültiger CSRF-Token"
+			components.SettingsPage(data).Render(r.Context(), w)
+			return
+		}
+
+		settings := components.Settings{
+			StoreName:     strings.TrimSpace(r.FormValue("store_name")),
+			Currency:      strings.ToUpper(strings.TrimSpace(r.FormValue("currency"))),
+			Timezone:      strings.TrimSpace(r.FormValue("timezone")),
+			ReceiptFooter: strings.TrimSpace(r.FormValue("receipt_footer")),
+			HasLogo:       data.Settings.HasLogo,
+		}
+		previous := data.Settings
+		data.Settings = settings
+
+		if settings.StoreName == "" {
+			data.Error = "Bitte geben Sie einen Namen für das Geschäft ein"
+			components.SettingsPage(data).Render(r.Context(), w)
+			return
+		}
+
+		if !isSupportedCurrency(settings.Currency) {
+			data.Error = "Ungültige Währung"
+			components.SettingsPage(data).Render(r.Context(), w)
+			return
+		}
+
+		if _, err := time.LoadLocation(settings.Timezone); err != nil || settings.Timezone == "" {
+			data.Error = "Unbekannte Zeitzone: " + settings.Timezone
+			components.SettingsPage(data).Render(r.Context(), w)
+			return
+		}
+
+		// Read the uploaded logo, if any. Without an upload the logo stays as it is.
+		var logo *services.Logo
+		file, header, err := r.FormFile("logo")
+		if err == nil {
+			defer file.Close()
+			image, err := io.ReadAll(io.LimitReader(file, maxLogoSize+1))
+			if err != nil {
+				data.Error = "Fehler beim Lesen des Logos"
+				components.SettingsPage(data).Render(r.Context(), w)
+				return
+			}
+			if len(image) > maxLogoSize {
+				data.Error = "Das Logo darf höchstens 512 KB groß sein"
+				components.SettingsPage(data).Render(r.Context(), w)
+				return
+			}
+			logoType := http.DetectContentType(image)
+			if logoType != "image/png" && logoType != "image/jpeg" {
+				data.Error = "Das Logo muss ein PNG- oder JPEG-Bild sein"
+				components.SettingsPage(data).Render(r.Context(), w)
+				return
+			}
+			settingsLog.DebugContext(r.Context(), "Received logo", "file", header.Filename, "bytes", len(image), "type", logoType)
+			logo = &services.Logo{Image: image, ContentType: logoType}
+		} else if err != http.ErrMissingFile {
+			data.Error = "Fehler beim Hochladen des Logos"
+			components.SettingsPage(data).Render(r.Context(), w)
+			return
+		} else if r.FormValue("remove_logo") == "true" {
+			logo = &services.Logo{}
+		}
+
+		if err := services.SaveSettings(db, settings, logo); err != nil {
+			settingsLog.ErrorContext(r.Context(), "Failed to save settings", "error", err)
+			data.Error = "Fehler beim Speichern der Einstellungen"
+			components.SettingsPage(data).Render(r.Context(), w)
+			return
+		}
+
+		// Log the action
+		adminUser := r.Context().Value(contextUserKey).(components.User)
+		event := newAuditEvent(r, adminUser.ID, "update_settings", fmt.Sprintf("Einstellungen geändert: %s (Währung: %s, Zeitzone: %s)", settings.StoreName, settings.Currency, settings.Timezone))
+		event.EntityType = "settings"
+		event.Changes = auditChanges(settingsAuditFields(previous), settingsAuditFields(settings))
+		if err := repository.NewSQLAuditStore(db).Log(event); err != nil {
+			settingsLog.ErrorContext(r.Context(), "Failed to write audit log", "error", err)
+		}
+
+		http.Redirect(w, r, "/settings?success=true", http.StatusSeeOther)
+	}
+}
+
+// HandleSettingsLogo serves the store logo
+func HandleSettingsLogo(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logo, contentType, err := services.GetLogo(db)
+		if err == sql.ErrNoRows {
+			http.NotFound(w, r)
+			return
+		} else if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Write(logo)
+	}
+}
+
+func isSupportedCurrency(code string) bool {
+	for _, supported := range components.SupportedCurrencies {
+		if code == supported {
+			return true
+		}
+	}
+	return false
+}
@@ -3,10 +3,16 @@ package handlers
 import (
 	"database/sql"
 	"gopos/components"
-	"log"
+	"gopos/database"
+	"gopos/logging"
+	"gopos/repository"
+	"gopos/services"
 	"net/http"
+	"time"
 )
 
+var statsLog = logging.Component("stats")
+
 type ProductStats struct {
 	Name     string
 	Quantity int
@@ -19,7 +25,7 @@ func HandleStats(db *sql.DB) http.HandlerFunc {
 		// Get user info from session
 		session, err := store.Get(r, sessionName)
 		if err != nil {
-			log.Printf("Stats error: failed to get session: %v", err)
+			statsLog.ErrorContext(r.Context(), "Failed to get session", "error", err)
 			http.Error(w, "Session error", http.StatusInternalServerError)
 			return
 		}
@@ -27,80 +33,49 @@ func HandleStats(db *sql.DB) http.HandlerFunc {
 		// Type assert session values with proper error checking
 		userName, ok := session.Values["name"].(string)
 		if !ok {
-			log.Printf("Stats error: name not found in session or wrong type")
+			statsLog.WarnContext(r.Context(), "Name not found in session")
 			http.Redirect(w, r, "/", http.StatusSeeOther)
 			return
 		}
 
 		userRole, ok := session.Values["role"].(string)
 		if !ok {
-			log.Printf("Stats error: role not found in session or wrong type")
+			statsLog.WarnContext(r.Context(), "Role not found in session")
 			http.Redirect(w, r, "/", http.StatusSeeOther)
 			return
 		}
 
-		// Get daily revenue with timestamp format awareness
-		var dailyRevenue float64
-		err = db.QueryRow(`
-            SELECT COALESCE(SUM(total), 0)
-            FROM transactions
-            WHERE substr(created_at, 1, 10) = substr(datetime('now', 'localtime'), 1, 10)
-        `).Scan(&dailyRevenue)
+		// Days and months are bucketed in the business timezone, timestamps are stored in UTC
+		location := services.GetSettings().Location()
+		now := time.Now().In(location)
+		startOfDay := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, location)
+		startOfMonth := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, location)
+
+		// Get daily revenue
+		dailyRevenue, err := revenueBetween(db, startOfDay, startOfDay.AddDate(0, 0, 1))
 		if err != nil {
-			log.Printf("Stats error: failed to get daily revenue: %v", err)
+			statsLog.ErrorContext(r.Context(), "Failed to get daily revenue", "error", err)
 			http.Error(w, "Database error", http.StatusInternalServerError)
 			return
 		}
 
-		// Get monthly revenue with timestamp format awareness
-		var monthlyRevenue float64
-		err = db.QueryRow(`
-            SELECT COALESCE(SUM(total), 0)
-            FROM transactions
-            WHERE substr(created_at, 1, 7) = substr(datetime('now', 'localtime'), 1, 7)
-        `).Scan(&monthlyRevenue)
+		// Get monthly revenue
+		monthlyRevenue, err := revenueBetween(db, startOfMonth, startOfMonth.AddDate(0, 1, 0))
 		if err != nil {
-			log.Printf("Stats error: failed to get monthly revenue: %v", err)
+			statsLog.ErrorContext(r.Context(), "Failed to get monthly revenue", "error", err)
 			http.Error(w, "Database error", http.StatusInternalServerError)
 			return
 		}
 
-		// Get transaction dates to debug
-		rows, err := db.Query(`
-			SELECT 
-				created_at, 
-				total,
-				substr(created_at, 1, 10) as day_part,
-				substr(datetime('now', 'localtime'), 1, 10) as today_part,
-				substr(created_at, 1, 7) as month_part,
-				substr(datetime('now', 'localtime'), 1, 7) as current_month_part,
-				CASE WHEN substr(created_at, 1, 10) = substr(datetime('now', 'localtime'), 1, 10) THEN 'YES' ELSE 'NO' END as is_today,
-				CASE WHEN substr(created_at, 1, 7) = substr(datetime('now', 'localtime'), 1, 7) THEN 'YES' ELSE 'NO' END as is_this_month
-			FROM transactions 
-			ORDER BY created_at DESC 
-			LIMIT 3
-		`)
-		if err == nil {
-			defer rows.Close()
-			log.Printf("Stats debug: Transaction dates analysis:")
-			for rows.Next() {
-				var date, total, dayPart, todayPart, monthPart, currentMonthPart, isToday, isThisMonth string
-				if err := rows.Scan(&date, &total, &dayPart, &todayPart, &monthPart, &currentMonthPart, &isToday, &isThisMonth); err == nil {
-					log.Printf("  Date: %s, Total: %s", date, total)
-					log.Printf("    Day part: %s, Today part: %s, Is Today: %s", dayPart, todayPart, isToday)
-					log.Printf("    Month part: %s, Current Month part: %s, Is This Month: %s", monthPart, currentMonthPart, isThisMonth)
-				}
-			}
-		}
-
 		// Get total revenue (all time)
 		var totalRevenue float64
 		err = db.QueryRow(`
             SELECT COALESCE(SUM(total), 0)
             FROM transactions
-        `).Scan(&totalRevenue)
+            WHERE kind = ?
+        `, repository.TransactionSale).Scan(&totalRevenue)
 		if err != nil {
-			log.Printf("Stats error: failed to get total revenue: %v", err)
+			statsLog.ErrorContext(r.Context(), "Failed to get total revenue", "error", err)
 			http.Error(w, "Database error", http.StatusInternalServerError)
 			return
 		}
@@ -112,7 +87,7 @@ func HandleStats(db *sql.DB) http.HandlerFunc {
             FROM users
         `).Scan(&systemBalance)
 		if err != nil {
-			log.Printf("Stats error: failed to get system balance: %v", err)
+			statsLog.ErrorContext(r.Context(), "Failed to get system balance", "error", err)
 			http.Error(w, "Database error", http.StatusInternalServerError)
 			return
 		}
@@ -120,7 +95,7 @@ func HandleStats(db *sql.DB) http.HandlerFunc {
 		// Get top selling products
 		topProducts, err := getProductStats(db, "DESC", 5)
 		if err != nil {
-			log.Printf("Stats error: failed to get top products: %v", err)
+			statsLog.ErrorContext(r.Context(), "Failed to get top products", "error", err)
 			http.Error(w, "Database error", http.StatusInternalServerError)
 			return
 		}
@@ -128,7 +103,7 @@ func HandleStats(db *sql.DB) http.HandlerFunc {
 		// Get low selling products
 		lowProducts, err := getProductStats(db, "ASC", 5)
 		if err != nil {
-			log.Printf("Stats error: failed to get low products: %v", err)
+			statsLog.ErrorContext(r.Context(), "Failed to get low products", "error", err)
 			http.Error(w, "Database error", http.StatusInternalServerError)
 			return
 		}
@@ -147,13 +122,24 @@ func HandleStats(db *sql.DB) http.HandlerFunc {
 		}
 
 		if err := components.Stats(data).Render(r.Context(), w); err != nil {
-			log.Printf("Stats error: failed to render template: %v", err)
+			statsLog.ErrorContext(r.Context(), "Failed to render template", "error", err)
 			http.Error(w, "Error rendering statistics", http.StatusInternalServerError)
 			return
 		}
 	}
 }
 
+// revenueBetween sums the sales created in the half-open interval [from, to)
+func revenueBetween(db *sql.DB, from, to time.Time) (float64, error) {
+	var revenue float64
+	err := db.QueryRow(`
+		SELECT COALESCE(SUM(total), 0)
+		FROM transactions
+		WHERE kind = ? AND created_at >= ? AND created_at < ?
+	`, repository.TransactionSale, database.FormatTime(from), database.FormatTime(to)).Scan(&revenue)
+	return revenue, err
+}
+
 func getProductStats(db *sql.DB, order string, limit int) ([]components.ProductStats, error) {
 	query := `
         SELECT 
@@ -1,17 +1,19 @@
 package handlers
 
 import (
-	"database/sql"
+	"errors"
 	"gopos/components"
+	"gopos/logging"
+	"gopos/repository"
 	"gopos/services"
-	"log"
 	"net/http"
 	"strconv"
-	"time"
 )
 
+var transactionLog = logging.Component("transaction")
+
 // HandleTransactions displays the transactions page for the logged-in user
-func HandleTransactions(db *sql.DB) http.HandlerFunc {
+func HandleTransactions(stores repository.Stores) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		// Get user from session
 		session, _ := store.Get(r, "pos-session")
@@ -20,71 +22,19 @@ func HandleTransactions(db *sql.DB) http.HandlerFunc {
 		userRole := session.Values["role"].(string)
 
 		// Get user balance
-		var balance float64
-		err := db.QueryRow("SELECT balance FROM users WHERE id = ?", userID).Scan(&balance)
+		user, err := stores.Users.Get(userID)
 		if err != nil {
 			http.Error(w, "Error loading user balance", http.StatusInternalServerError)
 			return
 		}
+		balance := user.Balance
 
-		// Get transactions from database with user and cashier names
-		rows, err := db.Query(`
-			SELECT 
-				t.id,
-				u.name as user_name,
-				c.name as cashier_name,
-				t.total,
-				datetime(t.created_at, 'localtime') as created_at
-			FROM transactions t
-			JOIN users u ON t.user_id = u.id
-			JOIN users c ON t.cashier_id = c.id
-			WHERE t.user_id = ?
-			ORDER BY t.created_at DESC
-			LIMIT 50
-		`, userID)
+		// Get transactions with user and cashier names
+		transactions, err := stores.Transactions.ListForUser(userID, 50)
 		if err != nil {
 			http.Error(w, "Error loading transactions", http.StatusInternalServerError)
 			return
 		}
-		defer rows.Close()
-
-		var transactions []components.Transaction
-		for rows.Next() {
-			var t components.Transaction
-			err := rows.Scan(&t.ID, &t.UserName, &t.CashierName, &t.Total, &t.CreatedAt)
-			if err != nil {
-				continue
-			}
-
-			// Load transaction items
-			itemRows, err := db.Query(`
-				SELECT 
-					p.name,
-					ti.quantity,
-					ti.price
-				FROM transaction_items ti
-				JOIN products p ON p.id = ti.product_id
-				WHERE ti.transaction_id = ?
-				ORDER BY p.name
-			`, t.ID)
-			if err != nil {
-				continue
-			}
-			defer itemRows.Close()
-
-			var items []components.TransactionItem
-			for itemRows.Next() {
-				var item components.TransactionItem
-				err := itemRows.Scan(&item.ProductName, &item.Quantity, &item.Price)
-				if err != nil {
-					continue
-				}
-				items = append(items, item)
-			}
-			t.Items = items
-
-			transactions = append(transactions, t)
-		}
 
 		data := components.TransactionsData{
 			Title:        "Meine Transaktionen",
@@ -104,7 +54,7 @@ func HandleTransactions(db *sql.DB) http.HandlerFunc {
 }
 
 // HandleTransaction processes a new transaction
-func HandleTransaction(db *sql.DB) http.HandlerFunc {
+func HandleTransaction(stores repository.Stores) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != "POST" {
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -128,82 +78,64 @@ func HandleTransaction(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
-		// Start transaction
-		tx, err := db.Begin()
-		if err != nil {
-			http.Error(w, "Database error", http.StatusInternalServerError)
-			return
-		}
-		defer tx.Rollback()
-
-		// Get user's current balance and email
-		var currentBalance float64
-		var userName string
-		var userEmail string
-		err = tx.QueryRow("SELECT balance, name, email FROM users WHERE id = ?", userID).Scan(&currentBalance, &userName, &userEmail)
+		// Get user's name and email
+		user, err := stores.Users.Get(int(userID))
 		if err != nil {
-			log.Printf("[TRANSACTION] Error getting user data: %v", err)
+			transactionLog.InfoContext(r.Context(), "Customer not found", "user_id", userID, "error", err)
 			http.Error(w, "User not found", http.StatusNotFound)
 			return
 		}
-		log.Printf("[TRANSACTION] Processing transaction for user %s (ID: %d, Email: %s)", userName, userID, userEmail)
-
-		// Calculate new balance
-		newBalance := currentBalance + amount
-		log.Printf("[TRANSACTION] Updating balance from %.2f€ to %.2f€", currentBalance, newBalance)
-
-		// Update user's balance
-		_, err = tx.Exec("UPDATE users SET balance = ? WHERE id = ?", newBalance, userID)
-		if err != nil {
-			log.Printf("[TRANSACTION] Error updating balance: %v", err)
-			http.Error(w, "Error updating balance", http.StatusInternalServerError)
-			return
-		}
 
-		// Record transaction
+		// Update the balance, record the transaction and log it together
 		cashier := r.Context().Value(userKey).(components.User)
-		_, err = tx.Exec(`
-			INSERT INTO transactions (user_id, cashier_id, total, description, created_at)
-			VALUES (?, ?, ?, ?, ?)
-		`, userID, cashier.ID, amount, description, time.Now())
-		if err != nil {
-			log.Printf("[TRANSACTION] Error recording transaction: %v", err)
-			http.Error(w, "Error recording transaction", http.StatusInternalServerError)
-			return
-		}
-
-		// Log the transaction
-		_, err = tx.Exec(`
-			INSERT INTO audit_log (user_id, action, details, created_at)
-			VALUES (?, ?, ?, ?)
-		`, cashier.ID, "transaction", description, time.Now())
-		if err != nil {
-			log.Printf("[TRANSACTION] Error logging to audit: %v", err)
-			http.Error(w, "Error logging transaction", http.StatusInternalServerError)
+		var newBalance float64
+		err = stores.Atomic(func(tx repository.Stores) error {
+			newBalance, err = tx.Users.AdjustBalance(user.ID, amount)
+			if err != nil {
+				return err
+			}
+			_, err = tx.Transactions.Record(repository.Booking{
+				UserID:       user.ID,
+				CashierID:    cashier.ID,
+				Total:        amount,
+				BalanceAfter: newBalance,
+				Kind:         repository.TransactionManual,
+				Description:  description,
+			})
+			if err != nil {
+				return err
+			}
+			event := newAuditEvent(r, cashier.ID, "transaction", description)
+			event.EntityType, event.EntityID = "user", user.ID
+			event.Changes = map[string]components.AuditChange{"balance": {Before: newBalance - amount, After: newBalance}}
+			return tx.Audit.Log(event)
+		})
+		if errors.Is(err, repository.ErrInsufficientBalance) {
+			http.Error(w, "Insufficient balance", http.StatusBadRequest)
 			return
-		}
-
-		// Commit transaction
-		if err := tx.Commit(); err != nil {
-			log.Printf("[TRANSACTION] Error committing transaction: %v", err)
-			http.Error(w, "Error committing transaction", http.StatusInternalServerError)
+		} else if err != nil {
+			transactionLog.ErrorContext(r.Context(), "Failed to record transaction", "user_id", userID, "error", err)
+			http.Error(w, "Error recording transaction", http.StatusInternalServerError)
 			return
 		}
 
-		log.Printf("[TRANSACTION] Transaction completed successfully, sending email notification...")
+		transactionLog.InfoContext(r.Context(), "Transaction recorded",
+			"user_id", userID,
+			"cashier_id", cashier.ID,
+			"amount", amount,
+			"balance", newBalance)
 
 		// Send email notification if user has email
-		if userEmail != "" {
+		if user.Email != "" {
 			// Use the transaction-specific email template
-			if err := services.SendTransactionEmail(userEmail, userName, amount, newBalance, []services.Product{}); err != nil {
-				log.Printf("[TRANSACTIONS] Error sending email notification: %v", err)
+			if err := services.SendTransactionEmail(user.Email, user.Name, amount, newBalance, []services.Product{}); err != nil {
+				transactionLog.ErrorContext(r.Context(), "Failed to send transaction email", "email", user.Email, "error", err)
 			} else {
-				log.Printf("[TRANSACTIONS] Email notification sent successfully")
+				transactionLog.DebugContext(r.Context(), "Transaction email sent", "user_id", userID)
 			}
 		}
 
 		// Return success response
 		w.WriteHeader(http.StatusOK)
-		log.Printf("[TRANSACTION] Request completed successfully")
 	}
 }
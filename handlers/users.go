@@ -1,13 +1,26 @@
 package handlers
 
 import (
-	"database/sql"
 	"gopos/components"
+	"gopos/repository"
 	"net/http"
 )
 
-// HandleUsers displays all users
-func HandleUsers(db *sql.DB) http.HandlerFunc {
+// userStatus returns the status filter of the request. Deactivated users are
+// hidden unless asked for.
+func userStatus(r *http.Request) string {
+	switch r.URL.Query().Get("status") {
+	case "all":
+		return ""
+	case repository.UserInactive:
+		return repository.UserInactive
+	default:
+		return repository.UserActive
+	}
+}
+
+// HandleUsers displays the active users, or the deactivated ones with ?status=inactive
+func HandleUsers(stores repository.Stores) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		// Get user from session
 		session, err := store.Get(r, sessionName)
@@ -28,30 +41,12 @@ func HandleUsers(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
-		// Get all users
-		rows, err := db.Query(`
-            SELECT id, name, role, card_number, balance, email, created_at 
-            FROM users 
-            ORDER BY created_at DESC
-        `)
+		status := userStatus(r)
+		users, err := stores.Users.List(repository.UserFilter{Status: status})
 		if err != nil {
 			http.Error(w, "Database error", http.StatusInternalServerError)
 			return
 		}
-		defer rows.Close()
-
-		var users []components.User
-		for rows.Next() {
-			var user components.User
-			var email sql.NullString
-			err := rows.Scan(&user.ID, &user.Name, &user.Role, &user.CardNumber, &user.Balance, &email, &user.CreatedAt)
-			if err != nil {
-				http.Error(w, "Database error", http.StatusInternalServerError)
-				return
-			}
-			user.Email = email.String
-			users = append(users, user)
-		}
 
 		data := components.UsersData{
 			Title:     "Benutzerverwaltung",
@@ -59,7 +54,11 @@ func HandleUsers(db *sql.DB) http.HandlerFunc {
 			Role:      userRole,
 			CSRFToken: generateCSRFToken(),
 			Users:     users,
+			Status:    status,
+			Message:   r.URL.Query().Get("message"),
+			Error:     r.URL.Query().Get("error"),
 		}
+		data.Success = data.Message != ""
 
 		components.Users(data).Render(r.Context(), w)
 	}
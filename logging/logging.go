@@ -0,0 +1,126 @@
+// Package logging sets up structured logging with log/slog. Log lines carry the
+// ID of the request they belong to, and card numbers, email addresses and
+// secrets are redacted before they are written.
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+)
+
+// Levels and Formats are the accepted values of log.level and log.format
+var (
+	Levels  = []string{"debug", "info", "warn", "error"}
+	Formats = []string{"text", "json"}
+)
+
+// ParseLevel returns the slog level for debug, info, warn or error
+func ParseLevel(level string) (slog.Level, error) {
+	switch strings.ToLower(level) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "", "info":
+		return slog.LevelInfo, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	}
+	return 0, fmt.Errorf("unknown log level %q, expected one of %s", level, strings.Join(Levels, ", "))
+}
+
+// Setup makes a redacting logger writing to w the default, so slog's top-level
+// functions, Component loggers and the standard log package all use it
+func Setup(w io.Writer, level, format string) error {
+	lvl, err := ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	options := &slog.HandlerOptions{Level: lvl}
+
+	var next slog.Handler
+	switch strings.ToLower(format) {
+	case "", "text":
+		next = slog.NewTextHandler(w, options)
+	case "json":
+		next = slog.NewJSONHandler(w, options)
+	default:
+		return fmt.Errorf("unknown log format %q, expected one of %s", format, strings.Join(Formats, ", "))
+	}
+
+	slog.SetDefault(slog.New(NewHandler(next)))
+	return nil
+}
+
+type requestIDKey struct{}
+
+// WithRequestID returns a context whose log lines carry the request ID
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestID returns the request ID of the context, or "" if there is none
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// NewRequestID returns a random ID for a request
+func NewRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Component returns a logger that tags its lines with the component, e.g.
+// checkout or backup. It writes to the default logger at the time of each
+// call, so it can be created in a package variable before Setup runs.
+func Component(name string) *slog.Logger {
+	return slog.New(&componentHandler{attrs: []slog.Attr{slog.String("component", name)}})
+}
+
+// componentHandler passes records on to the current default handler
+type componentHandler struct {
+	attrs []slog.Attr
+	group string
+}
+
+func (h *componentHandler) handler() slog.Handler {
+	next := slog.Default().Handler().WithAttrs(h.attrs)
+	if h.group != "" {
+		next = next.WithGroup(h.group)
+	}
+	return next
+}
+
+func (h *componentHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return slog.Default().Handler().Enabled(ctx, level)
+}
+
+func (h *componentHandler) Handle(ctx context.Context, r slog.Record) error {
+	return h.handler().Handle(ctx, r)
+}
+
+func (h *componentHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	if h.group != "" {
+		// Attributes after a group belong to it, which only the real handler can track
+		return &fixedHandler{h.handler().WithAttrs(attrs)}
+	}
+	return &componentHandler{attrs: append(h.attrs[:len(h.attrs):len(h.attrs)], attrs...)}
+}
+
+func (h *componentHandler) WithGroup(name string) slog.Handler {
+	if h.group != "" {
+		return &fixedHandler{h.handler().WithGroup(name)}
+	}
+	return &componentHandler{attrs: h.attrs, group: name}
+}
+
+// fixedHandler is a component handler bound to the default handler of the
+// time it was derived
+type fixedHandler struct{ slog.Handler }
@@ -0,0 +1,128 @@
+package logging
+
+import (
+	"context"
+	"log/slog"
+	"regexp"
+	"strings"
+)
+
+// Handler redacts sensitive values and adds the request ID before passing
+// records on
+type Handler struct {
+	next slog.Handler
+}
+
+// NewHandler returns a handler that redacts the records for next
+func NewHandler(next slog.Handler) *Handler {
+	return &Handler{next: next}
+}
+
+func (h *Handler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.next.Enabled(ctx, level)
+}
+
+func (h *Handler) Handle(ctx context.Context, r slog.Record) error {
+	redacted := slog.NewRecord(r.Time, r.Level, RedactText(r.Message), r.PC)
+	if id := RequestID(ctx); id != "" {
+		redacted.AddAttrs(slog.String("request_id", id))
+	}
+	r.Attrs(func(a slog.Attr) bool {
+		redacted.AddAttrs(redact(a))
+		return true
+	})
+	return h.next.Handle(ctx, redacted)
+}
+
+func (h *Handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	redacted := make([]slog.Attr, len(attrs))
+	for i, a := range attrs {
+		redacted[i] = redact(a)
+	}
+	return &Handler{next: h.next.WithAttrs(redacted)}
+}
+
+func (h *Handler) WithGroup(name string) slog.Handler {
+	return &Handler{next: h.next.WithGroup(name)}
+}
+
+// secretKeys are attributes whose values are never written
+var secretKeys = map[string]bool{
+	"access_key":  true,
+	"session_key": true,
+	"key":         true,
+	"password":    true,
+	"secret":      true,
+	"token":       true,
+	"csrf_token":  true,
+	"dsn":         true,
+}
+
+// redact masks an attribute by its key: card numbers and email addresses are
+// shortened, secrets removed, and email addresses in other text masked.
+// Durations are written as text, e.g. 1.5s.
+func redact(a slog.Attr) slog.Attr {
+	a.Value = a.Value.Resolve()
+	key := strings.ToLower(a.Key)
+
+	switch {
+	case a.Value.Kind() == slog.KindGroup:
+		attrs := a.Value.Group()
+		redacted := make([]slog.Attr, len(attrs))
+		for i, attr := range attrs {
+			redacted[i] = redact(attr)
+		}
+		return slog.Attr{Key: a.Key, Value: slog.GroupValue(redacted...)}
+	case secretKeys[key]:
+		return slog.String(a.Key, "[REDACTED]")
+	case key == "card_number" || key == "card":
+		return slog.String(a.Key, MaskCardNumber(a.Value.String()))
+	case key == "email" || strings.HasSuffix(key, "_email"):
+		return slog.String(a.Key, MaskEmail(a.Value.String()))
+	case a.Value.Kind() == slog.KindString:
+		return slog.String(a.Key, RedactText(a.Value.String()))
+	case a.Value.Kind() == slog.KindDuration:
+		// JSON would show nanoseconds
+		return slog.String(a.Key, a.Value.Duration().String())
+	case a.Value.Kind() == slog.KindAny:
+		if err, ok := a.Value.Any().(error); ok {
+			return slog.String(a.Key, RedactText(err.Error()))
+		}
+	}
+	return a
+}
+
+// MaskCardNumber keeps the last four characters of long card numbers, so a
+// card can be recognised in the log without being usable for a login
+func MaskCardNumber(cardNumber string) string {
+	if cardNumber == "" {
+		return ""
+	}
+	if len(cardNumber) < 8 {
+		return "****"
+	}
+	return "****" + cardNumber[len(cardNumber)-4:]
+}
+
+// MaskEmail keeps the first character and the domain of an email address
+func MaskEmail(email string) string {
+	at := strings.LastIndex(email, "@")
+	if at < 1 {
+		if email == "" {
+			return ""
+		}
+		return "***"
+	}
+	return email[:1] + "***" + email[at:]
+}
+
+var emailPattern = regexp.MustCompile(`[A-Za-z0-9._%+\-]+@[A-Za-z0-9.\-]+\.[A-Za-z]{2,}`)
+
+// RedactText masks the email addresses in free text, e.g. in messages of
+// errors or of the standard log package
+func RedactText(text string) string {
+	if !strings.Contains(text, "@") {
+		return text
+	}
+	return emailPattern.ReplaceAllStringFunc(text, MaskEmail)
+}
@@ -2,205 +2,253 @@ package main
 
 import (
 	"context"
-	"database/sql"
 	"embed"
+	"errors"
+	"flag"
 	"fmt"
 	"io/fs"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"syscall"
+	_ "time/tzdata"
 
 	"gopos/components"
 	"gopos/config"
 	"gopos/database"
 	"gopos/handlers"
+	"gopos/logging"
+	"gopos/metrics"
+	"gopos/server"
 	"gopos/services"
 
-	"gopkg.in/yaml.v3"
 	_ "modernc.org/sqlite"
 )
 
 //go:embed static
 var staticFiles embed.FS
 
+// vendorAssets are the third-party files below static the pages load. They are
+// not part of the repository and have to be downloaded before building.
+var vendorAssets = []string{"vendor/htmx.min.js", "vendor/fontawesome/css/all.min.css"}
+
 var (
 	version  = "development"
 	commitID = "unknown"
 )
 
-func getConfigLocations() []string {
-	homeDir, err := os.UserHomeDir()
-	if err != nil {
-		log.Printf("Warning: Could not get user home directory: %v", err)
-		homeDir = ""
-	}
-
-	// Default locations to check for config file
-	locations := []string{
-		"config.yaml", // Current directory
-	}
+// databaseOptions takes the database connection settings from the configuration
+func databaseOptions(cfg *config.Config) database.Options {
+	options := database.Options{
+		Driver:          cfg.Database.Driver,
+		JournalMode:     cfg.Database.JournalMode,
+		Synchronous:     cfg.Database.Synchronous,
+		BusyTimeout:     cfg.Database.BusyTimeout,
+		ForeignKeys:     true,
+		MaxOpenConns:    cfg.Database.MaxOpenConns,
+		MaxIdleConns:    cfg.Database.MaxIdleConns,
+		ConnMaxLifetime: cfg.Database.ConnMaxLifetime,
+	}
+	if cfg.Database.ForeignKeys != nil {
+		options.ForeignKeys = *cfg.Database.ForeignKeys
+	}
+	return options
+}
 
-	if homeDir != "" {
-		locations = append(locations, filepath.Join(homeDir, ".gopos", "config.yaml"))
+// databaseSource returns the SQLite database file or the PostgreSQL connection string
+func databaseSource(cfg *config.Config) string {
+	if cfg.Database.Driver == database.DriverPostgres {
+		return cfg.Database.DSN
 	}
+	return cfg.Database.Path
+}
 
-	// Add system-wide config location based on OS
-	if os.PathSeparator == '/' { // Unix-like systems
-		locations = append(locations, "/etc/gopos/config.yaml")
-	} else { // Windows
-		locations = append(locations, filepath.Join(os.Getenv("ProgramData"), "gopos", "config.yaml"))
+// newHTTPServer returns a server for addr with the configured timeouts
+func newHTTPServer(cfg *config.Config, addr string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: cfg.Server.ReadHeaderTimeout,
+		ReadTimeout:       cfg.Server.ReadTimeout,
+		WriteTimeout:      cfg.Server.WriteTimeout,
+		IdleTimeout:       cfg.Server.IdleTimeout,
 	}
-
-	return locations
 }
 
-func loadConfig() (*config.Config, error) {
-	var lastErr error
-	locations := getConfigLocations()
-
-	for _, loc := range locations {
-		data, err := os.ReadFile(loc)
-		if err != nil {
-			lastErr = err
-			continue
-		}
-
-		var cfg config.Config
-		if err := yaml.Unmarshal(data, &cfg); err != nil {
-			lastErr = err
-			continue
-		}
+// fatal logs an error that keeps GoPOS from starting and exits
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+	os.Exit(1)
+}
 
-		absPath, err := filepath.Abs(loc)
-		if err != nil {
-			log.Printf("Loaded configuration from: %s (could not resolve to absolute path: %v)", loc, err)
-		} else {
-			log.Printf("Loaded configuration from: %s", absPath)
-		}
-		return &cfg, nil
+func main() {
+	// Load configuration from defaults, file, environment and flags
+	cfg, args, err := config.Load(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		fmt.Fprintln(os.Stderr, commandUsage)
+		return
+	} else if err != nil {
+		log.Fatal("Error loading config: ", err)
 	}
 
-	return nil, fmt.Errorf("could not load config from any location, last error: %v", lastErr)
-}
+	// Log structured lines from here on
+	if err := logging.Setup(os.Stderr, cfg.Log.Level, cfg.Log.Format); err != nil {
+		log.Fatal(err)
+	}
+	if cfg.Source != "" {
+		slog.Info("Loaded configuration", "file", cfg.Source)
+	} else {
+		slog.Info("No configuration file found, using defaults and environment variables")
+	}
 
-func main() {
-	// Load configuration
-	config, err := loadConfig()
-	if err != nil {
-		log.Fatal("Error loading config:", err)
+	// Run maintenance commands like backup and restore instead of the server
+	if len(args) > 0 {
+		if err := runCommand(cfg, args); err != nil {
+			fatal("Command failed", err)
+		}
+		return
 	}
 
 	// Initialize session store
-	handlers.InitSessionStore(config)
+	handlers.InitSessionStore(cfg)
 
 	// Initialize email service
-	services.InitEmailService(config)
+	services.InitEmailService(cfg)
 
-	// Initialize database
-	db, err := sql.Open("sqlite", config.Database.Path)
-	if err != nil {
-		log.Fatal(err)
-	}
-	defer db.Close()
+	// Initialize receipt printer
+	services.InitPrinterService(cfg)
 
-	// Check if database file exists, if not it will be created automatically by SQLite
-	// when we initialize the schema
-	dbAbsPath, err := filepath.Abs(config.Database.Path)
-	if err != nil {
-		log.Printf("Using database at: %s (could not resolve to absolute path: %v)", config.Database.Path, err)
-	} else {
-		log.Printf("Using database at: %s", dbAbsPath)
-	}
-	if _, err := os.Stat(config.Database.Path); os.IsNotExist(err) {
-		log.Printf("Database file does not exist, it will be created automatically")
+	// Protect /metrics if a token is configured
+	metrics.Init(cfg)
 
-		// Ensure the directory exists
-		dbDir := filepath.Dir(config.Database.Path)
-		if dbDir != "" && dbDir != "." {
-			if err := os.MkdirAll(dbDir, 0755); err != nil {
-				log.Fatalf("Failed to create database directory: %v", err)
+	// Initialize database
+	if cfg.Database.Driver == database.DriverPostgres {
+		slog.Info("Using PostgreSQL database")
+	} else {
+		// Check if database file exists, if not it will be created automatically by SQLite
+		// when we initialize the schema
+		dbAbsPath, err := filepath.Abs(cfg.Database.Path)
+		if err != nil {
+			slog.Warn("Using database, could not resolve the absolute path", "path", cfg.Database.Path, "error", err)
+		} else {
+			slog.Info("Using database", "path", dbAbsPath)
+		}
+		if _, err := os.Stat(cfg.Database.Path); os.IsNotExist(err) {
+			slog.Info("Database file does not exist, it will be created automatically")
+
+			// Ensure the directory exists
+			dbDir := filepath.Dir(cfg.Database.Path)
+			if dbDir != "" && dbDir != "." {
+				if err := os.MkdirAll(dbDir, 0755); err != nil {
+					fatal("Failed to create database directory", err)
+				}
 			}
 		}
 	}
 
+	db, err := database.Open(databaseSource(cfg), databaseOptions(cfg))
+	if err != nil {
+		fatal("Failed to open database", err)
+	}
+	defer db.Close()
+
 	// Initialize database schema
 	if err := database.InitDB(db); err != nil {
-		log.Fatalf("Failed to initialize database: %v", err)
+		fatal("Failed to initialize database", err)
+	}
+
+	// Load store settings
+	if err := services.LoadSettings(db); err != nil {
+		fatal("Failed to load settings", err)
 	}
 
-	// Create a new ServeMux
-	mux := http.NewServeMux()
+	// Create backups on schedule
+	services.InitBackupService(cfg)
+	stopBackups := services.StartBackupSchedule(db)
+	defer stopBackups()
+
+	// Initialize signed checkpoints of the audit log
+	services.InitAuditService(cfg)
+	stopCheckpoints := services.StartAuditCheckpointSchedule(db)
+	defer stopCheckpoints()
+	stopArchiving := services.StartAuditArchiveSchedule(db)
+	defer stopArchiving()
 
 	// Serve embedded static files
 	staticFS, err := fs.Sub(staticFiles, "static")
 	if err != nil {
-		log.Fatal(err)
+		fatal("Failed to load static files", err)
 	}
-	mux.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.FS(staticFS))))
-
-	// Middleware to inject database and version info into context
-	withDB := func(handler http.HandlerFunc) http.HandlerFunc {
-		return func(w http.ResponseWriter, r *http.Request) {
-			ctx := context.WithValue(r.Context(), handlers.DbKey, db)
-			ctx = context.WithValue(ctx, "version", version)
-			ctx = context.WithValue(ctx, "commitID", commitID)
-			handler.ServeHTTP(w, r.WithContext(ctx))
+	for _, asset := range vendorAssets {
+		if _, err := fs.Stat(staticFS, asset); err != nil {
+			slog.Error("Vendored asset is missing, pages will lack htmx or icons; see Development in the README", "file", "static/"+asset)
 		}
 	}
+	mux := server.New(db, staticFS, version, commitID)
+
+	// Set up HTTPS with certificate files or ACME
+	tlsSetup, err := server.NewTLS(cfg)
+	if err != nil {
+		fatal("Failed to set up TLS", err)
+	}
 
-	// Define routes with their handlers
-	routes := map[string]http.HandlerFunc{
-		// Public routes
-		"/":       withDB(handlers.HandleLogin(db)),
-		"/login":  withDB(handlers.HandleLoginPost(db)),
-		"/logout": withDB(handlers.HandleLogout),
-
-		// Protected routes - require authentication
-		"/dashboard":    withDB(handlers.RequireAuth(handlers.HandleDashboard(db))),
-		"/transactions": withDB(handlers.RequireAuth(handlers.HandleTransactions(db))),
-
-		// Admin routes
-		"/users":           withDB(handlers.RequireAuth(handlers.RequireRole([]string{"admin"}, handlers.HandleUsers(db)))),
-		"/users/new":       withDB(handlers.RequireAuth(handlers.RequireRole([]string{"admin"}, handlers.HandleNewUser(db)))),
-		"/users/delete":    withDB(handlers.RequireAuth(handlers.RequireRole([]string{"admin"}, handlers.HandleDeleteUser(db)))),
-		"/users/edit":      withDB(handlers.RequireAuth(handlers.RequireRole([]string{"admin"}, handlers.HandleEditUser(db)))),
-		"/users/topup":     withDB(handlers.RequireAuth(handlers.RequireRole([]string{"admin", "cashier"}, handlers.HandleTopupUser(db)))),
-		"/users/search":    withDB(handlers.RequireAuth(handlers.RequireRole([]string{"admin"}, handlers.HandleUserSearch(db)))),
-		"/users/filter":    withDB(handlers.RequireAuth(handlers.RequireRole([]string{"admin"}, handlers.HandleUserFilter(db)))),
-		"/audit":           withDB(handlers.RequireAuth(handlers.RequireRole([]string{"admin"}, handlers.HandleAuditTrail(db)))),
-		"/stats":           withDB(handlers.RequireAuth(handlers.RequireRole([]string{"admin"}, handlers.HandleStats(db)))),
-		"/products":        withDB(handlers.RequireAuth(handlers.RequireRole([]string{"admin"}, handlers.HandleProducts(db)))),
-		"/products/new":    withDB(handlers.RequireAuth(handlers.RequireRole([]string{"admin"}, handlers.HandleNewProduct(db)))),
-		"/products/edit":   withDB(handlers.RequireAuth(handlers.RequireRole([]string{"admin"}, handlers.HandleEditProduct(db)))),
-		"/products/delete": withDB(handlers.RequireAuth(handlers.RequireRole([]string{"admin"}, handlers.HandleDeleteProduct(db)))),
-		"/products/search": withDB(handlers.RequireAuth(handlers.RequireRole([]string{"admin"}, handlers.HandleProductSearch(db)))),
-		"/products/filter": withDB(handlers.RequireAuth(handlers.RequireRole([]string{"admin"}, handlers.HandleProductFilter(db)))),
-
-		// Cashier routes
-		"/checkout":      withDB(handlers.RequireAuth(handlers.RequireRole([]string{"admin", "cashier"}, handlers.HandleCheckout(db)))),
-		"/balance/topup": withDB(handlers.RequireAuth(handlers.RequireRole([]string{"admin", "cashier"}, handlers.HandleBalanceTopup(db)))),
-
-		// API routes
-		"/api/customers": withDB(handlers.RequireAuth(handlers.RequireRole([]string{"admin", "cashier"}, handlers.HandleCustomerLookup(db)))),
-		"/api/products":  withDB(handlers.RequireAuth(handlers.RequireRole([]string{"admin", "cashier"}, handlers.HandleProductScan(db)))),
-		"/api/checkout":  withDB(handlers.RequireAuth(handlers.RequireRole([]string{"admin", "cashier"}, handlers.HandleCompleteCheckout(db)))),
-	}
-
-	// Register all routes
-	for path, handler := range routes {
-		mux.HandleFunc(path, handler)
+	srv := newHTTPServer(cfg, cfg.Server.Listen, mux)
+	var redirectSrv *http.Server
+	if tlsSetup != nil {
+		srv.Handler = tlsSetup.HSTS(mux)
+		srv.TLSConfig = tlsSetup.Config
+		if cfg.TLS.RedirectListen != "" {
+			redirectSrv = newHTTPServer(cfg, cfg.TLS.RedirectListen, tlsSetup.RedirectHandler())
+		}
 	}
 
+	// Stop on Ctrl+C or when the service manager asks
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
 	// Start server
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
+	slog.Info("Starting GoPOS", "version", components.Version, "commit", components.CommitID)
+	serverErr := make(chan error, 2)
+	if tlsSetup != nil {
+		slog.Info("Server listening", "address", cfg.Server.Listen, "tls", true)
+		go func() {
+			serverErr <- srv.ListenAndServeTLS("", "")
+		}()
+	} else {
+		slog.Info("Server listening", "address", cfg.Server.Listen)
+		go func() {
+			serverErr <- srv.ListenAndServe()
+		}()
+	}
+	if redirectSrv != nil {
+		slog.Info("Redirecting HTTP to HTTPS", "address", cfg.TLS.RedirectListen)
+		go func() {
+			serverErr <- redirectSrv.ListenAndServe()
+		}()
 	}
 
-	log.Printf("Version: %s (Commit: %s)", components.Version, components.CommitID)
-	log.Printf("Server starting on port %s...", port)
-	if err := http.ListenAndServe(":"+port, mux); err != nil {
-		log.Fatal(err)
+	select {
+	case err := <-serverErr:
+		fatal("Server failed", err)
+	case <-ctx.Done():
+	}
+	stop() // A second signal stops immediately
+
+	// Let running requests, emails and receipts finish within the grace period
+	slog.Info("Shutting down, waiting for running requests", "timeout", cfg.Server.ShutdownTimeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.Server.ShutdownTimeout)
+	defer cancel()
+	if redirectSrv != nil {
+		redirectSrv.Shutdown(shutdownCtx)
+	}
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		slog.Warn("Server did not shut down cleanly", "error", err)
+	}
+	if err := services.WaitBackground(shutdownCtx); err != nil {
+		slog.Warn("Background tasks did not finish", "error", err)
 	}
+	slog.Info("Server stopped")
 }
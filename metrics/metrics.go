@@ -0,0 +1,120 @@
+// Package metrics counts requests, sales and emails for Prometheus. The
+// counters are updated where the events happen and served on /metrics
+// together with the database connection pool and the build of GoPOS.
+package metrics
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"net/http"
+	"strconv"
+	"time"
+
+	"gopos/config"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	httpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gopos_http_requests_total",
+		Help: "HTTP requests by route, method and status code.",
+	}, []string{"route", "method", "status"})
+
+	httpDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "gopos_http_request_duration_seconds",
+		Help:    "Time to answer HTTP requests by route and method.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "method"})
+
+	checkouts = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "gopos_checkouts_total",
+		Help: "Completed checkouts.",
+	})
+
+	checkoutAmount = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "gopos_checkout_amount_total",
+		Help: "Sum of all completed checkouts in the store currency.",
+	})
+
+	topups = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "gopos_topups_total",
+		Help: "Balance top-ups.",
+	})
+
+	topupAmount = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "gopos_topup_amount_total",
+		Help: "Sum of all balance top-ups in the store currency.",
+	})
+
+	emails = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gopos_emails_total",
+		Help: "Emails by result, success or failure.",
+	}, []string{"result"})
+)
+
+// token is required as bearer token for /metrics if it is set
+var token string
+
+// Init sets the token that protects /metrics
+func Init(cfg *config.Config) {
+	token = cfg.Metrics.Token
+}
+
+// ObserveRequest counts an HTTP request to one of the routes
+func ObserveRequest(route, method string, status int, duration time.Duration) {
+	httpRequests.WithLabelValues(route, method, strconv.Itoa(status)).Inc()
+	httpDuration.WithLabelValues(route, method).Observe(duration.Seconds())
+}
+
+// Checkout counts a completed checkout
+func Checkout(total float64) {
+	checkouts.Inc()
+	checkoutAmount.Add(total)
+}
+
+// Topup counts a balance top-up
+func Topup(amount float64) {
+	topups.Inc()
+	topupAmount.Add(amount)
+}
+
+// Email counts a sent email, or a failed attempt if err is not nil
+func Email(err error) {
+	if err != nil {
+		emails.WithLabelValues("failure").Inc()
+	} else {
+		emails.WithLabelValues("success").Inc()
+	}
+}
+
+// Handler serves the metrics in the Prometheus text format, together with the
+// connection pool of db, the build and the Go runtime of the process
+func Handler(db *sql.DB, version, commitID string) http.Handler {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(
+		httpRequests, httpDuration,
+		checkouts, checkoutAmount, topups, topupAmount,
+		emails,
+		collectors.NewDBStatsCollector(db, "gopos"),
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name:        "gopos_build_info",
+			Help:        "Version and commit of the running build, always 1.",
+			ConstLabels: prometheus.Labels{"version": version, "commit": commitID},
+		}, func() float64 { return 1 }),
+	)
+	metrics := promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="metrics"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		metrics.ServeHTTP(w, r)
+	})
+}
@@ -43,3 +43,30 @@ type AuditLog struct {
 	Details   string    `json:"details"`
 	CreatedAt time.Time `json:"created_at"`
 }
+
+// Cart is a cart held on the server for a register until it is checked out
+type Cart struct {
+	ID          int64         `json:"id"`
+	Register    string        `json:"register"`
+	CashierID   int64         `json:"cashier_id"`
+	CashierName string        `json:"cashier_name"`
+	Customer    *CartCustomer `json:"customer"`
+	Items       []CartItem    `json:"items"`
+	Total       float64       `json:"total"`
+	Status      string        `json:"status"` // open, completed, discarded
+	UpdatedAt   time.Time     `json:"updated_at"`
+}
+
+type CartCustomer struct {
+	ID         int64   `json:"id"`
+	CardNumber string  `json:"card_number"`
+	Name       string  `json:"name"`
+	Balance    float64 `json:"balance"`
+}
+
+type CartItem struct {
+	ProductID int64   `json:"product_id"`
+	Name      string  `json:"name"`
+	Price     float64 `json:"price"`
+	Quantity  int     `json:"quantity"`
+}
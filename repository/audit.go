@@ -0,0 +1,365 @@
+package repository
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"gopos/components"
+	"gopos/database"
+)
+
+type sqlAuditStore struct {
+	q       Querier
+	dialect database.Dialect
+}
+
+// NewSQLAuditStore returns an AuditStore that works on a database or transaction.
+// Log within the transaction of the change, so the entry is only kept with it.
+// On PostgreSQL, take transactions from Stores.Atomic, whose stores know the
+// dialect and serialise the appends.
+func NewSQLAuditStore(q Querier) AuditStore {
+	store := &sqlAuditStore{q: q}
+	if db, ok := q.(*sql.DB); ok {
+		store.dialect = database.DialectOf(db)
+	}
+	return store
+}
+
+// auditLogAttempts is how often an entry is appended when another one took its place in the chain
+const auditLogAttempts = 3
+
+// auditChainLock is the key of the PostgreSQL advisory lock held while appending to the chain
+const auditChainLock = 7268350
+
+func (s *sqlAuditStore) Log(event AuditEvent) error {
+	db, ok := s.q.(*sql.DB)
+	if !ok {
+		// Within a transaction the caller's changes are rolled back with a failed entry
+		return s.append(event)
+	}
+
+	// Reading the head of the chain and appending to it must not interleave with another entry
+	for attempt := 1; ; attempt++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		err = (&sqlAuditStore{tx, s.dialect}).append(event)
+		if err == nil {
+			err = tx.Commit()
+		}
+		tx.Rollback()
+		if !database.IsUniqueViolation(err) || attempt == auditLogAttempts {
+			return err
+		}
+	}
+}
+
+// append adds the entry after the newest one
+func (s *sqlAuditStore) append(event AuditEvent) error {
+	var changes sql.NullString
+	if len(event.Changes) > 0 {
+		encoded, err := json.Marshal(event.Changes)
+		if err != nil {
+			return err
+		}
+		changes = sql.NullString{String: string(encoded), Valid: true}
+	}
+
+	// On PostgreSQL, transactions appending at the same time would all read the
+	// same head and all but one fail on idx_audit_log_prev_hash at commit. The lock
+	// is released with the transaction. SQLite allows a single writer anyway.
+	if s.dialect == database.Postgres {
+		if _, err := s.q.Exec(fmt.Sprintf("SELECT pg_advisory_xact_lock(%d)", auditChainLock)); err != nil {
+			return err
+		}
+	}
+
+	// With all entries archived, the chain continues after the newest archive
+	var prevHash string
+	err := s.q.QueryRow("SELECT hash FROM audit_log ORDER BY id DESC LIMIT 1").Scan(&prevHash)
+	if errors.Is(err, sql.ErrNoRows) {
+		err = s.q.QueryRow("SELECT last_hash FROM audit_archives ORDER BY last_id DESC LIMIT 1").Scan(&prevHash)
+	}
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	record := database.AuditRecord{
+		UserID:     event.UserID,
+		Action:     event.Action,
+		EntityType: event.EntityType,
+		EntityID:   event.EntityID,
+		Details:    event.Details,
+		Changes:    changes.String,
+		IP:         event.IP,
+		UserAgent:  event.UserAgent,
+		CreatedAt:  database.Now(),
+	}
+
+	_, err = s.q.Exec(`
+		INSERT INTO audit_log (user_id, action, entity_type, entity_id, details, changes, ip_address, user_agent, created_at, prev_hash, hash)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, event.UserID, event.Action, nullString(event.EntityType), nullInt(event.EntityID), event.Details, changes,
+		nullString(event.IP), nullString(event.UserAgent), record.CreatedAt, prevHash, record.Hash(prevHash))
+	return err
+}
+
+// auditWhere returns the condition and arguments that select the entries of the filter
+func auditWhere(filter AuditFilter) (string, []any) {
+	where := " WHERE 1=1"
+	var args []any
+	if filter.UserID != 0 {
+		where += " AND a.user_id = ?"
+		args = append(args, filter.UserID)
+	}
+	if filter.Action != "" {
+		where += " AND a.action = ?"
+		args = append(args, filter.Action)
+	}
+	if !filter.From.IsZero() {
+		where += " AND a.created_at >= ?"
+		args = append(args, database.FormatTime(filter.From))
+	}
+	if !filter.To.IsZero() {
+		where += " AND a.created_at < ?"
+		args = append(args, database.FormatTime(filter.To))
+	}
+	if filter.Search != "" {
+		// LIKE ignores case on SQLite only
+		where += " AND LOWER(a.details) LIKE LOWER(?)"
+		args = append(args, "%"+filter.Search+"%")
+	}
+	return where, args
+}
+
+func (s *sqlAuditStore) List(filter AuditFilter, page, pageSize int) ([]components.AuditEntry, error) {
+	where, args := auditWhere(filter)
+	query := `
+		SELECT a.id, a.created_at, u.name, a.user_id, a.action, a.entity_type, a.entity_id,
+			a.details, a.changes, a.ip_address, a.user_agent, a.prev_hash, a.hash
+		FROM audit_log a
+		LEFT JOIN users u ON a.user_id = u.id` + where + `
+		ORDER BY a.created_at DESC, a.id DESC`
+	if pageSize > 0 {
+		query += " LIMIT ? OFFSET ?"
+		args = append(args, pageSize, (page-1)*pageSize)
+	}
+
+	rows, err := s.q.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []components.AuditEntry
+	for rows.Next() {
+		var entry components.AuditEntry
+		var userName, entityType, changes, ip, userAgent, prevHash, hash sql.NullString
+		var entityID sql.NullInt64
+		if err := rows.Scan(&entry.ID, &entry.CreatedAt, &userName, &entry.UserID, &entry.Action, &entityType, &entityID,
+			&entry.Details, &changes, &ip, &userAgent, &prevHash, &hash); err != nil {
+			return nil, err
+		}
+		entry.PrevHash, entry.Hash = prevHash.String, hash.String
+		entry.UserName = userName.String
+		entry.EntityType = entityType.String
+		entry.EntityID = int(entityID.Int64)
+		entry.IP = ip.String
+		entry.UserAgent = userAgent.String
+		if changes.Valid {
+			if err := json.Unmarshal([]byte(changes.String), &entry.Changes); err != nil {
+				return nil, err
+			}
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+func (s *sqlAuditStore) Count(filter AuditFilter) (int, error) {
+	where, args := auditWhere(filter)
+	var count int
+	err := s.q.QueryRow("SELECT COUNT(*) FROM audit_log a"+where, args...).Scan(&count)
+	return count, err
+}
+
+func (s *sqlAuditStore) Actions() ([]string, error) {
+	rows, err := s.q.Query("SELECT DISTINCT action FROM audit_log ORDER BY action")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var actions []string
+	for rows.Next() {
+		var action string
+		if err := rows.Scan(&action); err != nil {
+			return nil, err
+		}
+		actions = append(actions, action)
+	}
+	return actions, rows.Err()
+}
+
+// auditRowColumns are the columns scanAuditRow reads
+const auditRowColumns = "id, user_id, action, entity_type, entity_id, details, changes, ip_address, user_agent, created_at, prev_hash, hash"
+
+// scanAuditRow reads an entry selected with auditRowColumns
+func scanAuditRow(rows *sql.Rows) (AuditRow, error) {
+	var row AuditRow
+	var entityType, changes, ip, userAgent, prevHash, hash sql.NullString
+	var entityID sql.NullInt64
+	var createdAt time.Time
+	if err := rows.Scan(&row.ID, &row.UserID, &row.Action, &entityType, &entityID, &row.Details,
+		&changes, &ip, &userAgent, &createdAt, &prevHash, &hash); err != nil {
+		return AuditRow{}, err
+	}
+	row.EntityType, row.EntityID = entityType.String, int(entityID.Int64)
+	row.Changes, row.IP, row.UserAgent = changes.String, ip.String, userAgent.String
+	row.CreatedAt = database.FormatTime(createdAt)
+	row.PrevHash, row.Hash = prevHash.String, hash.String
+	return row, nil
+}
+
+func (s *sqlAuditStore) Verify() (AuditVerification, error) {
+	// After archiving, the oldest entry left is chained to the last archived one
+	var verifier chainVerifier
+	err := s.q.QueryRow("SELECT last_hash FROM audit_archives ORDER BY last_id DESC LIMIT 1").Scan(&verifier.result.LastHash)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return AuditVerification{}, err
+	}
+
+	rows, err := s.q.Query("SELECT " + auditRowColumns + " FROM audit_log ORDER BY id")
+	if err != nil {
+		return AuditVerification{}, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		row, err := scanAuditRow(rows)
+		if err != nil {
+			return AuditVerification{}, err
+		}
+		verifier.check(row.ID, row.AuditRecord, row.PrevHash, row.Hash)
+	}
+	return verifier.result, rows.Err()
+}
+
+func (s *sqlAuditStore) Rows(before time.Time) ([]AuditRow, error) {
+	// Entries are only ever removed from the start of the chain, so an older
+	// entry after a newer one is kept until the newer one is old enough too
+	rows, err := s.q.Query(`
+		SELECT `+auditRowColumns+` FROM audit_log
+		WHERE id < COALESCE(
+			(SELECT MIN(id) FROM audit_log WHERE created_at >= ?),
+			(SELECT MAX(id) FROM audit_log) + 1
+		)
+		ORDER BY id
+	`, database.FormatTime(before))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []AuditRow
+	for rows.Next() {
+		row, err := scanAuditRow(rows)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, row)
+	}
+	return result, rows.Err()
+}
+
+func (s *sqlAuditStore) Archive(archive components.AuditArchive) error {
+	var first sql.NullInt64
+	if err := s.q.QueryRow("SELECT MIN(id) FROM audit_log").Scan(&first); err != nil {
+		return err
+	}
+	if int(first.Int64) != archive.FirstID {
+		return fmt.Errorf("archive starts at entry %d, but the oldest entry is %d", archive.FirstID, first.Int64)
+	}
+	result, err := s.q.Exec("DELETE FROM audit_log WHERE id <= ?", archive.LastID)
+	if err != nil {
+		return err
+	}
+	if deleted, err := result.RowsAffected(); err != nil {
+		return err
+	} else if int(deleted) != archive.Entries {
+		return fmt.Errorf("archive holds %d entries, but %d were deleted", archive.Entries, deleted)
+	}
+
+	_, err = s.q.Exec(`
+		INSERT INTO audit_archives (name, first_id, last_id, entries, first_prev_hash, last_hash, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`, archive.Name, archive.FirstID, archive.LastID, archive.Entries, archive.FirstPrevHash, archive.LastHash,
+		database.FormatTime(archive.CreatedAt))
+	if database.IsUniqueViolation(err) {
+		return ErrDuplicate
+	}
+	return err
+}
+
+func (s *sqlAuditStore) Archives() ([]components.AuditArchive, error) {
+	rows, err := s.q.Query(`
+		SELECT name, first_id, last_id, entries, first_prev_hash, last_hash, created_at
+		FROM audit_archives
+		ORDER BY last_id
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var archives []components.AuditArchive
+	for rows.Next() {
+		var archive components.AuditArchive
+		if err := rows.Scan(&archive.Name, &archive.FirstID, &archive.LastID, &archive.Entries,
+			&archive.FirstPrevHash, &archive.LastHash, &archive.CreatedAt); err != nil {
+			return nil, err
+		}
+		archives = append(archives, archive)
+	}
+	return archives, rows.Err()
+}
+
+func (s *sqlAuditStore) Hash(id int) (string, error) {
+	var hash sql.NullString
+	err := s.q.QueryRow("SELECT hash FROM audit_log WHERE id = ?", id).Scan(&hash)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrNotFound
+	}
+	return hash.String, err
+}
+
+// nullString stores an empty string as NULL
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
+// nullInt stores 0 as NULL
+func nullInt(i int) sql.NullInt64 {
+	return sql.NullInt64{Int64: int64(i), Valid: i != 0}
+}
+
+// chainVerifier checks the entries of the audit log one after the other, oldest first
+type chainVerifier struct {
+	result AuditVerification
+}
+
+func (v *chainVerifier) check(id int, record database.AuditRecord, prevHash, hash string) {
+	v.result.Entries++
+	if v.result.BrokenID == 0 {
+		switch {
+		case prevHash != v.result.LastHash:
+			v.result.BrokenID, v.result.Problem = id, AuditUnlinked
+		case record.Hash(prevHash) != hash:
+			v.result.BrokenID, v.result.Problem = id, AuditModified
+		}
+	}
+	v.result.LastID, v.result.LastHash = id, hash
+}
@@ -0,0 +1,278 @@
+package repository
+
+import (
+	"database/sql"
+
+	"gopos/database"
+	"gopos/models"
+)
+
+type sqlCartStore struct {
+	q Querier
+}
+
+// NewSQLCartStore returns a CartStore that works on a database or transaction
+func NewSQLCartStore(q Querier) CartStore {
+	return &sqlCartStore{q}
+}
+
+func (s *sqlCartStore) Open(register string, cashierID int) (*models.Cart, error) {
+	var id int64
+	err := s.q.QueryRow(`
+		SELECT id FROM carts
+		WHERE register = ? AND status = 'open'
+		ORDER BY updated_at DESC
+		LIMIT 1
+	`, register).Scan(&id)
+	if err == sql.ErrNoRows {
+		now := database.Now()
+		err = s.q.QueryRow(`
+			INSERT INTO carts (register, cashier_id, created_at, updated_at)
+			VALUES (?, ?, ?, ?)
+			RETURNING id
+		`, register, cashierID, now, now).Scan(&id)
+		if err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	}
+
+	return s.Get(id)
+}
+
+func (s *sqlCartStore) Get(id int64) (*models.Cart, error) {
+	var cart models.Cart
+	var customerID sql.NullInt64
+	err := s.q.QueryRow(`
+		SELECT c.id, c.register, c.cashier_id, u.name, c.customer_id, c.status, c.updated_at
+		FROM carts c
+		JOIN users u ON u.id = c.cashier_id
+		WHERE c.id = ?
+	`, id).Scan(&cart.ID, &cart.Register, &cart.CashierID, &cart.CashierName, &customerID, &cart.Status, &cart.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	if customerID.Valid {
+		var customer models.CartCustomer
+		err := s.q.QueryRow(`
+			SELECT id, card_number, name, balance FROM users WHERE id = ?
+		`, customerID.Int64).Scan(&customer.ID, &customer.CardNumber, &customer.Name, &customer.Balance)
+		if err != nil && err != sql.ErrNoRows {
+			return nil, err
+		}
+		if err == nil {
+			cart.Customer = &customer
+		}
+	}
+
+	rows, err := s.q.Query(`
+		SELECT p.id, p.name, p.price, ci.quantity
+		FROM cart_items ci
+		JOIN products p ON p.id = ci.product_id
+		WHERE ci.cart_id = ?
+		ORDER BY ci.position
+	`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	cart.Items = []models.CartItem{}
+	for rows.Next() {
+		var item models.CartItem
+		if err := rows.Scan(&item.ProductID, &item.Name, &item.Price, &item.Quantity); err != nil {
+			return nil, err
+		}
+		cart.Items = append(cart.Items, item)
+		cart.Total += item.Price * float64(item.Quantity)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return &cart, nil
+}
+
+func (s *sqlCartStore) ListOpen() ([]models.Cart, error) {
+	rows, err := s.q.Query(`
+		SELECT id FROM carts WHERE status = 'open' ORDER BY updated_at DESC
+	`)
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	carts := []models.Cart{}
+	for _, id := range ids {
+		cart, err := s.Get(id)
+		if err != nil {
+			return nil, err
+		}
+		carts = append(carts, *cart)
+	}
+	return carts, nil
+}
+
+func (s *sqlCartStore) AddItem(cartID int64, barcode string) error {
+	if err := s.touch(cartID); err != nil {
+		return err
+	}
+
+	var productID int64
+	if err := s.q.QueryRow("SELECT id FROM products WHERE barcode = ?", barcode).Scan(&productID); err != nil {
+		return err
+	}
+
+	_, err := s.q.Exec(`
+		INSERT INTO cart_items (cart_id, product_id, quantity, added_at, position)
+		VALUES (?1, ?2, 1, ?3, (SELECT COALESCE(MAX(position), 0) + 1 FROM cart_items WHERE cart_id = ?1))
+		ON CONFLICT (cart_id, product_id) DO UPDATE SET quantity = cart_items.quantity + 1
+	`, cartID, productID, database.Now())
+	return err
+}
+
+func (s *sqlCartStore) SetQuantity(cartID, productID int64, quantity int) error {
+	if err := s.touch(cartID); err != nil {
+		return err
+	}
+
+	if quantity <= 0 {
+		_, err := s.q.Exec("DELETE FROM cart_items WHERE cart_id = ? AND product_id = ?", cartID, productID)
+		return err
+	}
+	_, err := s.q.Exec("UPDATE cart_items SET quantity = ? WHERE cart_id = ? AND product_id = ?", quantity, cartID, productID)
+	return err
+}
+
+func (s *sqlCartStore) SetCustomer(cartID int64, cardNumber string) error {
+	if err := s.touch(cartID); err != nil {
+		return err
+	}
+
+	var customerID sql.NullInt64
+	if cardNumber != "" {
+		if err := s.q.QueryRow("SELECT id FROM users WHERE card_number = ? AND deactivated_at IS NULL", cardNumber).Scan(&customerID); err != nil {
+			return err
+		}
+	}
+	_, err := s.q.Exec("UPDATE carts SET customer_id = ? WHERE id = ?", customerID, cartID)
+	return err
+}
+
+func (s *sqlCartStore) TakeOver(cartID int64, register string, cashierID int) error {
+	if err := s.touch(cartID); err != nil {
+		return err
+	}
+
+	var filled int
+	err := s.q.QueryRow(`
+		SELECT COUNT(*) FROM carts c
+		WHERE c.register = ? AND c.status = 'open' AND c.id != ?
+		AND (c.customer_id IS NOT NULL OR EXISTS (SELECT 1 FROM cart_items ci WHERE ci.cart_id = c.id))
+	`, register, cartID).Scan(&filled)
+	if err != nil {
+		return err
+	}
+	if filled > 0 {
+		return ErrRegisterBusy
+	}
+
+	_, err = s.q.Exec(`
+		UPDATE carts SET status = 'discarded', updated_at = ?
+		WHERE register = ? AND status = 'open' AND id != ?
+	`, database.Now(), register, cartID)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.q.Exec("UPDATE carts SET register = ?, cashier_id = ? WHERE id = ?", register, cashierID, cartID)
+	return err
+}
+
+func (s *sqlCartStore) Discard(cartID int64) error {
+	if err := s.touch(cartID); err != nil {
+		return err
+	}
+
+	_, err := s.q.Exec("UPDATE carts SET status = 'discarded' WHERE id = ?", cartID)
+	return err
+}
+
+func (s *sqlCartStore) Complete(cart *models.Cart, transactionID int) error {
+	result, err := s.q.Exec(`
+		UPDATE carts SET status = 'completed', transaction_id = ?, updated_at = ?
+		WHERE id = ? AND status = 'open'
+	`, transactionID, database.Now(), cart.ID)
+	if database.IsForeignKeyError(err) {
+		return ErrNotFound
+	} else if err != nil {
+		return err
+	}
+	if rows, _ := result.RowsAffected(); rows != 1 {
+		return ErrCartNotOpen
+	}
+
+	// Changes wait for the update above, so the cart cannot change after this read
+	current, err := s.Get(cart.ID)
+	if err != nil {
+		return err
+	}
+	if !sameCartContents(cart, current) {
+		return ErrCartChanged
+	}
+	return nil
+}
+
+// touch marks an open cart as updated. Run first in a change, the update also
+// takes the write lock, so the cart cannot change or be completed meanwhile.
+func (s *sqlCartStore) touch(cartID int64) error {
+	result, err := s.q.Exec(`
+		UPDATE carts SET updated_at = ? WHERE id = ? AND status = 'open'
+	`, database.Now(), cartID)
+	if err != nil {
+		return err
+	}
+	if rows, _ := result.RowsAffected(); rows == 1 {
+		return nil
+	}
+
+	var status string
+	err = s.q.QueryRow("SELECT status FROM carts WHERE id = ?", cartID).Scan(&status)
+	if err == sql.ErrNoRows {
+		return ErrCartNotFound
+	} else if err != nil {
+		return err
+	}
+	return ErrCartNotOpen
+}
+
+// sameCartContents reports whether two carts charge the same customer for the same items at the same prices
+func sameCartContents(a, b *models.Cart) bool {
+	if (a.Customer == nil) != (b.Customer == nil) || (a.Customer != nil && a.Customer.ID != b.Customer.ID) {
+		return false
+	}
+	if len(a.Items) != len(b.Items) {
+		return false
+	}
+	for i := range a.Items {
+		if a.Items[i].ProductID != b.Items[i].ProductID || a.Items[i].Quantity != b.Items[i].Quantity || a.Items[i].Price != b.Items[i].Price {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,991 @@
+package repository
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gopos/components"
+	"gopos/database"
+	"gopos/models"
+)
+
+// Memory keeps users, products, transactions, carts and the audit log in memory. It
+// behaves like the SQL stores and is meant for tests.
+type Memory struct {
+	mu    sync.Mutex
+	state memoryState
+}
+
+type memoryState struct {
+	users        []components.User
+	products     []components.Product
+	transactions []memoryTransaction
+	sales        []memorySale
+	carts        []memoryCart
+	audit        []components.AuditEntry
+	archives     []components.AuditArchive
+	nextID       int
+	auditID      int // Entries keep counting after the oldest were archived
+}
+
+type memoryTransaction struct {
+	userID     int
+	cashierID  int
+	productIDs []int
+	components.Transaction
+}
+
+// memorySale keeps what RecordSale was given, to answer SaleByKey
+type memorySale struct {
+	id int
+	Sale
+}
+
+type memoryCart struct {
+	id         int64
+	register   string
+	cashierID  int
+	customerID int // 0 without a customer
+	status     string
+	items      []memoryCartItem // In the order they were added
+	updatedAt  time.Time
+}
+
+type memoryCartItem struct {
+	productID int
+	quantity  int
+}
+
+// NewMemory returns an empty in-memory database
+func NewMemory() *Memory {
+	return &Memory{}
+}
+
+// Stores returns the stores of the in-memory database
+func (m *Memory) Stores() Stores {
+	return Stores{
+		Users:        memoryUsers{m},
+		Products:     memoryProducts{m},
+		Transactions: memoryTransactions{m},
+		Carts:        memoryCarts{m},
+		Audit:        memoryAudit{m},
+		atomic:       m.atomic,
+	}
+}
+
+// AddTransaction records a sale of the given products, so tests can set up
+// history. Customer and cashier names are taken from the stored users.
+func (m *Memory) AddTransaction(userID, cashierID int, productIDs []int, t components.Transaction) components.Transaction {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	t.ID = m.state.id()
+	if t.CreatedAt.IsZero() {
+		t.CreatedAt = now()
+	}
+	if user := m.state.user(userID); user != nil {
+		t.UserName = user.Name
+	}
+	if cashier := m.state.user(cashierID); cashier != nil {
+		t.CashierName = cashier.Name
+	}
+	m.state.transactions = append(m.state.transactions, memoryTransaction{userID, cashierID, productIDs, t})
+	return t
+}
+
+// atomic works on a copy of the state and keeps it only if fn succeeds. The
+// lock is not held while fn runs, as the stores take it for every call.
+func (m *Memory) atomic(fn func(Stores) error) error {
+	m.mu.Lock()
+	saved := m.state.clone()
+	m.mu.Unlock()
+
+	if err := fn(m.Stores()); err != nil {
+		m.mu.Lock()
+		m.state = saved
+		m.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+func (s *memoryState) clone() memoryState {
+	c := *s
+	c.users = append([]components.User(nil), s.users...)
+	c.products = append([]components.Product(nil), s.products...)
+	c.transactions = append([]memoryTransaction(nil), s.transactions...)
+	c.sales = append([]memorySale(nil), s.sales...)
+	c.carts = append([]memoryCart(nil), s.carts...)
+	for i := range c.carts {
+		c.carts[i].items = append([]memoryCartItem(nil), c.carts[i].items...)
+	}
+	c.audit = append([]components.AuditEntry(nil), s.audit...)
+	c.archives = append([]components.AuditArchive(nil), s.archives...)
+	return c
+}
+
+func (s *memoryState) id() int {
+	s.nextID++
+	return s.nextID
+}
+
+func (s *memoryState) user(id int) *components.User {
+	for i := range s.users {
+		if s.users[i].ID == id {
+			return &s.users[i]
+		}
+	}
+	return nil
+}
+
+func (s *memoryState) product(id int) *components.Product {
+	for i := range s.products {
+		if s.products[i].ID == id {
+			return &s.products[i]
+		}
+	}
+	return nil
+}
+
+// now matches the precision timestamps are stored with in the database
+func now() time.Time {
+	return time.Now().UTC().Truncate(time.Second)
+}
+
+func containsFold(s, substr string) bool {
+	return strings.Contains(strings.ToLower(s), strings.ToLower(substr))
+}
+
+type memoryUsers struct{ m *Memory }
+
+func (s memoryUsers) Get(id int) (*components.User, error) {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+
+	user := s.m.state.user(id)
+	if user == nil {
+		return nil, ErrNotFound
+	}
+	u := *user
+	return &u, nil
+}
+
+func (s memoryUsers) GetByCardNumber(cardNumber string) (*components.User, error) {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+
+	for _, user := range s.m.state.users {
+		if user.CardNumber == cardNumber {
+			return &user, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (s memoryUsers) List(filter UserFilter) ([]components.User, error) {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+
+	var users []components.User
+	for _, user := range s.m.state.users {
+		if filter.Search != "" && !containsFold(user.Name, filter.Search) && !containsFold(user.CardNumber, filter.Search) {
+			continue
+		}
+		if filter.Role != "" && user.Role != filter.Role {
+			continue
+		}
+		if filter.Status == UserActive && !user.Active() || filter.Status == UserInactive && user.Active() {
+			continue
+		}
+		users = append(users, user)
+	}
+
+	switch filter.Sort {
+	case "name":
+		sort.SliceStable(users, func(i, j int) bool { return users[i].Name < users[j].Name })
+	case "balance":
+		sort.SliceStable(users, func(i, j int) bool { return users[i].Balance > users[j].Balance })
+	default:
+		sort.SliceStable(users, func(i, j int) bool { return users[i].CreatedAt.After(users[j].CreatedAt) })
+	}
+	return users, nil
+}
+
+func (s memoryUsers) Create(user *components.User) error {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+
+	for _, other := range s.m.state.users {
+		if other.CardNumber == user.CardNumber {
+			return ErrDuplicate
+		}
+	}
+	user.ID = s.m.state.id()
+	user.CreatedAt = now()
+	s.m.state.users = append(s.m.state.users, *user)
+	return nil
+}
+
+func (s memoryUsers) Update(user *components.User) error {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+
+	for _, other := range s.m.state.users {
+		if other.CardNumber == user.CardNumber && other.ID != user.ID {
+			return ErrDuplicate
+		}
+	}
+	stored := s.m.state.user(user.ID)
+	if stored == nil {
+		return ErrNotFound
+	}
+	stored.CardNumber = user.CardNumber
+	stored.Name = user.Name
+	stored.Role = user.Role
+	stored.Email = user.Email
+	return nil
+}
+
+func (s memoryUsers) Delete(id int) error {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+
+	for _, t := range s.m.state.transactions {
+		if t.userID == id || t.cashierID == id {
+			return ErrInUse
+		}
+	}
+	for _, entry := range s.m.state.audit {
+		if entry.UserID == id {
+			return ErrInUse
+		}
+	}
+	for i, user := range s.m.state.users {
+		if user.ID == id {
+			s.m.state.users = append(s.m.state.users[:i:i], s.m.state.users[i+1:]...)
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+func (s memoryUsers) AdjustBalance(id int, amount float64) (float64, error) {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+
+	user := s.m.state.user(id)
+	if user == nil {
+		return 0, ErrNotFound
+	}
+	if amount < 0 && user.Balance < -amount {
+		return 0, ErrInsufficientBalance
+	}
+	user.Balance += amount
+	return user.Balance, nil
+}
+
+func (s memoryUsers) Deactivate(id int) error {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+
+	user := s.m.state.user(id)
+	if user == nil {
+		return ErrNotFound
+	}
+	if user.Active() {
+		user.DeactivatedAt = now()
+	}
+	return nil
+}
+
+func (s memoryUsers) Reactivate(id int) error {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+
+	user := s.m.state.user(id)
+	if user == nil {
+		return ErrNotFound
+	}
+	if user.Anonymized() {
+		return ErrAnonymized
+	}
+	user.DeactivatedAt = time.Time{}
+	return nil
+}
+
+func (s memoryUsers) Anonymize(id int, pseudonym string) error {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+
+	for _, other := range s.m.state.users {
+		if other.CardNumber == pseudonym && other.ID != id {
+			return ErrDuplicate
+		}
+	}
+	user := s.m.state.user(id)
+	if user == nil {
+		return ErrNotFound
+	}
+	user.Name, user.CardNumber, user.Email = pseudonym, pseudonym, ""
+	user.AnonymizedAt = now()
+	if user.Active() {
+		user.DeactivatedAt = user.AnonymizedAt
+	}
+	return nil
+}
+
+type memoryProducts struct{ m *Memory }
+
+func (s memoryProducts) Get(id int) (*components.Product, error) {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+
+	product := s.m.state.product(id)
+	if product == nil {
+		return nil, ErrNotFound
+	}
+	p := *product
+	return &p, nil
+}
+
+func (s memoryProducts) GetByBarcode(barcode string) (*components.Product, error) {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+
+	for _, product := range s.m.state.products {
+		if product.Barcode == barcode {
+			return &product, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (s memoryProducts) List(filter ProductFilter) ([]components.Product, error) {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+
+	var products []components.Product
+	for _, product := range s.m.state.products {
+		if filter.Search != "" && !containsFold(product.Name, filter.Search) && !containsFold(product.Barcode, filter.Search) {
+			continue
+		}
+		products = append(products, product)
+	}
+
+	switch filter.Sort {
+	case "name":
+		sort.SliceStable(products, func(i, j int) bool { return products[i].Name < products[j].Name })
+	case "price":
+		sort.SliceStable(products, func(i, j int) bool { return products[i].Price < products[j].Price })
+	default:
+		sort.SliceStable(products, func(i, j int) bool { return products[i].CreatedAt.After(products[j].CreatedAt) })
+	}
+	return products, nil
+}
+
+func (s memoryProducts) Create(product *components.Product) error {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+
+	for _, other := range s.m.state.products {
+		if other.Barcode == product.Barcode {
+			return ErrDuplicate
+		}
+	}
+	product.ID = s.m.state.id()
+	product.CreatedAt = now()
+	s.m.state.products = append(s.m.state.products, *product)
+	return nil
+}
+
+func (s memoryProducts) Update(product *components.Product) error {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+
+	for _, other := range s.m.state.products {
+		if other.Barcode == product.Barcode && other.ID != product.ID {
+			return ErrDuplicate
+		}
+	}
+	stored := s.m.state.product(product.ID)
+	if stored == nil {
+		return ErrNotFound
+	}
+	stored.Barcode = product.Barcode
+	stored.Name = product.Name
+	stored.Price = product.Price
+	return nil
+}
+
+func (s memoryProducts) Delete(id int) error {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+
+	for _, t := range s.m.state.transactions {
+		for _, productID := range t.productIDs {
+			if productID == id {
+				return ErrInUse
+			}
+		}
+	}
+	for i, product := range s.m.state.products {
+		if product.ID == id {
+			s.m.state.products = append(s.m.state.products[:i:i], s.m.state.products[i+1:]...)
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+type memoryTransactions struct{ m *Memory }
+
+func (s memoryTransactions) Record(booking Booking) (int, error) {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+
+	if s.m.state.user(booking.UserID) == nil || s.m.state.user(booking.CashierID) == nil {
+		return 0, ErrNotFound
+	}
+	t := components.Transaction{ID: s.m.state.id(), Total: booking.Total, CreatedAt: now()}
+	s.m.state.transactions = append(s.m.state.transactions, memoryTransaction{booking.UserID, booking.CashierID, nil, t})
+	return t.ID, nil
+}
+
+func (s memoryTransactions) RecordSale(sale Sale) (int, error) {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+
+	if s.m.state.user(sale.UserID) == nil || s.m.state.user(sale.CashierID) == nil {
+		return 0, ErrNotFound
+	}
+	if sale.IdempotencyKey != "" {
+		for _, recorded := range s.m.state.sales {
+			if recorded.IdempotencyKey == sale.IdempotencyKey {
+				return 0, ErrDuplicate
+			}
+		}
+	}
+
+	t := components.Transaction{ID: s.m.state.id(), Total: sale.Total, CreatedAt: now()}
+	var productIDs []int
+	for _, item := range sale.Items {
+		product := s.m.state.product(item.ProductID)
+		if product == nil {
+			return 0, ErrNotFound
+		}
+		productIDs = append(productIDs, item.ProductID)
+		t.Items = append(t.Items, components.TransactionItem{ProductName: product.Name, Quantity: item.Quantity, Price: item.Price})
+	}
+	sort.SliceStable(t.Items, func(i, j int) bool { return t.Items[i].ProductName < t.Items[j].ProductName })
+
+	sale.Items = append([]SaleItem(nil), sale.Items...)
+	s.m.state.transactions = append(s.m.state.transactions, memoryTransaction{sale.UserID, sale.CashierID, productIDs, t})
+	s.m.state.sales = append(s.m.state.sales, memorySale{t.ID, sale})
+	return t.ID, nil
+}
+
+func (s memoryTransactions) SaleByKey(idempotencyKey string) (int, *Sale, error) {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+
+	for _, recorded := range s.m.state.sales {
+		if recorded.IdempotencyKey == idempotencyKey {
+			sale := recorded.Sale
+			sale.Items = append([]SaleItem(nil), sale.Items...)
+			return recorded.id, &sale, nil
+		}
+	}
+	return 0, nil, ErrNotFound
+}
+
+func (s memoryTransactions) ListForUser(userID, limit int) ([]components.Transaction, error) {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+
+	var transactions []components.Transaction
+	for _, t := range s.m.state.transactions {
+		if t.userID == userID {
+			// Names are joined when read, like in the database, so anonymized users show their pseudonym
+			if user := s.m.state.user(t.userID); user != nil {
+				t.UserName = user.Name
+			}
+			if cashier := s.m.state.user(t.cashierID); cashier != nil {
+				t.CashierName = cashier.Name
+			}
+			transactions = append(transactions, t.Transaction)
+		}
+	}
+	sort.SliceStable(transactions, func(i, j int) bool {
+		return transactions[i].CreatedAt.After(transactions[j].CreatedAt)
+	})
+	if len(transactions) > limit {
+		transactions = transactions[:limit]
+	}
+	return transactions, nil
+}
+
+func (s memoryTransactions) CountForUser(userID int) (int, error) {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+
+	count := 0
+	for _, t := range s.m.state.transactions {
+		if t.userID == userID || t.cashierID == userID {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (s memoryTransactions) CountForProduct(productID int) (int, error) {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+
+	count := 0
+	for _, t := range s.m.state.transactions {
+		for _, id := range t.productIDs {
+			if id == productID {
+				count++
+			}
+		}
+	}
+	return count, nil
+}
+
+type memoryCarts struct{ m *Memory }
+
+func (s memoryCarts) Open(register string, cashierID int) (*models.Cart, error) {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+
+	var open *memoryCart
+	for i := range s.m.state.carts {
+		cart := &s.m.state.carts[i]
+		if cart.register == register && cart.status == "open" && (open == nil || !cart.updatedAt.Before(open.updatedAt)) {
+			open = cart
+		}
+	}
+	if open == nil {
+		if s.m.state.user(cashierID) == nil {
+			return nil, ErrNotFound
+		}
+		s.m.state.carts = append(s.m.state.carts, memoryCart{
+			id:        int64(s.m.state.id()),
+			register:  register,
+			cashierID: cashierID,
+			status:    "open",
+			updatedAt: now(),
+		})
+		open = &s.m.state.carts[len(s.m.state.carts)-1]
+	}
+	return s.m.state.cartModel(open), nil
+}
+
+func (s memoryCarts) Get(id int64) (*models.Cart, error) {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+
+	cart := s.m.state.cart(id)
+	if cart == nil {
+		return nil, ErrNotFound
+	}
+	return s.m.state.cartModel(cart), nil
+}
+
+func (s memoryCarts) ListOpen() ([]models.Cart, error) {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+
+	carts := []models.Cart{}
+	for i := range s.m.state.carts {
+		if s.m.state.carts[i].status == "open" {
+			carts = append(carts, *s.m.state.cartModel(&s.m.state.carts[i]))
+		}
+	}
+	sort.SliceStable(carts, func(i, j int) bool {
+		return carts[i].UpdatedAt.After(carts[j].UpdatedAt)
+	})
+	return carts, nil
+}
+
+func (s memoryCarts) AddItem(cartID int64, barcode string) error {
+	return s.change(cartID, func(cart *memoryCart) error {
+		productID := 0
+		for _, product := range s.m.state.products {
+			if product.Barcode == barcode {
+				productID = product.ID
+			}
+		}
+		if productID == 0 {
+			return ErrNotFound
+		}
+
+		for i := range cart.items {
+			if cart.items[i].productID == productID {
+				cart.items[i].quantity++
+				return nil
+			}
+		}
+		cart.items = append(cart.items, memoryCartItem{productID, 1})
+		return nil
+	})
+}
+
+func (s memoryCarts) SetQuantity(cartID, productID int64, quantity int) error {
+	return s.change(cartID, func(cart *memoryCart) error {
+		for i := range cart.items {
+			if int64(cart.items[i].productID) != productID {
+				continue
+			}
+			if quantity <= 0 {
+				cart.items = append(cart.items[:i:i], cart.items[i+1:]...)
+			} else {
+				cart.items[i].quantity = quantity
+			}
+			break
+		}
+		return nil
+	})
+}
+
+func (s memoryCarts) SetCustomer(cartID int64, cardNumber string) error {
+	return s.change(cartID, func(cart *memoryCart) error {
+		if cardNumber == "" {
+			cart.customerID = 0
+			return nil
+		}
+		for _, user := range s.m.state.users {
+			if user.CardNumber == cardNumber && user.Active() {
+				cart.customerID = user.ID
+				return nil
+			}
+		}
+		return ErrNotFound
+	})
+}
+
+func (s memoryCarts) TakeOver(cartID int64, register string, cashierID int) error {
+	return s.change(cartID, func(cart *memoryCart) error {
+		if s.m.state.user(cashierID) == nil {
+			return ErrNotFound
+		}
+		for i := range s.m.state.carts {
+			other := &s.m.state.carts[i]
+			if other.id != cartID && other.register == register && other.status == "open" && (other.customerID != 0 || len(other.items) > 0) {
+				return ErrRegisterBusy
+			}
+		}
+		for i := range s.m.state.carts {
+			other := &s.m.state.carts[i]
+			if other.id != cartID && other.register == register && other.status == "open" {
+				other.status = "discarded"
+				other.updatedAt = now()
+			}
+		}
+		cart.register = register
+		cart.cashierID = cashierID
+		return nil
+	})
+}
+
+func (s memoryCarts) Discard(cartID int64) error {
+	return s.change(cartID, func(cart *memoryCart) error {
+		cart.status = "discarded"
+		return nil
+	})
+}
+
+func (s memoryCarts) Complete(charged *models.Cart, transactionID int) error {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+
+	cart := s.m.state.cart(charged.ID)
+	if cart == nil || cart.status != "open" {
+		return ErrCartNotOpen
+	}
+	if !sameCartContents(charged, s.m.state.cartModel(cart)) {
+		return ErrCartChanged
+	}
+	recorded := false
+	for _, t := range s.m.state.transactions {
+		recorded = recorded || t.ID == transactionID
+	}
+	if !recorded {
+		return ErrNotFound
+	}
+	cart.status = "completed"
+	cart.updatedAt = now()
+	return nil
+}
+
+// change applies a change to an open cart and marks it as updated
+func (s memoryCarts) change(cartID int64, change func(cart *memoryCart) error) error {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+
+	cart := s.m.state.cart(cartID)
+	if cart == nil {
+		return ErrCartNotFound
+	}
+	if cart.status != "open" {
+		return ErrCartNotOpen
+	}
+	if err := change(cart); err != nil {
+		return err
+	}
+	cart.updatedAt = now()
+	return nil
+}
+
+func (s *memoryState) cart(id int64) *memoryCart {
+	for i := range s.carts {
+		if s.carts[i].id == id {
+			return &s.carts[i]
+		}
+	}
+	return nil
+}
+
+// cartModel returns a cart with the names, balances and prices stored now, like a join in the database
+func (s *memoryState) cartModel(cart *memoryCart) *models.Cart {
+	c := &models.Cart{
+		ID:        cart.id,
+		Register:  cart.register,
+		CashierID: int64(cart.cashierID),
+		Items:     []models.CartItem{},
+		Status:    cart.status,
+		UpdatedAt: cart.updatedAt,
+	}
+	if cashier := s.user(cart.cashierID); cashier != nil {
+		c.CashierName = cashier.Name
+	}
+	if customer := s.user(cart.customerID); customer != nil {
+		c.Customer = &models.CartCustomer{
+			ID:         int64(customer.ID),
+			CardNumber: customer.CardNumber,
+			Name:       customer.Name,
+			Balance:    customer.Balance,
+		}
+	}
+	for _, item := range cart.items {
+		product := s.product(item.productID)
+		if product == nil {
+			continue
+		}
+		c.Items = append(c.Items, models.CartItem{
+			ProductID: int64(product.ID),
+			Name:      product.Name,
+			Price:     product.Price,
+			Quantity:  item.quantity,
+		})
+		c.Total += product.Price * float64(item.quantity)
+	}
+	return c
+}
+
+type memoryAudit struct{ m *Memory }
+
+func (s memoryAudit) Log(event AuditEvent) error {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+
+	s.m.state.auditID++
+	entry := components.AuditEntry{
+		ID:         s.m.state.auditID,
+		CreatedAt:  now(),
+		UserID:     event.UserID,
+		Action:     event.Action,
+		EntityType: event.EntityType,
+		EntityID:   event.EntityID,
+		Details:    event.Details,
+		Changes:    maps.Clone(event.Changes),
+		IP:         event.IP,
+		UserAgent:  event.UserAgent,
+	}
+	entry.PrevHash = s.head()
+	record, err := auditRecord(entry)
+	if err != nil {
+		return err
+	}
+	entry.Hash = record.Hash(entry.PrevHash)
+	s.m.state.audit = append(s.m.state.audit, entry)
+	return nil
+}
+
+// head returns the hash of the newest entry, archived or not. The caller holds the lock.
+func (s memoryAudit) head() string {
+	if n := len(s.m.state.audit); n > 0 {
+		return s.m.state.audit[n-1].Hash
+	}
+	if n := len(s.m.state.archives); n > 0 {
+		return s.m.state.archives[n-1].LastHash
+	}
+	return ""
+}
+
+// auditRecord returns the hashed content of an entry
+func auditRecord(entry components.AuditEntry) (database.AuditRecord, error) {
+	var changes []byte
+	if len(entry.Changes) > 0 {
+		var err error
+		if changes, err = json.Marshal(entry.Changes); err != nil {
+			return database.AuditRecord{}, err
+		}
+	}
+	return database.AuditRecord{
+		UserID:     entry.UserID,
+		Action:     entry.Action,
+		EntityType: entry.EntityType,
+		EntityID:   entry.EntityID,
+		Details:    entry.Details,
+		Changes:    string(changes),
+		IP:         entry.IP,
+		UserAgent:  entry.UserAgent,
+		CreatedAt:  database.FormatTime(entry.CreatedAt),
+	}, nil
+}
+
+// matching returns the entries of the filter, newest first. The caller holds the lock.
+func (s memoryAudit) matching(filter AuditFilter) []components.AuditEntry {
+	// Entries are kept in the order they were logged, so the newest is last
+	var entries []components.AuditEntry
+	for i := len(s.m.state.audit) - 1; i >= 0; i-- {
+		entry := s.m.state.audit[i]
+		switch {
+		case filter.UserID != 0 && entry.UserID != filter.UserID,
+			filter.Action != "" && entry.Action != filter.Action,
+			!filter.From.IsZero() && entry.CreatedAt.Before(filter.From),
+			!filter.To.IsZero() && !entry.CreatedAt.Before(filter.To),
+			filter.Search != "" && !containsFold(entry.Details, filter.Search):
+			continue
+		}
+		if user := s.m.state.user(entry.UserID); user != nil {
+			entry.UserName = user.Name
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func (s memoryAudit) List(filter AuditFilter, page, pageSize int) ([]components.AuditEntry, error) {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+
+	entries := s.matching(filter)
+	if pageSize <= 0 {
+		return entries, nil
+	}
+	offset := (page - 1) * pageSize
+	if offset >= len(entries) {
+		return nil, nil
+	}
+	return entries[offset:min(offset+pageSize, len(entries))], nil
+}
+
+func (s memoryAudit) Count(filter AuditFilter) (int, error) {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+
+	return len(s.matching(filter)), nil
+}
+
+func (s memoryAudit) Actions() ([]string, error) {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+
+	seen := map[string]bool{}
+	var actions []string
+	for _, entry := range s.m.state.audit {
+		if !seen[entry.Action] {
+			seen[entry.Action] = true
+			actions = append(actions, entry.Action)
+		}
+	}
+	sort.Strings(actions)
+	return actions, nil
+}
+
+func (s memoryAudit) Verify() (AuditVerification, error) {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+
+	var verifier chainVerifier
+	if n := len(s.m.state.archives); n > 0 {
+		verifier.result.LastHash = s.m.state.archives[n-1].LastHash
+	}
+	for _, entry := range s.m.state.audit {
+		record, err := auditRecord(entry)
+		if err != nil {
+			return AuditVerification{}, err
+		}
+		verifier.check(entry.ID, record, entry.PrevHash, entry.Hash)
+	}
+	return verifier.result, nil
+}
+
+func (s memoryAudit) Hash(id int) (string, error) {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+
+	for _, entry := range s.m.state.audit {
+		if entry.ID == id {
+			return entry.Hash, nil
+		}
+	}
+	return "", ErrNotFound
+}
+
+func (s memoryAudit) Rows(before time.Time) ([]AuditRow, error) {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+
+	var rows []AuditRow
+	for _, entry := range s.m.state.audit {
+		if !entry.CreatedAt.Before(before) {
+			break
+		}
+		record, err := auditRecord(entry)
+		if err != nil {
+			return nil, err
+		}
+		rows = append(rows, AuditRow{ID: entry.ID, AuditRecord: record, PrevHash: entry.PrevHash, Hash: entry.Hash})
+	}
+	return rows, nil
+}
+
+func (s memoryAudit) Archive(archive components.AuditArchive) error {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+
+	audit := s.m.state.audit
+	if len(audit) == 0 || audit[0].ID != archive.FirstID {
+		return fmt.Errorf("archive starts at entry %d, which is not the oldest", archive.FirstID)
+	}
+	for _, existing := range s.m.state.archives {
+		if existing.Name == archive.Name {
+			return ErrDuplicate
+		}
+	}
+	archived := 0
+	for archived < len(audit) && audit[archived].ID <= archive.LastID {
+		archived++
+	}
+	if archived != archive.Entries {
+		return fmt.Errorf("archive holds %d entries, but %d were deleted", archive.Entries, archived)
+	}
+	s.m.state.audit = append([]components.AuditEntry(nil), audit[archived:]...)
+	s.m.state.archives = append(s.m.state.archives, archive)
+	return nil
+}
+
+func (s memoryAudit) Archives() ([]components.AuditArchive, error) {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+
+	return append([]components.AuditArchive(nil), s.m.state.archives...), nil
+}
@@ -0,0 +1,125 @@
+package repository
+
+import (
+	"time"
+
+	"gopos/components"
+	"gopos/database"
+)
+
+const productColumns = "id, name, barcode, price, created_at"
+
+type sqlProductStore struct {
+	q Querier
+}
+
+// NewSQLProductStore returns a ProductStore that works on a database or transaction
+func NewSQLProductStore(q Querier) ProductStore {
+	return &sqlProductStore{q}
+}
+
+func scanProduct(row scanner) (components.Product, error) {
+	var product components.Product
+	err := row.Scan(&product.ID, &product.Name, &product.Barcode, &product.Price, &product.CreatedAt)
+	return product, err
+}
+
+func (s *sqlProductStore) Get(id int) (*components.Product, error) {
+	product, err := scanProduct(s.q.QueryRow("SELECT "+productColumns+" FROM products WHERE id = ?", id))
+	if err != nil {
+		return nil, err
+	}
+	return &product, nil
+}
+
+func (s *sqlProductStore) GetByBarcode(barcode string) (*components.Product, error) {
+	product, err := scanProduct(s.q.QueryRow("SELECT "+productColumns+" FROM products WHERE barcode = ?", barcode))
+	if err != nil {
+		return nil, err
+	}
+	return &product, nil
+}
+
+func (s *sqlProductStore) List(filter ProductFilter) ([]components.Product, error) {
+	query := "SELECT " + productColumns + " FROM products"
+	var args []any
+	if filter.Search != "" {
+		query += " WHERE LOWER(name) LIKE LOWER(?) OR LOWER(barcode) LIKE LOWER(?)"
+		args = append(args, "%"+filter.Search+"%", "%"+filter.Search+"%")
+	}
+
+	switch filter.Sort {
+	case "name":
+		query += " ORDER BY name ASC"
+	case "price":
+		query += " ORDER BY price ASC"
+	default:
+		query += " ORDER BY created_at DESC"
+	}
+
+	rows, err := s.q.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var products []components.Product
+	for rows.Next() {
+		product, err := scanProduct(rows)
+		if err != nil {
+			return nil, err
+		}
+		products = append(products, product)
+	}
+	return products, rows.Err()
+}
+
+func (s *sqlProductStore) Create(product *components.Product) error {
+	createdAt := time.Now().UTC().Truncate(time.Second)
+	err := s.q.QueryRow(`
+		INSERT INTO products (barcode, name, price, created_at)
+		VALUES (?, ?, ?, ?)
+		RETURNING id
+	`, product.Barcode, product.Name, product.Price, database.FormatTime(createdAt)).Scan(&product.ID)
+	if database.IsUniqueViolation(err) {
+		return ErrDuplicate
+	} else if err != nil {
+		return err
+	}
+	product.CreatedAt = createdAt
+	return nil
+}
+
+func (s *sqlProductStore) Update(product *components.Product) error {
+	result, err := s.q.Exec(`
+		UPDATE products
+		SET barcode = ?, name = ?, price = ?
+		WHERE id = ?
+	`, product.Barcode, product.Name, product.Price, product.ID)
+	if database.IsUniqueViolation(err) {
+		return ErrDuplicate
+	} else if err != nil {
+		return err
+	}
+	return expectOneRow(result)
+}
+
+// Delete removes a product. Closed carts are only history and do not keep it
+// from being deleted; open carts and sold items do.
+func (s *sqlProductStore) Delete(id int) error {
+	_, err := s.q.Exec(`
+		DELETE FROM cart_items
+		WHERE product_id = ? AND cart_id IN (SELECT id FROM carts WHERE status != 'open')
+	`, id)
+	if err != nil {
+		return err
+	}
+
+	result, err := s.q.Exec("DELETE FROM products WHERE id = ?", id)
+	if database.IsForeignKeyError(err) {
+		return ErrInUse
+	} else if err != nil {
+		return err
+	}
+	return expectOneRow(result)
+}
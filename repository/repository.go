@@ -0,0 +1,326 @@
+// Package repository holds the data access for users, products, transactions, carts and
+// the audit log behind interfaces. Handlers use the SQL implementations in
+// production and the in-memory ones from NewMemory in tests.
+package repository
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"gopos/components"
+	"gopos/database"
+	"gopos/models"
+)
+
+var (
+	// ErrNotFound is returned for records that do not exist. It is sql.ErrNoRows,
+	// so callers that still check for that keep working.
+	ErrNotFound = sql.ErrNoRows
+
+	// ErrInUse is returned when a record cannot be deleted because others refer to it
+	ErrInUse = errors.New("record is still referenced")
+
+	// ErrAnonymized is returned when an anonymized user should be changed
+	ErrAnonymized = errors.New("user is anonymized")
+
+	// ErrDuplicate is returned when a card number or barcode is taken already
+	ErrDuplicate = errors.New("record already exists")
+
+	// ErrInsufficientBalance is returned when a debit would make a balance negative
+	ErrInsufficientBalance = errors.New("insufficient balance")
+
+	// ErrCartNotOpen is returned when changing a cart that was already completed or discarded
+	ErrCartNotOpen = errors.New("cart is not open")
+	// ErrCartNotFound is returned when changing a cart that does not exist. It wraps
+	// ErrNotFound, but is not equal to it, so callers can tell it from a missing
+	// product or card.
+	ErrCartNotFound = fmt.Errorf("cart not found: %w", ErrNotFound)
+	// ErrCartChanged is returned when a cart was changed after it was loaded for the checkout
+	ErrCartChanged = errors.New("cart was changed during the checkout")
+	// ErrRegisterBusy is returned when taking over a cart to a register that has a filled cart of its own
+	ErrRegisterBusy = errors.New("register already has an open cart")
+)
+
+// Querier is implemented by *sql.DB and *sql.Tx, so the SQL stores can work
+// inside a transaction
+type Querier interface {
+	Exec(query string, args ...any) (sql.Result, error)
+	Query(query string, args ...any) (*sql.Rows, error)
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+// Statuses of users for UserFilter
+const (
+	UserActive   = "active"
+	UserInactive = "inactive" // Deactivated, including anonymized users
+)
+
+// Kinds of transactions
+const (
+	TransactionSale       = "sale"       // A checkout, the total is taken from the balance
+	TransactionTopup      = "topup"      // The total is added to the balance
+	TransactionManual     = "manual"     // A booking by hand with a description, neither sale nor top-up
+	TransactionAdjustment = "adjustment" // A balance corrected by an admin on the user form, neither sale nor top-up
+)
+
+// UserFilter selects and orders users. Zero values match all users, newest first.
+type UserFilter struct {
+	Search string // Part of the name or card number, ignoring case
+	Role   string
+	Status string // UserActive, UserInactive or "" for both
+	Sort   string // "name", "balance" or "" for the newest first
+}
+
+type UserStore interface {
+	Get(id int) (*components.User, error)
+	GetByCardNumber(cardNumber string) (*components.User, error)
+	List(filter UserFilter) ([]components.User, error)
+	// Create stores a new user and sets its ID and creation time
+	Create(user *components.User) error
+	// Update changes card number, name, role and email of an existing user. The
+	// balance is only changed by AdjustBalance, so no payment in between gets lost.
+	Update(user *components.User) error
+	Delete(id int) error
+	// AdjustBalance adds amount to the balance of a user and returns the new
+	// balance. A debit the balance does not cover fails with ErrInsufficientBalance.
+	AdjustBalance(id int, amount float64) (float64, error)
+	// Deactivate keeps the user from logging in and paying, Reactivate undoes it
+	Deactivate(id int) error
+	// Reactivate fails with ErrAnonymized for anonymized users
+	Reactivate(id int) error
+	// Anonymize replaces name and card number with the pseudonym and erases the
+	// email. The user is deactivated for good; transactions keep referring to it.
+	Anonymize(id int, pseudonym string) error
+}
+
+// ProductFilter selects and orders products. Zero values match all products, newest first.
+type ProductFilter struct {
+	Search string // Part of the name or barcode, ignoring case
+	Sort   string // "name", "price" or "" for the newest first
+}
+
+type ProductStore interface {
+	Get(id int) (*components.Product, error)
+	GetByBarcode(barcode string) (*components.Product, error)
+	List(filter ProductFilter) ([]components.Product, error)
+	// Create stores a new product and sets its ID and creation time
+	Create(product *components.Product) error
+	// Update changes barcode, name and price of an existing product
+	Update(product *components.Product) error
+	Delete(id int) error
+}
+
+// Booking is a transaction without items to record with TransactionStore.Record
+type Booking struct {
+	UserID       int
+	CashierID    int
+	Total        float64
+	BalanceAfter float64
+	Kind         string // TransactionTopup, TransactionManual or TransactionAdjustment
+	Description  string
+}
+
+// Sale is a checkout to record with TransactionStore.RecordSale
+type Sale struct {
+	UserID       int
+	CashierID    int
+	Total        float64
+	BalanceAfter float64
+	Items        []SaleItem
+	// IdempotencyKey identifies a checkout across retries, it is optional
+	IdempotencyKey string
+}
+
+// SaleItem is a product sold in a Sale
+type SaleItem struct {
+	ProductID int
+	Quantity  int
+	Price     float64
+}
+
+type TransactionStore interface {
+	// Record stores a booking and returns its ID. Call it within Atomic
+	// together with the change of the balance.
+	Record(booking Booking) (int, error)
+	// RecordSale stores a sale with its items and returns its ID. It fails with
+	// ErrDuplicate if the idempotency key was used already. Call it within
+	// Atomic together with the debit of the balance.
+	RecordSale(sale Sale) (int, error)
+	// SaleByKey returns the ID and the sale recorded with an idempotency key, or ErrNotFound
+	SaleByKey(idempotencyKey string) (int, *Sale, error)
+	// ListForUser returns the latest transactions of a customer with their items, newest first
+	ListForUser(userID, limit int) ([]components.Transaction, error)
+	// CountForUser counts the transactions a user took part in as customer or cashier
+	CountForUser(userID int) (int, error)
+	// CountForProduct counts the transactions the product was sold in
+	CountForProduct(productID int) (int, error)
+}
+
+type CartStore interface {
+	// Open returns the open cart of a register, creating an empty one for the
+	// cashier if there is none
+	Open(register string, cashierID int) (*models.Cart, error)
+	// Get returns a cart with its customer and items at the current product prices
+	Get(id int64) (*models.Cart, error)
+	// ListOpen returns all open carts, most recently changed first
+	ListOpen() ([]models.Cart, error)
+
+	// The changes below fail with ErrCartNotFound or ErrCartNotOpen unless the
+	// cart is open. Call them within Atomic, so a failed change is undone.
+
+	// AddItem adds one piece of the product with the given barcode, or fails
+	// with ErrNotFound if there is no such product
+	AddItem(cartID int64, barcode string) error
+	// SetQuantity changes the quantity of a product; zero or less removes it
+	SetQuantity(cartID, productID int64, quantity int) error
+	// SetCustomer attaches the customer with the given card number, or detaches
+	// the customer if the card number is empty. It fails with ErrNotFound if
+	// there is no such card or its user is deactivated.
+	SetCustomer(cartID int64, cardNumber string) error
+	// TakeOver moves a cart to another register and cashier. An empty cart left
+	// open on that register is discarded; a filled one makes the takeover fail
+	// with ErrRegisterBusy.
+	TakeOver(cartID int64, register string, cashierID int) error
+	// Discard closes a cart without checking it out
+	Discard(cartID int64) error
+	// Complete marks a cart as checked out with the given transaction. cart is
+	// the cart as it was charged: if its customer, items or prices changed since
+	// it was loaded, Complete fails with ErrCartChanged. Call it within Atomic
+	// together with the sale; an unknown transaction fails with ErrNotFound.
+	Complete(cart *models.Cart, transactionID int) error
+}
+
+// AuditFilter selects audit entries. Zero values match all entries.
+type AuditFilter struct {
+	UserID int
+	Action string
+	From   time.Time // Entries at or after From
+	To     time.Time // Entries before To
+	Search string    // Part of the details, ignoring case
+}
+
+// AuditEvent is an action to record in the audit log
+type AuditEvent struct {
+	UserID     int    // Who did it
+	Action     string // What was done, e.g. "edit_user"
+	EntityType string // Kind of the affected record, e.g. "user" or "product"
+	EntityID   int
+	Details    string                            // Summary for people
+	Changes    map[string]components.AuditChange // Changed fields by name
+	IP         string
+	UserAgent  string
+}
+
+// AuditProblem tells what is wrong with an entry of the audit log
+type AuditProblem string
+
+const (
+	// AuditModified entries do not match their hash
+	AuditModified AuditProblem = "modified"
+	// AuditUnlinked entries do not follow the entry before them, which was
+	// deleted or modified together with its hash
+	AuditUnlinked AuditProblem = "unlinked"
+)
+
+// AuditVerification is the result of checking the hash chain of the audit log
+type AuditVerification struct {
+	Entries  int          // Entries that were checked, archived ones are left out
+	BrokenID int          // First entry that breaks the chain, 0 if it is intact
+	Problem  AuditProblem // What is wrong with BrokenID
+	LastID   int          // Newest entry, the head of the chain
+	LastHash string
+}
+
+// Intact reports whether every entry matches its hash and follows the one before
+func (v AuditVerification) Intact() bool {
+	return v.BrokenID == 0
+}
+
+type AuditStore interface {
+	// Log appends an entry to the hash chain of the audit log
+	Log(event AuditEvent) error
+	// List returns a page of the matching entries, newest first; pages start
+	// at 1. A pageSize of 0 returns all of them.
+	List(filter AuditFilter, page, pageSize int) ([]components.AuditEntry, error)
+	Count(filter AuditFilter) (int, error)
+	// Actions returns the actions that were logged, in alphabetical order
+	Actions() ([]string, error)
+	// Verify checks the hash chain of all entries, oldest first
+	Verify() (AuditVerification, error)
+	// Hash returns the stored hash of an entry, or ErrNotFound
+	Hash(id int) (string, error)
+	// Rows returns the oldest entries written before the given time, in the
+	// order of the chain. It stops at the first newer entry.
+	Rows(before time.Time) ([]AuditRow, error)
+	// Archive deletes the entries of an archive, which must be the oldest
+	// ones, and records the archive to continue the chain from. Call it
+	// within Atomic, so the entries are kept if it fails.
+	Archive(archive components.AuditArchive) error
+	// Archives returns the archives of removed entries, oldest first
+	Archives() ([]components.AuditArchive, error)
+}
+
+// AuditRow is an audit log entry as stored, with the content its hash covers
+type AuditRow struct {
+	ID int `json:"id"`
+	database.AuditRecord
+	PrevHash string `json:"prev_hash"`
+	Hash     string `json:"hash"`
+}
+
+// Stores bundles the stores handlers work with
+type Stores struct {
+	Users        UserStore
+	Products     ProductStore
+	Transactions TransactionStore
+	Carts        CartStore
+	Audit        AuditStore
+
+	atomic func(fn func(Stores) error) error
+}
+
+// Atomic runs fn with stores whose changes are applied together if fn returns
+// nil and discarded if it returns an error
+func (s Stores) Atomic(fn func(Stores) error) error {
+	if s.atomic == nil {
+		return fn(s)
+	}
+	return s.atomic(fn)
+}
+
+// NewSQL returns the stores of a database opened with database.Open
+func NewSQL(db *sql.DB) Stores {
+	dialect := database.DialectOf(db)
+	stores := newSQLStores(db, dialect)
+	stores.atomic = func(fn func(Stores) error) error {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		// Changes within the transaction are atomic already
+		if err := fn(newSQLStores(tx, dialect)); err != nil {
+			return err
+		}
+		return tx.Commit()
+	}
+	return stores
+}
+
+func newSQLStores(q Querier, dialect database.Dialect) Stores {
+	return Stores{
+		Users:        NewSQLUserStore(q),
+		Products:     NewSQLProductStore(q),
+		Transactions: NewSQLTransactionStore(q),
+		Carts:        NewSQLCartStore(q),
+		Audit:        &sqlAuditStore{q, dialect},
+	}
+}
+
+// scanner is implemented by *sql.Row and *sql.Rows
+type scanner interface {
+	Scan(dest ...any) error
+}
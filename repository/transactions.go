@@ -0,0 +1,177 @@
+package repository
+
+import (
+	"database/sql"
+
+	"gopos/components"
+	"gopos/database"
+)
+
+type sqlTransactionStore struct {
+	q Querier
+}
+
+// NewSQLTransactionStore returns a TransactionStore that works on a database or transaction
+func NewSQLTransactionStore(q Querier) TransactionStore {
+	return &sqlTransactionStore{q}
+}
+
+func (s *sqlTransactionStore) Record(booking Booking) (int, error) {
+	var id int
+	err := s.q.QueryRow(`
+		INSERT INTO transactions (user_id, cashier_id, total, balance_after, kind, description, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+		RETURNING id
+	`, booking.UserID, booking.CashierID, booking.Total, booking.BalanceAfter, booking.Kind, booking.Description, database.Now()).Scan(&id)
+	if database.IsForeignKeyError(err) {
+		return 0, ErrNotFound
+	}
+	return id, err
+}
+
+func (s *sqlTransactionStore) RecordSale(sale Sale) (int, error) {
+	var idempotencyKey sql.NullString
+	if sale.IdempotencyKey != "" {
+		idempotencyKey = sql.NullString{String: sale.IdempotencyKey, Valid: true}
+	}
+
+	var id int
+	err := s.q.QueryRow(`
+		INSERT INTO transactions (user_id, cashier_id, total, balance_after, kind, idempotency_key, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+		RETURNING id
+	`, sale.UserID, sale.CashierID, sale.Total, sale.BalanceAfter, TransactionSale, idempotencyKey, database.Now()).Scan(&id)
+	if database.IsUniqueViolation(err) {
+		return 0, ErrDuplicate
+	} else if database.IsForeignKeyError(err) {
+		return 0, ErrNotFound
+	} else if err != nil {
+		return 0, err
+	}
+
+	for _, item := range sale.Items {
+		_, err := s.q.Exec(`
+			INSERT INTO transaction_items (transaction_id, product_id, quantity, price)
+			VALUES (?, ?, ?, ?)
+		`, id, item.ProductID, item.Quantity, item.Price)
+		if database.IsForeignKeyError(err) {
+			return 0, ErrNotFound
+		} else if err != nil {
+			return 0, err
+		}
+	}
+	return id, nil
+}
+
+func (s *sqlTransactionStore) SaleByKey(idempotencyKey string) (int, *Sale, error) {
+	var id int
+	var balanceAfter sql.NullFloat64
+	sale := Sale{IdempotencyKey: idempotencyKey}
+	err := s.q.QueryRow(`
+		SELECT id, user_id, cashier_id, total, balance_after
+		FROM transactions
+		WHERE idempotency_key = ?
+	`, idempotencyKey).Scan(&id, &sale.UserID, &sale.CashierID, &sale.Total, &balanceAfter)
+	if err != nil {
+		return 0, nil, err
+	}
+	sale.BalanceAfter = balanceAfter.Float64
+
+	rows, err := s.q.Query(`
+		SELECT product_id, quantity, price FROM transaction_items WHERE transaction_id = ?
+	`, id)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var item SaleItem
+		if err := rows.Scan(&item.ProductID, &item.Quantity, &item.Price); err != nil {
+			return 0, nil, err
+		}
+		sale.Items = append(sale.Items, item)
+	}
+	if err := rows.Err(); err != nil {
+		return 0, nil, err
+	}
+	return id, &sale, nil
+}
+
+func (s *sqlTransactionStore) ListForUser(userID, limit int) ([]components.Transaction, error) {
+	rows, err := s.q.Query(`
+		SELECT
+			t.id,
+			u.name AS user_name,
+			c.name AS cashier_name,
+			t.total,
+			t.created_at
+		FROM transactions t
+		JOIN users u ON t.user_id = u.id
+		JOIN users c ON t.cashier_id = c.id
+		WHERE t.user_id = ?
+		ORDER BY t.created_at DESC
+		LIMIT ?
+	`, userID, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	var transactions []components.Transaction
+	for rows.Next() {
+		var t components.Transaction
+		if err := rows.Scan(&t.ID, &t.UserName, &t.CashierName, &t.Total, &t.CreatedAt); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		transactions = append(transactions, t)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Load the items once the transactions are read, a transaction holds a single connection
+	for i := range transactions {
+		if transactions[i].Items, err = s.items(transactions[i].ID); err != nil {
+			return nil, err
+		}
+	}
+	return transactions, nil
+}
+
+func (s *sqlTransactionStore) items(transactionID int) ([]components.TransactionItem, error) {
+	rows, err := s.q.Query(`
+		SELECT p.name, ti.quantity, ti.price
+		FROM transaction_items ti
+		JOIN products p ON p.id = ti.product_id
+		WHERE ti.transaction_id = ?
+		ORDER BY p.name
+	`, transactionID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var items []components.TransactionItem
+	for rows.Next() {
+		var item components.TransactionItem
+		if err := rows.Scan(&item.ProductName, &item.Quantity, &item.Price); err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, rows.Err()
+}
+
+func (s *sqlTransactionStore) CountForUser(userID int) (int, error) {
+	var count int
+	err := s.q.QueryRow("SELECT COUNT(*) FROM transactions WHERE user_id = ? OR cashier_id = ?", userID, userID).Scan(&count)
+	return count, err
+}
+
+func (s *sqlTransactionStore) CountForProduct(productID int) (int, error) {
+	var count int
+	err := s.q.QueryRow("SELECT COUNT(*) FROM transaction_items WHERE product_id = ?", productID).Scan(&count)
+	return count, err
+}
@@ -0,0 +1,212 @@
+package repository
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"gopos/components"
+	"gopos/database"
+)
+
+const userColumns = "id, name, card_number, role, balance, email, created_at, deactivated_at, anonymized_at"
+
+type sqlUserStore struct {
+	q Querier
+}
+
+// NewSQLUserStore returns a UserStore that works on a database or transaction
+func NewSQLUserStore(q Querier) UserStore {
+	return &sqlUserStore{q}
+}
+
+func scanUser(row scanner) (components.User, error) {
+	var user components.User
+	var email sql.NullString
+	var deactivatedAt, anonymizedAt sql.NullTime
+	err := row.Scan(&user.ID, &user.Name, &user.CardNumber, &user.Role, &user.Balance, &email, &user.CreatedAt,
+		&deactivatedAt, &anonymizedAt)
+	user.Email = email.String
+	user.DeactivatedAt, user.AnonymizedAt = deactivatedAt.Time, anonymizedAt.Time
+	return user, err
+}
+
+func (s *sqlUserStore) Get(id int) (*components.User, error) {
+	user, err := scanUser(s.q.QueryRow("SELECT "+userColumns+" FROM users WHERE id = ?", id))
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func (s *sqlUserStore) GetByCardNumber(cardNumber string) (*components.User, error) {
+	user, err := scanUser(s.q.QueryRow("SELECT "+userColumns+" FROM users WHERE card_number = ?", cardNumber))
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func (s *sqlUserStore) List(filter UserFilter) ([]components.User, error) {
+	query := "SELECT " + userColumns + " FROM users WHERE 1=1"
+	var args []any
+	if filter.Search != "" {
+		// LIKE ignores case on SQLite only
+		query += " AND (LOWER(name) LIKE LOWER(?) OR LOWER(card_number) LIKE LOWER(?))"
+		args = append(args, "%"+filter.Search+"%", "%"+filter.Search+"%")
+	}
+	if filter.Role != "" {
+		query += " AND role = ?"
+		args = append(args, filter.Role)
+	}
+	switch filter.Status {
+	case UserActive:
+		query += " AND deactivated_at IS NULL"
+	case UserInactive:
+		query += " AND deactivated_at IS NOT NULL"
+	}
+
+	switch filter.Sort {
+	case "name":
+		query += " ORDER BY name ASC"
+	case "balance":
+		query += " ORDER BY balance DESC"
+	default:
+		query += " ORDER BY created_at DESC"
+	}
+
+	rows, err := s.q.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []components.User
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	return users, rows.Err()
+}
+
+func (s *sqlUserStore) Create(user *components.User) error {
+	createdAt := time.Now().UTC().Truncate(time.Second)
+	err := s.q.QueryRow(`
+		INSERT INTO users (card_number, name, role, balance, email, created_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+		RETURNING id
+	`, user.CardNumber, user.Name, user.Role, user.Balance, user.Email, database.FormatTime(createdAt)).Scan(&user.ID)
+	if database.IsUniqueViolation(err) {
+		return ErrDuplicate
+	} else if err != nil {
+		return err
+	}
+	user.CreatedAt = createdAt
+	return nil
+}
+
+func (s *sqlUserStore) Update(user *components.User) error {
+	result, err := s.q.Exec(`
+		UPDATE users
+		SET card_number = ?, name = ?, role = ?, email = ?
+		WHERE id = ?
+	`, user.CardNumber, user.Name, user.Role, user.Email, user.ID)
+	if database.IsUniqueViolation(err) {
+		return ErrDuplicate
+	} else if err != nil {
+		return err
+	}
+	return expectOneRow(result)
+}
+
+func (s *sqlUserStore) Delete(id int) error {
+	result, err := s.q.Exec("DELETE FROM users WHERE id = ?", id)
+	if database.IsForeignKeyError(err) {
+		return ErrInUse
+	} else if err != nil {
+		return err
+	}
+	return expectOneRow(result)
+}
+
+// AdjustBalance is a single conditional update, so concurrent changes to the
+// same account can neither get lost nor debit more than the balance
+func (s *sqlUserStore) AdjustBalance(id int, amount float64) (float64, error) {
+	var balance float64
+	// Comparing with 0.0 makes PostgreSQL type the amount as a decimal, not an integer
+	err := s.q.QueryRow(`
+		UPDATE users SET balance = balance + ?1
+		WHERE id = ?2 AND (?1 >= 0.0 OR balance >= -?1)
+		RETURNING balance
+	`, amount, id).Scan(&balance)
+	if err != sql.ErrNoRows {
+		return balance, err
+	}
+
+	// Tell a missing user apart from a balance that is too low
+	var exists bool
+	if err := s.q.QueryRow("SELECT EXISTS (SELECT 1 FROM users WHERE id = ?)", id).Scan(&exists); err != nil {
+		return 0, err
+	}
+	if !exists {
+		return 0, ErrNotFound
+	}
+	return 0, ErrInsufficientBalance
+}
+
+func (s *sqlUserStore) Deactivate(id int) error {
+	result, err := s.q.Exec("UPDATE users SET deactivated_at = COALESCE(deactivated_at, ?) WHERE id = ?", database.Now(), id)
+	if err != nil {
+		return err
+	}
+	return expectOneRow(result)
+}
+
+func (s *sqlUserStore) Reactivate(id int) error {
+	result, err := s.q.Exec("UPDATE users SET deactivated_at = NULL WHERE id = ? AND anonymized_at IS NULL", id)
+	if err != nil {
+		return err
+	}
+	if err := expectOneRow(result); !errors.Is(err, ErrNotFound) {
+		return err
+	}
+
+	// Tell a missing user apart from an anonymized one
+	var exists bool
+	if err := s.q.QueryRow("SELECT EXISTS (SELECT 1 FROM users WHERE id = ?)", id).Scan(&exists); err != nil {
+		return err
+	}
+	if !exists {
+		return ErrNotFound
+	}
+	return ErrAnonymized
+}
+
+func (s *sqlUserStore) Anonymize(id int, pseudonym string) error {
+	now := database.Now()
+	result, err := s.q.Exec(`
+		UPDATE users
+		SET name = ?, card_number = ?, email = NULL, deactivated_at = COALESCE(deactivated_at, ?), anonymized_at = ?
+		WHERE id = ?
+	`, pseudonym, pseudonym, now, now, id)
+	if database.IsUniqueViolation(err) {
+		return ErrDuplicate
+	} else if err != nil {
+		return err
+	}
+	return expectOneRow(result)
+}
+
+func expectOneRow(result sql.Result) error {
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows != 1 {
+		return ErrNotFound
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+// Package server wires the handlers into the routes of GoPOS and sets up HTTPS
+package server
+
+import (
+	"context"
+	"database/sql"
+	"io/fs"
+	"net/http"
+
+	"gopos/components"
+	"gopos/handlers"
+	"gopos/metrics"
+	"gopos/repository"
+	"gopos/services"
+)
+
+// New returns the handler for all pages and API routes of GoPOS, with the
+// security headers set on every response and every request logged and counted
+// in /metrics. static holds the files served below /static/. The session
+// store, settings and services have to be initialized before it handles
+// requests.
+func New(db *sql.DB, static fs.FS, version, commitID string) http.Handler {
+	// Data access for the handlers that go through the repository
+	stores := repository.NewSQL(db)
+
+	// Create a new ServeMux
+	mux := http.NewServeMux()
+
+	// Serve static files
+	mux.Handle("/static/", instrument("/static/", http.StripPrefix("/static/", http.FileServer(http.FS(static)))))
+
+	// Prometheus metrics
+	mux.Handle("/metrics", metrics.Handler(db, version, commitID))
+
+	// Middleware to inject database and version info into context
+	withDB := func(handler http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			ctx := context.WithValue(r.Context(), handlers.DbKey, db)
+			ctx = context.WithValue(ctx, "version", version)
+			ctx = context.WithValue(ctx, "commitID", commitID)
+			ctx = components.WithSettings(ctx, services.GetSettings())
+			handler.ServeHTTP(w, r.WithContext(ctx))
+		}
+	}
+
+	// Define routes with their handlers
+	routes := map[string]http.HandlerFunc{
+		// Public routes
+		"/":       withDB(handlers.HandleLogin(db)),
+		"/login":  withDB(handlers.HandleLoginPost(stores)),
+		"/logout": withDB(handlers.HandleLogout),
+
+		// Liveness and readiness for the process supervisor
+		"/healthz": withDB(handlers.HandleHealthz),
+		"/readyz":  withDB(handlers.HandleReadyz(db)),
+
+		// Store logo, also shown on the login page
+		"/settings/logo": withDB(handlers.HandleSettingsLogo(db)),
+
+		// Protected routes - require authentication
+		"/dashboard":                  withDB(handlers.RequireAuth(handlers.HandleDashboard(db))),
+		"/transactions":               withDB(handlers.RequireAuth(handlers.HandleTransactions(stores))),
+		"/transactions/receipt":       withDB(handlers.RequireAuth(handlers.HandleReceipt(db))),
+		"/transactions/receipt/pdf":   withDB(handlers.RequireAuth(handlers.HandleReceiptPDF(db))),
+		"/transactions/receipt/print": withDB(handlers.RequireAuth(handlers.RequireRole([]string{"admin", "cashier"}, handlers.HandlePrintReceipt(db)))),
+
+		// Admin routes
+		"/users":            withDB(handlers.RequireAuth(handlers.RequireRole([]string{"admin"}, handlers.HandleUsers(stores)))),
+		"/users/new":        withDB(handlers.RequireAuth(handlers.RequireRole([]string{"admin"}, handlers.HandleNewUser(stores)))),
+		"/users/delete":     withDB(handlers.RequireAuth(handlers.RequireRole([]string{"admin"}, handlers.HandleDeleteUser(stores)))),
+		"/users/deactivate": withDB(handlers.RequireAuth(handlers.RequireRole([]string{"admin"}, handlers.HandleDeactivateUser(stores)))),
+		"/users/reactivate": withDB(handlers.RequireAuth(handlers.RequireRole([]string{"admin"}, handlers.HandleReactivateUser(stores)))),
+		"/users/anonymize":  withDB(handlers.RequireAuth(handlers.RequireRole([]string{"admin"}, handlers.HandleAnonymizeUser(stores)))),
+		"/users/edit":       withDB(handlers.RequireAuth(handlers.RequireRole([]string{"admin"}, handlers.HandleEditUser(stores)))),
+		"/users/topup":      withDB(handlers.RequireAuth(handlers.RequireRole([]string{"admin", "cashier"}, handlers.HandleTopupUser(stores)))),
+		"/users/search":     withDB(handlers.RequireAuth(handlers.RequireRole([]string{"admin"}, handlers.HandleUserSearch(stores)))),
+		"/users/filter":     withDB(handlers.RequireAuth(handlers.RequireRole([]string{"admin"}, handlers.HandleUserFilter(stores)))),
+		"/audit":            withDB(handlers.RequireAuth(handlers.RequireRole([]string{"admin"}, handlers.HandleAuditTrail(stores)))),
+		"/audit/export":     withDB(handlers.RequireAuth(handlers.RequireRole([]string{"admin"}, handlers.HandleAuditExport(stores)))),
+		"/audit/verify":     withDB(handlers.RequireAuth(handlers.RequireRole([]string{"admin"}, handlers.HandleAuditVerify(db)))),
+		"/audit/archive":    withDB(handlers.RequireAuth(handlers.RequireRole([]string{"admin"}, handlers.HandleAuditArchive(db)))),
+		"/stats":            withDB(handlers.RequireAuth(handlers.RequireRole([]string{"admin"}, handlers.HandleStats(db)))),
+		"/reports":          withDB(handlers.RequireAuth(handlers.RequireRole([]string{"admin"}, handlers.HandleReports(db)))),
+		"/reports/export":   withDB(handlers.RequireAuth(handlers.RequireRole([]string{"admin"}, handlers.HandleReportsExport(db)))),
+		"/settings":         withDB(handlers.RequireAuth(handlers.RequireRole([]string{"admin"}, handlers.HandleSettings(db)))),
+		"/backups":          withDB(handlers.RequireAuth(handlers.RequireRole([]string{"admin"}, handlers.HandleBackups(db)))),
+		"/backups/download": withDB(handlers.RequireAuth(handlers.RequireRole([]string{"admin"}, handlers.HandleBackupDownload(db)))),
+		"/products":         withDB(handlers.RequireAuth(handlers.RequireRole([]string{"admin"}, handlers.HandleProducts(stores)))),
+		"/products/new":     withDB(handlers.RequireAuth(handlers.RequireRole([]string{"admin"}, handlers.HandleNewProduct(stores)))),
+		"/products/edit":    withDB(handlers.RequireAuth(handlers.RequireRole([]string{"admin"}, handlers.HandleEditProduct(stores)))),
+		"/products/delete":  withDB(handlers.RequireAuth(handlers.RequireRole([]string{"admin"}, handlers.HandleDeleteProduct(stores)))),
+		"/products/search":  withDB(handlers.RequireAuth(handlers.RequireRole([]string{"admin"}, handlers.HandleProductSearch(stores)))),
+		"/products/filter":  withDB(handlers.RequireAuth(handlers.RequireRole([]string{"admin"}, handlers.HandleProductFilter(stores)))),
+
+		// Cashier routes
+		"/checkout":      withDB(handlers.RequireAuth(handlers.RequireRole([]string{"admin", "cashier"}, handlers.HandleCheckout(db)))),
+		"/balance/topup": withDB(handlers.RequireAuth(handlers.RequireRole([]string{"admin", "cashier"}, handlers.HandleBalanceTopup(stores)))),
+
+		// API routes
+		"/api/customers": withDB(handlers.RequireAuth(handlers.RequireRole([]string{"admin", "cashier"}, handlers.HandleCustomerLookup(stores)))),
+		"/api/products":  withDB(handlers.RequireAuth(handlers.RequireRole([]string{"admin", "cashier"}, handlers.HandleProductScan(stores)))),
+		"/api/checkout":  withDB(handlers.RequireAuth(handlers.RequireRole([]string{"admin", "cashier"}, handlers.HandleCompleteCheckout(stores, db)))),
+
+		// Server-side carts
+		"/api/carts":         withDB(handlers.RequireAuth(handlers.RequireRole([]string{"admin", "cashier"}, handlers.HandleListCarts(stores)))),
+		"/api/cart":          withDB(handlers.RequireAuth(handlers.RequireRole([]string{"admin", "cashier"}, handlers.HandleGetCart(stores)))),
+		"/api/cart/open":     withDB(handlers.RequireAuth(handlers.RequireRole([]string{"admin", "cashier"}, handlers.HandleOpenCart(stores)))),
+		"/api/cart/items":    withDB(handlers.RequireAuth(handlers.RequireRole([]string{"admin", "cashier"}, handlers.HandleAddCartItem(stores)))),
+		"/api/cart/quantity": withDB(handlers.RequireAuth(handlers.RequireRole([]string{"admin", "cashier"}, handlers.HandleSetCartQuantity(stores)))),
+		"/api/cart/remove":   withDB(handlers.RequireAuth(handlers.RequireRole([]string{"admin", "cashier"}, handlers.HandleRemoveCartItem(stores)))),
+		"/api/cart/customer": withDB(handlers.RequireAuth(handlers.RequireRole([]string{"admin", "cashier"}, handlers.HandleSetCartCustomer(stores)))),
+		"/api/cart/takeover": withDB(handlers.RequireAuth(handlers.RequireRole([]string{"admin", "cashier"}, handlers.HandleTakeOverCart(stores)))),
+		"/api/cart/discard":  withDB(handlers.RequireAuth(handlers.RequireRole([]string{"admin", "cashier"}, handlers.HandleDiscardCart(stores)))),
+		"/api/cart/complete": withDB(handlers.RequireAuth(handlers.RequireRole([]string{"admin", "cashier"}, handlers.HandleCompleteCart(stores, db)))),
+	}
+
+	// Register all routes
+	for path, handler := range routes {
+		mux.Handle(path, instrument(path, handler))
+	}
+
+	return RequestLogger(SecurityHeaders(mux))
+}
@@ -0,0 +1,211 @@
+package server
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"gopos/config"
+	"gopos/logging"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+var tlsLog = logging.Component("tls")
+
+// TLS holds the HTTPS setup of the server: the certificates, either from files
+// or obtained over ACME, the redirect from plain HTTP and HSTS
+type TLS struct {
+	Config   *tls.Config
+	redirect http.Handler
+	hsts     time.Duration
+}
+
+// NewTLS sets up HTTPS as configured, or returns nil if TLS is not enabled.
+// Certificate files are read now and again whenever they change. ACME
+// certificates are requested on the first connection for a domain and renewed
+// before they expire.
+func NewTLS(cfg *config.Config) (*TLS, error) {
+	if !cfg.TLSEnabled() {
+		return nil, nil
+	}
+
+	t := &TLS{hsts: cfg.TLS.HSTSMaxAge}
+	redirect := redirectHandler(cfg.Server.Listen)
+
+	if cfg.TLS.CertFile != "" {
+		files := &certFiles{certFile: cfg.TLS.CertFile, keyFile: cfg.TLS.KeyFile}
+		if err := files.load(); err != nil {
+			return nil, err
+		}
+		t.Config = &tls.Config{GetCertificate: files.GetCertificate}
+		t.redirect = redirect
+		tlsLog.Info("Using certificate", "file", cfg.TLS.CertFile)
+	} else {
+		manager, err := newACMEManager(cfg)
+		if err != nil {
+			return nil, err
+		}
+		t.Config = manager.TLSConfig()
+		t.redirect = redirect
+		// HTTP-01 challenges can only be answered with the plain HTTP listener,
+		// otherwise TLS-ALPN-01 on the HTTPS listener is used
+		if cfg.TLS.RedirectListen != "" {
+			t.redirect = manager.HTTPHandler(redirect)
+		}
+		tlsLog.Info("Obtaining certificates over ACME", "domains", cfg.TLS.ACME.Domains, "directory", manager.Client.DirectoryURL)
+	}
+
+	t.Config.MinVersion = tls.VersionTLS12
+	return t, nil
+}
+
+// RedirectHandler returns the handler for the plain HTTP listener. It answers
+// ACME challenges and redirects everything else to HTTPS.
+func (t *TLS) RedirectHandler() http.Handler {
+	return t.redirect
+}
+
+// HSTS tells browsers to only use HTTPS for the configured time
+func (t *TLS) HSTS(next http.Handler) http.Handler {
+	if t.hsts <= 0 {
+		return next
+	}
+	value := fmt.Sprintf("max-age=%d", int(t.hsts.Seconds()))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Strict-Transport-Security", value)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// redirectHandler sends requests to the same path on the HTTPS listener. The
+// port is kept unless it is the default one.
+func redirectHandler(listen string) http.Handler {
+	port := ""
+	if _, p, err := net.SplitHostPort(listen); err == nil && p != "443" {
+		port = p
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, "Bitte HTTPS verwenden", http.StatusBadRequest)
+			return
+		}
+		host := r.Host
+		if h, _, err := net.SplitHostPort(r.Host); err == nil {
+			host = h
+		}
+		if port != "" {
+			host = net.JoinHostPort(host, port)
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
+
+// newACMEManager returns the ACME client for the configured domains. The
+// account key and the certificates are kept in the cache directory, so a
+// restart does not request new ones.
+func newACMEManager(cfg *config.Config) (*autocert.Manager, error) {
+	acmeConfig := cfg.TLS.ACME
+
+	cacheDir := acmeConfig.CacheDir
+	if cacheDir == "" {
+		cacheDir = filepath.Join(filepath.Dir(cfg.Database.Path), "certs")
+	}
+	if err := os.MkdirAll(cacheDir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create certificate directory: %v", err)
+	}
+
+	client := &acme.Client{DirectoryURL: acmeConfig.DirectoryURL}
+	if client.DirectoryURL == "" {
+		client.DirectoryURL = acme.LetsEncryptURL
+	}
+	if acmeConfig.CAFile != "" {
+		roots, err := x509.SystemCertPool()
+		if err != nil {
+			roots = x509.NewCertPool()
+		}
+		pem, err := os.ReadFile(acmeConfig.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read ACME CA file: %v", err)
+		}
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in ACME CA file %s", acmeConfig.CAFile)
+		}
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = &tls.Config{RootCAs: roots}
+		client.HTTPClient = &http.Client{Transport: transport, Timeout: time.Minute}
+	}
+
+	return &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(cacheDir),
+		HostPolicy: autocert.HostWhitelist(acmeConfig.Domains...),
+		Email:      acmeConfig.Email,
+		Client:     client,
+	}, nil
+}
+
+// certFiles serves a certificate from files and reloads it when a file
+// changes, so renewed certificates are used without a restart
+type certFiles struct {
+	certFile, keyFile string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	version []byte
+}
+
+// fileVersion identifies the current content of the files by their size and
+// modification time
+func (c *certFiles) fileVersion() ([]byte, error) {
+	var version bytes.Buffer
+	for _, name := range []string{c.certFile, c.keyFile} {
+		info, err := os.Stat(name)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(&version, "%d:%d;", info.Size(), info.ModTime().UnixNano())
+	}
+	return version.Bytes(), nil
+}
+
+func (c *certFiles) load() error {
+	version, err := c.fileVersion()
+	if err != nil {
+		return fmt.Errorf("failed to read certificate: %v", err)
+	}
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load certificate: %v", err)
+	}
+	c.cert = &cert
+	c.version = version
+	return nil
+}
+
+// GetCertificate returns the current certificate. If the files changed but
+// cannot be loaded, e.g. while they are being written, the previous
+// certificate is kept.
+func (c *certFiles) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if version, err := c.fileVersion(); err == nil && !bytes.Equal(version, c.version) {
+		if err := c.load(); err != nil {
+			// Not retried until the files change again
+			c.version = version
+			tlsLog.Error("Keeping the current certificate", "error", err)
+		} else {
+			tlsLog.Info("Reloaded certificate", "file", c.certFile)
+		}
+	}
+	return c.cert, nil
+}
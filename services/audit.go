@@ -0,0 +1,271 @@
+package services
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"gopos/components"
+	"gopos/config"
+	"gopos/logging"
+	"gopos/repository"
+)
+
+// Problems of a checkpoint found by VerifyAudit
+const (
+	CheckpointSignature    = "signature"    // The file was changed or signed with another key
+	CheckpointMissing      = "missing"      // The entry it points to was deleted
+	CheckpointMismatch     = "mismatch"     // The entry it points to has another hash now
+	CheckpointUnverifiable = "unverifiable" // audit.checkpoint_key is not set
+)
+
+// ErrNoCheckpointKey is returned when a checkpoint should be signed without a key
+var ErrNoCheckpointKey = errors.New("audit.checkpoint_key is not set")
+
+// checkpointNamePattern matches the file names of checkpoints made by CreateAuditCheckpoint
+var checkpointNamePattern = regexp.MustCompile(`^audit-checkpoint-\d{8}-\d{6}\.json$`)
+
+var (
+	auditConfig *config.Config
+	// checkpointMutex keeps checkpoints and archiving, scheduled or manual, from running at the same time
+	checkpointMutex sync.Mutex
+
+	auditLog = logging.Component("audit")
+)
+
+// InitAuditService configures where checkpoints of the audit log are stored and how they are signed
+func InitAuditService(cfg *config.Config) {
+	auditConfig = cfg
+}
+
+// CheckpointDirectory returns the directory checkpoints are written to
+func CheckpointDirectory() string {
+	if auditConfig == nil {
+		return "audit"
+	}
+	if auditConfig.Audit.CheckpointDirectory != "" {
+		return auditConfig.Audit.CheckpointDirectory
+	}
+	return filepath.Join(filepath.Dir(auditConfig.Database.Path), "audit")
+}
+
+// CheckpointSchedule describes the interval of automatic checkpoints, or returns "" if they are disabled
+func CheckpointSchedule() string {
+	if auditConfig == nil || auditConfig.Audit.CheckpointInterval <= 0 {
+		return ""
+	}
+	return auditConfig.Audit.CheckpointInterval.String()
+}
+
+func checkpointKey() []byte {
+	if auditConfig == nil {
+		return nil
+	}
+	return []byte(auditConfig.Audit.CheckpointKey)
+}
+
+// signCheckpoint returns the HMAC-SHA256 of the fields of a checkpoint
+func signCheckpoint(key []byte, checkpoint components.AuditCheckpoint) string {
+	mac := hmac.New(sha256.New, key)
+	fmt.Fprintf(mac, "%s\n%d\n%d\n%s", checkpoint.CreatedAt.UTC().Format(time.RFC3339),
+		checkpoint.Entries, checkpoint.LastID, checkpoint.LastHash)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// CreateAuditCheckpoint writes the signed head of the audit log hash chain to
+// the checkpoint directory. Deleting or rewriting entries up to the head is
+// detected later even if the chain is recomputed. A broken chain is not signed.
+func CreateAuditCheckpoint(db *sql.DB) (components.AuditCheckpoint, error) {
+	checkpointMutex.Lock()
+	defer checkpointMutex.Unlock()
+
+	key := checkpointKey()
+	if len(key) == 0 {
+		return components.AuditCheckpoint{}, ErrNoCheckpointKey
+	}
+
+	verification, err := repository.NewSQLAuditStore(db).Verify()
+	if err != nil {
+		return components.AuditCheckpoint{}, err
+	}
+	if !verification.Intact() {
+		return components.AuditCheckpoint{}, fmt.Errorf("audit log entry %d is %s, not signing a broken chain", verification.BrokenID, verification.Problem)
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	checkpoint := components.AuditCheckpoint{
+		Name:      fmt.Sprintf("audit-checkpoint-%s.json", now.Format(backupTimeFormat)),
+		CreatedAt: now,
+		Entries:   verification.Entries,
+		LastID:    verification.LastID,
+		LastHash:  verification.LastHash,
+	}
+	checkpoint.Signature = signCheckpoint(key, checkpoint)
+
+	content, err := json.MarshalIndent(checkpoint, "", "  ")
+	if err != nil {
+		return components.AuditCheckpoint{}, err
+	}
+	if err := os.MkdirAll(CheckpointDirectory(), 0755); err != nil {
+		return components.AuditCheckpoint{}, err
+	}
+	path := filepath.Join(CheckpointDirectory(), checkpoint.Name)
+	if err := os.WriteFile(path, append(content, '\n'), 0644); err != nil {
+		return components.AuditCheckpoint{}, err
+	}
+	auditLog.Info("Created audit checkpoint", "path", path, "entries", checkpoint.Entries, "last_id", checkpoint.LastID)
+	return checkpoint, nil
+}
+
+// ListAuditCheckpoints returns the checkpoints in the checkpoint directory, newest first
+func ListAuditCheckpoints() ([]components.AuditCheckpoint, error) {
+	entries, err := os.ReadDir(CheckpointDirectory())
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var checkpoints []components.AuditCheckpoint
+	for _, entry := range entries {
+		if entry.IsDir() || !checkpointNamePattern.MatchString(entry.Name()) {
+			continue
+		}
+		content, err := os.ReadFile(filepath.Join(CheckpointDirectory(), entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		var checkpoint components.AuditCheckpoint
+		if err := json.Unmarshal(content, &checkpoint); err != nil {
+			return nil, fmt.Errorf("invalid checkpoint %s: %w", entry.Name(), err)
+		}
+		checkpoint.Name = entry.Name()
+		checkpoints = append(checkpoints, checkpoint)
+	}
+
+	sort.Slice(checkpoints, func(i, j int) bool {
+		return checkpoints[i].Name > checkpoints[j].Name
+	})
+	return checkpoints, nil
+}
+
+// VerifyAudit checks the hash chain of the audit log, the archives of entries
+// removed from it and whether every checkpoint still matches the entry it was
+// taken at
+func VerifyAudit(db *sql.DB) (components.AuditReport, error) {
+	audit := repository.NewSQLAuditStore(db)
+	verification, err := audit.Verify()
+	if err != nil {
+		return components.AuditReport{}, err
+	}
+	report := components.AuditReport{
+		Entries:  verification.Entries,
+		BrokenID: verification.BrokenID,
+		Problem:  string(verification.Problem),
+		LastID:   verification.LastID,
+		LastHash: verification.LastHash,
+	}
+
+	checkpoints, err := ListAuditCheckpoints()
+	if err != nil {
+		return report, err
+	}
+	archives, err := audit.Archives()
+	if err != nil {
+		return report, err
+	}
+
+	// Checkpoints taken before archiving point to entries that are only in the archives now
+	archivedHashes := map[int]string{}
+	for _, checkpoint := range checkpoints {
+		for _, archive := range archives {
+			if checkpoint.LastID >= archive.FirstID && checkpoint.LastID <= archive.LastID {
+				archivedHashes[checkpoint.LastID] = ""
+			}
+		}
+	}
+	prevHash := ""
+	for _, archive := range archives {
+		check := verifyArchive(archive, archivedHashes)
+		if check.Problem == "" && archive.FirstPrevHash != prevHash {
+			check.Problem = ArchiveUnlinked
+		}
+		prevHash = archive.LastHash
+		report.Archives = append([]components.AuditArchiveCheck{check}, report.Archives...)
+	}
+
+	key := checkpointKey()
+	for _, checkpoint := range checkpoints {
+		check := components.AuditCheckpointCheck{Checkpoint: checkpoint}
+		if len(key) == 0 {
+			check.Problem = CheckpointUnverifiable
+		} else if !hmac.Equal([]byte(signCheckpoint(key, checkpoint)), []byte(checkpoint.Signature)) {
+			check.Problem = CheckpointSignature
+		} else if archivedHash, ok := archivedHashes[checkpoint.LastID]; ok {
+			switch archivedHash {
+			case "":
+				check.Problem = CheckpointMissing
+			case checkpoint.LastHash:
+			default:
+				check.Problem = CheckpointMismatch
+			}
+		} else if checkpoint.LastID != 0 {
+			hash, err := audit.Hash(checkpoint.LastID)
+			switch {
+			case errors.Is(err, repository.ErrNotFound):
+				check.Problem = CheckpointMissing
+			case err != nil:
+				return report, err
+			case hash != checkpoint.LastHash:
+				check.Problem = CheckpointMismatch
+			}
+		}
+		report.Checkpoints = append(report.Checkpoints, check)
+	}
+	return report, nil
+}
+
+// StartAuditCheckpointSchedule writes a checkpoint at the configured interval until stop is called.
+// stop waits for a checkpoint that is being written. Without an interval it does nothing.
+func StartAuditCheckpointSchedule(db *sql.DB) (stop func()) {
+	if auditConfig == nil || auditConfig.Audit.CheckpointInterval <= 0 {
+		return func() {}
+	}
+
+	interval := auditConfig.Audit.CheckpointInterval
+	auditLog.Info("Scheduled audit checkpoints", "interval", interval, "directory", CheckpointDirectory())
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if _, err := CreateAuditCheckpoint(db); err != nil {
+					auditLog.Error("Scheduled audit checkpoint failed", "error", err)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(done) })
+		<-stopped
+	}
+}
@@ -0,0 +1,246 @@
+package services
+
+import (
+	"bufio"
+	"compress/gzip"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"gopos/components"
+	"gopos/repository"
+)
+
+// Problems of an archive found by VerifyAudit
+const (
+	ArchiveMissing    = "missing"    // The file was deleted
+	ArchiveUnreadable = "unreadable" // The file is not a compressed JSON Lines file
+	ArchiveModified   = "modified"   // An entry in the file does not match its hash
+	ArchiveUnlinked   = "unlinked"   // An entry does not follow the one before, or the archive not the one before it
+	ArchiveIncomplete = "incomplete" // The file holds other entries than recorded
+)
+
+// archiveInterval is the time between runs of the retention policy
+const archiveInterval = 24 * time.Hour
+
+// ArchiveDirectory returns the directory archives of the audit log are written to
+func ArchiveDirectory() string {
+	if auditConfig != nil && auditConfig.Audit.ArchiveDirectory != "" {
+		return auditConfig.Audit.ArchiveDirectory
+	}
+	return CheckpointDirectory()
+}
+
+// AuditRetention returns the number of days entries stay in the database, 0 if they are kept
+func AuditRetention() int {
+	if auditConfig == nil {
+		return 0
+	}
+	return auditConfig.Audit.RetentionDays
+}
+
+// ArchiveAuditLog moves the entries written before the given time to a
+// compressed JSON Lines file in the archive directory and deletes them from
+// the database. The file is complete before anything is deleted. A broken
+// chain is not archived, so the evidence stays where VerifyAudit finds it.
+// Without entries to archive it returns an archive of 0 entries.
+func ArchiveAuditLog(db *sql.DB, before time.Time) (components.AuditArchive, error) {
+	checkpointMutex.Lock()
+	defer checkpointMutex.Unlock()
+
+	stores := repository.NewSQL(db)
+	rows, err := stores.Audit.Rows(before)
+	if err != nil || len(rows) == 0 {
+		return components.AuditArchive{}, err
+	}
+
+	archives, err := stores.Audit.Archives()
+	if err != nil {
+		return components.AuditArchive{}, err
+	}
+	prevHash := ""
+	if len(archives) > 0 {
+		prevHash = archives[len(archives)-1].LastHash
+	}
+	for _, row := range rows {
+		if row.PrevHash != prevHash || row.Hash != row.AuditRecord.Hash(row.PrevHash) {
+			return components.AuditArchive{}, fmt.Errorf("audit log entry %d breaks the hash chain, not archiving it", row.ID)
+		}
+		prevHash = row.Hash
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	archive := components.AuditArchive{
+		Name:          fmt.Sprintf("audit-archive-%s.jsonl.gz", now.Format(backupTimeFormat)),
+		FirstID:       rows[0].ID,
+		LastID:        rows[len(rows)-1].ID,
+		Entries:       len(rows),
+		FirstPrevHash: rows[0].PrevHash,
+		LastHash:      rows[len(rows)-1].Hash,
+		CreatedAt:     now,
+	}
+	path := filepath.Join(ArchiveDirectory(), archive.Name)
+	if err := writeArchive(path, rows); err != nil {
+		return components.AuditArchive{}, err
+	}
+
+	err = stores.Atomic(func(tx repository.Stores) error {
+		return tx.Audit.Archive(archive)
+	})
+	if err != nil {
+		// The entries are still in the database
+		os.Remove(path)
+		return components.AuditArchive{}, err
+	}
+	auditLog.Info("Archived audit log entries", "path", path, "entries", archive.Entries,
+		"first_id", archive.FirstID, "last_id", archive.LastID)
+	return archive, nil
+}
+
+// writeArchive writes the rows to a new gzip compressed JSON Lines file. It
+// is written under a temporary name first, so path is either complete or missing.
+func writeArchive(path string, rows []repository.AuditRow) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	if _, err := os.Stat(path); err == nil {
+		return fmt.Errorf("archive %s already exists", filepath.Base(path))
+	}
+
+	file, err := os.CreateTemp(filepath.Dir(path), ".audit-archive-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	compressed := gzip.NewWriter(file)
+	encoder := json.NewEncoder(compressed)
+	for _, row := range rows {
+		if err := encoder.Encode(row); err != nil {
+			return err
+		}
+	}
+	if err := compressed.Close(); err != nil {
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), path)
+}
+
+// readArchive calls fn for every entry in an archive file, in the order they were written
+func readArchive(path string, fn func(repository.AuditRow)) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	compressed, err := gzip.NewReader(file)
+	if err != nil {
+		return err
+	}
+	decoder := json.NewDecoder(bufio.NewReader(compressed))
+	for {
+		var row repository.AuditRow
+		if err := decoder.Decode(&row); errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		fn(row)
+	}
+}
+
+// verifyArchive checks that the file of an archive holds the recorded entries
+// and that they form an unbroken chain from FirstPrevHash to LastHash. The
+// hashes of the entries in wanted are filled in along the way.
+func verifyArchive(archive components.AuditArchive, wanted map[int]string) components.AuditArchiveCheck {
+	check := components.AuditArchiveCheck{Archive: archive}
+	prevHash := archive.FirstPrevHash
+	var entries, firstID, lastID int
+	err := readArchive(filepath.Join(ArchiveDirectory(), archive.Name), func(row repository.AuditRow) {
+		if _, ok := wanted[row.ID]; ok {
+			wanted[row.ID] = row.Hash
+		}
+		entries++
+		if firstID == 0 {
+			firstID = row.ID
+		}
+		lastID = row.ID
+		if check.BrokenID != 0 {
+			return
+		}
+		switch {
+		case row.PrevHash != prevHash:
+			check.BrokenID, check.Problem = row.ID, ArchiveUnlinked
+		case row.AuditRecord.Hash(row.PrevHash) != row.Hash:
+			check.BrokenID, check.Problem = row.ID, ArchiveModified
+		}
+		prevHash = row.Hash
+	})
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		check.Problem = ArchiveMissing
+	case err != nil:
+		check.Problem = ArchiveUnreadable
+	case check.Problem != "":
+	case entries != archive.Entries || firstID != archive.FirstID || lastID != archive.LastID:
+		check.Problem = ArchiveIncomplete
+	case prevHash != archive.LastHash:
+		check.Problem = ArchiveUnlinked
+	}
+	return check
+}
+
+// StartAuditArchiveSchedule applies the retention policy now and once a day
+// until stop is called. stop waits for an archive that is being written.
+// Without a retention period it does nothing.
+func StartAuditArchiveSchedule(db *sql.DB) (stop func()) {
+	if AuditRetention() <= 0 {
+		return func() {}
+	}
+
+	days := AuditRetention()
+	auditLog.Info("Scheduled audit log archiving", "retention_days", days, "directory", ArchiveDirectory())
+
+	archive := func() {
+		if _, err := ArchiveAuditLog(db, time.Now().AddDate(0, 0, -days)); err != nil {
+			auditLog.Error("Scheduled audit log archiving failed", "error", err)
+		}
+	}
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		archive()
+		ticker := time.NewTicker(archiveInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				archive()
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(done) })
+		<-stopped
+	}
+}
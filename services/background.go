@@ -0,0 +1,36 @@
+package services
+
+import (
+	"context"
+	"sync"
+)
+
+// background counts the tasks started with Go, such as notification emails
+// sent after the response, so a shutdown can wait for them
+var background sync.WaitGroup
+
+// Go runs fn in the background. WaitBackground waits for it to finish.
+func Go(fn func()) {
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		fn()
+	}()
+}
+
+// WaitBackground waits until all tasks started with Go have finished or ctx
+// is done. Tasks still running then are abandoned.
+func WaitBackground(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		background.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
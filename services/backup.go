@@ -0,0 +1,202 @@
+package services
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"gopos/components"
+	"gopos/config"
+	"gopos/database"
+	"gopos/logging"
+)
+
+const (
+	defaultBackupKeep = 7
+	backupTimeFormat  = "20060102-150405"
+)
+
+// backupNamePattern matches the file names of backups made by CreateBackup
+var backupNamePattern = regexp.MustCompile(`^gopos-\d{8}-\d{6}\.db$`)
+
+var (
+	backupConfig *config.Config
+	// backupMutex keeps a scheduled and a manual backup from running at the same time
+	backupMutex sync.Mutex
+
+	backupLog = logging.Component("backup")
+)
+
+// InitBackupService configures where backups are stored and how many are kept
+func InitBackupService(cfg *config.Config) {
+	backupConfig = cfg
+	backupLog.Info("Service initialized", "directory", BackupDirectory())
+}
+
+// BackupDirectory returns the directory backups are written to
+func BackupDirectory() string {
+	if backupConfig == nil {
+		return "backups"
+	}
+	if backupConfig.Backup.Directory != "" {
+		return backupConfig.Backup.Directory
+	}
+	return filepath.Join(filepath.Dir(backupConfig.Database.Path), "backups")
+}
+
+// BackupSchedule describes the interval of automatic backups, or returns "" if they are disabled
+func BackupSchedule() string {
+	if backupConfig == nil || backupConfig.Backup.Interval <= 0 {
+		return ""
+	}
+	return backupConfig.Backup.Interval.String()
+}
+
+func backupKeep() int {
+	if backupConfig == nil || backupConfig.Backup.Keep <= 0 {
+		return defaultBackupKeep
+	}
+	return backupConfig.Backup.Keep
+}
+
+// CreateBackup writes a snapshot of the database to the backup directory and
+// removes the oldest backups beyond the configured number to keep
+func CreateBackup(db *sql.DB) (components.BackupInfo, error) {
+	backupMutex.Lock()
+	defer backupMutex.Unlock()
+
+	if err := os.MkdirAll(BackupDirectory(), 0755); err != nil {
+		return components.BackupInfo{}, err
+	}
+
+	now := time.Now().UTC()
+	name := fmt.Sprintf("gopos-%s.db", now.Format(backupTimeFormat))
+	path := filepath.Join(BackupDirectory(), name)
+
+	// Backups are named by the second; one taken in the same second is just as current
+	if info, err := os.Stat(path); err == nil {
+		return components.BackupInfo{Name: name, Size: info.Size(), CreatedAt: now}, nil
+	}
+
+	if err := database.Backup(db, path); err != nil {
+		return components.BackupInfo{}, err
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return components.BackupInfo{}, err
+	}
+	backupLog.Info("Created backup", "path", path, "bytes", info.Size())
+
+	if err := pruneBackups(backupKeep()); err != nil {
+		backupLog.Error("Failed to remove old backups", "error", err)
+	}
+
+	return components.BackupInfo{Name: name, Size: info.Size(), CreatedAt: now}, nil
+}
+
+// ListBackups returns the backups in the backup directory, newest first
+func ListBackups() ([]components.BackupInfo, error) {
+	entries, err := os.ReadDir(BackupDirectory())
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var backups []components.BackupInfo
+	for _, entry := range entries {
+		if entry.IsDir() || !backupNamePattern.MatchString(entry.Name()) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		createdAt, err := time.Parse(backupTimeFormat, entry.Name()[len("gopos-"):len(entry.Name())-len(".db")])
+		if err != nil {
+			continue
+		}
+		backups = append(backups, components.BackupInfo{
+			Name:      entry.Name(),
+			Size:      info.Size(),
+			CreatedAt: createdAt,
+		})
+	}
+
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[i].CreatedAt.After(backups[j].CreatedAt)
+	})
+	return backups, nil
+}
+
+// BackupPath returns the path of the backup with the given name. Only names of
+// existing backups are accepted, so the name cannot point outside the directory.
+func BackupPath(name string) (string, error) {
+	if !backupNamePattern.MatchString(name) {
+		return "", os.ErrNotExist
+	}
+	path := filepath.Join(BackupDirectory(), name)
+	if _, err := os.Stat(path); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+func pruneBackups(keep int) error {
+	backups, err := ListBackups()
+	if err != nil {
+		return err
+	}
+	for i := keep; i < len(backups); i++ {
+		if err := os.Remove(filepath.Join(BackupDirectory(), backups[i].Name)); err != nil {
+			return err
+		}
+		backupLog.Info("Removed old backup", "backup", backups[i].Name)
+	}
+	return nil
+}
+
+// StartBackupSchedule creates a backup at the configured interval until stop is called.
+// stop waits for a backup that is being written. Without an interval it does nothing.
+func StartBackupSchedule(db *sql.DB) (stop func()) {
+	if backupConfig == nil || backupConfig.Backup.Interval <= 0 {
+		return func() {}
+	}
+	if database.DialectOf(db) != database.SQLite {
+		backupLog.Warn("Automatic backups are only supported for SQLite, back up the database with its own tools", "dialect", database.DialectOf(db))
+		return func() {}
+	}
+
+	interval := backupConfig.Backup.Interval
+	backupLog.Info("Scheduled backups", "interval", interval, "keep", backupKeep())
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if _, err := CreateBackup(db); err != nil {
+					backupLog.Error("Scheduled backup failed", "error", err)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(done) })
+		<-stopped
+	}
+}
@@ -2,21 +2,25 @@ package services
 
 import (
 	"context"
+	"encoding/base64"
 	"fmt"
-	"log"
 	"strings"
 	"time"
 
 	"gopos/config"
+	"gopos/logging"
+	"gopos/metrics"
 
 	"github.com/karim-w/go-azure-communication-services/emails"
 )
 
 var emailConfig *config.Config
 
+var emailLog = logging.Component("email")
+
 func InitEmailService(cfg *config.Config) {
 	emailConfig = cfg
-	log.Printf("[EMAIL] Service initialized with endpoint: %s", cfg.Email.Endpoint)
+	emailLog.Info("Service initialized", "endpoint", cfg.Email.Endpoint)
 }
 
 type Config struct {
@@ -33,6 +37,13 @@ type Product struct {
 	Quantity int
 }
 
+// Attachment is a file sent along with an email
+type Attachment struct {
+	Name        string
+	ContentType string
+	Content     []byte
+}
+
 // EmailType represents different types of notifications
 type EmailType string
 
@@ -42,24 +53,86 @@ const (
 	EmailTypeUserUpdated EmailType = "user_updated"
 )
 
-// sendEmail is a generic function to send emails using Azure Communication Services
-func sendEmail(toEmail, userName, subject, plainText, htmlContent string) error {
+// Email is a message ready to be sent
+type Email struct {
+	To          string
+	ToName      string
+	Subject     string
+	PlainText   string
+	HTML        string
+	Attachments []Attachment
+}
+
+// EmailSender delivers emails
+type EmailSender interface {
+	Send(email Email) error
+}
+
+// emailSender sends through Azure Communication Services unless replaced by SetEmailSender
+var emailSender EmailSender = azureEmailSender{}
+
+// SetEmailSender replaces the way emails are delivered, e.g. with a fake in
+// tests, and returns the previous sender
+func SetEmailSender(sender EmailSender) EmailSender {
+	previous := emailSender
+	emailSender = sender
+	return previous
+}
+
+// sendEmail is a generic function to send emails with the configured sender
+func sendEmail(toEmail, userName, subject, plainText, htmlContent string, attachments ...Attachment) error {
+	err := emailSender.Send(Email{
+		To:          toEmail,
+		ToName:      userName,
+		Subject:     subject,
+		PlainText:   plainText,
+		HTML:        htmlContent,
+		Attachments: attachments,
+	})
+	metrics.Email(err)
+	return err
+}
+
+// CheckEmailTransport reports why emails cannot be sent, or nil if the
+// transport is configured. A sender set with SetEmailSender is always ready.
+func CheckEmailTransport() error {
+	if _, ok := emailSender.(azureEmailSender); !ok {
+		return nil
+	}
+	return azureEmailSender{}.check()
+}
+
+// azureEmailSender sends emails using Azure Communication Services
+type azureEmailSender struct{}
+
+// check reports settings that are missing to send emails
+func (azureEmailSender) check() error {
 	if emailConfig == nil {
 		return fmt.Errorf("email service not initialized")
 	}
 
-	if emailConfig.Email.Endpoint == "" || emailConfig.Email.AccessKey == "" || emailConfig.Email.SenderMail == "" {
-		return fmt.Errorf("email configuration incomplete: endpoint=%s, access_key=%s, sender_mail=%s",
-			emailConfig.Email.Endpoint,
-			emailConfig.Email.AccessKey,
-			emailConfig.Email.SenderMail)
+	var missing []string
+	for _, setting := range []struct{ name, value string }{
+		{"endpoint", emailConfig.Email.Endpoint},
+		{"access_key", emailConfig.Email.AccessKey},
+		{"sender_mail", emailConfig.Email.SenderMail},
+	} {
+		if setting.value == "" {
+			missing = append(missing, setting.name)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("email configuration incomplete, missing %s", strings.Join(missing, ", "))
 	}
+	return nil
+}
 
-	endpoint := emailConfig.Email.Endpoint
+func (sender azureEmailSender) Send(email Email) error {
+	if err := sender.check(); err != nil {
+		return err
+	}
 
-	log.Printf("[EMAIL] Attempting to send email to: %s", toEmail)
-	log.Printf("[EMAIL] Using sender: %s", emailConfig.Email.SenderMail)
-	log.Printf("[EMAIL] Using endpoint: %s", endpoint)
+	endpoint := emailConfig.Email.Endpoint
 
 	client := emails.NewClient(endpoint, emailConfig.Email.AccessKey, nil)
 
@@ -74,49 +147,55 @@ func sendEmail(toEmail, userName, subject, plainText, htmlContent string) error
 		},
 		SenderAddress: emailConfig.Email.SenderMail,
 		Content: emails.Content{
-			Subject:   subject,
-			PlainText: plainText,
-			HTML:      htmlContent,
+			Subject:   email.Subject,
+			PlainText: email.PlainText,
+			HTML:      email.HTML,
 		},
 		Recipients: emails.Recipients{
 			To: []emails.ReplyTo{
 				{
-					Address:     toEmail,
-					DisplayName: userName,
+					Address:     email.To,
+					DisplayName: email.ToName,
 				},
 			},
 		},
 	}
 
-	log.Printf("[EMAIL] Sending email with subject: %s", subject)
+	for _, attachment := range email.Attachments {
+		payload.Attachments = append(payload.Attachments, emails.Attachment{
+			Name:            attachment.Name,
+			ContentType:     attachment.ContentType,
+			ContentInBase64: base64.StdEncoding.EncodeToString(attachment.Content),
+		})
+	}
+
 	result, err := client.SendEmail(ctx, payload)
 	if err != nil {
-		log.Printf("[EMAIL] Error sending email: %+v", err)
-		log.Printf("[EMAIL] API Response: %+v", result)
+		emailLog.Debug("Sending email failed", "email", email.To, "status", result.Status, "error", err)
 		return fmt.Errorf("failed to send email: %+v", err)
 	}
-	log.Printf("[EMAIL] Email sent successfully with response: %+v", result)
+	emailLog.Debug("Email sent", "email", email.To, "subject", email.Subject, "id", result.ID, "status", result.Status)
 	return nil
 }
 
-// SendTransactionEmail sends an email notification for a transaction
-func SendTransactionEmail(toEmail, userName string, amount float64, newBalance float64, products []Product) error {
+// SendTransactionEmail sends an email notification for a transaction, optionally with the receipt attached
+func SendTransactionEmail(toEmail, userName string, amount float64, newBalance float64, products []Product, attachments ...Attachment) error {
 	// Build product list for plain text
 	var productListText strings.Builder
 	productListText.WriteString("\nAbgerechnete Produkte:\n")
 	for _, p := range products {
-		productListText.WriteString(fmt.Sprintf("- %dx %s (%.2f €)\n", p.Quantity, p.Name, p.Price))
+		productListText.WriteString(fmt.Sprintf("- %dx %s (%s)\n", p.Quantity, p.Name, FormatMoney(p.Price)))
 	}
 
-	subject := fmt.Sprintf("Transaktion: %.2f€", amount)
+	subject := fmt.Sprintf("Transaktion: %s", FormatMoney(amount))
 	messageText := fmt.Sprintf(`Hallo %s,
 
 Ihre Transaktion wurde erfolgreich durchgeführt:
 
-Betrag: %.2f €
-Neuer Kontostand: %.2f €
+Betrag: %s
+Neuer Kontostand: %s
 Zeitpunkt: %s
-%s`, userName, amount, newBalance, time.Now().Format("02.01.2006 15:04:05"), productListText.String())
+%s`, userName, FormatMoney(amount), FormatMoney(newBalance), timestamp(), productListText.String())
 
 	// Build product list for HTML
 	var productListHTML strings.Builder
@@ -125,9 +204,9 @@ Zeitpunkt: %s
             <tr>
                 <td style="padding: 8px">%s</td>
                 <td style="padding: 8px; text-align: center">%d</td>
-                <td style="padding: 8px; text-align: right">%.2f €</td>
-                <td style="padding: 8px; text-align: right">%.2f €</td>
-            </tr>`, p.Name, p.Quantity, p.Price, float64(p.Quantity)*p.Price))
+                <td style="padding: 8px; text-align: right">%s</td>
+                <td style="padding: 8px; text-align: right">%s</td>
+            </tr>`, p.Name, p.Quantity, FormatMoney(p.Price), FormatMoney(float64(p.Quantity)*p.Price)))
 	}
 
 	htmlContent := fmt.Sprintf(`
@@ -160,8 +239,8 @@ Zeitpunkt: %s
         <p>Ihre Transaktion wurde erfolgreich durchgeführt:</p>
         
         <div class="transaction-details">
-            <p>Betrag: <span class="amount">%.2f €</span></p>
-            <p>Neuer Kontostand: <span class="balance">%.2f €</span></p>
+            <p>Betrag: <span class="amount">%s</span></p>
+            <p>Neuer Kontostand: <span class="balance">%s</span></p>
             <p class="timestamp">Zeitpunkt: %s</p>
         </div>
 
@@ -181,21 +260,21 @@ Zeitpunkt: %s
         </table>
     </div>
 </body>
-</html>`, userName, amount, newBalance, time.Now().Format("02.01.2006 15:04:05"), productListHTML.String())
+</html>`, userName, FormatMoney(amount), FormatMoney(newBalance), timestamp(), productListHTML.String())
 
-	return sendEmail(toEmail, userName, subject, messageText, htmlContent)
+	return sendEmail(toEmail, userName, subject, messageText, htmlContent, attachments...)
 }
 
 // SendTopupEmail sends an email notification for a balance top-up
 func SendTopupEmail(toEmail, userName string, amount float64, newBalance float64) error {
-	subject := fmt.Sprintf("Guthaben aufgeladen: %.2f€", amount)
+	subject := fmt.Sprintf("Guthaben aufgeladen: %s", FormatMoney(amount))
 	messageText := fmt.Sprintf(`Hallo %s,
 
 Ihr Guthaben wurde erfolgreich aufgeladen:
 
-Aufgeladener Betrag: %.2f €
-Neuer Kontostand: %.2f €
-Zeitpunkt: %s`, userName, amount, newBalance, time.Now().Format("02.01.2006 15:04:05"))
+Aufgeladener Betrag: %s
+Neuer Kontostand: %s
+Zeitpunkt: %s`, userName, FormatMoney(amount), FormatMoney(newBalance), timestamp())
 
 	htmlContent := fmt.Sprintf(`
 <!DOCTYPE html>
@@ -223,13 +302,13 @@ Zeitpunkt: %s`, userName, amount, newBalance, time.Now().Format("02.01.2006 15:0
         <p>Ihr Guthaben wurde erfolgreich aufgeladen:</p>
         
         <div class="transaction-details">
-            <p>Aufgeladener Betrag: <span class="amount">%.2f €</span></p>
-            <p>Neuer Kontostand: <span class="balance">%.2f €</span></p>
+            <p>Aufgeladener Betrag: <span class="amount">%s</span></p>
+            <p>Neuer Kontostand: <span class="balance">%s</span></p>
             <p class="timestamp">Zeitpunkt: %s</p>
         </div>
     </div>
 </body>
-</html>`, userName, amount, newBalance, time.Now().Format("02.01.2006 15:04:05"))
+</html>`, userName, FormatMoney(amount), FormatMoney(newBalance), timestamp())
 
 	return sendEmail(toEmail, userName, subject, messageText, htmlContent)
 }
@@ -237,9 +316,10 @@ Zeitpunkt: %s`, userName, amount, newBalance, time.Now().Format("02.01.2006 15:0
 // SendUserUpdatedEmail sends an email notification when user information is updated
 func SendUserUpdatedEmail(toEmail, userName string, isNewUser bool, changes map[string]map[string]string) error {
 	var subject, messageText, htmlContent string
+	storeName := GetSettings().StoreName
 
 	if isNewUser {
-		subject = "Willkommen bei GoPOS"
+		subject = "Willkommen bei " + storeName
 
 		// Build account details for plain text
 		var detailsText strings.Builder
@@ -252,10 +332,10 @@ func SendUserUpdatedEmail(toEmail, userName string, isNewUser bool, changes map[
 
 		messageText = fmt.Sprintf(`Hallo %s,
 
-Ihr Benutzerkonto bei GoPOS wurde erfolgreich erstellt. Sie können jetzt alle Funktionen des Systems nutzen.
+Ihr Benutzerkonto bei %s wurde erfolgreich erstellt. Sie können jetzt alle Funktionen des Systems nutzen.
 
 %s
-Zeitpunkt: %s`, userName, detailsText.String(), time.Now().Format("02.01.2006 15:04:05"))
+Zeitpunkt: %s`, userName, storeName, detailsText.String(), timestamp())
 
 		// Build account details for HTML
 		var detailsHTML strings.Builder
@@ -289,11 +369,11 @@ Zeitpunkt: %s`, userName, detailsText.String(), time.Now().Format("02.01.2006 15
 </head>
 <body>
     <div class="header">
-        <h2>Willkommen bei GoPOS</h2>
+        <h2>Willkommen bei %s</h2>
     </div>
     <div class="content">
         <p class="greeting">Hallo %s,</p>
-        <p class="welcome">Willkommen bei GoPOS!</p>
+        <p class="welcome">Willkommen bei %s!</p>
         <p>Ihr Benutzerkonto wurde erfolgreich erstellt. Sie können jetzt alle Funktionen des Systems nutzen.</p>
         
         <div class="update-info">
@@ -313,7 +393,7 @@ Zeitpunkt: %s`, userName, detailsText.String(), time.Now().Format("02.01.2006 15
         </div>
     </div>
 </body>
-</html>`, userName, detailsHTML.String(), time.Now().Format("02.01.2006 15:04:05"))
+</html>`, storeName, userName, storeName, detailsHTML.String(), timestamp())
 	} else {
 		subject = "Ihre Kontoinformationen wurden aktualisiert"
 
@@ -330,12 +410,12 @@ Zeitpunkt: %s`, userName, detailsText.String(), time.Now().Format("02.01.2006 15
 
 		messageText = fmt.Sprintf(`Hallo %s,
 
-Ihre Kontoinformationen bei GoPOS wurden aktualisiert.
+Ihre Kontoinformationen bei %s wurden aktualisiert.
 
 %s
 Zeitpunkt: %s
 
-Wenn Sie diese Änderung nicht vorgenommen haben, kontaktieren Sie bitte den Administrator.`, userName, changesText.String(), time.Now().Format("02.01.2006 15:04:05"))
+Wenn Sie diese Änderung nicht vorgenommen haben, kontaktieren Sie bitte den Administrator.`, userName, storeName, changesText.String(), timestamp())
 
 		// Build changed fields for HTML
 		var changesHTML strings.Builder
@@ -382,7 +462,7 @@ Wenn Sie diese Änderung nicht vorgenommen haben, kontaktieren Sie bitte den Adm
     </div>
     <div class="content">
         <p class="greeting">Hallo %s,</p>
-        <p>Ihre Kontoinformationen bei GoPOS wurden aktualisiert.</p>
+        <p>Ihre Kontoinformationen bei %s wurden aktualisiert.</p>
         
         <div class="update-info">
             <h3>Änderungen</h3>
@@ -404,8 +484,13 @@ Wenn Sie diese Änderung nicht vorgenommen haben, kontaktieren Sie bitte den Adm
         <p class="note">Wenn Sie diese Änderung nicht vorgenommen haben, kontaktieren Sie bitte den Administrator.</p>
     </div>
 </body>
-</html>`, userName, changesHTML.String(), time.Now().Format("02.01.2006 15:04:05"))
+</html>`, userName, storeName, changesHTML.String(), timestamp())
 	}
 
 	return sendEmail(toEmail, userName, subject, messageText, htmlContent)
 }
+
+// timestamp returns the current time in the business timezone for email texts
+func timestamp() string {
+	return time.Now().In(GetSettings().Location()).Format("02.01.2006 15:04:05")
+}
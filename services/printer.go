@@ -0,0 +1,208 @@
+package services
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"gopos/components"
+	"gopos/config"
+	"gopos/logging"
+)
+
+// ESC/POS control sequences
+var (
+	escposInit        = []byte{0x1b, '@'}        // ESC @: reset printer
+	escposCodePage    = []byte{0x1b, 't', 16}    // ESC t 16: WPC1252 code page
+	escposAlignLeft   = []byte{0x1b, 'a', 0}     // ESC a 0
+	escposAlignCenter = []byte{0x1b, 'a', 1}     // ESC a 1
+	escposBoldOn      = []byte{0x1b, 'E', 1}     // ESC E 1
+	escposBoldOff     = []byte{0x1b, 'E', 0}     // ESC E 0
+	escposDoubleSize  = []byte{0x1d, '!', 0x11}  // GS ! 0x11: double width and height
+	escposNormalSize  = []byte{0x1d, '!', 0x00}  // GS ! 0x00
+	escposFeedAndCut  = []byte{0x1d, 'V', 66, 3} // GS V 66 3: feed 3 lines, then partial cut
+)
+
+const (
+	defaultPrinterPort  = "9100"
+	defaultPrinterWidth = 48
+	printerTimeout      = 5 * time.Second
+)
+
+// ErrPrinterNotConfigured is returned when printing without a configured printer
+var ErrPrinterNotConfigured = errors.New("no receipt printer configured")
+
+var printerConfig *config.Config
+
+var printerLog = logging.Component("printer")
+
+// InitPrinterService configures the receipt printer
+func InitPrinterService(cfg *config.Config) {
+	printerConfig = cfg
+	switch {
+	case cfg.Printer.Address != "":
+		printerLog.Info("Service initialized", "address", printerAddress())
+	case cfg.Printer.Device != "":
+		printerLog.Info("Service initialized", "device", cfg.Printer.Device)
+	}
+}
+
+// PrinterConfigured reports whether a receipt printer is set up
+func PrinterConfigured() bool {
+	return printerConfig != nil && (printerConfig.Printer.Address != "" || printerConfig.Printer.Device != "")
+}
+
+// AutoPrintEnabled reports whether every completed checkout should be printed
+func AutoPrintEnabled() bool {
+	return PrinterConfigured() && printerConfig.Printer.AutoPrint
+}
+
+// PrintReceipt renders a receipt as ESC/POS and sends it to the configured printer
+func PrintReceipt(receipt *components.Receipt) error {
+	if !PrinterConfigured() {
+		return ErrPrinterNotConfigured
+	}
+
+	data := RenderReceiptESCPOS(receipt, printerWidth())
+	if printerConfig.Printer.Address != "" {
+		return sendToNetworkPrinter(printerAddress(), data)
+	}
+	return writeToPrinterDevice(printerConfig.Printer.Device, data)
+}
+
+// RenderReceiptESCPOS renders a receipt as ESC/POS byte stream for a printer with
+// the given number of characters per line
+func RenderReceiptESCPOS(receipt *components.Receipt, width int) []byte {
+	settings := GetSettings()
+	var buf bytes.Buffer
+
+	buf.Write(escposInit)
+	buf.Write(escposCodePage)
+
+	// Store header
+	buf.Write(escposAlignCenter)
+	buf.Write(escposDoubleSize)
+	buf.Write(escposBoldOn)
+	writeESCPOSLine(&buf, settings.StoreName)
+	buf.Write(escposBoldOff)
+	buf.Write(escposNormalSize)
+	buf.Write(escposAlignLeft)
+	writeESCPOSLine(&buf, strings.Repeat("-", width))
+
+	writeESCPOSLine(&buf, escposRow("Beleg-Nr.", fmt.Sprint(receipt.TransactionID), width))
+	writeESCPOSLine(&buf, escposRow("Datum", receipt.CreatedAt.In(settings.Location()).Format("02.01.2006 15:04"), width))
+	writeESCPOSLine(&buf, escposRow("Kunde", receipt.CustomerName, width))
+	writeESCPOSLine(&buf, escposRow("Kassierer", receipt.CashierName, width))
+	writeESCPOSLine(&buf, strings.Repeat("-", width))
+
+	// Items
+	money := func(amount float64) string {
+		return components.FormatCurrency(settings, amount)
+	}
+	if receipt.IsTopup() {
+		writeESCPOSLine(&buf, escposRow(receipt.Description, money(receipt.Total), width))
+	} else {
+		for _, item := range receipt.Items {
+			writeESCPOSLine(&buf, item.ProductName)
+			writeESCPOSLine(&buf, escposRow(fmt.Sprintf("  %d x %s", item.Quantity, money(item.Price)), money(item.Price*float64(item.Quantity)), width))
+		}
+		writeESCPOSLine(&buf, strings.Repeat("-", width))
+		buf.Write(escposBoldOn)
+		writeESCPOSLine(&buf, escposRow("Gesamt", money(receipt.Total), width))
+		buf.Write(escposBoldOff)
+	}
+	if receipt.HasBalance {
+		writeESCPOSLine(&buf, escposRow("Neues Guthaben", money(receipt.BalanceAfter), width))
+	}
+
+	// Footer
+	if footer := strings.TrimSpace(settings.ReceiptFooter); footer != "" {
+		writeESCPOSLine(&buf, strings.Repeat("-", width))
+		buf.Write(escposAlignCenter)
+		for _, line := range strings.Split(footer, "\n") {
+			writeESCPOSLine(&buf, strings.TrimSpace(line))
+		}
+		buf.Write(escposAlignLeft)
+	}
+
+	buf.Write(escposFeedAndCut)
+	return buf.Bytes()
+}
+
+// escposRow puts the left text and the right-aligned value on one line, shortening
+// the left text if both do not fit
+func escposRow(left, right string, width int) string {
+	space := width - utf8.RuneCountInString(right) - 1
+	if space < 1 {
+		return left + " " + right
+	}
+	leftRunes := []rune(left)
+	if len(leftRunes) > space {
+		leftRunes = leftRunes[:space]
+	}
+	return string(leftRunes) + strings.Repeat(" ", width-len(leftRunes)-utf8.RuneCountInString(right)) + right
+}
+
+// writeESCPOSLine writes a line of text encoded for the WPC1252 code page
+func writeESCPOSLine(buf *bytes.Buffer, text string) {
+	for _, r := range text {
+		switch {
+		case r == '€':
+			buf.WriteByte(0x80)
+		case r < 0x100:
+			buf.WriteByte(byte(r))
+		default:
+			buf.WriteByte('?')
+		}
+	}
+	buf.WriteByte('\n')
+}
+
+func printerWidth() int {
+	if printerConfig.Printer.Width > 0 {
+		return printerConfig.Printer.Width
+	}
+	return defaultPrinterWidth
+}
+
+// printerAddress returns the configured printer address, using the raw printing port if none is given
+func printerAddress() string {
+	address := printerConfig.Printer.Address
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		return net.JoinHostPort(address, defaultPrinterPort)
+	}
+	return address
+}
+
+func sendToNetworkPrinter(address string, data []byte) error {
+	conn, err := net.DialTimeout("tcp", address, printerTimeout)
+	if err != nil {
+		return fmt.Errorf("failed to connect to printer %s: %v", address, err)
+	}
+	defer conn.Close()
+
+	if err := conn.SetWriteDeadline(time.Now().Add(printerTimeout)); err != nil {
+		return err
+	}
+	if _, err := conn.Write(data); err != nil {
+		return fmt.Errorf("failed to send receipt to printer %s: %v", address, err)
+	}
+	return nil
+}
+
+func writeToPrinterDevice(path string, data []byte) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open printer device %s: %v", path, err)
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to write receipt to %s: %v", path, err)
+	}
+	return file.Close()
+}
@@ -0,0 +1,219 @@
+package services
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"gopos/components"
+
+	"github.com/go-pdf/fpdf"
+)
+
+// Receipt layout for 80mm thermal paper, all sizes in millimetres
+const (
+	receiptPaperWidth = 80.0
+	receiptMargin     = 4.0
+	receiptLineHeight = 4.5
+	receiptLogoHeight = 18.0
+)
+
+// GetReceipt loads a transaction together with its items for printing a receipt
+func GetReceipt(db *sql.DB, transactionID int) (*components.Receipt, error) {
+	var receipt components.Receipt
+	var balanceAfter sql.NullFloat64
+	var description sql.NullString
+	err := db.QueryRow(`
+		SELECT t.id, t.user_id, t.created_at, u.name, c.name, t.total, t.balance_after, t.description
+		FROM transactions t
+		JOIN users u ON t.user_id = u.id
+		JOIN users c ON t.cashier_id = c.id
+		WHERE t.id = ?
+	`, transactionID).Scan(&receipt.TransactionID, &receipt.UserID, &receipt.CreatedAt, &receipt.CustomerName,
+		&receipt.CashierName, &receipt.Total, &balanceAfter, &description)
+	if err != nil {
+		return nil, err
+	}
+	receipt.BalanceAfter = balanceAfter.Float64
+	receipt.HasBalance = balanceAfter.Valid
+	receipt.Description = description.String
+
+	rows, err := db.Query(`
+		SELECT p.name, ti.quantity, ti.price
+		FROM transaction_items ti
+		JOIN products p ON p.id = ti.product_id
+		WHERE ti.transaction_id = ?
+		ORDER BY ti.id
+	`, transactionID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var item components.TransactionItem
+		if err := rows.Scan(&item.ProductName, &item.Quantity, &item.Price); err != nil {
+			return nil, err
+		}
+		receipt.Items = append(receipt.Items, item)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return &receipt, nil
+}
+
+// RenderReceiptPDF renders a receipt as a PDF sized for 80mm thermal paper
+func RenderReceiptPDF(db *sql.DB, receipt *components.Receipt) ([]byte, error) {
+	settings := GetSettings()
+	contentWidth := receiptPaperWidth - 2*receiptMargin
+
+	pdf := fpdf.NewCustom(&fpdf.InitType{
+		UnitStr: "mm",
+		Size:    fpdf.SizeType{Wd: receiptPaperWidth, Ht: 200},
+	})
+	pdf.SetMargins(receiptMargin, receiptMargin, receiptMargin)
+	pdf.SetAutoPageBreak(false, 0)
+	pdf.SetTitle(fmt.Sprintf("%s - Beleg %d", settings.StoreName, receipt.TransactionID), true)
+	pdf.SetFont("Courier", "", 9)
+	tr := pdf.UnicodeTranslatorFromDescriptor("")
+	money := func(amount float64) string {
+		return tr(components.FormatCurrency(settings, amount))
+	}
+
+	// The page height depends on the content, so measure before adding the page
+	var logo []byte
+	var logoType string
+	if settings.HasLogo {
+		var err error
+		logo, logoType, err = GetLogo(db)
+		if err != nil && err != sql.ErrNoRows {
+			return nil, err
+		}
+	}
+
+	lines := 8
+	for _, item := range receipt.Items {
+		lines += len(wrapReceiptText(pdf, tr(item.ProductName), contentWidth)) + 1
+	}
+	footerLines := splitReceiptFooter(pdf, tr, settings.ReceiptFooter, contentWidth)
+	lines += len(footerLines) + 2
+	height := 2*receiptMargin + 12 + float64(lines)*receiptLineHeight
+	if len(logo) > 0 {
+		height += receiptLogoHeight + 2
+	}
+	pdf.AddPageFormat("P", fpdf.SizeType{Wd: receiptPaperWidth, Ht: height})
+
+	// Store header
+	if len(logo) > 0 {
+		imageType := "PNG"
+		if logoType == "image/jpeg" {
+			imageType = "JPG"
+		}
+		info := pdf.RegisterImageOptionsReader("logo", fpdf.ImageOptions{ImageType: imageType}, bytes.NewReader(logo))
+		if pdf.Ok() && info != nil {
+			width := info.Width() * receiptLogoHeight / info.Height()
+			if width > contentWidth {
+				width = contentWidth
+			}
+			pdf.ImageOptions("logo", (receiptPaperWidth-width)/2, pdf.GetY(), width, 0, true, fpdf.ImageOptions{ImageType: imageType}, 0, "")
+			pdf.Ln(2)
+		} else {
+			// A broken logo should not prevent printing the receipt
+			pdf.ClearError()
+		}
+	}
+	pdf.SetFont("Courier", "B", 12)
+	pdf.CellFormat(contentWidth, 6, tr(settings.StoreName), "", 1, "C", false, 0, "")
+	pdf.SetFont("Courier", "", 9)
+	receiptRule(pdf, contentWidth)
+
+	receiptRow(pdf, contentWidth, "Beleg-Nr.", fmt.Sprint(receipt.TransactionID))
+	receiptRow(pdf, contentWidth, "Datum", receipt.CreatedAt.In(settings.Location()).Format("02.01.2006 15:04"))
+	receiptRow(pdf, contentWidth, "Kunde", tr(receipt.CustomerName))
+	receiptRow(pdf, contentWidth, "Kassierer", tr(receipt.CashierName))
+	receiptRule(pdf, contentWidth)
+
+	// Items
+	if receipt.IsTopup() {
+		receiptRow(pdf, contentWidth, tr(receipt.Description), money(receipt.Total))
+	} else {
+		for _, item := range receipt.Items {
+			for _, line := range wrapReceiptText(pdf, tr(item.ProductName), contentWidth) {
+				pdf.CellFormat(contentWidth, receiptLineHeight, line, "", 1, "L", false, 0, "")
+			}
+			receiptRow(pdf, contentWidth, fmt.Sprintf("  %d x %s", item.Quantity, money(item.Price)), money(item.Price*float64(item.Quantity)))
+		}
+		receiptRule(pdf, contentWidth)
+		pdf.SetFont("Courier", "B", 10)
+		receiptRow(pdf, contentWidth, "Gesamt", money(receipt.Total))
+		pdf.SetFont("Courier", "", 9)
+	}
+	if receipt.HasBalance {
+		receiptRow(pdf, contentWidth, "Neues Guthaben", money(receipt.BalanceAfter))
+	}
+
+	// Footer
+	if len(footerLines) > 0 {
+		receiptRule(pdf, contentWidth)
+		for _, line := range footerLines {
+			pdf.CellFormat(contentWidth, receiptLineHeight, line, "", 1, "C", false, 0, "")
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := pdf.Output(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func receiptRow(pdf *fpdf.Fpdf, width float64, left, right string) {
+	pdf.CellFormat(width, receiptLineHeight, left, "", 0, "L", false, 0, "")
+	pdf.SetX(receiptMargin)
+	pdf.CellFormat(width, receiptLineHeight, right, "", 1, "R", false, 0, "")
+}
+
+func receiptRule(pdf *fpdf.Fpdf, width float64) {
+	y := pdf.GetY() + 1.5
+	pdf.SetDashPattern([]float64{1, 1}, 0)
+	pdf.Line(receiptMargin, y, receiptMargin+width, y)
+	pdf.SetDashPattern([]float64{}, 0)
+	pdf.SetY(y + 1.5)
+}
+
+func splitReceiptFooter(pdf *fpdf.Fpdf, tr func(string) string, footer string, width float64) []string {
+	var lines []string
+	for _, paragraph := range strings.Split(strings.TrimSpace(footer), "\n") {
+		paragraph = strings.TrimSpace(paragraph)
+		if paragraph == "" {
+			continue
+		}
+		lines = append(lines, wrapReceiptText(pdf, tr(paragraph), width)...)
+	}
+	return lines
+}
+
+// wrapReceiptText breaks already translated text into lines that fit the given width.
+// fpdf's SplitText expects UTF-8 and cannot be used on translated text.
+func wrapReceiptText(pdf *fpdf.Fpdf, text string, width float64) []string {
+	var lines []string
+	var line string
+	for _, word := range strings.Fields(text) {
+		candidate := word
+		if line != "" {
+			candidate = line + " " + word
+		}
+		if line != "" && pdf.GetStringWidth(candidate) > width {
+			lines = append(lines, line)
+			candidate = word
+		}
+		line = candidate
+	}
+	if line != "" {
+		lines = append(lines, line)
+	}
+	return lines
+}
@@ -0,0 +1,151 @@
+package services
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"time"
+
+	"gopos/components"
+	"gopos/database"
+	"gopos/repository"
+)
+
+// BuildReport computes the revenue report for the days from through to (inclusive).
+// Both dates are midnight in the business timezone; sales and top-ups are bucketed
+// in that timezone as well.
+func BuildReport(db *sql.DB, from, to time.Time, group string) (*components.Report, error) {
+	end := to.AddDate(0, 0, 1)
+	days := daysBetween(from, end)
+
+	report := &components.Report{
+		From:         from,
+		To:           to,
+		PreviousFrom: from.AddDate(0, 0, -days),
+		PreviousTo:   from.AddDate(0, 0, -1),
+		Group:        group,
+	}
+
+	// Create empty periods so days without sales show up as well
+	for start := periodStart(from, group); start.Before(end); start = nextPeriod(start, group) {
+		report.Periods = append(report.Periods, components.ReportPeriod{
+			Label: periodLabel(start, group),
+			Start: start,
+			End:   nextPeriod(start, group),
+		})
+	}
+
+	rows, err := db.Query(`
+		SELECT t.created_at, c.name, t.total, t.kind
+		FROM transactions t
+		JOIN users c ON t.cashier_id = c.id
+		WHERE t.created_at >= ? AND t.created_at < ?
+		ORDER BY t.created_at
+	`, database.FormatTime(report.PreviousFrom), database.FormatTime(end))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	cashiers := make(map[string]*components.CashierReport)
+	period := 0
+	for rows.Next() {
+		var createdAt time.Time
+		var cashier string
+		var total float64
+		var kind string
+		if err := rows.Scan(&createdAt, &cashier, &total, &kind); err != nil {
+			return nil, err
+		}
+		createdAt = createdAt.In(from.Location())
+
+		if createdAt.Before(from) {
+			addToSummary(&report.Previous, total, kind)
+			continue
+		}
+		addToSummary(&report.Current, total, kind)
+
+		// Rows are ordered by time, so the matching period never lies behind the current one
+		for period < len(report.Periods)-1 && !createdAt.Before(report.Periods[period].End) {
+			period++
+		}
+		addToSummary(&report.Periods[period].ReportSummary, total, kind)
+
+		if cashiers[cashier] == nil {
+			cashiers[cashier] = &components.CashierReport{Name: cashier}
+		}
+		addToSummary(&cashiers[cashier].ReportSummary, total, kind)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, cashier := range cashiers {
+		report.Cashiers = append(report.Cashiers, *cashier)
+	}
+	sort.Slice(report.Cashiers, func(i, j int) bool {
+		if report.Cashiers[i].Revenue != report.Cashiers[j].Revenue {
+			return report.Cashiers[i].Revenue > report.Cashiers[j].Revenue
+		}
+		return report.Cashiers[i].Name < report.Cashiers[j].Name
+	})
+
+	return report, nil
+}
+
+// addToSummary counts sales and top-ups. Manual bookings correct a balance and are neither.
+func addToSummary(summary *components.ReportSummary, total float64, kind string) {
+	switch kind {
+	case repository.TransactionSale:
+		summary.Revenue += total
+		summary.Sales++
+	case repository.TransactionTopup:
+		summary.Topups += total
+	}
+}
+
+// daysBetween counts calendar days, which is not the same as 24 hour periods across DST changes
+func daysBetween(from, to time.Time) int {
+	days := 0
+	for day := from; day.Before(to); day = day.AddDate(0, 0, 1) {
+		days++
+	}
+	return days
+}
+
+// periodStart returns the start of the day, ISO week or month containing t
+func periodStart(t time.Time, group string) time.Time {
+	switch group {
+	case components.ReportGroupWeek:
+		day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+		offset := (int(day.Weekday()) + 6) % 7 // Monday is the first day of the week
+		return day.AddDate(0, 0, -offset)
+	case components.ReportGroupMonth:
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, t.Location())
+	default:
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	}
+}
+
+func nextPeriod(start time.Time, group string) time.Time {
+	switch group {
+	case components.ReportGroupWeek:
+		return start.AddDate(0, 0, 7)
+	case components.ReportGroupMonth:
+		return start.AddDate(0, 1, 0)
+	default:
+		return start.AddDate(0, 0, 1)
+	}
+}
+
+func periodLabel(start time.Time, group string) string {
+	switch group {
+	case components.ReportGroupWeek:
+		year, week := start.ISOWeek()
+		return fmt.Sprintf("KW %02d/%d", week, year)
+	case components.ReportGroupMonth:
+		return start.Format("01/2006")
+	default:
+		return start.Format("02.01.2006")
+	}
+}
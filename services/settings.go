@@ -0,0 +1,158 @@
+package services
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"sync"
+
+	"gopos/components"
+	"gopos/logging"
+)
+
+// Keys of the settings table
+const (
+	settingStoreName     = "store_name"
+	settingCurrency      = "currency"
+	settingTimezone      = "timezone"
+	settingReceiptFooter = "receipt_footer"
+	settingLogo          = "logo"
+	settingLogoType      = "logo_content_type"
+)
+
+var (
+	currentSettings = components.DefaultSettings()
+	settingsMutex   sync.RWMutex
+
+	settingsLog = logging.Component("settings")
+)
+
+// LoadSettings reads the store settings from the database and makes them active
+func LoadSettings(db *sql.DB) error {
+	rows, err := db.Query("SELECT key, value FROM settings")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	settings := components.DefaultSettings()
+	for rows.Next() {
+		var key, value string
+		if err := rows.Scan(&key, &value); err != nil {
+			return err
+		}
+
+		switch key {
+		case settingStoreName:
+			settings.StoreName = value
+		case settingCurrency:
+			settings.Currency = value
+		case settingTimezone:
+			settings.Timezone = value
+		case settingReceiptFooter:
+			settings.ReceiptFooter = value
+		case settingLogo:
+			settings.HasLogo = value != ""
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	settingsMutex.Lock()
+	currentSettings = settings
+	settingsMutex.Unlock()
+
+	settingsLog.Info("Loaded settings", "store", settings.StoreName, "currency", settings.Currency, "timezone", settings.Timezone)
+	return nil
+}
+
+// GetSettings returns the currently active store settings
+func GetSettings() components.Settings {
+	settingsMutex.RLock()
+	defer settingsMutex.RUnlock()
+	return currentSettings
+}
+
+// Logo is a store logo to save with SaveSettings
+type Logo struct {
+	Image       []byte
+	ContentType string
+}
+
+// SaveSettings stores the given settings and makes them active. A nil logo keeps
+// the current one and a logo without an image removes it. Settings and logo are
+// saved together or not at all.
+func SaveSettings(db *sql.DB, settings components.Settings, logo *Logo) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	values := map[string]string{
+		settingStoreName:     settings.StoreName,
+		settingCurrency:      settings.Currency,
+		settingTimezone:      settings.Timezone,
+		settingReceiptFooter: settings.ReceiptFooter,
+	}
+	if logo != nil {
+		values[settingLogo] = base64.StdEncoding.EncodeToString(logo.Image)
+		values[settingLogoType] = logo.ContentType
+	}
+	for key, value := range values {
+		if err := putSetting(tx, key, value); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	settingsMutex.Lock()
+	settings.HasLogo = currentSettings.HasLogo
+	if logo != nil {
+		settings.HasLogo = len(logo.Image) > 0
+	}
+	currentSettings = settings
+	settingsMutex.Unlock()
+
+	return nil
+}
+
+// GetLogo returns the store logo and its content type, or sql.ErrNoRows if no logo is set
+func GetLogo(db *sql.DB) ([]byte, string, error) {
+	var encoded, contentType string
+	err := db.QueryRow("SELECT value FROM settings WHERE key = ?", settingLogo).Scan(&encoded)
+	if err != nil {
+		return nil, "", err
+	}
+	if encoded == "" {
+		return nil, "", sql.ErrNoRows
+	}
+
+	err = db.QueryRow("SELECT value FROM settings WHERE key = ?", settingLogoType).Scan(&contentType)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, "", err
+	}
+
+	image, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, "", err
+	}
+	return image, contentType, nil
+}
+
+// FormatMoney formats an amount in the configured store currency
+func FormatMoney(amount float64) string {
+	return components.FormatCurrency(GetSettings(), amount)
+}
+
+func putSetting(tx *sql.Tx, key, value string) error {
+	_, err := tx.Exec(`
+		INSERT INTO settings (key, value)
+		VALUES (?, ?)
+		ON CONFLICT(key) DO UPDATE SET value = excluded.value
+	`, key, value)
+	return err
+}
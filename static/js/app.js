@@ -0,0 +1,193 @@
+// Behaviour shared by all pages. The Content-Security-Policy does not allow
+// inline scripts or event handler attributes, so elements opt in with data
+// attributes instead.
+
+// Add CSRF token to all HTMX requests
+document.addEventListener('htmx:configRequest', function(evt) {
+    evt.detail.headers['X-CSRF-Token'] = document.querySelector('meta[name="csrf-token"]').content;
+});
+
+// Clicks on elements with data attributes
+document.addEventListener('click', function(event) {
+    // Close a dismissible message
+    const dismiss = event.target.closest('[data-dismiss]');
+    if (dismiss) {
+        dismiss.closest('[data-dismissible]').remove();
+        return;
+    }
+
+    // Close a modal from its backdrop or close button
+    const modalClose = event.target.closest('[data-modal-close]');
+    if (modalClose) {
+        document.getElementById(modalClose.dataset.modalClose).classList.add('hidden');
+        return;
+    }
+
+    if (event.target.closest('[data-print]')) {
+        window.print();
+        return;
+    }
+
+    // Table rows that link to a page
+    const row = event.target.closest('tr[data-href]');
+    if (row) {
+        window.location.href = row.dataset.href;
+    }
+});
+
+// Ask before submitting forms with data-confirm, e.g. to delete a user
+document.addEventListener('submit', function(event) {
+    const form = event.target.closest('form[data-confirm]');
+    if (form && !confirm(form.dataset.confirm)) {
+        event.preventDefault();
+        event.stopImmediatePropagation();
+    }
+}, true);
+
+// Enter in a scanner field moves on to the field named in data-next-field
+// instead of submitting the form
+document.addEventListener('keydown', function(event) {
+    const input = event.target.closest('[data-next-field]');
+    if (input && event.key === 'Enter') {
+        event.preventDefault();
+        document.getElementById(input.dataset.nextField).focus();
+    }
+});
+
+// Select the value of fields with data-select-on-focus, so a scan replaces it
+document.addEventListener('focusin', function(event) {
+    const input = event.target.closest('[data-select-on-focus]');
+    if (input && input.value) {
+        input.select();
+    }
+});
+
+// Amount fields accept a comma as decimal separator
+document.addEventListener('input', function(event) {
+    const input = event.target.closest('input[data-decimal]');
+    if (!input) return;
+
+    // Nur Zahlen, Komma und Punkt erlauben
+    input.value = input.value.replace(/[^0-9.,]/g, '');
+    // Komma zu Punkt umwandeln - alle Kommas ersetzen
+    input.value = input.value.replace(/,/g, '.');
+    // Sicherstellen, dass höchstens ein Dezimalpunkt vorhanden ist
+    const parts = input.value.split('.');
+    if (parts.length > 2) {
+        input.value = parts[0] + '.' + parts.slice(1).join('');
+    }
+});
+
+document.addEventListener('DOMContentLoaded', function() {
+    // Add loading state to all forms
+    document.querySelectorAll('form').forEach(form => {
+        form.addEventListener('submit', function() {
+            // Nochmal sicherstellen, dass alle Kommas in Punkte umgewandelt wurden
+            this.querySelectorAll('input[data-decimal]').forEach(input => {
+                input.value = input.value.replace(/,/g, '.');
+            });
+
+            const button = this.querySelector('button[type="submit"]');
+            if (button) {
+                const originalContent = button.innerHTML;
+                button.innerHTML = '<i class="fas fa-circle-notch fa-spin mr-2"></i>Verarbeite...';
+                button.disabled = true;
+
+                // Reset button after timeout (in case of error)
+                setTimeout(() => {
+                    if (button.disabled) {
+                        button.innerHTML = originalContent;
+                        button.disabled = false;
+                    }
+                }, 5000);
+            }
+        });
+    });
+
+    initLogin();
+    initDashboardNotifications();
+    initCountdown();
+});
+
+window.addEventListener('load', function() {
+    // Receipts opened for printing right after a sale
+    if (document.body.dataset.autoPrint !== undefined) {
+        window.print();
+    }
+});
+
+// Prevent the login form from being sent twice by a scanner
+function initLogin() {
+    const form = document.getElementById('login-form');
+    const submitButton = document.getElementById('submit-button');
+    if (!form || !submitButton) return;
+
+    form.addEventListener('submit', function(event) {
+        if (submitButton.disabled) {
+            event.preventDefault();
+            return;
+        }
+        submitButton.disabled = true;
+        submitButton.innerHTML = '<i class="fas fa-circle-notch fa-spin mr-2"></i>Anmeldung...';
+    });
+
+    // Re-enable the submit button if the form submission fails
+    form.addEventListener('invalid', function() {
+        submitButton.disabled = false;
+        submitButton.innerHTML = '<i class="fas fa-sign-in-alt mr-2"></i>Anmelden';
+    }, true);
+}
+
+// Show the message passed in the URL on the dashboard
+function initDashboardNotifications() {
+    const successNotification = document.getElementById('successNotification');
+    const errorNotification = document.getElementById('errorNotification');
+
+    // If we're not on the dashboard page, don't initialize anything
+    if (!successNotification || !errorNotification) return;
+
+    // Get URL parameters
+    const urlParams = new URLSearchParams(window.location.search);
+    const success = urlParams.get('success');
+    const message = urlParams.get('message');
+    const error = urlParams.get('error');
+
+    // Show success message if present
+    if (success === 'true' && message) {
+        showNotification('success', message);
+    }
+
+    // Show error message if present
+    if (error) {
+        showNotification('error', error);
+    }
+
+    function showNotification(type, message) {
+        const notification = type === 'success' ? successNotification : errorNotification;
+        const messageElement = document.getElementById(type + 'Message');
+        if (!notification || !messageElement) return;
+
+        messageElement.textContent = message;
+        notification.style.transform = 'translateX(-100%)';
+
+        setTimeout(() => {
+            notification.style.transform = 'translateX(100%)';
+        }, 3000);
+    }
+}
+
+// Go back to the start page after a completed top-up
+function initCountdown() {
+    const countdown = document.getElementById('countdown');
+    if (!countdown) return;
+
+    let count = parseInt(countdown.textContent, 10);
+    const timer = setInterval(() => {
+        count--;
+        countdown.textContent = count;
+        if (count <= 0) {
+            clearInterval(timer);
+            window.location.href = countdown.dataset.redirect || '/';
+        }
+    }, 1000);
+}
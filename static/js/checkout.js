@@ -0,0 +1,438 @@
+// Checkout page: the cart is kept on the server and changed over /api/cart/...
+
+// Only initialize checkout functionality if we're on the checkout page
+document.addEventListener('DOMContentLoaded', () => {
+    const customerForm = document.getElementById('customer-form');
+    // If we're not on the checkout page, don't initialize anything
+    if (!customerForm) return;
+
+    // The cart is held on the server; this is only the last state we received
+    let cart = null;
+    const currency = document.getElementById('checkout').dataset.currency;
+    const cartItemsElement = document.getElementById('cartItems');
+    const cartTotalElement = document.getElementById('cartTotal');
+    const checkoutBtn = document.getElementById('checkoutBtn');
+    const productForm = document.getElementById('product-form');
+    const cardInput = document.getElementById('card_number');
+    const barcodeInput = document.getElementById('barcode');
+    const customerInfo = document.getElementById('customer-info');
+    const customerFormContainer = document.getElementById('customer-form-container');
+    const customerName = document.getElementById('customer-name');
+    const customerBalance = document.getElementById('customer-balance');
+    const openCartsElement = document.getElementById('open-carts');
+    const csrfToken = document.querySelector('input[name="csrf_token"]').value;
+
+    function escapeHTML(value) {
+        const div = document.createElement('div');
+        div.textContent = value;
+        return div.innerHTML;
+    }
+
+    // Send a change to the server and return the JSON response
+    async function cartRequest(url, body) {
+        const response = await fetch(url, {
+            method: 'POST',
+            headers: {
+                'Content-Type': 'application/json',
+                'X-CSRF-Token': csrfToken
+            },
+            body: body ? JSON.stringify(body) : null
+        });
+        if (!response.ok) {
+            throw new Error(await response.text() || 'Ein Fehler ist aufgetreten');
+        }
+        return response.json();
+    }
+
+    // Change the current cart and show the result; a cart that was completed
+    // or taken over elsewhere is replaced by a fresh one
+    async function changeCart(action, body) {
+        try {
+            cart = await cartRequest(`/api/cart/${action}?id=${cart.id}`, body);
+            updateCart();
+            return true;
+        } catch (error) {
+            alert(error.message);
+            await loadCart();
+            return false;
+        }
+    }
+
+    async function loadCart() {
+        try {
+            cart = await cartRequest('/api/cart/open');
+            updateCart();
+        } catch (error) {
+            console.error('Error loading cart:', error);
+            alert('Warenkorb konnte nicht geladen werden');
+        }
+        loadOpenCarts();
+    }
+
+    async function loadOpenCarts() {
+        try {
+            const response = await fetch('/api/carts');
+            if (!response.ok) return;
+            const carts = (await response.json()).filter(other =>
+                (!cart || other.id !== cart.id) && (other.customer || other.items.length > 0));
+
+            if (carts.length === 0) {
+                openCartsElement.innerHTML = '<p class="text-gray-500 text-sm">Keine weiteren offenen Warenkörbe</p>';
+                return;
+            }
+
+            openCartsElement.innerHTML = carts.map(other => `
+                <div class="flex items-center justify-between p-3 bg-gray-50 rounded-lg">
+                    <div>
+                        <p class="font-medium text-gray-900">${escapeHTML(other.register)} · ${escapeHTML(other.cashier_name)}</p>
+                        <p class="text-sm text-gray-600">
+                            ${other.customer ? escapeHTML(other.customer.name) : 'Kein Kunde'} ·
+                            ${other.items.reduce((sum, item) => sum + item.quantity, 0)} Artikel ·
+                            ${other.total.toFixed(2)} ${currency}
+                        </p>
+                    </div>
+                    <button data-action="take-over" data-cart-id="${other.id}"
+                            class="px-3 py-2 text-sm font-medium text-brand-700 bg-brand-50 rounded-lg hover:bg-brand-100 transition-colors">
+                        <i class="fas fa-hand-holding mr-1"></i>
+                        Übernehmen
+                    </button>
+                </div>
+            `).join('');
+        } catch (error) {
+            console.error('Error loading open carts:', error);
+        }
+    }
+
+    function updateQuantity(productID, quantity) {
+        if (quantity <= 0) {
+            removeItem(productID);
+            return;
+        }
+        changeCart('quantity', { product_id: productID, quantity: quantity });
+    }
+
+    function removeItem(productID) {
+        changeCart('remove', { product_id: productID });
+    }
+
+    async function takeOverCart(cartID) {
+        try {
+            cart = await cartRequest(`/api/cart/takeover?id=${cartID}`);
+            updateCart();
+        } catch (error) {
+            alert(error.message);
+        }
+        loadOpenCarts();
+    }
+
+    function editQuantity(quantitySpan, productID, currentQuantity) {
+        // Replace the span with an input field
+        const spanParent = quantitySpan.parentNode;
+        
+        // Create the input element
+        const input = document.createElement('input');
+        input.type = 'number';
+        input.value = currentQuantity;
+        input.min = 1;
+        input.step = 1;  // Nur ganze Zahlen erlauben
+        input.pattern = "[0-9]*";  // Nur Ziffern erlauben
+        input.inputMode = "numeric";  // Numerische Tastatur auf Mobilgeräten
+        input.className = 'w-16 px-2 py-1 text-lg border border-brand-500 rounded-lg text-center focus:outline-none focus:ring-2 focus:ring-brand-500';
+        
+        // Replace the span with the input
+        spanParent.replaceChild(input, quantitySpan);
+        
+        // Focus and select the input
+        input.focus();
+        input.select();
+        
+        // Function to update and restore the span
+        const updateAndRestore = () => {
+            // Stelle sicher, dass die Eingabe eine ganze Zahl ist
+            input.value = input.value.replace(/,/g, '').replace(/\./g, '');
+            const newQuantity = parseInt(input.value, 10);
+            
+            if (isNaN(newQuantity) || newQuantity <= 0) {
+                alert("Bitte geben Sie eine gültige ganze Zahl größer als 0 ein.");
+                input.focus();
+                input.select();
+                return;
+            }
+            
+            if (newQuantity > 100) {
+                if (!confirm(`Sind Sie sicher, dass Sie ${newQuantity} Stück hinzufügen möchten?`)) {
+                    input.focus();
+                    input.select();
+                    return;
+                }
+            }
+            
+            // Remove the input and event listeners
+            input.removeEventListener('blur', updateAndRestore);
+            input.removeEventListener('keydown', handleKeyDown);
+            
+            // The span will be re-created by updateCart()
+            updateQuantity(productID, newQuantity);
+        };
+        
+        // Handle key events
+        const handleKeyDown = (e) => {
+            if (e.key === 'Enter') {
+                e.preventDefault();
+                updateAndRestore();
+            } else if (e.key === 'Escape') {
+                e.preventDefault();
+                // Just restore the span without updating
+                input.removeEventListener('blur', updateAndRestore);
+                updateCart();  // This will re-render the cart and restore the span
+            }
+        };
+        
+        // Add event listeners
+        input.addEventListener('blur', updateAndRestore);
+        input.addEventListener('keydown', handleKeyDown);
+    }
+
+    // Discard the current cart and start over with an empty one
+    async function clearCustomer() {
+        if (cart.items.length > 0 && !confirm('Warenkorb verwerfen?')) return;
+        try {
+            await cartRequest(`/api/cart/discard?id=${cart.id}`);
+        } catch (error) {
+            console.error('Error discarding cart:', error);
+        }
+        cardInput.value = '';
+        barcodeInput.value = '';
+        await loadCart();
+    }
+
+    // Buttons in the rendered cart and in the list of open carts
+    document.getElementById('checkout').addEventListener('click', (e) => {
+        const target = e.target.closest('[data-action]');
+        if (!target) return;
+
+        const productID = parseInt(target.dataset.productId, 10);
+        const quantity = parseInt(target.dataset.quantity, 10);
+        switch (target.dataset.action) {
+            case 'clear-customer':
+                clearCustomer();
+                break;
+            case 'take-over':
+                takeOverCart(parseInt(target.dataset.cartId, 10));
+                break;
+            case 'remove':
+                removeItem(productID);
+                break;
+            case 'quantity':
+                updateQuantity(productID, quantity);
+                break;
+            case 'edit-quantity':
+                editQuantity(target, productID, quantity);
+                break;
+        }
+    });
+
+    function updateCart() {
+        const customer = cart.customer;
+        if (customer) {
+            customerName.textContent = customer.name || 'Unbekannt';
+            customerBalance.textContent = `Guthaben: ${customer.balance.toFixed(2)} ${currency}`;
+            customerInfo.classList.remove('hidden');
+            customerFormContainer.classList.add('hidden');
+            barcodeInput.disabled = false;
+            cardInput.disabled = true;
+            barcodeInput.focus();
+        } else {
+            customerInfo.classList.add('hidden');
+            customerFormContainer.classList.remove('hidden');
+            barcodeInput.disabled = true;
+            cardInput.disabled = false;
+            cardInput.focus();
+        }
+
+        if (cart.items.length === 0) {
+            cartItemsElement.innerHTML = `
+                <div class="text-center py-8">
+                    <i class="fas fa-shopping-basket text-2xl text-gray-400 mb-2"></i>
+                    <p class="text-gray-500 text-sm">Warenkorb ist leer</p>
+                </div>
+            `;
+            cartTotalElement.textContent = '0.00 ' + currency;
+            checkoutBtn.disabled = true;
+            return;
+        }
+
+        let html = '';
+
+        cart.items.forEach(item => {
+            html += `
+                <div class="p-4 bg-gray-50 rounded-lg shadow mb-4">
+                    <div class="flex justify-between items-start">
+                        <div class="flex-grow">
+                            <h3 class="text-lg font-medium text-gray-900">${escapeHTML(item.name)}</h3>
+                            <p class="text-gray-600">${item.price.toFixed(2)} ${currency} pro Stück</p>
+                        </div>
+                        <button data-action="remove" data-product-id="${item.product_id}"
+                                class="ml-4 p-3 text-red-500 hover:text-red-600 hover:bg-red-50 rounded-lg transition-colors text-lg">
+                            <i class="fas fa-trash"></i>
+                        </button>
+                    </div>
+                    <div class="mt-4 flex items-center justify-between">
+                        <div class="flex items-center space-x-4">
+                            <button data-action="quantity" data-product-id="${item.product_id}" data-quantity="${item.quantity - 1}"
+                                    class="p-3 text-lg bg-gray-100 hover:bg-gray-200 text-gray-700 rounded-lg transition-colors min-w-[48px]">
+                                <i class="fas fa-minus"></i>
+                            </button>
+                            <span class="text-lg font-medium min-w-[3ch] text-center cursor-pointer hover:bg-gray-100 py-2 px-3 rounded-lg flex items-center justify-center bg-white border border-gray-200" 
+                                  data-action="edit-quantity" data-product-id="${item.product_id}" data-quantity="${item.quantity}"
+                                  title="Klicken, um Anzahl zu ändern">
+                                <span>${item.quantity}</span>
+                                <i class="fas fa-edit text-xs text-gray-400 ml-1"></i>
+                            </span>
+                            <button data-action="quantity" data-product-id="${item.product_id}" data-quantity="${item.quantity + 1}"
+                                    class="p-3 text-lg bg-gray-100 hover:bg-gray-200 text-gray-700 rounded-lg transition-colors min-w-[48px]">
+                                <i class="fas fa-plus"></i>
+                            </button>
+                        </div>
+                        <div class="text-right">
+                            <span class="text-lg font-medium text-gray-900">
+                                ${(item.price * item.quantity).toFixed(2)} ${currency}
+                            </span>
+                        </div>
+                    </div>
+                </div>
+            `;
+        });
+
+        cartItemsElement.innerHTML = html;
+        cartTotalElement.textContent = cart.total.toFixed(2) + ' ' + currency;
+        checkoutBtn.disabled = !customer;
+
+        // Scroll to the bottom of the cart
+        const cartContainer = cartItemsElement.parentElement;
+        cartContainer.scrollTop = cartContainer.scrollHeight;
+    }
+
+    customerForm.addEventListener('submit', async (e) => {
+        e.preventDefault();
+        const cardNumber = cardInput.value.trim();
+        
+        if (!cardNumber) return;
+
+        if (await changeCart('customer', { card_number: cardNumber })) {
+            cardInput.value = '';
+        } else {
+            cardInput.select();
+        }
+    });
+
+    productForm.addEventListener('submit', async (e) => {
+        e.preventDefault();
+        if (!cart.customer) {
+            alert('Bitte zuerst einen Kunden auswählen');
+            cardInput.focus();
+            barcodeInput.value = '';
+            return;
+        }
+
+        const barcode = barcodeInput.value;
+        if (!barcode) return;
+
+        if (await changeCart('items', { barcode: barcode })) {
+            barcodeInput.value = '';
+            barcodeInput.focus();
+        } else {
+            barcodeInput.select();
+        }
+    });
+
+    checkoutBtn.addEventListener('click', async () => {
+        if (!cart.customer || cart.items.length === 0) return;
+
+        checkoutBtn.disabled = true;
+        try {
+            const result = await cartRequest(`/api/cart/complete?id=${cart.id}`);
+
+            // Show success message
+            showSuccessNotification(`Transaktion erfolgreich! Neues Guthaben: ${result.balance.toFixed(2)} ${currency}`);
+
+            // Offer the receipt of this sale for printing
+            const receiptLink = document.getElementById('receipt-link');
+            if (receiptLink && result.receipt_url) {
+                receiptLink.href = result.receipt_url;
+                receiptLink.classList.remove('hidden');
+            }
+            const printButton = document.getElementById('print-receipt');
+            if (printButton) {
+                printButton.dataset.transactionId = result.transaction_id;
+                printButton.classList.remove('hidden');
+            }
+        } catch (error) {
+            console.error('Checkout error:', error);
+            alert(error.message);
+        }
+
+        // Continue with a fresh cart
+        await loadCart();
+    });
+
+    // Send the last receipt to the receipt printer on demand
+    const printButton = document.getElementById('print-receipt');
+    if (printButton) {
+        printButton.addEventListener('click', async () => {
+            const response = await fetch(`/transactions/receipt/print?id=${printButton.dataset.transactionId}`, {
+                method: 'POST',
+                headers: {
+                    'X-CSRF-Token': csrfToken
+                }
+            });
+            if (!response.ok) {
+                alert(await response.text() || 'Fehler beim Drucken des Belegs');
+                return;
+            }
+            showSuccessNotification('Beleg wird gedruckt');
+        });
+    }
+
+    // Handle Enter key in barcode input
+    barcodeInput.addEventListener('keydown', (e) => {
+        if (e.key === 'Enter') {
+            e.preventDefault();
+            productForm.dispatchEvent(new Event('submit'));
+        }
+    });
+
+    // Handle Enter key in card input
+    cardInput.addEventListener('keydown', (e) => {
+        if (e.key === 'Enter') {
+            e.preventDefault();
+            customerForm.dispatchEvent(new Event('submit'));
+        }
+    });
+
+    // Resume the open cart of this register and keep the list of other carts current
+    loadCart();
+    setInterval(loadOpenCarts, 15000);
+});
+
+// Keep showSuccessNotification function global since it might be needed by other components
+function showSuccessNotification(message) {
+    const notification = document.getElementById('successNotification');
+    if (!notification) return;
+    
+    const messageElement = document.getElementById('successMessage');
+    if (!messageElement) return;
+    
+    messageElement.textContent = message;
+    
+    notification.style.display = 'flex';
+    notification.offsetHeight;
+    notification.classList.remove('opacity-0');
+    
+    setTimeout(() => {
+        notification.classList.add('opacity-0');
+        setTimeout(() => {
+            notification.style.display = 'none';
+        }, 300);
+    }, 2000);
+}
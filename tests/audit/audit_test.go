@@ -0,0 +1,266 @@
+package audit_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gopos/components"
+	"gopos/config"
+	"gopos/database"
+	"gopos/repository"
+	"gopos/services"
+
+	_ "modernc.org/sqlite"
+)
+
+// setup returns a database with a few audit entries and configures the
+// checkpoints to be signed with key
+func setup(t *testing.T, key string) *sql.DB {
+	dir := t.TempDir()
+	db, err := database.Open(filepath.Join(dir, "gopos.db"), database.DefaultOptions())
+	if err != nil {
+		t.Fatalf("Failed to open test database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := database.InitDB(db); err != nil {
+		t.Fatalf("Failed to initialize test database: %v", err)
+	}
+
+	cfg := config.Default()
+	cfg.Database.Path = filepath.Join(dir, "gopos.db")
+	cfg.Audit.CheckpointKey = key
+	services.InitAuditService(cfg)
+	t.Cleanup(func() { services.InitAuditService(config.Default()) })
+
+	logEntries(t, db, 3)
+	return db
+}
+
+func logEntries(t *testing.T, db *sql.DB, n int) {
+	audit := repository.NewSQLAuditStore(db)
+	for range n {
+		if err := audit.Log(repository.AuditEvent{UserID: 1, Action: "login", Details: "Login"}); err != nil {
+			t.Fatalf("Log failed: %v", err)
+		}
+	}
+}
+
+// problems returns the problems of the checkpoints, newest first
+func problems(report components.AuditReport) []string {
+	var problems []string
+	for _, check := range report.Checkpoints {
+		problems = append(problems, check.Problem)
+	}
+	return problems
+}
+
+func TestCheckpoints(t *testing.T) {
+	db := setup(t, "geheim")
+
+	checkpoint, err := services.CreateAuditCheckpoint(db)
+	if err != nil {
+		t.Fatalf("CreateAuditCheckpoint failed: %v", err)
+	}
+	if checkpoint.Entries != 3 || checkpoint.LastID != 3 || checkpoint.Signature == "" {
+		t.Errorf("Checkpoint = %+v, want the head of 3 entries", checkpoint)
+	}
+	path := filepath.Join(services.CheckpointDirectory(), checkpoint.Name)
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("Checkpoint file was not written: %v", err)
+	}
+
+	// New entries extend the chain the checkpoint points into
+	logEntries(t, db, 2)
+	report, err := services.VerifyAudit(db)
+	if err != nil || !report.Intact() || report.Entries != 5 || len(report.Checkpoints) != 1 {
+		t.Fatalf("VerifyAudit = %+v, %v, want 5 intact entries and 1 matching checkpoint", report, err)
+	}
+
+	// Deleting the newest entries keeps the chain intact, but not the checkpoint
+	if _, err := db.Exec("DELETE FROM audit_log WHERE id >= 3"); err != nil {
+		t.Fatal(err)
+	}
+	report, _ = services.VerifyAudit(db)
+	if report.BrokenID != 0 || report.Intact() || problems(report)[0] != services.CheckpointMissing {
+		t.Errorf("VerifyAudit after deleting the tail = %+v, want an intact chain and a missing checkpoint entry", report)
+	}
+
+	// Replacing them with a recomputed chain does not match the checkpoint either
+	if err := repository.NewSQLAuditStore(db).Log(repository.AuditEvent{UserID: 1, Action: "login", Details: "Ersetzt"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("UPDATE audit_log SET id = 3 WHERE id = (SELECT MAX(id) FROM audit_log)"); err != nil {
+		t.Fatal(err)
+	}
+	report, _ = services.VerifyAudit(db)
+	if problems(report)[0] != services.CheckpointMismatch {
+		t.Errorf("VerifyAudit after replacing the entry = %+v, want a mismatch", problems(report))
+	}
+
+	// Changed checkpoint files fail the signature
+	var stored components.AuditCheckpoint
+	content, _ := os.ReadFile(path)
+	json.Unmarshal(content, &stored)
+	stored.LastID = 2
+	content, _ = json.Marshal(stored)
+	os.WriteFile(path, content, 0644)
+	report, _ = services.VerifyAudit(db)
+	if problems(report)[0] != services.CheckpointSignature {
+		t.Errorf("VerifyAudit with a changed checkpoint = %+v, want an invalid signature", problems(report))
+	}
+}
+
+func TestCheckpointRequiresKeyAndIntactChain(t *testing.T) {
+	db := setup(t, "")
+	if _, err := services.CreateAuditCheckpoint(db); !errors.Is(err, services.ErrNoCheckpointKey) {
+		t.Errorf("CreateAuditCheckpoint without key returned %v, want ErrNoCheckpointKey", err)
+	}
+
+	db = setup(t, "geheim")
+	if _, err := db.Exec("UPDATE audit_log SET details = 'changed' WHERE id = 2"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := services.CreateAuditCheckpoint(db); err == nil {
+		t.Error("CreateAuditCheckpoint signed a broken chain")
+	}
+	report, err := services.VerifyAudit(db)
+	if err != nil || report.BrokenID != 2 || report.Problem != string(repository.AuditModified) {
+		t.Errorf("VerifyAudit = %+v, %v, want entry 2 modified", report, err)
+	}
+}
+
+// age moves the entries up to id into the past, so the retention period has
+// passed for them, and hashes the chain again as if they had been written then
+func age(t *testing.T, db *sql.DB, id int) {
+	if _, err := db.Exec("UPDATE audit_log SET created_at = ? WHERE id <= ?", "2020-01-01 00:00:00", id); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := repository.NewSQLAuditStore(db).Rows(time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	prevHash := ""
+	for _, row := range rows {
+		hash := row.AuditRecord.Hash(prevHash)
+		if _, err := db.Exec("UPDATE audit_log SET prev_hash = ?, hash = ? WHERE id = ?", prevHash, hash, row.ID); err != nil {
+			t.Fatal(err)
+		}
+		prevHash = hash
+	}
+}
+
+// archiveProblems returns the problems of the archives, newest first
+func archiveProblems(report components.AuditReport) []string {
+	var problems []string
+	for _, check := range report.Archives {
+		problems = append(problems, check.Problem)
+	}
+	return problems
+}
+
+// rewriteArchive replaces the details of every entry in an archive file
+func rewriteArchive(t *testing.T, path, details string) {
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compressed, err := gzip.NewReader(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rows []repository.AuditRow
+	decoder := json.NewDecoder(compressed)
+	for decoder.More() {
+		var row repository.AuditRow
+		if err := decoder.Decode(&row); err != nil {
+			t.Fatal(err)
+		}
+		row.Details = details
+		rows = append(rows, row)
+	}
+	file.Close()
+
+	var buf bytes.Buffer
+	writer := gzip.NewWriter(&buf)
+	encoder := json.NewEncoder(writer)
+	for _, row := range rows {
+		encoder.Encode(row)
+	}
+	writer.Close()
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestArchive(t *testing.T) {
+	db := setup(t, "geheim")
+	age(t, db, 3)
+	if _, err := services.CreateAuditCheckpoint(db); err != nil {
+		t.Fatalf("CreateAuditCheckpoint failed: %v", err)
+	}
+	logEntries(t, db, 2)
+
+	archive, err := services.ArchiveAuditLog(db, time.Now().AddDate(0, 0, -30))
+	if err != nil {
+		t.Fatalf("ArchiveAuditLog failed: %v", err)
+	}
+	if archive.Entries != 3 || archive.FirstID != 1 || archive.LastID != 3 || archive.FirstPrevHash != "" {
+		t.Errorf("Archive = %+v, want entries 1 to 3", archive)
+	}
+	path := filepath.Join(services.ArchiveDirectory(), archive.Name)
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("Archive file was not written: %v", err)
+	}
+
+	// The checkpoint now points into the archive, and new entries follow it
+	logEntries(t, db, 1)
+	report, err := services.VerifyAudit(db)
+	if err != nil || !report.Intact() || report.Entries != 3 || len(report.Archives) != 1 || len(report.Checkpoints) != 1 {
+		t.Fatalf("VerifyAudit = %+v, %v, want 3 intact entries, a matching archive and checkpoint", report, err)
+	}
+
+	// Nothing else is old enough
+	if archive, err := services.ArchiveAuditLog(db, time.Now().AddDate(0, 0, -30)); err != nil || archive.Entries != 0 {
+		t.Errorf("Second ArchiveAuditLog = %+v, %v, want nothing archived", archive, err)
+	}
+
+	// Archived entries cannot be changed unnoticed
+	rewriteArchive(t, path, "Geändert")
+	report, _ = services.VerifyAudit(db)
+	if report.Intact() || archiveProblems(report)[0] != services.ArchiveModified || report.Archives[0].BrokenID != 1 {
+		t.Errorf("VerifyAudit with a changed archive = %+v, want entry 1 modified", report.Archives)
+	}
+	if problems(report)[0] != "" {
+		t.Errorf("Checkpoint problems = %v, the hash of entry 3 is still in the archive", problems(report))
+	}
+
+	os.Remove(path)
+	report, _ = services.VerifyAudit(db)
+	if archiveProblems(report)[0] != services.ArchiveMissing || problems(report)[0] != services.CheckpointMissing {
+		t.Errorf("VerifyAudit without the archive = %v, %v, want the archive and the checkpoint entry missing",
+			archiveProblems(report), problems(report))
+	}
+}
+
+func TestArchiveRequiresIntactChain(t *testing.T) {
+	db := setup(t, "geheim")
+	age(t, db, 3)
+	if _, err := db.Exec("UPDATE audit_log SET details = 'changed' WHERE id = 2"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := services.ArchiveAuditLog(db, time.Now()); err == nil {
+		t.Error("ArchiveAuditLog archived a broken chain")
+	}
+	report, err := services.VerifyAudit(db)
+	if err != nil || report.Entries != 3 || report.BrokenID != 2 || len(report.Archives) != 0 {
+		t.Errorf("VerifyAudit = %+v, %v, want the broken entry still in the database", report, err)
+	}
+}
@@ -0,0 +1,177 @@
+package backup_test
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gopos/config"
+	"gopos/database"
+	"gopos/services"
+
+	_ "modernc.org/sqlite"
+)
+
+func setupTestDB(t *testing.T, path string) *sql.DB {
+	db, err := database.Open(path, database.DefaultOptions())
+	if err != nil {
+		t.Fatalf("Failed to open test database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	if err := database.InitDB(db); err != nil {
+		t.Fatalf("Failed to initialize test database: %v", err)
+	}
+	return db
+}
+
+func countProducts(t *testing.T, path string) int {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM products").Scan(&count); err != nil {
+		t.Fatalf("Failed to count products: %v", err)
+	}
+	return count
+}
+
+func TestBackupAndRestore(t *testing.T) {
+	dir := t.TempDir()
+	dbPath := filepath.Join(dir, "gopos.db")
+	db := setupTestDB(t, dbPath)
+
+	_, err := db.Exec("INSERT INTO products (barcode, name, price, created_at) VALUES ('4001', 'Kaffee', 1.5, ?)", database.Now())
+	if err != nil {
+		t.Fatalf("Failed to create product: %v", err)
+	}
+
+	backupPath := filepath.Join(dir, "backup.db")
+	if err := database.Backup(db, backupPath); err != nil {
+		t.Fatalf("Backup failed: %v", err)
+	}
+	if err := database.Backup(db, backupPath); err == nil {
+		t.Error("Expected an error when the backup file already exists")
+	}
+
+	version, err := database.ValidateBackup(backupPath)
+	if err != nil {
+		t.Fatalf("Backup is not valid: %v", err)
+	}
+	if version != database.SchemaVersion() {
+		t.Errorf("Expected schema version %d, got %d", database.SchemaVersion(), version)
+	}
+
+	// Changes after the backup are undone by the restore
+	_, err = db.Exec("INSERT INTO products (barcode, name, price, created_at) VALUES ('4002', 'Brezel', 0.8, ?)", database.Now())
+	if err != nil {
+		t.Fatalf("Failed to create product: %v", err)
+	}
+	db.Close()
+
+	keptPath, err := database.Restore(dbPath, backupPath)
+	if err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	if got := countProducts(t, dbPath); got != 1 {
+		t.Errorf("Expected 1 product after restore, got %d", got)
+	}
+	if got := countProducts(t, keptPath); got != 2 {
+		t.Errorf("Expected the kept database to have 2 products, got %d", got)
+	}
+}
+
+func TestValidateBackupRejectsInvalidFiles(t *testing.T) {
+	dir := t.TempDir()
+
+	notADatabase := filepath.Join(dir, "notes.txt")
+	if err := os.WriteFile(notADatabase, []byte("no database"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	if _, err := database.ValidateBackup(notADatabase); err == nil {
+		t.Error("Expected an error for a file that is not a database")
+	}
+
+	// An empty SQLite database is not a GoPOS database
+	otherPath := filepath.Join(dir, "other.db")
+	other, err := sql.Open("sqlite", otherPath)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	if _, err := other.Exec("CREATE TABLE notes (text TEXT)"); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+	other.Close()
+	if _, err := database.ValidateBackup(otherPath); err == nil {
+		t.Error("Expected an error for a database without the GoPOS tables")
+	}
+
+	// A backup of a newer GoPOS version must not be restored
+	newerPath := filepath.Join(dir, "newer.db")
+	newer := setupTestDB(t, newerPath)
+	if _, err := newer.Exec("PRAGMA user_version = 999"); err != nil {
+		t.Fatalf("Failed to set schema version: %v", err)
+	}
+	newer.Close()
+	if _, err := database.ValidateBackup(newerPath); err == nil {
+		t.Error("Expected an error for a newer schema version")
+	}
+
+	// The current database stays in place when the backup is invalid
+	dbPath := filepath.Join(dir, "gopos.db")
+	setupTestDB(t, dbPath).Close()
+	if _, err := database.Restore(dbPath, newerPath); err == nil {
+		t.Error("Expected restore of an invalid backup to fail")
+	}
+	if _, err := database.ValidateBackup(dbPath); err != nil {
+		t.Errorf("Expected the current database to be untouched: %v", err)
+	}
+}
+
+func TestCreateBackupKeepsConfiguredNumber(t *testing.T) {
+	dir := t.TempDir()
+	db := setupTestDB(t, filepath.Join(dir, "gopos.db"))
+
+	cfg := &config.Config{}
+	cfg.Database.Path = filepath.Join(dir, "gopos.db")
+	cfg.Backup.Keep = 2
+	services.InitBackupService(cfg)
+
+	if services.BackupDirectory() != filepath.Join(dir, "backups") {
+		t.Errorf("Expected backups next to the database, got %s", services.BackupDirectory())
+	}
+
+	// Backups are named by the second they were taken, so fake older ones
+	for _, name := range []string{"gopos-20240101-000000.db", "gopos-20240102-000000.db"} {
+		if err := os.MkdirAll(services.BackupDirectory(), 0755); err != nil {
+			t.Fatalf("Failed to create backup directory: %v", err)
+		}
+		if err := database.Backup(db, filepath.Join(services.BackupDirectory(), name)); err != nil {
+			t.Fatalf("Backup failed: %v", err)
+		}
+	}
+
+	backup, err := services.CreateBackup(db)
+	if err != nil {
+		t.Fatalf("CreateBackup failed: %v", err)
+	}
+
+	backups, err := services.ListBackups()
+	if err != nil {
+		t.Fatalf("ListBackups failed: %v", err)
+	}
+	if len(backups) != 2 || backups[0].Name != backup.Name || backups[1].Name != "gopos-20240102-000000.db" {
+		t.Errorf("Expected the newest two backups to be kept, got %+v", backups)
+	}
+
+	if _, err := services.BackupPath("../gopos.db"); err == nil {
+		t.Error("Expected names outside the backup directory to be rejected")
+	}
+	if _, err := services.BackupPath(backup.Name); err != nil {
+		t.Errorf("Expected the new backup to be found: %v", err)
+	}
+}
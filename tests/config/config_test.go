@@ -0,0 +1,252 @@
+package config_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"gopos/config"
+)
+
+// isolate runs the test in an empty directory with an empty home, so no
+// configuration file or variable of the machine gets in the way
+func isolate(t *testing.T) string {
+	dir := t.TempDir()
+	t.Chdir(dir)
+	t.Setenv("HOME", dir)
+	t.Setenv("XDG_CONFIG_HOME", filepath.Join(dir, ".config"))
+	for _, name := range []string{"PORT", "ENV", "GOPOS_CONFIG", "GOPOS_SESSION_KEY", "GOPOS_SERVER_LISTEN", "GOPOS_DATABASE_PATH", "GOPOS_TLS_ACME_DOMAINS"} {
+		t.Setenv(name, "")
+	}
+	return dir
+}
+
+func writeFile(t *testing.T, path, content string) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDefaultsAndEnvironment(t *testing.T) {
+	isolate(t)
+	t.Setenv("GOPOS_SESSION_KEY", "from-env")
+	t.Setenv("GOPOS_BACKUP_INTERVAL", "12h")
+	t.Setenv("GOPOS_DATABASE_FOREIGN_KEYS", "false")
+	t.Setenv("GOPOS_SERVER_SHUTDOWN_TIMEOUT", "5s")
+
+	cfg, args, err := config.Load([]string{"backup"})
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if len(args) != 1 || args[0] != "backup" {
+		t.Errorf("Remaining arguments = %v, want the command", args)
+	}
+	if cfg.Server.Listen != ":8080" || cfg.Database.Driver != "sqlite" || cfg.Database.Path != "gopos.db" {
+		t.Errorf("Unexpected defaults: listen %q, driver %q, path %q", cfg.Server.Listen, cfg.Database.Driver, cfg.Database.Path)
+	}
+	if cfg.Session.Key != "from-env" || cfg.Backup.Interval != 12*time.Hour {
+		t.Errorf("Environment was not applied: key %q, interval %v", cfg.Session.Key, cfg.Backup.Interval)
+	}
+	if cfg.Database.ForeignKeys == nil || *cfg.Database.ForeignKeys {
+		t.Errorf("GOPOS_DATABASE_FOREIGN_KEYS=false was not applied")
+	}
+	if cfg.Server.ReadHeaderTimeout <= 0 || cfg.Server.WriteTimeout <= 0 || cfg.Server.IdleTimeout <= 0 {
+		t.Errorf("Server timeouts default to unlimited: %+v", cfg.Server)
+	}
+	if cfg.Log.Level != "info" || cfg.Log.Format != "text" {
+		t.Errorf("Log defaults = %q %q, want info and text", cfg.Log.Level, cfg.Log.Format)
+	}
+	if cfg.Server.ShutdownTimeout != 5*time.Second {
+		t.Errorf("ShutdownTimeout = %v, want GOPOS_SERVER_SHUTDOWN_TIMEOUT", cfg.Server.ShutdownTimeout)
+	}
+}
+
+func TestPrecedence(t *testing.T) {
+	dir := isolate(t)
+	file := filepath.Join(dir, "custom.yaml")
+	writeFile(t, file, `
+server:
+  listen: ":7000"
+database:
+  path: "from-file.db"
+  max_open_conns: 3
+session:
+  key: "from-file"
+`)
+	t.Setenv("GOPOS_DATABASE_PATH", "from-env.db")
+
+	cfg, _, err := config.Load([]string{"--config", file, "--listen", "127.0.0.1:9000"})
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if cfg.Server.Listen != "127.0.0.1:9000" {
+		t.Errorf("Listen = %q, want the flag", cfg.Server.Listen)
+	}
+	if cfg.Database.Path != "from-env.db" {
+		t.Errorf("Path = %q, want the environment to override the file", cfg.Database.Path)
+	}
+	if cfg.Session.Key != "from-file" || cfg.Database.MaxOpenConns != 3 {
+		t.Errorf("File was not applied: key %q, max_open_conns %d", cfg.Session.Key, cfg.Database.MaxOpenConns)
+	}
+	if cfg.Database.Driver != "sqlite" {
+		t.Errorf("Driver = %q, want the default for a section the file only partly sets", cfg.Database.Driver)
+	}
+}
+
+func TestSearchLocations(t *testing.T) {
+	dir := isolate(t)
+	writeFile(t, filepath.Join(dir, ".config", "gopos", "config.yaml"), "session:\n  key: user-dir\n")
+	writeFile(t, filepath.Join(dir, ".gopos", "config.yaml"), "session:\n  key: legacy-dir\n")
+
+	cfg, _, err := config.Load(nil)
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if cfg.Session.Key != "user-dir" {
+		t.Errorf("Key = %q, want the file in the user configuration directory", cfg.Session.Key)
+	}
+
+	writeFile(t, filepath.Join(dir, "config.yaml"), "session:\n  key: current-dir\n")
+	cfg, _, err = config.Load(nil)
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if cfg.Session.Key != "current-dir" {
+		t.Errorf("Key = %q, want the file in the current directory", cfg.Session.Key)
+	}
+}
+
+func TestLegacyEnvironment(t *testing.T) {
+	isolate(t)
+	t.Setenv("GOPOS_SESSION_KEY", "key")
+	t.Setenv("PORT", "8181")
+	t.Setenv("ENV", "production")
+
+	cfg, _, err := config.Load(nil)
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if cfg.Server.Listen != ":8181" || !cfg.Server.SecureCookies {
+		t.Errorf("PORT and ENV were not applied: listen %q, secure cookies %v", cfg.Server.Listen, cfg.Server.SecureCookies)
+	}
+
+	t.Setenv("GOPOS_SERVER_LISTEN", ":8282")
+	cfg, _, _ = config.Load(nil)
+	if cfg.Server.Listen != ":8282" {
+		t.Errorf("Listen = %q, want GOPOS_SERVER_LISTEN to win over PORT", cfg.Server.Listen)
+	}
+}
+
+func TestValidation(t *testing.T) {
+	dir := isolate(t)
+	writeFile(t, filepath.Join(dir, "config.yaml"), `
+server:
+  write_timeout: "-1s"
+database:
+  driver: "postgres"
+email:
+  access_key: "secret"
+printer:
+  address: "192.168.1.50"
+  device: "/dev/usb/lp0"
+backup:
+  keep: -1
+audit:
+  checkpoint_interval: 24h
+  retention_days: -30
+log:
+  level: "verbose"
+  format: "xml"
+`)
+
+	_, _, err := config.Load([]string{"--listen", "8080"})
+	if err == nil {
+		t.Fatal("Load accepted an invalid configuration")
+	}
+	for _, want := range []string{
+		"server.listen (GOPOS_SERVER_LISTEN)",
+		"server.write_timeout (GOPOS_SERVER_WRITE_TIMEOUT)",
+		"database.dsn (GOPOS_DATABASE_DSN)",
+		"email.endpoint",
+		"email.sender_mail",
+		"session.key (GOPOS_SESSION_KEY)",
+		"printer.device",
+		"backup.keep",
+		"audit.checkpoint_key (GOPOS_AUDIT_CHECKPOINT_KEY)",
+		"audit.retention_days (GOPOS_AUDIT_RETENTION_DAYS)",
+		"log.level (GOPOS_LOG_LEVEL)",
+		"log.format (GOPOS_LOG_FORMAT)",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("Error does not mention %s:\n%v", want, err)
+		}
+	}
+	if strings.Contains(err.Error(), "email.access_key") {
+		t.Errorf("Error mentions the access key that is set:\n%v", err)
+	}
+}
+
+func TestInvalidInput(t *testing.T) {
+	dir := isolate(t)
+
+	writeFile(t, filepath.Join(dir, "config.yaml"), "sesion:\n  key: typo\n")
+	if _, _, err := config.Load(nil); err == nil || !strings.Contains(err.Error(), "sesion") {
+		t.Errorf("Unknown key was not reported: %v", err)
+	}
+
+	if _, _, err := config.Load([]string{"--config", filepath.Join(dir, "missing.yaml")}); err == nil {
+		t.Error("Missing configuration file given with --config was not reported")
+	}
+
+	writeFile(t, filepath.Join(dir, "config.yaml"), "session:\n  key: key\n")
+	t.Setenv("GOPOS_BACKUP_KEEP", "seven")
+	if _, _, err := config.Load(nil); err == nil || !strings.Contains(err.Error(), "GOPOS_BACKUP_KEEP") {
+		t.Errorf("Invalid number in the environment was not reported: %v", err)
+	}
+}
+
+func TestTLS(t *testing.T) {
+	dir := isolate(t)
+	t.Setenv("GOPOS_SESSION_KEY", "key")
+	t.Setenv("GOPOS_TLS_ACME_DOMAINS", "pos.example.com, kasse.example.com")
+
+	cfg, _, err := config.Load(nil)
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if len(cfg.TLS.ACME.Domains) != 2 || cfg.TLS.ACME.Domains[1] != "kasse.example.com" {
+		t.Errorf("Domains = %q, want the comma separated list", cfg.TLS.ACME.Domains)
+	}
+	if !cfg.TLSEnabled() || !cfg.Server.SecureCookies {
+		t.Errorf("TLS enabled %v, secure cookies %v, want both with ACME domains", cfg.TLSEnabled(), cfg.Server.SecureCookies)
+	}
+
+	writeFile(t, filepath.Join(dir, "config.yaml"), `
+tls:
+  cert_file: "cert.pem"
+  redirect_listen: "80"
+  acme:
+    directory_url: "http://localhost:14000/dir"
+`)
+	t.Setenv("GOPOS_TLS_ACME_DOMAINS", "localhost")
+	_, _, err = config.Load(nil)
+	if err == nil {
+		t.Fatal("Load accepted an invalid TLS configuration")
+	}
+	for _, want := range []string{
+		"tls.key_file (GOPOS_TLS_KEY_FILE)",
+		"tls.acme.domains (GOPOS_TLS_ACME_DOMAINS): set either",
+		"tls.acme.domains (GOPOS_TLS_ACME_DOMAINS): invalid domain \"localhost\"",
+		"tls.redirect_listen",
+		"tls.acme.directory_url",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("Error does not mention %s:\n%v", want, err)
+		}
+	}
+}
@@ -1,24 +1,85 @@
 package database_test
 
 import (
+	"context"
 	"database/sql"
+	"fmt"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"gopos/components"
 	"gopos/database"
+	"gopos/repository"
 
 	_ "modernc.org/sqlite"
 )
 
+// testPostgresDSN runs the tests against PostgreSQL instead of SQLite, e.g.
+// GOPOS_TEST_POSTGRES_DSN="postgres://postgres@localhost/postgres?sslmode=disable" go test ./tests/database
+// Every test gets a schema of its own, which is dropped afterwards.
+var testPostgresDSN = os.Getenv("GOPOS_TEST_POSTGRES_DSN")
+
+func testOptions() database.Options {
+	options := database.DefaultOptions()
+	if testPostgresDSN != "" {
+		options.Driver = database.DriverPostgres
+	}
+	return options
+}
+
+// testSource returns the source of a new, empty test database
+func testSource(t *testing.T) string {
+	if testPostgresDSN == "" {
+		return filepath.Join(t.TempDir(), "test.db")
+	}
+
+	admin, err := database.Open(testPostgresDSN, testOptions())
+	if err != nil {
+		t.Fatalf("Failed to connect to PostgreSQL: %v", err)
+	}
+	schema := fmt.Sprintf("gopos_test_%d", time.Now().UnixNano())
+	if _, err := admin.Exec("CREATE SCHEMA " + schema); err != nil {
+		admin.Close()
+		t.Fatalf("Failed to create schema: %v", err)
+	}
+	t.Cleanup(func() {
+		if _, err := admin.Exec("DROP SCHEMA " + schema + " CASCADE"); err != nil {
+			t.Errorf("Failed to drop schema %s: %v", schema, err)
+		}
+		admin.Close()
+	})
+
+	// Unknown connection parameters are passed to the server as settings
+	if strings.HasPrefix(testPostgresDSN, "postgres://") || strings.HasPrefix(testPostgresDSN, "postgresql://") {
+		u, err := url.Parse(testPostgresDSN)
+		if err != nil {
+			t.Fatalf("Invalid GOPOS_TEST_POSTGRES_DSN: %v", err)
+		}
+		query := u.Query()
+		query.Set("search_path", schema)
+		u.RawQuery = query.Encode()
+		return u.String()
+	}
+	return testPostgresDSN + " search_path=" + schema
+}
+
+// requireSQLite skips tests of SQLite specific behaviour when running against PostgreSQL
+func requireSQLite(t *testing.T) {
+	if testPostgresDSN != "" {
+		t.Skip("SQLite only")
+	}
+}
+
 func setupTestDB(t *testing.T) (*sql.DB, string, func()) {
-	// Create temporary directory for test database
-	tmpDir := t.TempDir()
-	dbPath := filepath.Join(tmpDir, "test.db")
+	source := testSource(t)
 
 	// Open test database
-	db, err := sql.Open("sqlite", dbPath)
+	db, err := database.Open(source, testOptions())
 	if err != nil {
 		t.Fatalf("Failed to open test database: %v", err)
 	}
@@ -39,10 +100,9 @@ func setupTestDB(t *testing.T) (*sql.DB, string, func()) {
 	// Return cleanup function
 	cleanup := func() {
 		db.Close()
-		os.RemoveAll(tmpDir)
 	}
 
-	return db, dbPath, cleanup
+	return db, source, cleanup
 }
 
 func TestUserOperations(t *testing.T) {
@@ -52,19 +112,16 @@ func TestUserOperations(t *testing.T) {
 	// Test user creation
 	t.Run("CreateUser", func(t *testing.T) {
 		now := time.Now()
-		result, err := db.Exec(`
+		var id int64
+		err := db.QueryRow(`
 			INSERT INTO users (card_number, name, role, balance, created_at)
 			VALUES (?, ?, ?, ?, ?)
-		`, "TEST123", "Test User", "customer", 100.0, now)
+			RETURNING id
+		`, "TEST123", "Test User", "customer", 100.0, now).Scan(&id)
 		if err != nil {
 			t.Fatalf("Failed to create test user: %v", err)
 		}
 
-		id, err := result.LastInsertId()
-		if err != nil {
-			t.Fatalf("Failed to get last insert id: %v", err)
-		}
-
 		// Verify user was created
 		var user struct {
 			ID         int64
@@ -117,19 +174,16 @@ func TestProductOperations(t *testing.T) {
 	// Test product creation
 	t.Run("CreateProduct", func(t *testing.T) {
 		now := time.Now()
-		result, err := db.Exec(`
+		var id int64
+		err := db.QueryRow(`
 			INSERT INTO products (barcode, name, price, created_at)
 			VALUES (?, ?, ?, ?)
-		`, "123456789", "Test Product", 9.99, now)
+			RETURNING id
+		`, "123456789", "Test Product", 9.99, now).Scan(&id)
 		if err != nil {
 			t.Fatalf("Failed to create test product: %v", err)
 		}
 
-		id, err := result.LastInsertId()
-		if err != nil {
-			t.Fatalf("Failed to get last insert id: %v", err)
-		}
-
 		// Verify product was created
 		var product struct {
 			ID      int64
@@ -269,21 +323,17 @@ func TestTransactionOperations(t *testing.T) {
 		}
 
 		// Create transaction record
-		result, err := tx.Exec(`
+		var transactionID int64
+		err = tx.QueryRow(`
 			INSERT INTO transactions (user_id, cashier_id, total, created_at)
 			VALUES (?, ?, ?, ?)
-		`, userID, cashierID, total, now)
+			RETURNING id
+		`, userID, cashierID, total, now).Scan(&transactionID)
 		if err != nil {
 			tx.Rollback()
 			t.Fatalf("Failed to create transaction: %v", err)
 		}
 
-		transactionID, err := result.LastInsertId()
-		if err != nil {
-			tx.Rollback()
-			t.Fatalf("Failed to get transaction id: %v", err)
-		}
-
 		// Add transaction items
 		_, err = tx.Exec(`
 			INSERT INTO transaction_items (transaction_id, product_id, quantity, price)
@@ -331,3 +381,464 @@ func TestTransactionOperations(t *testing.T) {
 		}
 	})
 }
+
+func TestMigrations(t *testing.T) {
+	db, source, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	version, err := database.GetSchemaVersion(context.Background(), db)
+	if err != nil {
+		t.Fatalf("Failed to read schema version: %v", err)
+	}
+	if version != database.SchemaVersion() {
+		t.Errorf("Schema version mismatch: got %d, want %d", version, database.SchemaVersion())
+	}
+
+	// Receipts need the balance after the transaction and its description
+	_, err = db.Exec(`
+		INSERT INTO transactions (user_id, cashier_id, total, balance_after, description, created_at)
+		VALUES (1, 1, 10.0, 10.0, 'Guthaben aufgeladen', ?)
+	`, time.Now())
+	if err != nil {
+		t.Fatalf("Failed to insert transaction with migrated columns: %v", err)
+	}
+
+	// Running the initialization again must not apply migrations twice
+	db.Close()
+	db, err = database.Open(source, testOptions())
+	if err != nil {
+		t.Fatalf("Failed to reopen test database: %v", err)
+	}
+	defer db.Close()
+	if err := database.InitDB(db); err != nil {
+		t.Fatalf("Failed to initialize migrated database: %v", err)
+	}
+}
+
+func TestTimestampNormalization(t *testing.T) {
+	requireSQLite(t)
+	db, _, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	// Simulate a database written by an older version, which stored
+	// time.Time.String() in server local time
+	legacy := map[string]string{
+		"2024-03-31 01:30:00.123456789 +0100 CET m=+12.345678901": "2024-03-31 00:30:00",
+		"2024-07-01 12:00:00 +0200 CEST":                          "2024-07-01 10:00:00",
+		"2024-07-01T12:00:00Z":                                    "2024-07-01 12:00:00",
+		"2024-07-01 12:00:00":                                     "2024-07-01 12:00:00",
+	}
+	ids := make(map[string]int64)
+	for value := range legacy {
+		result, err := db.Exec(`
+			INSERT INTO audit_log (user_id, action, details, created_at)
+			VALUES (1, 'test', 'legacy timestamp', ?)
+		`, value)
+		if err != nil {
+			t.Fatalf("Failed to insert legacy timestamp: %v", err)
+		}
+		ids[value], _ = result.LastInsertId()
+	}
+	if _, err := db.Exec("PRAGMA user_version = 1"); err != nil {
+		t.Fatalf("Failed to reset schema version: %v", err)
+	}
+
+	if err := database.InitDB(db); err != nil {
+		t.Fatalf("Failed to migrate database: %v", err)
+	}
+
+	for value, want := range legacy {
+		var got string
+		err := db.QueryRow("SELECT CAST(created_at AS TEXT) FROM audit_log WHERE id = ?", ids[value]).Scan(&got)
+		if err != nil {
+			t.Fatalf("Failed to query timestamp: %v", err)
+		}
+		if got != want {
+			t.Errorf("Timestamp %q normalised to %q, want %q", value, got, want)
+		}
+	}
+
+	// New timestamps are written in the same canonical UTC format
+	now := database.Now()
+	if _, err := time.Parse(database.TimeFormat, now); err != nil {
+		t.Errorf("database.Now() returned %q, not in canonical format: %v", now, err)
+	}
+}
+
+func TestIdempotencyKeyIsUnique(t *testing.T) {
+	db, _, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	insert := func(key interface{}) error {
+		_, err := db.Exec(`
+			INSERT INTO transactions (user_id, cashier_id, total, balance_after, idempotency_key, created_at)
+			VALUES (1, 1, 5.0, 0, ?, ?)
+		`, key, database.Now())
+		return err
+	}
+
+	if err := insert("checkout-abc"); err != nil {
+		t.Fatalf("Failed to insert transaction with idempotency key: %v", err)
+	}
+	if err := insert("checkout-abc"); err == nil {
+		t.Error("Expected a second transaction with the same idempotency key to be rejected")
+	}
+
+	// Transactions without key, like top-ups, are not affected
+	for i := 0; i < 2; i++ {
+		if err := insert(nil); err != nil {
+			t.Fatalf("Failed to insert transaction without idempotency key: %v", err)
+		}
+	}
+}
+
+func TestConcurrentBalanceDebits(t *testing.T) {
+	// Writers wait for each other instead of failing with SQLITE_BUSY
+	options := testOptions()
+	options.BusyTimeout = 10 * time.Second
+	db, err := database.Open(testSource(t), options)
+	if err != nil {
+		t.Fatalf("Failed to open test database: %v", err)
+	}
+	defer db.Close()
+	if err := database.InitDB(db); err != nil {
+		t.Fatalf("Failed to initialize test database: %v", err)
+	}
+
+	var userID int64
+	err = db.QueryRow(`
+		INSERT INTO users (card_number, name, role, balance, created_at)
+		VALUES ('CUSTOMER', 'Kunde', 'customer', 100, ?)
+		RETURNING id
+	`, database.Now()).Scan(&userID)
+	if err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+
+	// 60 registers try to charge 3.00 at once; only 33 debits fit into the balance
+	const workers = 60
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	succeeded, rejected := 0, 0
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			tx, err := db.Begin()
+			if err != nil {
+				t.Errorf("Failed to begin transaction: %v", err)
+				return
+			}
+			defer tx.Rollback()
+
+			balance, err := repository.NewSQLUserStore(tx).AdjustBalance(int(userID), -3)
+			if err == repository.ErrInsufficientBalance {
+				mu.Lock()
+				rejected++
+				mu.Unlock()
+				return
+			} else if err != nil {
+				t.Errorf("Failed to debit balance: %v", err)
+				return
+			}
+			if balance < 0 {
+				t.Errorf("Balance went negative: %.2f", balance)
+			}
+			if err := tx.Commit(); err != nil {
+				t.Errorf("Failed to commit: %v", err)
+				return
+			}
+			mu.Lock()
+			succeeded++
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	var balance float64
+	if err := db.QueryRow("SELECT balance FROM users WHERE id = ?", userID).Scan(&balance); err != nil {
+		t.Fatalf("Failed to read balance: %v", err)
+	}
+	if succeeded != 33 || rejected != workers-33 {
+		t.Errorf("Expected 33 debits and %d rejections, got %d and %d", workers-33, succeeded, rejected)
+	}
+	if balance != 100-3*float64(succeeded) || balance != 1 {
+		t.Errorf("Expected final balance 1.00 after %d debits, got %.2f", succeeded, balance)
+	}
+
+	// Unknown users are reported as such, not as insufficient balance
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatalf("Failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+	if _, err := repository.NewSQLUserStore(tx).AdjustBalance(9999, -1); err != repository.ErrNotFound {
+		t.Errorf("Expected repository.ErrNotFound for an unknown user, got %v", err)
+	}
+}
+
+func TestOpenAppliesPragmas(t *testing.T) {
+	requireSQLite(t)
+	db, err := database.Open(filepath.Join(t.TempDir(), "test.db"), database.DefaultOptions())
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	if got := db.Stats().MaxOpenConnections; got != 10 {
+		t.Errorf("Expected 10 open connections at most, got %d", got)
+	}
+
+	// Every connection of the pool must have the pragmas, not just the first one
+	ctx := context.Background()
+	var conns []*sql.Conn
+	for i := 0; i < 3; i++ {
+		conn, err := db.Conn(ctx)
+		if err != nil {
+			t.Fatalf("Failed to get connection: %v", err)
+		}
+		conns = append(conns, conn)
+
+		var journalMode string
+		var busyTimeout, foreignKeys, synchronous int
+		conn.QueryRowContext(ctx, "PRAGMA journal_mode").Scan(&journalMode)
+		conn.QueryRowContext(ctx, "PRAGMA busy_timeout").Scan(&busyTimeout)
+		conn.QueryRowContext(ctx, "PRAGMA foreign_keys").Scan(&foreignKeys)
+		conn.QueryRowContext(ctx, "PRAGMA synchronous").Scan(&synchronous)
+		if journalMode != "wal" || busyTimeout != 5000 || foreignKeys != 1 || synchronous != 1 {
+			t.Errorf("Connection %d: journal_mode=%s busy_timeout=%d foreign_keys=%d synchronous=%d, want wal/5000/1/1",
+				i, journalMode, busyTimeout, foreignKeys, synchronous)
+		}
+	}
+	for _, conn := range conns {
+		conn.Close()
+	}
+
+	// Foreign keys are enforced
+	if err := database.InitDB(db); err != nil {
+		t.Fatalf("Failed to initialize database: %v", err)
+	}
+	_, err = db.Exec(`
+		INSERT INTO transactions (user_id, cashier_id, total, created_at)
+		VALUES (9999, 1, 1.0, ?)
+	`, database.Now())
+	if !database.IsForeignKeyError(err) {
+		t.Errorf("Expected a foreign key error for an unknown user, got %v", err)
+	}
+}
+
+func TestOpenOptions(t *testing.T) {
+	requireSQLite(t)
+	options := database.Options{
+		JournalMode:  "delete",
+		Synchronous:  "full",
+		BusyTimeout:  250 * time.Millisecond,
+		MaxOpenConns: 2,
+	}
+	db, err := database.Open(filepath.Join(t.TempDir(), "test.db"), options)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	var journalMode string
+	var busyTimeout, foreignKeys, synchronous int
+	db.QueryRow("PRAGMA journal_mode").Scan(&journalMode)
+	db.QueryRow("PRAGMA busy_timeout").Scan(&busyTimeout)
+	db.QueryRow("PRAGMA foreign_keys").Scan(&foreignKeys)
+	db.QueryRow("PRAGMA synchronous").Scan(&synchronous)
+	if journalMode != "delete" || busyTimeout != 250 || foreignKeys != 0 || synchronous != 2 {
+		t.Errorf("Got journal_mode=%s busy_timeout=%d foreign_keys=%d synchronous=%d, want delete/250/0/2",
+			journalMode, busyTimeout, foreignKeys, synchronous)
+	}
+	if got := db.Stats().MaxOpenConnections; got != 2 {
+		t.Errorf("Expected 2 open connections at most, got %d", got)
+	}
+
+	for _, invalid := range []database.Options{{JournalMode: "fast"}, {Synchronous: "sometimes"}, {BusyTimeout: -time.Second}} {
+		if _, err := database.Open(filepath.Join(t.TempDir(), "test.db"), invalid); err == nil {
+			t.Errorf("Expected an error for options %+v", invalid)
+		}
+	}
+}
+
+func TestPlaceholders(t *testing.T) {
+	db, _, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	// Question marks in string literals are not placeholders
+	var id int64
+	err := db.QueryRow(`
+		INSERT INTO products (barcode, name, price, created_at)
+		VALUES (?, 'Wer? Wie? Was?', ?, ?)
+		RETURNING id
+	`, "4711", 2.5, database.Now()).Scan(&id)
+	if err != nil {
+		t.Fatalf("Failed to create product: %v", err)
+	}
+
+	// Numbered placeholders can be used more than once
+	var name string
+	var price float64
+	err = db.QueryRow(`
+		SELECT name, price FROM products
+		WHERE id = ?1 AND (barcode = ?2 OR name = ?2)
+	`, id, "4711").Scan(&name, &price)
+	if err != nil {
+		t.Fatalf("Failed to query product: %v", err)
+	}
+	if name != "Wer? Wie? Was?" || price != 2.5 {
+		t.Errorf("Got %q for %.2f, want %q for 2.50", name, price, "Wer? Wie? Was?")
+	}
+}
+
+func TestOpenRejectsUnknownDriver(t *testing.T) {
+	options := database.DefaultOptions()
+	options.Driver = "mysql"
+	if _, err := database.Open(filepath.Join(t.TempDir(), "test.db"), options); err == nil {
+		t.Error("Expected an error for an unknown database driver")
+	}
+}
+
+func TestAuditLogHashChain(t *testing.T) {
+	requireSQLite(t)
+	db, _, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	// Entries of a version without the hash chain are chained by the migration
+	for i := range 3 {
+		_, err := db.Exec(`
+			INSERT INTO audit_log (user_id, action, details, created_at)
+			VALUES (1, 'login', ?, ?)
+		`, fmt.Sprintf("legacy %d", i), database.Now())
+		if err != nil {
+			t.Fatalf("Failed to insert audit entry: %v", err)
+		}
+	}
+	// Migration 7 chains the entries, the later ones can be applied again
+	if _, err := db.Exec("PRAGMA user_version = 6"); err != nil {
+		t.Fatalf("Failed to reset schema version: %v", err)
+	}
+	if err := database.InitDB(db); err != nil {
+		t.Fatalf("Failed to migrate database: %v", err)
+	}
+
+	audit := repository.NewSQLAuditStore(db)
+	if verification, err := audit.Verify(); err != nil || !verification.Intact() || verification.Entries != 3 {
+		t.Fatalf("Verify after migration = %+v, %v, want 3 intact entries", verification, err)
+	}
+
+	// Entries written at once still form a single chain
+	const writers = 20
+	var wg sync.WaitGroup
+	for i := range writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := audit.Log(repository.AuditEvent{UserID: 1, Action: "login", Details: fmt.Sprintf("concurrent %d", i)}); err != nil {
+				t.Errorf("Log failed: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if verification, err := audit.Verify(); err != nil || !verification.Intact() || verification.Entries != 3+writers {
+		t.Errorf("Verify after concurrent writes = %+v, %v, want %d intact entries", verification, err, 3+writers)
+	}
+
+	// No two entries may follow the same one
+	_, err := db.Exec(`
+		INSERT INTO audit_log (user_id, action, details, created_at, prev_hash, hash)
+		SELECT user_id, action, details, created_at, prev_hash, 'forged' FROM audit_log ORDER BY id DESC LIMIT 1
+	`)
+	if !database.IsUniqueViolation(err) {
+		t.Errorf("Forking the chain returned %v, want a unique violation", err)
+	}
+}
+
+func TestConcurrentAtomicAuditLog(t *testing.T) {
+	// Writers wait for each other instead of failing with SQLITE_BUSY
+	options := testOptions()
+	options.BusyTimeout = 10 * time.Second
+	db, err := database.Open(testSource(t), options)
+	if err != nil {
+		t.Fatalf("Failed to open test database: %v", err)
+	}
+	defer db.Close()
+	if err := database.InitDB(db); err != nil {
+		t.Fatalf("Failed to initialize test database: %v", err)
+	}
+	stores := repository.NewSQL(db)
+
+	customer := &components.User{CardNumber: "CUSTOMER", Name: "Kunde", Role: "customer"}
+	if err := stores.Users.Create(customer); err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+
+	// Top-ups log within their transaction; none may lose the race for the head of the chain
+	const workers = 20
+	var wg sync.WaitGroup
+	for i := range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := stores.Atomic(func(tx repository.Stores) error {
+				if _, err := tx.Users.AdjustBalance(customer.ID, 1); err != nil {
+					return err
+				}
+				return tx.Audit.Log(repository.AuditEvent{UserID: customer.ID, Action: "balance_topup", Details: fmt.Sprintf("concurrent %d", i)})
+			})
+			if err != nil {
+				t.Errorf("Top-up %d failed: %v", i, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if user, err := stores.Users.Get(customer.ID); err != nil || user.Balance != workers {
+		t.Errorf("Balance after %d top-ups = %+v, %v", workers, user, err)
+	}
+	if verification, err := stores.Audit.Verify(); err != nil || !verification.Intact() || verification.Entries != workers {
+		t.Errorf("Verify after concurrent top-ups = %+v, %v, want %d intact entries", verification, err, workers)
+	}
+}
+
+func TestTransactionKindMigration(t *testing.T) {
+	requireSQLite(t)
+	db, _, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	// Older versions told top-ups and manual bookings from sales by their description only
+	for _, description := range []any{nil, "Guthaben aufgeladen", "Korrektur"} {
+		_, err := db.Exec(`
+			INSERT INTO transactions (user_id, cashier_id, total, description, created_at)
+			VALUES (1, 1, 5, ?, ?)
+		`, description, database.Now())
+		if err != nil {
+			t.Fatalf("Failed to insert transaction: %v", err)
+		}
+	}
+	if _, err := db.Exec("PRAGMA user_version = 9"); err != nil {
+		t.Fatalf("Failed to reset schema version: %v", err)
+	}
+	if err := database.InitDB(db); err != nil {
+		t.Fatalf("Failed to migrate database: %v", err)
+	}
+
+	rows, err := db.Query("SELECT kind FROM transactions ORDER BY id")
+	if err != nil {
+		t.Fatalf("Failed to read transactions: %v", err)
+	}
+	defer rows.Close()
+	var kinds []string
+	for rows.Next() {
+		var kind string
+		if err := rows.Scan(&kind); err != nil {
+			t.Fatalf("Failed to read kind: %v", err)
+		}
+		kinds = append(kinds, kind)
+	}
+	want := []string{repository.TransactionSale, repository.TransactionTopup, repository.TransactionManual}
+	if strings.Join(kinds, ",") != strings.Join(want, ",") {
+		t.Errorf("Kinds after migration = %v, want %v", kinds, want)
+	}
+}
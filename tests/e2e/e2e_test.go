@@ -0,0 +1,1256 @@
+package e2e_test
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"gopos/config"
+	"gopos/database"
+	"gopos/handlers"
+	"gopos/metrics"
+	"gopos/repository"
+	"gopos/server"
+	"gopos/services"
+
+	_ "modernc.org/sqlite"
+)
+
+// fakeSender records emails instead of sending them
+type fakeSender struct {
+	mu     sync.Mutex
+	emails []services.Email
+}
+
+func (f *fakeSender) Send(email services.Email) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.emails = append(f.emails, email)
+	return nil
+}
+
+// waitFor returns the first email to the address. Some emails are sent in the
+// background after the response, so it waits a moment for them.
+func (f *fakeSender) waitFor(t *testing.T, to string) services.Email {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		f.mu.Lock()
+		for _, email := range f.emails {
+			if email.To == to {
+				f.mu.Unlock()
+				return email
+			}
+		}
+		f.mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("No email sent to %s", to)
+	return services.Email{}
+}
+
+type testServer struct {
+	*httptest.Server
+	db     *sql.DB
+	emails *fakeSender
+	// realEmails is the sender the fake replaced
+	realEmails services.EmailSender
+}
+
+// newTestServer boots the routes of GoPOS on a new SQLite database and a fake
+// email sender. The database has the default admin with card number ADMIN.
+func newTestServer(t *testing.T) *testServer {
+	db, err := database.Open(filepath.Join(t.TempDir(), "gopos.db"), database.DefaultOptions())
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := database.InitDB(db); err != nil {
+		t.Fatalf("Failed to initialize database: %v", err)
+	}
+	if err := services.LoadSettings(db); err != nil {
+		t.Fatalf("Failed to load settings: %v", err)
+	}
+
+	cfg := &config.Config{}
+	cfg.Session.Key = "e2e-test-session-key-0123456789ab"
+	handlers.InitSessionStore(cfg)
+	services.InitEmailService(cfg)
+	services.InitPrinterService(cfg)
+
+	emails := &fakeSender{}
+	previous := services.SetEmailSender(emails)
+	t.Cleanup(func() { services.SetEmailSender(previous) })
+
+	ts := httptest.NewServer(server.New(db, os.DirFS("../../static"), "test", "test"))
+	t.Cleanup(ts.Close)
+	return &testServer{Server: ts, db: db, emails: emails, realEmails: previous}
+}
+
+// createUser inserts a user directly, for tests that are not about user management
+func (s *testServer) createUser(t *testing.T, cardNumber, name, role, email string, balance float64) int {
+	t.Helper()
+	var id int
+	err := s.db.QueryRow(`
+		INSERT INTO users (card_number, name, role, balance, email, created_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+		RETURNING id
+	`, cardNumber, name, role, balance, email, database.Now()).Scan(&id)
+	if err != nil {
+		t.Fatalf("Failed to create user %s: %v", name, err)
+	}
+	return id
+}
+
+func (s *testServer) balance(t *testing.T, cardNumber string) float64 {
+	t.Helper()
+	var balance float64
+	if err := s.db.QueryRow("SELECT balance FROM users WHERE card_number = ?", cardNumber).Scan(&balance); err != nil {
+		t.Fatalf("Failed to get balance of %s: %v", cardNumber, err)
+	}
+	return balance
+}
+
+// auditActions returns the actions in the audit log, oldest first
+func (s *testServer) auditActions(t *testing.T) []string {
+	t.Helper()
+	rows, err := s.db.Query("SELECT action FROM audit_log ORDER BY id")
+	if err != nil {
+		t.Fatalf("Failed to read audit log: %v", err)
+	}
+	defer rows.Close()
+
+	var actions []string
+	for rows.Next() {
+		var action string
+		if err := rows.Scan(&action); err != nil {
+			t.Fatalf("Failed to read audit log: %v", err)
+		}
+		actions = append(actions, action)
+	}
+	return actions
+}
+
+func (s *testServer) requireAudit(t *testing.T, actions ...string) {
+	t.Helper()
+	logged := strings.Join(s.auditActions(t), ",")
+	for _, action := range actions {
+		if !strings.Contains(","+logged+",", ","+action+",") {
+			t.Errorf("Audit log %q is missing %q", logged, action)
+		}
+	}
+}
+
+// browser is a client with its own session that does not follow redirects
+type browser struct {
+	t      *testing.T
+	server *testServer
+	client *http.Client
+}
+
+func (s *testServer) browser(t *testing.T) *browser {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &browser{t: t, server: s, client: &http.Client{
+		Jar: jar,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}}
+}
+
+// response is a response with its body already read
+type response struct {
+	status   int
+	location string
+	header   http.Header
+	body     string
+}
+
+func (b *browser) do(request *http.Request) response {
+	b.t.Helper()
+	resp, err := b.client.Do(request)
+	if err != nil {
+		b.t.Fatalf("%s %s failed: %v", request.Method, request.URL, err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		b.t.Fatalf("Reading %s failed: %v", request.URL, err)
+	}
+	location, _ := url.QueryUnescape(resp.Header.Get("Location"))
+	return response{status: resp.StatusCode, location: location, header: resp.Header, body: string(body)}
+}
+
+func (b *browser) get(path string) response {
+	b.t.Helper()
+	request, err := http.NewRequest(http.MethodGet, b.server.URL+path, nil)
+	if err != nil {
+		b.t.Fatal(err)
+	}
+	return b.do(request)
+}
+
+func (b *browser) post(path string, form url.Values) response {
+	b.t.Helper()
+	request, err := http.NewRequest(http.MethodPost, b.server.URL+path, strings.NewReader(form.Encode()))
+	if err != nil {
+		b.t.Fatal(err)
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return b.do(request)
+}
+
+func (b *browser) postJSON(path string, value any) response {
+	b.t.Helper()
+	body, err := json.Marshal(value)
+	if err != nil {
+		b.t.Fatal(err)
+	}
+	request, err := http.NewRequest(http.MethodPost, b.server.URL+path, bytes.NewReader(body))
+	if err != nil {
+		b.t.Fatal(err)
+	}
+	request.Header.Set("Content-Type", "application/json")
+	return b.do(request)
+}
+
+var csrfTokenPattern = regexp.MustCompile(`name="csrf_token" value="([^"]+)"`)
+
+// submit posts a form like a browser does: it loads the page first and sends
+// the form with the CSRF token rendered into it
+func (b *browser) submit(page, action string, form url.Values) response {
+	b.t.Helper()
+	form.Set("csrf_token", b.csrfToken(page))
+	return b.post(action, form)
+}
+
+// csrfToken loads the page and returns the CSRF token rendered into its form
+func (b *browser) csrfToken(page string) string {
+	b.t.Helper()
+	loaded := b.get(page)
+	match := csrfTokenPattern.FindStringSubmatch(loaded.body)
+	if match == nil {
+		b.t.Fatalf("No CSRF token on %s (status %d)", page, loaded.status)
+	}
+	return match[1]
+}
+
+// upload submits a form with a file like submit does, as multipart/form-data
+func (b *browser) upload(page, action string, form url.Values, field, filename string, content []byte) response {
+	b.t.Helper()
+	form.Set("csrf_token", b.csrfToken(page))
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	for key, values := range form {
+		for _, value := range values {
+			writer.WriteField(key, value)
+		}
+	}
+	if content != nil {
+		part, err := writer.CreateFormFile(field, filename)
+		if err != nil {
+			b.t.Fatal(err)
+		}
+		part.Write(content)
+	}
+	writer.Close()
+
+	request, err := http.NewRequest(http.MethodPost, b.server.URL+action, &body)
+	if err != nil {
+		b.t.Fatal(err)
+	}
+	request.Header.Set("Content-Type", writer.FormDataContentType())
+	return b.do(request)
+}
+
+// login signs in with a card number and fails the test if that does not work
+func (b *browser) login(cardNumber string) {
+	b.t.Helper()
+	resp := b.submit("/", "/login", url.Values{"card_number": {cardNumber}})
+	if resp.status != http.StatusSeeOther || resp.location != "/dashboard" {
+		b.t.Fatalf("Login with %s returned %d to %q", cardNumber, resp.status, resp.location)
+	}
+}
+
+func (s *testServer) loggedIn(t *testing.T, cardNumber string) *browser {
+	b := s.browser(t)
+	b.login(cardNumber)
+	return b
+}
+
+func requireStatus(t *testing.T, what string, resp response, status int) {
+	t.Helper()
+	if resp.status != status {
+		t.Fatalf("%s returned %d, want %d: %s", what, resp.status, status, resp.body)
+	}
+}
+
+func TestLogin(t *testing.T) {
+	s := newTestServer(t)
+	b := s.browser(t)
+
+	resp := b.post("/login", url.Values{"card_number": {"ADMIN"}, "csrf_token": {"forged"}})
+	if !strings.Contains(resp.body, "Ungültiger CSRF-Token") {
+		t.Errorf("Login with a forged CSRF token was not rejected: %d %s", resp.status, resp.body)
+	}
+
+	resp = b.submit("/", "/login", url.Values{"card_number": {"UNKNOWN"}})
+	if !strings.Contains(resp.body, "Ungültige Kartennummer") {
+		t.Errorf("Login with an unknown card was not rejected: %d %s", resp.status, resp.body)
+	}
+
+	if resp := b.get("/dashboard"); resp.status != http.StatusSeeOther || resp.location != "/" {
+		t.Errorf("Dashboard without login returned %d to %q, want a redirect to the login", resp.status, resp.location)
+	}
+
+	b.login("ADMIN")
+	requireStatus(t, "Dashboard", b.get("/dashboard"), http.StatusOK)
+	s.requireAudit(t, "login")
+
+	b.get("/logout")
+	if resp := b.get("/dashboard"); resp.status != http.StatusSeeOther {
+		t.Errorf("Dashboard after logout returned %d, want a redirect", resp.status)
+	}
+	s.requireAudit(t, "logout")
+}
+
+// inlineCode matches what the Content-Security-Policy blocks: script and style
+// elements without a source, style attributes and event handler attributes
+var inlineCode = regexp.MustCompile(`<script>|<style|\sstyle="|\son[a-z]+="`)
+
+func TestSecurityHeaders(t *testing.T) {
+	s := newTestServer(t)
+	check := func(page string, resp response) {
+		t.Helper()
+		requireStatus(t, page, resp, http.StatusOK)
+		if csp := resp.header.Get("Content-Security-Policy"); !strings.Contains(csp, "script-src 'self';") || strings.Contains(csp, "unsafe-inline") {
+			t.Errorf("%s: Content-Security-Policy = %q, want a strict policy", page, csp)
+		}
+		if resp.header.Get("X-Frame-Options") != "DENY" || resp.header.Get("X-Content-Type-Options") != "nosniff" || resp.header.Get("Referrer-Policy") == "" {
+			t.Errorf("%s: security headers missing: %v", page, resp.header)
+		}
+		if match := inlineCode.FindString(resp.body); match != "" {
+			t.Errorf("%s: contains %q, which the Content-Security-Policy blocks", page, match)
+		}
+		if strings.Contains(resp.body, "https://unpkg.com") || strings.Contains(resp.body, "https://cdnjs.") {
+			t.Errorf("%s: loads assets from a CDN", page)
+		}
+	}
+
+	check("Login page", s.browser(t).get("/"))
+
+	b := s.loggedIn(t, "ADMIN")
+	for _, page := range []string{"/dashboard", "/users", "/users/new", "/products", "/products/new", "/checkout", "/balance/topup", "/transactions", "/audit", "/settings", "/backups", "/reports", "/stats"} {
+		check(page, b.get(page))
+	}
+
+	requireStatus(t, "app.js", b.get("/static/js/app.js"), http.StatusOK)
+	requireStatus(t, "checkout.js", b.get("/static/js/checkout.js"), http.StatusOK)
+}
+
+func TestRoleEnforcement(t *testing.T) {
+	s := newTestServer(t)
+	s.createUser(t, "CASH1", "Kassierer", "cashier", "", 0)
+	s.createUser(t, "CUST1", "Kunde", "customer", "", 0)
+
+	tests := []struct {
+		cardNumber string
+		path       string
+		status     int
+	}{
+		{"ADMIN", "/users", http.StatusOK},
+		{"ADMIN", "/products", http.StatusOK},
+		{"ADMIN", "/audit", http.StatusOK},
+		{"ADMIN", "/checkout", http.StatusOK},
+		{"CASH1", "/checkout", http.StatusOK},
+		{"CASH1", "/users/topup", http.StatusOK},
+		{"CASH1", "/users", http.StatusUnauthorized},
+		{"CASH1", "/products", http.StatusUnauthorized},
+		{"CASH1", "/audit", http.StatusUnauthorized},
+		{"CUST1", "/transactions", http.StatusOK},
+		{"CUST1", "/checkout", http.StatusUnauthorized},
+		{"CUST1", "/api/customers?card_number=ADMIN", http.StatusUnauthorized},
+		{"CUST1", "/users/topup", http.StatusUnauthorized},
+		{"CUST1", "/settings", http.StatusUnauthorized},
+	}
+
+	browsers := map[string]*browser{}
+	for _, test := range tests {
+		b, ok := browsers[test.cardNumber]
+		if !ok {
+			b = s.loggedIn(t, test.cardNumber)
+			browsers[test.cardNumber] = b
+		}
+		if resp := b.get(test.path); resp.status != test.status {
+			t.Errorf("%s as %s returned %d, want %d", test.path, test.cardNumber, resp.status, test.status)
+		}
+	}
+
+	// Customers cannot change data either
+	resp := browsers["CUST1"].post("/users/delete", url.Values{"id": {"1"}})
+	requireStatus(t, "Deleting a user as customer", resp, http.StatusUnauthorized)
+}
+
+func TestUserManagement(t *testing.T) {
+	s := newTestServer(t)
+	admin := s.loggedIn(t, "ADMIN")
+
+	resp := admin.submit("/users/new", "/users/new", url.Values{
+		"card_number": {"1001"},
+		"name":        {"Erika Muster"},
+		"role":        {"customer"},
+		"email":       {"erika@example.com"},
+	})
+	requireStatus(t, "Creating a user", resp, http.StatusSeeOther)
+	if email := s.emails.waitFor(t, "erika@example.com"); !strings.Contains(email.PlainText, "Erika Muster") {
+		t.Errorf("Welcome email does not name the user: %q", email.PlainText)
+	}
+
+	resp = admin.submit("/users/new", "/users/new", url.Values{
+		"card_number": {"1001"},
+		"name":        {"Doppelt"},
+		"role":        {"customer"},
+	})
+	if !strings.Contains(resp.body, "Diese Kartennummer existiert bereits") {
+		t.Errorf("Duplicate card number was not rejected: %d", resp.status)
+	}
+
+	var id int
+	if err := s.db.QueryRow("SELECT id FROM users WHERE card_number = '1001'").Scan(&id); err != nil {
+		t.Fatalf("Created user not found: %v", err)
+	}
+	if resp := admin.get("/users"); !strings.Contains(resp.body, "Erika Muster") {
+		t.Errorf("User list does not show the new user")
+	}
+
+	editPath := "/users/edit?id=" + strconv.Itoa(id)
+	resp = admin.submit(editPath, editPath, url.Values{
+		"card_number":      {"1001"},
+		"name":             {"Erika Beispiel"},
+		"role":             {"cashier"},
+		"email":            {"erika@example.com"},
+		"balance":          {"7,50"},
+		"original_balance": {"0.00"},
+	})
+	requireStatus(t, "Editing the user", resp, http.StatusSeeOther)
+	var name, role string
+	s.db.QueryRow("SELECT name, role FROM users WHERE id = ?", id).Scan(&name, &role)
+	if name != "Erika Beispiel" || role != "cashier" || s.balance(t, "1001") != 7.5 {
+		t.Errorf("Edit was not stored: %s, %s, %.2f", name, role, s.balance(t, "1001"))
+	}
+	// The changed balance is booked as a correction, which reports count as neither sale nor top-up
+	var kind string
+	var total float64
+	s.db.QueryRow("SELECT kind, total FROM transactions WHERE user_id = ?", id).Scan(&kind, &total)
+	if kind != repository.TransactionAdjustment || total != 7.5 {
+		t.Errorf("Balance edit was booked as %q over %.2f, want an adjustment over 7.50", kind, total)
+	}
+
+	// A payment while the form is open is kept by an edit of other fields
+	s.db.Exec("UPDATE users SET balance = balance + 2 WHERE id = ?", id)
+	resp = admin.submit(editPath, editPath, url.Values{
+		"card_number":      {"1001"},
+		"name":             {"Erika Beispiel"},
+		"role":             {"cashier"},
+		"email":            {"erika.beispiel@example.com"},
+		"balance":          {"7,50"},
+		"original_balance": {"7.50"},
+	})
+	requireStatus(t, "Editing the user after a payment", resp, http.StatusSeeOther)
+	if balance := s.balance(t, "1001"); balance != 9.5 {
+		t.Errorf("Balance = %.2f after editing the email, want the 9.50 of the payment", balance)
+	}
+	// and a balance entered in that form is refused instead of overwriting it
+	resp = admin.submit(editPath, editPath, url.Values{
+		"card_number":      {"1001"},
+		"name":             {"Erika Beispiel"},
+		"role":             {"cashier"},
+		"balance":          {"5"},
+		"original_balance": {"7.50"},
+	})
+	if !strings.Contains(resp.body, "inzwischen durch eine Zahlung geändert") {
+		t.Errorf("Balance entered before a payment was not refused: %d", resp.status)
+	}
+	if balance := s.balance(t, "1001"); balance != 9.5 {
+		t.Errorf("Balance = %.2f after a refused edit, want 9.50", balance)
+	}
+
+	if resp := admin.get("/users/search?q=beispiel"); !strings.Contains(resp.body, "Erika Beispiel") {
+		t.Errorf("User search does not find the edited user")
+	}
+	if resp := admin.get("/users/filter?role=customer"); strings.Contains(resp.body, "Erika Beispiel") {
+		t.Errorf("Filtering customers lists a cashier")
+	}
+
+	// The booked correction keeps the user from being deleted, a user without bookings can be
+	resp = admin.post("/users/delete", url.Values{"id": {strconv.Itoa(id)}})
+	requireStatus(t, "Deleting a user with a booking", resp, http.StatusBadRequest)
+	unbooked := s.createUser(t, "1002", "Max Muster", "customer", "", 0)
+	resp = admin.post("/users/delete", url.Values{"id": {strconv.Itoa(unbooked)}})
+	requireStatus(t, "Deleting the user", resp, http.StatusSeeOther)
+	var count int
+	s.db.QueryRow("SELECT COUNT(*) FROM users WHERE id = ?", unbooked).Scan(&count)
+	if count != 0 {
+		t.Errorf("User was not deleted")
+	}
+
+	s.requireAudit(t, "create_user", "edit_user", "delete_user")
+}
+
+func TestUserDeactivationAndAnonymization(t *testing.T) {
+	s := newTestServer(t)
+	admin := s.loggedIn(t, "ADMIN")
+	s.createUser(t, "CASH1", "Kassierer", "cashier", "", 0)
+	id := s.createUser(t, "CUST1", "Karl Kunde", "customer", "karl@example.com", 5)
+	cashier := s.loggedIn(t, "CASH1")
+	requireStatus(t, "Checkout", cashier.postJSON("/api/checkout", handlers.CheckoutRequest{CardNumber: "CUST1", Total: 2}), http.StatusOK)
+	customer := s.loggedIn(t, "CUST1")
+	requireStatus(t, "Transactions of the customer", customer.get("/transactions"), http.StatusOK)
+
+	// redirected returns the message or error a status change redirected with
+	redirected := func(resp response) string {
+		t.Helper()
+		requireStatus(t, "Changing the user status", resp, http.StatusSeeOther)
+		location, _ := url.Parse(resp.location)
+		return location.Query().Get("message") + location.Query().Get("error")
+	}
+	form := url.Values{"id": {strconv.Itoa(id)}}
+
+	// An edit before leaves an audit entry about the personal data
+	editPath := "/users/edit?id=" + strconv.Itoa(id)
+	requireStatus(t, "Editing the user", admin.submit(editPath, editPath, url.Values{
+		"card_number":      {"CUST1"},
+		"name":             {"Karl Kunde"},
+		"role":             {"customer"},
+		"email":            {"karl.kunde@example.com"},
+		"balance":          {"3"},
+		"original_balance": {"3.00"},
+	}), http.StatusSeeOther)
+
+	if message := redirected(admin.submit("/users", "/users/deactivate", form)); !strings.Contains(message, "deaktiviert") {
+		t.Errorf("Deactivating redirected with %q", message)
+	}
+	if resp := admin.get("/users"); strings.Contains(resp.body, "Karl Kunde") {
+		t.Error("User list shows the deactivated user by default")
+	}
+	if resp := admin.get("/users?status=inactive"); !strings.Contains(resp.body, "Karl Kunde") || !strings.Contains(resp.body, "Deaktiviert") {
+		t.Error("User list of deactivated users does not show the user")
+	}
+
+	// Deactivated users can neither log in nor pay
+	if resp := s.browser(t).submit("/", "/login", url.Values{"card_number": {"CUST1"}}); !strings.Contains(resp.body, "deaktiviert") {
+		t.Errorf("Login of a deactivated user returned %d to %q", resp.status, resp.location)
+	}
+	// A session opened before the deactivation ends with it
+	if resp := customer.get("/transactions"); resp.status != http.StatusSeeOther || resp.location != "/" {
+		t.Errorf("Session of a deactivated user returned %d to %q, want a redirect to the login", resp.status, resp.location)
+	}
+	if resp := customer.get("/dashboard"); resp.status != http.StatusSeeOther {
+		t.Errorf("Ended session of a deactivated user returned %d for the dashboard", resp.status)
+	}
+	requireStatus(t, "Customer lookup", cashier.get("/api/customers?card_number=CUST1"), http.StatusForbidden)
+	requireStatus(t, "Checkout", cashier.postJSON("/api/checkout", handlers.CheckoutRequest{CardNumber: "CUST1", Total: 1}), http.StatusNotFound)
+
+	if message := redirected(admin.submit("/users?status=inactive", "/users/reactivate", form)); !strings.Contains(message, "reaktiviert") {
+		t.Errorf("Reactivating redirected with %q", message)
+	}
+	s.loggedIn(t, "CUST1")
+	admin.submit("/users", "/users/deactivate", form)
+
+	// The balance has to be paid out before the data is erased
+	if message := redirected(admin.submit("/users?status=inactive", "/users/anonymize", form)); !strings.Contains(message, "Guthaben") {
+		t.Errorf("Anonymizing with a balance redirected with %q", message)
+	}
+	s.db.Exec("UPDATE users SET balance = 0 WHERE id = ?", id)
+	if message := redirected(admin.submit("/users?status=inactive", "/users/anonymize", form)); !strings.Contains(message, "ANON-") {
+		t.Errorf("Anonymizing redirected with %q", message)
+	}
+	var name, cardNumber string
+	var email sql.NullString
+	s.db.QueryRow("SELECT name, card_number, email FROM users WHERE id = ?", id).Scan(&name, &cardNumber, &email)
+	if !strings.HasPrefix(name, "ANON-") || cardNumber != name || email.Valid {
+		t.Errorf("Anonymized user has name %q, card %q and email %v", name, cardNumber, email)
+	}
+	var transactions int
+	s.db.QueryRow("SELECT COUNT(*) FROM transactions WHERE user_id = ?", id).Scan(&transactions)
+	if transactions != 1 {
+		t.Errorf("Anonymized user has %d transactions, want the one from before", transactions)
+	}
+	resp := admin.get("/users?status=all")
+	if strings.Contains(resp.body, "Karl Kunde") || strings.Contains(resp.body, "karl@example.com") || !strings.Contains(resp.body, name) {
+		t.Error("User list shows personal data of the anonymized user")
+	}
+	var details string
+	s.db.QueryRow("SELECT details FROM audit_log WHERE action = 'anonymize_user'").Scan(&details)
+	if strings.Contains(details, "Karl") || !strings.Contains(details, name) {
+		t.Errorf("Audit entry of the anonymization = %q, want only the pseudonym", details)
+	}
+	var personal int
+	s.db.QueryRow(`
+		SELECT COUNT(*) FROM audit_log
+		WHERE details LIKE '%Karl%' OR changes LIKE '%Karl%' OR changes LIKE '%karl%example.com%' OR changes LIKE '%CUST1%'
+	`).Scan(&personal)
+	if personal != 0 {
+		t.Errorf("%d audit entries still hold personal data of the anonymized user", personal)
+	}
+
+	if message := redirected(admin.submit("/users?status=inactive", "/users/reactivate", form)); !strings.Contains(message, "Anonymisierte") {
+		t.Errorf("Reactivating an anonymized user redirected with %q", message)
+	}
+	if resp := admin.get("/users/edit?id=" + strconv.Itoa(id)); resp.status != http.StatusSeeOther {
+		t.Errorf("Editing an anonymized user returned %d", resp.status)
+	}
+
+	var adminID int
+	s.db.QueryRow("SELECT id FROM users WHERE card_number = 'ADMIN'").Scan(&adminID)
+	if message := redirected(admin.submit("/users", "/users/deactivate", url.Values{"id": {strconv.Itoa(adminID)}})); !strings.Contains(message, "eigenes Konto") {
+		t.Errorf("Deactivating oneself redirected with %q", message)
+	}
+
+	s.requireAudit(t, "deactivate_user", "reactivate_user", "anonymize_user")
+}
+
+func TestProductManagement(t *testing.T) {
+	s := newTestServer(t)
+	admin := s.loggedIn(t, "ADMIN")
+
+	resp := admin.submit("/products/new", "/products/new", url.Values{
+		"barcode": {"4001"},
+		"name":    {"Apfelschorle"},
+		"price":   {"1,80"},
+	})
+	requireStatus(t, "Creating a product", resp, http.StatusSeeOther)
+
+	resp = admin.submit("/products/new", "/products/new", url.Values{
+		"barcode": {"4001"},
+		"name":    {"Doppelt"},
+		"price":   {"1"},
+	})
+	if !strings.Contains(resp.body, "Dieser Barcode existiert bereits") {
+		t.Errorf("Duplicate barcode was not rejected: %d", resp.status)
+	}
+
+	resp = admin.post("/products/new", url.Values{"barcode": {"4002"}, "name": {"Ohne Token"}, "price": {"1"}})
+	if !strings.Contains(resp.body, "Ungültiger CSRF-Token") {
+		t.Errorf("Product form without CSRF token was not rejected: %d", resp.status)
+	}
+
+	var id int
+	var price float64
+	if err := s.db.QueryRow("SELECT id, price FROM products WHERE barcode = '4001'").Scan(&id, &price); err != nil {
+		t.Fatalf("Created product not found: %v", err)
+	}
+	if price != 1.8 {
+		t.Errorf("Price = %.2f, want 1.80", price)
+	}
+
+	editPath := "/products/edit?id=" + strconv.Itoa(id)
+	resp = admin.submit(editPath, editPath, url.Values{
+		"barcode": {"4001"},
+		"name":    {"Apfelschorle 0,5l"},
+		"price":   {"2,10"},
+	})
+	requireStatus(t, "Editing the product", resp, http.StatusSeeOther)
+	if resp := admin.get("/products/search?q=SCHORLE"); !strings.Contains(resp.body, "Apfelschorle 0,5l") {
+		t.Errorf("Product search does not find the edited product")
+	}
+
+	resp = admin.post("/products/delete", url.Values{"id": {strconv.Itoa(id)}})
+	requireStatus(t, "Deleting the product", resp, http.StatusSeeOther)
+	var count int
+	s.db.QueryRow("SELECT COUNT(*) FROM products WHERE id = ?", id).Scan(&count)
+	if count != 0 {
+		t.Errorf("Product was not deleted")
+	}
+
+	s.requireAudit(t, "create_product", "edit_product", "delete_product")
+}
+
+func TestTopup(t *testing.T) {
+	s := newTestServer(t)
+	s.createUser(t, "CASH1", "Kassierer", "cashier", "", 0)
+	s.createUser(t, "CUST1", "Kunde", "customer", "kunde@example.com", 2)
+	cashier := s.loggedIn(t, "CASH1")
+
+	resp := cashier.submit("/users/topup", "/users/topup", url.Values{
+		"card_number": {"CUST1"},
+		"amount":      {"10,50"},
+	})
+	requireStatus(t, "Top-up", resp, http.StatusSeeOther)
+	if !strings.Contains(resp.location, "success=true") {
+		t.Errorf("Top-up redirected to %q, want success", resp.location)
+	}
+	if balance := s.balance(t, "CUST1"); balance != 12.5 {
+		t.Errorf("Balance = %.2f, want 12.50", balance)
+	}
+	s.emails.waitFor(t, "kunde@example.com")
+	var kind string
+	var total, balanceAfter float64
+	s.db.QueryRow("SELECT kind, total, balance_after FROM transactions").Scan(&kind, &total, &balanceAfter)
+	if kind != repository.TransactionTopup || total != 10.5 || balanceAfter != 12.5 {
+		t.Errorf("Top-up was booked as %q over %.2f with balance %.2f, want a top-up over 10.50", kind, total, balanceAfter)
+	}
+
+	resp = cashier.submit("/users/topup", "/users/topup", url.Values{
+		"card_number": {"CUST1"},
+		"amount":      {"-5"},
+	})
+	if !strings.Contains(resp.location, "error=") {
+		t.Errorf("Negative top-up redirected to %q, want an error", resp.location)
+	}
+	if balance := s.balance(t, "CUST1"); balance != 12.5 {
+		t.Errorf("Balance = %.2f after a rejected top-up, want 12.50", balance)
+	}
+
+	s.requireAudit(t, "balance_topup")
+}
+
+func TestCheckout(t *testing.T) {
+	s := newTestServer(t)
+	s.createUser(t, "CASH1", "Kassierer", "cashier", "", 0)
+	s.createUser(t, "CUST1", "Kunde", "customer", "kunde@example.com", 10)
+	var productID int
+	s.db.QueryRow(`
+		INSERT INTO products (barcode, name, price, created_at) VALUES ('4001', 'Brezel', 1.5, ?)
+		RETURNING id
+	`, database.Now()).Scan(&productID)
+
+	cashier := s.loggedIn(t, "CASH1")
+	requireStatus(t, "Customer lookup", cashier.get("/api/customers?card_number=CUST1"), http.StatusOK)
+	scan := cashier.get("/api/products?barcode=4001")
+	requireStatus(t, "Product scan", scan, http.StatusOK)
+	var item handlers.CartItem
+	if err := json.Unmarshal([]byte(scan.body), &item); err != nil || item.Name != "Brezel" {
+		t.Fatalf("Unexpected product scan %s: %v", scan.body, err)
+	}
+	item.Quantity = 2
+
+	resp := cashier.postJSON("/api/checkout", handlers.CheckoutRequest{
+		CardNumber: "CUST1",
+		Total:      3,
+		Items:      []handlers.CartItem{item},
+	})
+	requireStatus(t, "Checkout", resp, http.StatusOK)
+	if balance := s.balance(t, "CUST1"); balance != 7 {
+		t.Errorf("Balance = %.2f after checkout, want 7.00", balance)
+	}
+
+	var quantity int
+	if err := s.db.QueryRow("SELECT quantity FROM transaction_items WHERE product_id = ?", productID).Scan(&quantity); err != nil || quantity != 2 {
+		t.Errorf("Transaction item quantity = %d, %v, want 2", quantity, err)
+	}
+
+	email := s.emails.waitFor(t, "kunde@example.com")
+	if len(email.Attachments) != 1 || email.Attachments[0].ContentType != "application/pdf" {
+		t.Errorf("Checkout email should have the receipt attached, got %d attachments", len(email.Attachments))
+	}
+
+	resp = cashier.postJSON("/api/checkout", handlers.CheckoutRequest{
+		CardNumber: "CUST1",
+		Total:      100,
+		Items:      []handlers.CartItem{item},
+	})
+	requireStatus(t, "Checkout beyond the balance", resp, http.StatusBadRequest)
+	if balance := s.balance(t, "CUST1"); balance != 7 {
+		t.Errorf("Balance = %.2f after a rejected checkout, want 7.00", balance)
+	}
+
+	// The customer sees the purchase in their transactions
+	customer := s.loggedIn(t, "CUST1")
+	if resp := customer.get("/transactions"); !strings.Contains(resp.body, "Brezel") {
+		t.Errorf("Transactions of the customer do not show the purchase")
+	}
+}
+
+func TestSettings(t *testing.T) {
+	s := newTestServer(t)
+	admin := s.loggedIn(t, "ADMIN")
+	settings := func(currency, timezone string) url.Values {
+		return url.Values{
+			"store_name":     {"Kiosk am See"},
+			"currency":       {currency},
+			"timezone":       {timezone},
+			"receipt_footer": {"Danke!"},
+		}
+	}
+
+	requireStatus(t, "Logo without upload", admin.get("/settings/logo"), http.StatusNotFound)
+
+	resp := admin.upload("/settings", "/settings", settings("XYZ", "Europe/Zurich"), "logo", "", nil)
+	if !strings.Contains(resp.body, "Ungültige Währung") {
+		t.Errorf("Unknown currency was not rejected: %d", resp.status)
+	}
+	resp = admin.upload("/settings", "/settings", settings("CHF", "Mars/Olympus"), "logo", "", nil)
+	if !strings.Contains(resp.body, "Unbekannte Zeitzone: Mars/Olympus") {
+		t.Errorf("Unknown timezone was not rejected: %d", resp.status)
+	}
+	resp = admin.upload("/settings", "/settings", settings("CHF", "Europe/Zurich"), "logo", "logo.txt", []byte("kein Bild"))
+	if !strings.Contains(resp.body, "PNG- oder JPEG-Bild") {
+		t.Errorf("Logo that is no image was not rejected: %d", resp.status)
+	}
+	if services.GetSettings().StoreName != "GoPOS" {
+		t.Errorf("Rejected forms changed the settings to %+v", services.GetSettings())
+	}
+
+	logo := []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+	resp = admin.upload("/settings", "/settings", settings("chf", "Europe/Zurich"), "logo", "logo.png", logo)
+	requireStatus(t, "Saving the settings", resp, http.StatusSeeOther)
+	if resp := admin.get(resp.location); !strings.Contains(resp.body, "Einstellungen gespeichert") || !strings.Contains(resp.body, "Kiosk am See") {
+		t.Errorf("Settings page does not show the saved settings")
+	}
+	if current := services.GetSettings(); current.Currency != "CHF" || current.Timezone != "Europe/Zurich" || !current.HasLogo {
+		t.Errorf("Active settings = %+v", current)
+	}
+
+	// The logo is served to everyone, the login page shows it
+	resp = s.browser(t).get("/settings/logo")
+	requireStatus(t, "Logo", resp, http.StatusOK)
+	if resp.body != string(logo) || resp.header.Get("Content-Type") != "image/png" {
+		t.Errorf("Logo = %q as %s, want the upload", resp.body, resp.header.Get("Content-Type"))
+	}
+
+	// Saving without an upload keeps the logo, remove_logo removes it
+	requireStatus(t, "Saving without logo", admin.upload("/settings", "/settings", settings("CHF", "Europe/Zurich"), "logo", "", nil), http.StatusSeeOther)
+	requireStatus(t, "Logo after saving", admin.get("/settings/logo"), http.StatusOK)
+	form := settings("CHF", "Europe/Zurich")
+	form.Set("remove_logo", "true")
+	requireStatus(t, "Removing the logo", admin.upload("/settings", "/settings", form, "logo", "", nil), http.StatusSeeOther)
+	requireStatus(t, "Removed logo", admin.get("/settings/logo"), http.StatusNotFound)
+
+	s.createUser(t, "CASH1", "Kassierer", "cashier", "", 0)
+	requireStatus(t, "Settings as cashier", s.loggedIn(t, "CASH1").get("/settings"), http.StatusUnauthorized)
+	s.requireAudit(t, "update_settings")
+}
+
+func TestCartErrors(t *testing.T) {
+	s := newTestServer(t)
+	s.createUser(t, "CASH1", "Kassierer", "cashier", "", 0)
+	cashier := s.loggedIn(t, "CASH1")
+	token := cashier.csrfToken("/dashboard")
+
+	// cartRequest posts a change to a cart like the checkout page does
+	cartRequest := func(path string, body string) response {
+		t.Helper()
+		request, err := http.NewRequest(http.MethodPost, s.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		request.Header.Set("Content-Type", "application/json")
+		request.Header.Set("X-CSRF-Token", token)
+		return cashier.do(request)
+	}
+
+	resp := cartRequest("/api/cart/open?register=Kasse-1", "")
+	requireStatus(t, "Opening a cart", resp, http.StatusOK)
+	var cart struct {
+		ID int64 `json:"id"`
+	}
+	if err := json.Unmarshal([]byte(resp.body), &cart); err != nil || cart.ID == 0 {
+		t.Fatalf("Opened cart %s: %v", resp.body, err)
+	}
+	id := strconv.FormatInt(cart.ID, 10)
+
+	requireStatus(t, "Adding to an unknown cart", cartRequest("/api/cart/items?id=9999", `{"barcode":"4001"}`), http.StatusNotFound)
+	requireStatus(t, "Discarding an unknown cart", cartRequest("/api/cart/discard?id=9999", ""), http.StatusNotFound)
+	if resp := cartRequest("/api/cart/items?id=9999", `{"barcode":"4001"}`); !strings.Contains(resp.body, "Warenkorb nicht gefunden") {
+		t.Errorf("Unknown cart answered %q", resp.body)
+	}
+
+	requireStatus(t, "Discarding the cart", cartRequest("/api/cart/discard?id="+id, ""), http.StatusOK)
+	requireStatus(t, "Adding to a discarded cart", cartRequest("/api/cart/items?id="+id, `{"barcode":"4001"}`), http.StatusConflict)
+}
+
+func TestCompleteCart(t *testing.T) {
+	s := newTestServer(t)
+	s.createUser(t, "CASH1", "Kassierer", "cashier", "", 0)
+	s.createUser(t, "CUST1", "Kunde", "customer", "", 10)
+	s.db.Exec("INSERT INTO products (barcode, name, price, created_at) VALUES ('4001', 'Brezel', 1.5, ?)", database.Now())
+	cashier := s.loggedIn(t, "CASH1")
+	token := cashier.csrfToken("/dashboard")
+
+	cartRequest := func(path string, body string) response {
+		t.Helper()
+		request, err := http.NewRequest(http.MethodPost, s.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		request.Header.Set("Content-Type", "application/json")
+		request.Header.Set("X-CSRF-Token", token)
+		return cashier.do(request)
+	}
+
+	resp := cartRequest("/api/cart/open?register=Kasse-1", "")
+	requireStatus(t, "Opening a cart", resp, http.StatusOK)
+	var cart struct {
+		ID int64 `json:"id"`
+	}
+	if err := json.Unmarshal([]byte(resp.body), &cart); err != nil || cart.ID == 0 {
+		t.Fatalf("Opened cart %s: %v", resp.body, err)
+	}
+	id := strconv.FormatInt(cart.ID, 10)
+
+	requireStatus(t, "Completing an empty cart", cartRequest("/api/cart/complete?id="+id, ""), http.StatusBadRequest)
+	requireStatus(t, "Scanning", cartRequest("/api/cart/items?id="+id, `{"barcode":"4001"}`), http.StatusOK)
+	requireStatus(t, "Scanning again", cartRequest("/api/cart/items?id="+id, `{"barcode":"4001"}`), http.StatusOK)
+	requireStatus(t, "Unknown card", cartRequest("/api/cart/customer?id="+id, `{"card_number":"NOPE"}`), http.StatusNotFound)
+	requireStatus(t, "Attaching the customer", cartRequest("/api/cart/customer?id="+id, `{"card_number":"CUST1"}`), http.StatusOK)
+
+	first := cartRequest("/api/cart/complete?id="+id, "")
+	requireStatus(t, "Completing the cart", first, http.StatusOK)
+	if balance := s.balance(t, "CUST1"); balance != 7 {
+		t.Errorf("Balance = %.2f after the cart was completed, want 7.00", balance)
+	}
+	var quantity int
+	s.db.QueryRow("SELECT SUM(quantity) FROM transaction_items").Scan(&quantity)
+	if quantity != 2 {
+		t.Errorf("Sold %d items, want 2", quantity)
+	}
+
+	// Completing again answers with the first result and does not charge twice
+	second := cartRequest("/api/cart/complete?id="+id, "")
+	requireStatus(t, "Completing the cart again", second, http.StatusOK)
+	if second.body != first.body || second.header.Get("Idempotent-Replayed") != "true" {
+		t.Errorf("Completing again answered %s, want the replayed first answer %s", second.body, first.body)
+	}
+	if balance := s.balance(t, "CUST1"); balance != 7 {
+		t.Errorf("Balance = %.2f after completing again, want 7.00", balance)
+	}
+	requireStatus(t, "Scanning into the completed cart", cartRequest("/api/cart/items?id="+id, `{"barcode":"4001"}`), http.StatusConflict)
+}
+
+func TestCheckoutIdempotency(t *testing.T) {
+	s := newTestServer(t)
+	s.createUser(t, "CASH1", "Kassierer", "cashier", "", 0)
+	s.createUser(t, "CUST1", "Kunde", "customer", "", 10)
+	var productID int64
+	s.db.QueryRow(`
+		INSERT INTO products (barcode, name, price, created_at) VALUES ('4001', 'Brezel', 1.5, ?)
+		RETURNING id
+	`, database.Now()).Scan(&productID)
+	cashier := s.loggedIn(t, "CASH1")
+
+	// checkout posts a sale with the key in the Idempotency-Key header, like a register that retries
+	checkout := func(key string, request handlers.CheckoutRequest) response {
+		t.Helper()
+		body, err := json.Marshal(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		httpRequest, err := http.NewRequest(http.MethodPost, s.URL+"/api/checkout", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		httpRequest.Header.Set("Content-Type", "application/json")
+		httpRequest.Header.Set("Idempotency-Key", key)
+		return cashier.do(httpRequest)
+	}
+	sale := handlers.CheckoutRequest{
+		CardNumber: "CUST1",
+		Total:      3,
+		Items:      []handlers.CartItem{{ProductID: productID, Name: "Brezel", Price: 1.5, Quantity: 2}},
+	}
+
+	first := checkout("sale-1", sale)
+	requireStatus(t, "Checkout", first, http.StatusOK)
+	second := checkout("sale-1", sale)
+	requireStatus(t, "Repeated checkout", second, http.StatusOK)
+	if second.body != first.body {
+		t.Errorf("Repeated checkout answered %s, want the first answer %s", second.body, first.body)
+	}
+	if first.header.Get("Idempotent-Replayed") != "" || second.header.Get("Idempotent-Replayed") != "true" {
+		t.Errorf("Only the repeated checkout should be marked as replayed")
+	}
+
+	var transactions, items int
+	s.db.QueryRow("SELECT COUNT(*) FROM transactions WHERE kind = 'sale'").Scan(&transactions)
+	s.db.QueryRow("SELECT COUNT(*) FROM transaction_items").Scan(&items)
+	if transactions != 1 || items != 1 {
+		t.Errorf("Repeated checkout recorded %d transactions with %d items, want 1 with 1", transactions, items)
+	}
+	if balance := s.balance(t, "CUST1"); balance != 7 {
+		t.Errorf("Balance = %.2f after a repeated checkout, want 7.00", balance)
+	}
+
+	// The key cannot be used for another sale
+	changed := sale
+	changed.Total = 1.5
+	changed.Items = []handlers.CartItem{{ProductID: productID, Name: "Brezel", Price: 1.5, Quantity: 1}}
+	requireStatus(t, "Checkout with another total", checkout("sale-1", changed), http.StatusUnprocessableEntity)
+	changed = sale
+	changed.Items = []handlers.CartItem{{ProductID: productID, Name: "Brezel", Price: 1, Quantity: 3}}
+	requireStatus(t, "Checkout with other items", checkout("sale-1", changed), http.StatusUnprocessableEntity)
+	if balance := s.balance(t, "CUST1"); balance != 7 {
+		t.Errorf("Balance = %.2f after refused checkouts, want 7.00", balance)
+	}
+
+	// Another key is another sale
+	requireStatus(t, "Checkout with a new key", checkout("sale-2", sale), http.StatusOK)
+	if balance := s.balance(t, "CUST1"); balance != 4 {
+		t.Errorf("Balance = %.2f after a second sale, want 4.00", balance)
+	}
+}
+
+// metric returns the value of the sample with the name and labels, e.g.
+// gopos_checkouts_total or gopos_emails_total{result="success"}
+func (b *browser) metric(sample string) float64 {
+	b.t.Helper()
+	resp := b.get("/metrics")
+	requireStatus(b.t, "Metrics", resp, http.StatusOK)
+	for _, line := range strings.Split(resp.body, "\n") {
+		if value, ok := strings.CutPrefix(line, sample+" "); ok {
+			f, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				b.t.Fatalf("Invalid value in %q: %v", line, err)
+			}
+			return f
+		}
+	}
+	return 0
+}
+
+func TestMetrics(t *testing.T) {
+	s := newTestServer(t)
+	s.createUser(t, "CASH1", "Kassierer", "cashier", "", 0)
+	s.createUser(t, "CUST1", "Kunde", "customer", "kunde@example.com", 10)
+	scraper := s.browser(t)
+
+	// The counters are shared by all tests of the package
+	samples := []string{
+		"gopos_checkouts_total",
+		"gopos_checkout_amount_total",
+		"gopos_topups_total",
+		"gopos_topup_amount_total",
+		`gopos_http_requests_total{method="POST",route="/api/checkout",status="200"}`,
+	}
+	before := map[string]float64{}
+	for _, sample := range samples {
+		before[sample] = scraper.metric(sample)
+	}
+	emailsBefore := scraper.metric(`gopos_emails_total{result="success"}`)
+
+	cashier := s.loggedIn(t, "CASH1")
+	requireStatus(t, "Checkout", cashier.postJSON("/api/checkout", handlers.CheckoutRequest{CardNumber: "CUST1", Total: 2.5}), http.StatusOK)
+	resp := cashier.submit("/users/topup", "/users/topup", url.Values{"card_number": {"CUST1"}, "amount": {"20"}})
+	requireStatus(t, "Top-up", resp, http.StatusSeeOther)
+
+	for sample, want := range map[string]float64{
+		"gopos_checkouts_total":       1,
+		"gopos_checkout_amount_total": 2.5,
+		"gopos_topups_total":          1,
+		"gopos_topup_amount_total":    20,
+		`gopos_http_requests_total{method="POST",route="/api/checkout",status="200"}`: 1,
+	} {
+		if got := scraper.metric(sample) - before[sample]; got != want {
+			t.Errorf("%s increased by %v, want %v", sample, got, want)
+		}
+	}
+
+	// Both emails are sent in the background
+	deadline := time.Now().Add(2 * time.Second)
+	for scraper.metric(`gopos_emails_total{result="success"}`) < emailsBefore+2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := scraper.metric(`gopos_emails_total{result="success"}`) - emailsBefore; got != 2 {
+		t.Errorf("Sent emails increased by %v, want 2", got)
+	}
+
+	if scraper.metric(`gopos_build_info{commit="test",version="test"}`) != 1 {
+		t.Error("Build info is missing")
+	}
+	if scraper.metric(`go_sql_max_open_connections{db_name="gopos"}`) == 0 {
+		t.Error("Connection pool stats are missing")
+	}
+
+	// With a token the metrics are only served to Prometheus
+	cfg := &config.Config{}
+	cfg.Metrics.Token = "scrape-token"
+	metrics.Init(cfg)
+	t.Cleanup(func() { metrics.Init(&config.Config{}) })
+	requireStatus(t, "Metrics without token", scraper.get("/metrics"), http.StatusUnauthorized)
+	request, _ := http.NewRequest(http.MethodGet, s.URL+"/metrics", nil)
+	request.Header.Set("Authorization", "Bearer scrape-token")
+	requireStatus(t, "Metrics with token", scraper.do(request), http.StatusOK)
+}
+
+func TestHealth(t *testing.T) {
+	s := newTestServer(t)
+	b := s.browser(t)
+	health := func(path string, status int) handlers.HealthStatus {
+		t.Helper()
+		resp := b.get(path)
+		requireStatus(t, path, resp, status)
+		var health handlers.HealthStatus
+		if err := json.Unmarshal([]byte(resp.body), &health); err != nil {
+			t.Fatalf("%s returned invalid JSON %q: %v", path, resp.body, err)
+		}
+		return health
+	}
+
+	if h := health("/healthz", http.StatusOK); h.Status != "ok" || h.Version != "test" || h.Commit != "test" {
+		t.Errorf("/healthz = %+v, want ok with the version", h)
+	}
+
+	h := health("/readyz", http.StatusOK)
+	db := h.Components["database"]
+	if h.Status != "ok" || db.Status != "ok" || db.SchemaVersion == nil || *db.SchemaVersion != database.SchemaVersion() || h.Components["email"].Status != "ok" {
+		t.Errorf("/readyz = %+v, want all components ok", h)
+	}
+
+	// A database with an older schema is not ready
+	if _, err := s.db.Exec("PRAGMA user_version = 1"); err != nil {
+		t.Fatal(err)
+	}
+	h = health("/readyz", http.StatusServiceUnavailable)
+	if h.Status != "unavailable" || h.Components["database"].Status != "unavailable" || h.Components["email"].Status != "ok" {
+		t.Errorf("/readyz with an old schema = %+v, want the database unavailable", h)
+	}
+	s.db.Exec(fmt.Sprintf("PRAGMA user_version = %d", database.SchemaVersion()))
+
+	// Without email settings emails cannot be sent
+	services.SetEmailSender(s.realEmails)
+	t.Cleanup(func() { services.SetEmailSender(s.emails) })
+	h = health("/readyz", http.StatusServiceUnavailable)
+	if email := h.Components["email"]; email.Status != "unavailable" || !strings.Contains(email.Error, "endpoint") {
+		t.Errorf("/readyz without email settings = %+v, want email unavailable", h)
+	}
+
+	// The process is still alive
+	health("/healthz", http.StatusOK)
+}
+
+func TestAuditLog(t *testing.T) {
+	s := newTestServer(t)
+	admin := s.loggedIn(t, "ADMIN")
+	resp := admin.submit("/users/new", "/users/new", url.Values{
+		"card_number": {"1001"},
+		"name":        {"Erika Muster"},
+		"role":        {"customer"},
+	})
+	requireStatus(t, "Creating a user", resp, http.StatusSeeOther)
+
+	resp = admin.get("/audit?action=create_user&size=25")
+	requireStatus(t, "Filtering the audit log", resp, http.StatusOK)
+	if !strings.Contains(resp.body, "Benutzer erstellt (Rolle: customer)") || strings.Count(resp.body, "<tr") != 1 {
+		t.Errorf("Filtered audit log does not show only the created user:\n%s", resp.body)
+	}
+	if resp := admin.get("/audit?search=nobody"); !strings.Contains(resp.body, "Keine Einträge gefunden") {
+		t.Errorf("Searching the audit log for unknown details found entries")
+	}
+	if resp := admin.get("/audit?from=gestern"); !strings.Contains(resp.body, "Ungültiges Startdatum") {
+		t.Errorf("Invalid date was not reported")
+	}
+
+	resp = admin.get("/audit/export?format=csv&action=create_user")
+	requireStatus(t, "Exporting CSV", resp, http.StatusOK)
+	lines := strings.Split(strings.TrimSpace(resp.body), "\n")
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], "ID,Zeitpunkt") || !strings.Contains(lines[1], "create_user") {
+		t.Errorf("Unexpected CSV export:\n%s", resp.body)
+	}
+	if disposition := resp.header.Get("Content-Disposition"); !strings.Contains(disposition, "audit-") {
+		t.Errorf("Content-Disposition = %q, want an audit file", disposition)
+	}
+
+	resp = admin.get("/audit/export?format=json&action=login")
+	requireStatus(t, "Exporting JSON", resp, http.StatusOK)
+	var entries []struct {
+		Action   string `json:"action"`
+		UserName string `json:"user_name"`
+	}
+	if err := json.Unmarshal([]byte(resp.body), &entries); err != nil {
+		t.Fatalf("Invalid JSON export: %v", err)
+	}
+	if len(entries) != 1 || entries[0].Action != "login" || entries[0].UserName != "Administrator" {
+		t.Errorf("JSON export = %+v, want the login of the admin", entries)
+	}
+
+	// Edits record the changed fields and the client
+	var id int
+	s.db.QueryRow("SELECT id FROM users WHERE card_number = '1001'").Scan(&id)
+	editPath := "/users/edit?id=" + strconv.Itoa(id)
+	resp = admin.submit(editPath, editPath, url.Values{
+		"card_number":      {"1001"},
+		"name":             {"Erika Beispiel"},
+		"role":             {"customer"},
+		"balance":          {"2,50"},
+		"original_balance": {"0.00"},
+	})
+	requireStatus(t, "Editing the user", resp, http.StatusSeeOther)
+	resp = admin.get("/audit/export?format=json&action=edit_user")
+	var edits []struct {
+		EntityType string `json:"entity_type"`
+		EntityID   int    `json:"entity_id"`
+		Changes    map[string]struct {
+			Before any `json:"before"`
+			After  any `json:"after"`
+		} `json:"changes"`
+		IP string `json:"ip"`
+	}
+	if err := json.Unmarshal([]byte(resp.body), &edits); err != nil || len(edits) != 1 {
+		t.Fatalf("JSON export of the edit = %q, %v", resp.body, err)
+	}
+	edit := edits[0]
+	if edit.EntityType != "user" || edit.EntityID != id || edit.IP != "127.0.0.1" || len(edit.Changes) != 2 {
+		t.Errorf("Edit entry = %+v, want the user, the client and two changes", edit)
+	}
+	// Personal data is only recorded as changed, since audit entries cannot be anonymized
+	if change := edit.Changes["name"]; change.Before != "(verborgen)" || change.After != "(verborgen)" {
+		t.Errorf("Name change = %+v, want the values hidden", change)
+	}
+	if resp := admin.get("/audit/export?format=json"); strings.Contains(resp.body, "Erika") {
+		t.Errorf("Audit log contains the name of the user:\n%s", resp.body)
+	}
+	if change := edit.Changes["balance"]; change.Before != 0.0 || change.After != 2.5 {
+		t.Errorf("Balance change = %+v", change)
+	}
+	if resp := admin.get("/audit?action=edit_user"); !strings.Contains(resp.body, "Benutzer #"+strconv.Itoa(id)) || !strings.Contains(resp.body, "Guthaben:") {
+		t.Errorf("Audit page does not show the changed user and fields")
+	}
+
+	// The hash chain of everything logged above is intact
+	resp = admin.get("/audit/verify")
+	requireStatus(t, "Verifying the audit log", resp, http.StatusOK)
+	if !strings.Contains(resp.body, "Hash-Kette vollständig") || !strings.Contains(resp.body, "Noch keine Einträge archiviert") {
+		t.Errorf("Verification page does not report an intact chain without archives")
+	}
+	resp = admin.submit("/audit/verify", "/audit/archive", url.Values{"days": {"1"}})
+	if !strings.Contains(resp.location, "Keine Einträge älter als 1 Tage") {
+		t.Errorf("Archiving without old entries redirected to %q", resp.location)
+	}
+	resp = admin.submit("/audit/verify", "/audit/archive", url.Values{"days": {"0"}})
+	if !strings.Contains(resp.location, "error=") {
+		t.Errorf("Archiving with 0 days redirected to %q", resp.location)
+	}
+	s.db.Exec("UPDATE audit_log SET details = 'Nichts passiert' WHERE action = 'create_user'")
+	if resp := admin.get("/audit/verify"); !strings.Contains(resp.body, "Hash-Kette unterbrochen") {
+		t.Errorf("Verification page does not report the modified entry")
+	}
+	resp = admin.submit("/audit/verify", "/audit/verify", url.Values{})
+	if !strings.Contains(resp.location, "audit.checkpoint_key") {
+		t.Errorf("Creating a checkpoint without key redirected to %q", resp.location)
+	}
+
+	cashier := s.browser(t)
+	s.createUser(t, "CASH1", "Kassierer", "cashier", "", 0)
+	cashier.login("CASH1")
+	requireStatus(t, "Export as cashier", cashier.get("/audit/export"), http.StatusUnauthorized)
+	requireStatus(t, "Verification as cashier", cashier.get("/audit/verify"), http.StatusUnauthorized)
+	requireStatus(t, "Archiving as cashier", cashier.get("/audit/archive"), http.StatusUnauthorized)
+}
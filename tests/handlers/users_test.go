@@ -0,0 +1,53 @@
+package handlers_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"gopos/components"
+	"gopos/handlers"
+	"gopos/repository"
+)
+
+// seedUsers returns in-memory stores with a customer and a cashier
+func seedUsers(t *testing.T) repository.Stores {
+	stores := repository.NewMemory().Stores()
+	for _, user := range []components.User{
+		{CardNumber: "1001", Name: "Anna Schmidt", Role: "customer"},
+		{CardNumber: "1002", Name: "Bernd Meier", Role: "cashier"},
+	} {
+		if err := stores.Users.Create(&user); err != nil {
+			t.Fatalf("Failed to create user: %v", err)
+		}
+	}
+	return stores
+}
+
+func TestUserSearchWithoutDatabase(t *testing.T) {
+	stores := seedUsers(t)
+
+	recorder := httptest.NewRecorder()
+	handlers.HandleUserSearch(stores)(recorder, httptest.NewRequest(http.MethodGet, "/users/search?q=schmidt", nil))
+
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Status = %d, want 200", recorder.Code)
+	}
+	body := recorder.Body.String()
+	if !strings.Contains(body, "Anna Schmidt") || strings.Contains(body, "Bernd Meier") {
+		t.Errorf("Search for schmidt should list Anna only:\n%s", body)
+	}
+}
+
+func TestUserFilterWithoutDatabase(t *testing.T) {
+	stores := seedUsers(t)
+
+	recorder := httptest.NewRecorder()
+	handlers.HandleUserFilter(stores)(recorder, httptest.NewRequest(http.MethodGet, "/users/filter?role=cashier", nil))
+
+	body := recorder.Body.String()
+	if !strings.Contains(body, "Bernd Meier") || strings.Contains(body, "Anna Schmidt") {
+		t.Errorf("Filtering cashiers should list Bernd only:\n%s", body)
+	}
+}
@@ -0,0 +1,143 @@
+package logging_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+
+	"gopos/logging"
+)
+
+// setup makes a logger writing to the returned buffer the default for the test
+func setup(t *testing.T, level, format string) *bytes.Buffer {
+	previous := slog.Default()
+	t.Cleanup(func() { slog.SetDefault(previous) })
+
+	var buf bytes.Buffer
+	if err := logging.Setup(&buf, level, format); err != nil {
+		t.Fatalf("Setup failed: %v", err)
+	}
+	return &buf
+}
+
+// entries decodes the JSON log lines in buf
+func entries(t *testing.T, buf *bytes.Buffer) []map[string]any {
+	var lines []map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var entry map[string]any
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("Invalid JSON log line %q: %v", line, err)
+		}
+		lines = append(lines, entry)
+	}
+	return lines
+}
+
+func TestRedaction(t *testing.T) {
+	buf := setup(t, "info", "json")
+
+	logging.Component("checkout").Info("Checkout for max@example.com",
+		"card_number", "4000123412341234",
+		"email", "max@example.com",
+		"access_key", "azure-key",
+		"password", "secret",
+		"error", errors.New("sending to erika@example.org failed"),
+		"duration", 1500*time.Millisecond,
+		slog.Group("user", "card", "12345", "name", "Max"),
+	)
+
+	lines := entries(t, buf)
+	if len(lines) != 1 {
+		t.Fatalf("Got %d log lines, want 1", len(lines))
+	}
+	entry := lines[0]
+	for key, want := range map[string]any{
+		"msg":         "Checkout for m***@example.com",
+		"component":   "checkout",
+		"card_number": "****1234",
+		"email":       "m***@example.com",
+		"access_key":  "[REDACTED]",
+		"password":    "[REDACTED]",
+		"error":       "sending to e***@example.org failed",
+		"duration":    "1.5s",
+	} {
+		if entry[key] != want {
+			t.Errorf("%s = %v, want %v", key, entry[key], want)
+		}
+	}
+	user, _ := entry["user"].(map[string]any)
+	if user["card"] != "****" || user["name"] != "Max" {
+		t.Errorf("user = %v, want a masked short card number", entry["user"])
+	}
+
+	for _, secret := range []string{"4000123412341234", "max@example.com", "azure-key", "erika@"} {
+		if strings.Contains(buf.String(), secret) {
+			t.Errorf("Log contains %q:\n%s", secret, buf)
+		}
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	buf := setup(t, "info", "json")
+
+	ctx := logging.WithRequestID(context.Background(), "abc123")
+	if id := logging.RequestID(ctx); id != "abc123" {
+		t.Errorf("RequestID = %q, want abc123", id)
+	}
+	logging.Component("cart").InfoContext(ctx, "Cart opened")
+	logging.Component("cart").Info("Without request")
+
+	lines := entries(t, buf)
+	if len(lines) != 2 {
+		t.Fatalf("Got %d log lines, want 2", len(lines))
+	}
+	if lines[0]["request_id"] != "abc123" {
+		t.Errorf("request_id = %v, want the ID of the context", lines[0]["request_id"])
+	}
+	if _, ok := lines[1]["request_id"]; ok {
+		t.Errorf("Line without request context has request_id %v", lines[1]["request_id"])
+	}
+
+	if a, b := logging.NewRequestID(), logging.NewRequestID(); a == b || len(a) != 16 {
+		t.Errorf("NewRequestID returned %q and %q, want different 16 character IDs", a, b)
+	}
+}
+
+func TestLevelsAndFormats(t *testing.T) {
+	buf := setup(t, "warn", "text")
+
+	logger := logging.Component("backup")
+	logger.Info("Created backup")
+	logger.Warn("Disk almost full", "email", "admin@example.com")
+
+	out := buf.String()
+	if strings.Contains(out, "Created backup") {
+		t.Errorf("Info line written at level warn:\n%s", out)
+	}
+	if !strings.Contains(out, `level=WARN msg="Disk almost full" component=backup email=a***@example.com`) {
+		t.Errorf("Unexpected text output:\n%s", out)
+	}
+
+	// The standard log package goes through the same handler
+	buf = setup(t, "debug", "text")
+	log.Printf("Mail to max@example.com")
+	if !strings.Contains(buf.String(), "m***@example.com") || strings.Contains(buf.String(), "max@") {
+		t.Errorf("Standard log output was not redacted:\n%s", buf)
+	}
+
+	if err := logging.Setup(&bytes.Buffer{}, "verbose", "text"); err == nil {
+		t.Error("Setup accepted an unknown level")
+	}
+	if err := logging.Setup(&bytes.Buffer{}, "info", "xml"); err == nil {
+		t.Error("Setup accepted an unknown format")
+	}
+}
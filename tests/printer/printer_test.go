@@ -0,0 +1,130 @@
+package printer_test
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gopos/components"
+	"gopos/config"
+	"gopos/services"
+)
+
+func testReceipt() *components.Receipt {
+	return &components.Receipt{
+		TransactionID: 42,
+		UserID:        2,
+		CreatedAt:     time.Date(2024, 3, 1, 12, 30, 0, 0, time.UTC),
+		CustomerName:  "Jürgen Müller",
+		CashierName:   "Kasse 1",
+		Items: []components.TransactionItem{
+			{ProductName: "Kaffee", Quantity: 2, Price: 1.5},
+		},
+		Total:        3.0,
+		BalanceAfter: 17.0,
+		HasBalance:   true,
+	}
+}
+
+func TestRenderReceiptESCPOS(t *testing.T) {
+	data := services.RenderReceiptESCPOS(testReceipt(), 32)
+
+	if !bytes.HasPrefix(data, []byte{0x1b, '@'}) {
+		t.Errorf("Receipt does not start with printer reset")
+	}
+	if !bytes.HasSuffix(data, []byte{0x1d, 'V', 66, 3}) {
+		t.Errorf("Receipt does not end with paper cut")
+	}
+
+	// Umlauts and the euro sign are encoded for the WPC1252 code page
+	if !bytes.Contains(data, []byte("J\xfcrgen M\xfcller")) {
+		t.Errorf("Customer name not encoded as WPC1252")
+	}
+	if !bytes.Contains(data, []byte("3.00 \x80")) {
+		t.Errorf("Total not found in receipt")
+	}
+
+	// Rows are padded to the printer width
+	row := []byte("Kaffee\n  2 x 1.50 \x80")
+	if !bytes.Contains(data, row) {
+		t.Errorf("Item not found in receipt")
+	}
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		if bytes.HasPrefix(line, []byte("Beleg-Nr.")) && len(line) != 32 {
+			t.Errorf("Row has %d characters, want 32", len(line))
+		}
+	}
+}
+
+func TestPrintReceiptToNetworkPrinter(t *testing.T) {
+	// Local stand-in for a raw TCP printer
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to start printer stand-in: %v", err)
+	}
+	defer listener.Close()
+
+	received := make(chan []byte, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		data, _ := io.ReadAll(conn)
+		received <- data
+	}()
+
+	cfg := &config.Config{}
+	cfg.Printer.Address = listener.Addr().String()
+	services.InitPrinterService(cfg)
+
+	if err := services.PrintReceipt(testReceipt()); err != nil {
+		t.Fatalf("Failed to print receipt: %v", err)
+	}
+
+	select {
+	case data := <-received:
+		if !bytes.Equal(data, services.RenderReceiptESCPOS(testReceipt(), 48)) {
+			t.Errorf("Printer received unexpected data (%d bytes)", len(data))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Printer stand-in did not receive the receipt")
+	}
+}
+
+func TestPrintReceiptToDevice(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "lp0")
+
+	cfg := &config.Config{}
+	cfg.Printer.Device = path
+	cfg.Printer.Width = 42
+	services.InitPrinterService(cfg)
+
+	if err := services.PrintReceipt(testReceipt()); err != nil {
+		t.Fatalf("Failed to print receipt: %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read printer device: %v", err)
+	}
+	if !bytes.Equal(data, services.RenderReceiptESCPOS(testReceipt(), 42)) {
+		t.Errorf("Device received unexpected data (%d bytes)", len(data))
+	}
+}
+
+func TestPrintReceiptWithoutPrinter(t *testing.T) {
+	services.InitPrinterService(&config.Config{})
+
+	if services.PrinterConfigured() {
+		t.Errorf("Printer reported as configured without address or device")
+	}
+	if err := services.PrintReceipt(testReceipt()); err != services.ErrPrinterNotConfigured {
+		t.Errorf("Expected ErrPrinterNotConfigured, got %v", err)
+	}
+}
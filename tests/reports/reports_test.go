@@ -0,0 +1,141 @@
+package reports_test
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gopos/components"
+	"gopos/database"
+	"gopos/repository"
+	"gopos/services"
+
+	_ "modernc.org/sqlite"
+)
+
+func setupTestDB(t *testing.T) *sql.DB {
+	db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Failed to open test database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	if err := database.InitDB(db); err != nil {
+		t.Fatalf("Failed to initialize test database: %v", err)
+	}
+
+	// The default admin (ID 1) books everything unless a cashier is given
+	_, err = db.Exec(`
+		INSERT INTO users (card_number, name, role, balance, created_at)
+		VALUES ('CASHIER', 'Kasse 2', 'cashier', 0, ?), ('CUSTOMER', 'Kunde', 'customer', 0, ?)
+	`, database.Now(), database.Now())
+	if err != nil {
+		t.Fatalf("Failed to create users: %v", err)
+	}
+	return db
+}
+
+func addTransaction(t *testing.T, db *sql.DB, cashierID int, total float64, kind string, description interface{}, createdAt time.Time) {
+	_, err := db.Exec(`
+		INSERT INTO transactions (user_id, cashier_id, total, kind, description, created_at)
+		VALUES (3, ?, ?, ?, ?, ?)
+	`, cashierID, total, kind, description, database.FormatTime(createdAt))
+	if err != nil {
+		t.Fatalf("Failed to create transaction: %v", err)
+	}
+}
+
+func TestBuildReport(t *testing.T) {
+	db := setupTestDB(t)
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Fatalf("Failed to load timezone: %v", err)
+	}
+
+	// 00:30 in Berlin is still the previous day in UTC, it must count for March 5th
+	addTransaction(t, db, 1, 10, repository.TransactionSale, nil, time.Date(2024, 3, 5, 0, 30, 0, 0, berlin))
+	addTransaction(t, db, 2, 5, repository.TransactionSale, nil, time.Date(2024, 3, 5, 18, 0, 0, 0, berlin))
+	addTransaction(t, db, 2, 20, repository.TransactionTopup, "Guthaben aufgeladen", time.Date(2024, 3, 6, 9, 0, 0, 0, berlin))
+	// Previous period
+	addTransaction(t, db, 1, 3, repository.TransactionSale, nil, time.Date(2024, 3, 4, 23, 59, 0, 0, berlin))
+	// Outside of both periods
+	addTransaction(t, db, 1, 100, repository.TransactionSale, nil, time.Date(2024, 3, 8, 0, 0, 0, 0, berlin))
+
+	from := time.Date(2024, 3, 5, 0, 0, 0, 0, berlin)
+	to := time.Date(2024, 3, 7, 0, 0, 0, 0, berlin)
+	report, err := services.BuildReport(db, from, to, components.ReportGroupDay)
+	if err != nil {
+		t.Fatalf("Failed to build report: %v", err)
+	}
+
+	if report.Current.Revenue != 15 || report.Current.Sales != 2 || report.Current.Topups != 20 {
+		t.Errorf("Current period mismatch: got %+v", report.Current)
+	}
+	if report.Previous.Revenue != 3 || report.Previous.Sales != 1 {
+		t.Errorf("Previous period mismatch: got %+v", report.Previous)
+	}
+	if !report.PreviousFrom.Equal(time.Date(2024, 3, 2, 0, 0, 0, 0, berlin)) {
+		t.Errorf("Previous period starts %v, want March 2nd", report.PreviousFrom)
+	}
+
+	if len(report.Periods) != 3 {
+		t.Fatalf("Expected 3 days, got %d", len(report.Periods))
+	}
+	if report.Periods[0].Label != "05.03.2024" || report.Periods[0].Revenue != 15 {
+		t.Errorf("First day mismatch: got %+v", report.Periods[0])
+	}
+	if report.Periods[1].Topups != 20 || report.Periods[2].Revenue != 0 {
+		t.Errorf("Following days mismatch: got %+v", report.Periods[1:])
+	}
+
+	if len(report.Cashiers) != 2 || report.Cashiers[0].Name != "Administrator" || report.Cashiers[1].Topups != 20 {
+		t.Errorf("Cashier breakdown mismatch: got %+v", report.Cashiers)
+	}
+}
+
+func TestBuildReportGrouping(t *testing.T) {
+	db := setupTestDB(t)
+	utc := time.UTC
+
+	addTransaction(t, db, 1, 1, repository.TransactionSale, nil, time.Date(2024, 1, 31, 12, 0, 0, 0, utc))
+	addTransaction(t, db, 1, 2, repository.TransactionSale, nil, time.Date(2024, 2, 1, 12, 0, 0, 0, utc))
+
+	report, err := services.BuildReport(db, time.Date(2024, 1, 29, 0, 0, 0, 0, utc), time.Date(2024, 2, 11, 0, 0, 0, 0, utc), components.ReportGroupWeek)
+	if err != nil {
+		t.Fatalf("Failed to build report: %v", err)
+	}
+	if len(report.Periods) != 2 || report.Periods[0].Label != "KW 05/2024" || report.Periods[0].Revenue != 3 {
+		t.Errorf("Weekly grouping mismatch: got %+v", report.Periods)
+	}
+
+	report, err = services.BuildReport(db, time.Date(2024, 1, 29, 0, 0, 0, 0, utc), time.Date(2024, 2, 11, 0, 0, 0, 0, utc), components.ReportGroupMonth)
+	if err != nil {
+		t.Fatalf("Failed to build report: %v", err)
+	}
+	if len(report.Periods) != 2 || report.Periods[0].Revenue != 1 || report.Periods[1].Label != "02/2024" || report.Periods[1].Revenue != 2 {
+		t.Errorf("Monthly grouping mismatch: got %+v", report.Periods)
+	}
+}
+
+func TestBuildReportManualBookings(t *testing.T) {
+	db := setupTestDB(t)
+	utc := time.UTC
+	day := time.Date(2024, 3, 5, 12, 0, 0, 0, utc)
+
+	addTransaction(t, db, 1, 4, repository.TransactionSale, nil, day)
+	addTransaction(t, db, 1, 10, repository.TransactionTopup, "Guthaben aufgeladen", day)
+	// Manual bookings carry a description like top-ups, but are neither sales nor top-ups
+	addTransaction(t, db, 1, 7, repository.TransactionManual, "Korrektur Fehlbuchung", day)
+	addTransaction(t, db, 1, -2, repository.TransactionManual, "", day)
+	// as are balances corrected on the user form
+	addTransaction(t, db, 1, 3, repository.TransactionAdjustment, "Guthaben korrigiert", day)
+
+	report, err := services.BuildReport(db, time.Date(2024, 3, 5, 0, 0, 0, 0, utc), time.Date(2024, 3, 5, 0, 0, 0, 0, utc), components.ReportGroupDay)
+	if err != nil {
+		t.Fatalf("Failed to build report: %v", err)
+	}
+	if report.Current.Revenue != 4 || report.Current.Sales != 1 || report.Current.Topups != 10 {
+		t.Errorf("Report with manual bookings = %+v, want only the sale and the top-up", report.Current)
+	}
+}
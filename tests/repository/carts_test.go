@@ -0,0 +1,274 @@
+package repository_test
+
+import (
+	"errors"
+	"testing"
+
+	"gopos/models"
+	"gopos/repository"
+)
+
+// setupCarts creates two cashiers, a customer with a balance and two products
+func setupCarts(t *testing.T, b backend) (cashier, other, customer int) {
+	cashier = createUser(t, b.stores, "7001", "Kasse 1", "cashier").ID
+	other = createUser(t, b.stores, "7002", "Kasse 2", "cashier").ID
+	customer = createUser(t, b.stores, "CUSTOMER", "Kunde", "customer").ID
+	if _, err := b.stores.Users.AdjustBalance(customer, 50); err != nil {
+		t.Fatalf("AdjustBalance failed: %v", err)
+	}
+	createProduct(t, b.stores, "4001", "Kaffee", 1.5)
+	createProduct(t, b.stores, "4002", "Brezel", 0.8)
+	return cashier, other, customer
+}
+
+// completeCart records the sale of a cart and completes the cart with it
+func completeCart(tx repository.Stores, cart *models.Cart) error {
+	id, err := tx.Transactions.RecordSale(repository.Sale{UserID: int(cart.Customer.ID), CashierID: int(cart.CashierID), Total: cart.Total})
+	if err != nil {
+		return err
+	}
+	return tx.Carts.Complete(cart, id)
+}
+
+func TestCartLifecycle(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, b backend) {
+		carts := b.stores.Carts
+		cashier, _, customer := setupCarts(t, b)
+
+		cart, err := carts.Open("Kasse-1", cashier)
+		if err != nil {
+			t.Fatalf("Open failed: %v", err)
+		}
+
+		// Opening again resumes the same cart
+		again, err := carts.Open("Kasse-1", cashier)
+		if err != nil {
+			t.Fatalf("Open failed: %v", err)
+		}
+		if again.ID != cart.ID {
+			t.Fatalf("Expected cart %d to be resumed, got %d", cart.ID, again.ID)
+		}
+
+		for _, barcode := range []string{"4001", "4002", "4001"} {
+			if err := carts.AddItem(cart.ID, barcode); err != nil {
+				t.Fatalf("AddItem(%s) failed: %v", barcode, err)
+			}
+		}
+		if err := carts.AddItem(cart.ID, "9999"); err != repository.ErrNotFound {
+			t.Errorf("Expected ErrNotFound for an unknown barcode, got %v", err)
+		}
+		if err := carts.SetCustomer(cart.ID, "CUSTOMER"); err != nil {
+			t.Fatalf("SetCustomer failed: %v", err)
+		}
+
+		cart, err = carts.Get(cart.ID)
+		if err != nil {
+			t.Fatalf("Get failed: %v", err)
+		}
+		if len(cart.Items) != 2 || cart.Items[0].Name != "Kaffee" || cart.Items[0].Quantity != 2 {
+			t.Fatalf("Unexpected items: %+v", cart.Items)
+		}
+		if cart.Total != 3.8 {
+			t.Errorf("Expected total 3.80, got %.2f", cart.Total)
+		}
+		if cart.Customer == nil || cart.Customer.Name != "Kunde" || cart.Customer.Balance != 50 {
+			t.Errorf("Expected customer Kunde, got %+v", cart.Customer)
+		}
+
+		// Changing the quantity to zero removes the item
+		if err := carts.SetQuantity(cart.ID, cart.Items[1].ProductID, 0); err != nil {
+			t.Fatalf("SetQuantity failed: %v", err)
+		}
+		if err := carts.SetQuantity(cart.ID, cart.Items[0].ProductID, 5); err != nil {
+			t.Fatalf("SetQuantity failed: %v", err)
+		}
+		cart, _ = carts.Get(cart.ID)
+		if len(cart.Items) != 1 || cart.Items[0].Quantity != 5 || cart.Total != 7.5 {
+			t.Fatalf("Unexpected cart after quantity change: %+v", cart)
+		}
+
+		// Complete the cart as part of a checkout
+		err = b.stores.Atomic(func(tx repository.Stores) error {
+			id, err := tx.Transactions.RecordSale(repository.Sale{UserID: customer, CashierID: cashier, Total: cart.Total})
+			if err != nil {
+				return err
+			}
+			if err := tx.Carts.Complete(cart, id+100); err != repository.ErrNotFound {
+				t.Errorf("Expected ErrNotFound when completing with an unknown transaction, got %v", err)
+			}
+			if err := tx.Carts.Complete(cart, id); err != nil {
+				t.Fatalf("Complete failed: %v", err)
+			}
+			if err := tx.Carts.Complete(cart, id); err != repository.ErrCartNotOpen {
+				t.Errorf("Expected ErrCartNotOpen when completing twice, got %v", err)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("Atomic failed: %v", err)
+		}
+
+		if err := carts.AddItem(cart.ID, "4001"); err != repository.ErrCartNotOpen {
+			t.Errorf("Expected ErrCartNotOpen for a completed cart, got %v", err)
+		}
+
+		// A cart that does not exist is not found rather than closed
+		if err := carts.AddItem(cart.ID+100, "4001"); err != repository.ErrCartNotFound || !errors.Is(err, repository.ErrNotFound) {
+			t.Errorf("Expected ErrCartNotFound for an unknown cart, got %v", err)
+		}
+		if err := carts.Discard(cart.ID + 100); err != repository.ErrCartNotFound {
+			t.Errorf("Expected ErrCartNotFound when discarding an unknown cart, got %v", err)
+		}
+
+		// The register gets a fresh cart afterwards
+		next, err := carts.Open("Kasse-1", cashier)
+		if err != nil {
+			t.Fatalf("Open failed: %v", err)
+		}
+		if next.ID == cart.ID || len(next.Items) != 0 {
+			t.Errorf("Expected a new empty cart, got %+v", next)
+		}
+	})
+}
+
+func TestCompleteChangedCart(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, b backend) {
+		carts := b.stores.Carts
+		cashier, _, _ := setupCarts(t, b)
+
+		cart, err := carts.Open("Kasse-1", cashier)
+		if err != nil {
+			t.Fatalf("Open failed: %v", err)
+		}
+		if err := carts.AddItem(cart.ID, "4001"); err != nil {
+			t.Fatalf("AddItem failed: %v", err)
+		}
+		if err := carts.SetCustomer(cart.ID, "CUSTOMER"); err != nil {
+			t.Fatalf("SetCustomer failed: %v", err)
+		}
+		charged, err := carts.Get(cart.ID)
+		if err != nil {
+			t.Fatalf("Get failed: %v", err)
+		}
+
+		// complete completes the charged cart and rolls back
+		rollback := errors.New("rollback")
+		complete := func() error {
+			var completeErr error
+			b.stores.Atomic(func(tx repository.Stores) error {
+				completeErr = completeCart(tx, charged)
+				return rollback
+			})
+			return completeErr
+		}
+
+		// Another register adds an item after the cart was charged
+		if err := carts.AddItem(cart.ID, "4002"); err != nil {
+			t.Fatalf("AddItem failed: %v", err)
+		}
+		if err := complete(); err != repository.ErrCartChanged {
+			t.Errorf("Completing a cart with an added item returned %v, want ErrCartChanged", err)
+		}
+
+		// A changed quantity or price is a change as well
+		charged, _ = carts.Get(cart.ID)
+		if err := carts.SetQuantity(cart.ID, charged.Items[0].ProductID, 3); err != nil {
+			t.Fatalf("SetQuantity failed: %v", err)
+		}
+		if err := complete(); err != repository.ErrCartChanged {
+			t.Errorf("Completing a cart with a changed quantity returned %v, want ErrCartChanged", err)
+		}
+		charged, _ = carts.Get(cart.ID)
+		coffee, _ := b.stores.Products.GetByBarcode("4001")
+		coffee.Price = 2
+		if err := b.stores.Products.Update(coffee); err != nil {
+			t.Fatal(err)
+		}
+		if err := complete(); err != repository.ErrCartChanged {
+			t.Errorf("Completing a cart with a changed price returned %v, want ErrCartChanged", err)
+		}
+
+		if cart, _ := carts.Get(cart.ID); cart.Status != "open" {
+			t.Errorf("Cart is %s after the refused completions, want open", cart.Status)
+		}
+		charged, _ = carts.Get(cart.ID)
+		if err := complete(); err != nil {
+			t.Errorf("Completing the unchanged cart failed: %v", err)
+		}
+	})
+}
+
+func TestTakeOverCart(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, b backend) {
+		carts := b.stores.Carts
+		cashier, other, _ := setupCarts(t, b)
+
+		cart, err := carts.Open("Kasse-1", cashier)
+		if err != nil {
+			t.Fatalf("Open failed: %v", err)
+		}
+		if err := carts.AddItem(cart.ID, "4001"); err != nil {
+			t.Fatalf("AddItem failed: %v", err)
+		}
+
+		// An empty cart on the target register is discarded by the takeover
+		empty, err := carts.Open("Kasse-2", other)
+		if err != nil {
+			t.Fatalf("Open failed: %v", err)
+		}
+		if err := carts.TakeOver(cart.ID, "Kasse-2", other); err != nil {
+			t.Fatalf("TakeOver failed: %v", err)
+		}
+
+		cart, _ = carts.Get(cart.ID)
+		if cart.Register != "Kasse-2" || cart.CashierName != "Kasse 2" {
+			t.Errorf("Expected cart at Kasse-2 with cashier Kasse 2, got %s / %s", cart.Register, cart.CashierName)
+		}
+		empty, _ = carts.Get(empty.ID)
+		if empty.Status != "discarded" {
+			t.Errorf("Expected the empty cart to be discarded, got %s", empty.Status)
+		}
+
+		// A filled cart on the target register blocks the takeover
+		next, _ := carts.Open("Kasse-1", cashier)
+		if err := carts.AddItem(next.ID, "4002"); err != nil {
+			t.Fatalf("AddItem failed: %v", err)
+		}
+		if err := carts.TakeOver(next.ID, "Kasse-2", other); err != repository.ErrRegisterBusy {
+			t.Errorf("Expected ErrRegisterBusy, got %v", err)
+		}
+
+		open, err := carts.ListOpen()
+		if err != nil {
+			t.Fatalf("ListOpen failed: %v", err)
+		}
+		if len(open) != 2 {
+			t.Errorf("Expected 2 open carts, got %d", len(open))
+		}
+	})
+}
+
+func TestCartChangeRollsBack(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, b backend) {
+		cashier, _, _ := setupCarts(t, b)
+		cart, err := b.stores.Carts.Open("Kasse-1", cashier)
+		if err != nil {
+			t.Fatalf("Open failed: %v", err)
+		}
+
+		// A failed change within Atomic leaves the cart as it was
+		err = b.stores.Atomic(func(tx repository.Stores) error {
+			if err := tx.Carts.AddItem(cart.ID, "4001"); err != nil {
+				return err
+			}
+			return tx.Carts.SetCustomer(cart.ID, "UNKNOWN")
+		})
+		if err != repository.ErrNotFound {
+			t.Fatalf("Change with an unknown card returned %v, want ErrNotFound", err)
+		}
+		var got *models.Cart
+		if got, err = b.stores.Carts.Get(cart.ID); err != nil || len(got.Items) != 0 {
+			t.Errorf("Cart after the failed change = %+v, %v, want it empty", got, err)
+		}
+	})
+}
@@ -0,0 +1,800 @@
+package repository_test
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"gopos/components"
+	"gopos/database"
+	"gopos/repository"
+
+	_ "modernc.org/sqlite"
+)
+
+// backend is a store implementation under test. addSale records a sale of one
+// product, which keeps customer, cashier and product from being deleted. db is
+// the database of the SQL stores, nil for the memory stores.
+type backend struct {
+	stores  repository.Stores
+	addSale func(t *testing.T, userID, cashierID, productID int)
+	db      *sql.DB
+}
+
+func sqlBackend(t *testing.T) backend {
+	db, err := database.Open(filepath.Join(t.TempDir(), "test.db"), database.DefaultOptions())
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := database.InitDB(db); err != nil {
+		t.Fatalf("Failed to initialize database: %v", err)
+	}
+	// InitDB creates the default admin, the tests start without users
+	if _, err := db.Exec("DELETE FROM users"); err != nil {
+		t.Fatalf("Failed to remove default users: %v", err)
+	}
+
+	return backend{
+		stores: repository.NewSQL(db),
+		db:     db,
+		addSale: func(t *testing.T, userID, cashierID, productID int) {
+			var transactionID int
+			err := db.QueryRow(`
+				INSERT INTO transactions (user_id, cashier_id, total, created_at)
+				VALUES (?, ?, 1.5, ?)
+				RETURNING id
+			`, userID, cashierID, database.Now()).Scan(&transactionID)
+			if err != nil {
+				t.Fatalf("Failed to insert transaction: %v", err)
+			}
+			_, err = db.Exec(`
+				INSERT INTO transaction_items (transaction_id, product_id, quantity, price)
+				VALUES (?, ?, 1, 1.5)
+			`, transactionID, productID)
+			if err != nil {
+				t.Fatalf("Failed to insert transaction item: %v", err)
+			}
+		},
+	}
+}
+
+func memoryBackend(t *testing.T) backend {
+	memory := repository.NewMemory()
+	return backend{
+		stores: memory.Stores(),
+		addSale: func(t *testing.T, userID, cashierID, productID int) {
+			product, err := memory.Stores().Products.Get(productID)
+			if err != nil {
+				t.Fatalf("Failed to get product: %v", err)
+			}
+			memory.AddTransaction(userID, cashierID, []int{productID}, components.Transaction{
+				Total: 1.5,
+				Items: []components.TransactionItem{{ProductName: product.Name, Quantity: 1, Price: 1.5}},
+			})
+		},
+	}
+}
+
+// forEachBackend runs a test against every implementation, so the in-memory
+// stores handler tests rely on behave like the database
+func forEachBackend(t *testing.T, test func(t *testing.T, b backend)) {
+	t.Run("sql", func(t *testing.T) { test(t, sqlBackend(t)) })
+	t.Run("memory", func(t *testing.T) { test(t, memoryBackend(t)) })
+}
+
+func createUser(t *testing.T, stores repository.Stores, cardNumber, name, role string) *components.User {
+	user := &components.User{CardNumber: cardNumber, Name: name, Role: role}
+	if err := stores.Users.Create(user); err != nil {
+		t.Fatalf("Failed to create user %s: %v", name, err)
+	}
+	return user
+}
+
+func createProduct(t *testing.T, stores repository.Stores, barcode, name string, price float64) *components.Product {
+	product := &components.Product{Barcode: barcode, Name: name, Price: price}
+	if err := stores.Products.Create(product); err != nil {
+		t.Fatalf("Failed to create product %s: %v", name, err)
+	}
+	return product
+}
+
+func TestUsers(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, b backend) {
+		users := b.stores.Users
+		anna := createUser(t, b.stores, "1001", "Anna", "customer")
+		createUser(t, b.stores, "1002", "Bernd", "cashier")
+
+		if anna.ID == 0 || anna.CreatedAt.IsZero() {
+			t.Errorf("Create did not set ID and creation time: %+v", anna)
+		}
+
+		got, err := users.GetByCardNumber("1001")
+		if err != nil || got.ID != anna.ID || got.Name != "Anna" {
+			t.Errorf("GetByCardNumber = %+v, %v, want Anna", got, err)
+		}
+		if _, err := users.Get(anna.ID + 100); !errors.Is(err, repository.ErrNotFound) {
+			t.Errorf("Get of a missing user returned %v, want ErrNotFound", err)
+		}
+		if err := users.Create(&components.User{CardNumber: "1001", Name: "Doppelt", Role: "customer"}); !errors.Is(err, repository.ErrDuplicate) {
+			t.Errorf("Create with a taken card number returned %v, want ErrDuplicate", err)
+		}
+
+		anna.Name = "Anna Schmidt"
+		anna.Email = "anna@example.com"
+		anna.Balance = 12.5
+		if err := users.Update(anna); err != nil {
+			t.Fatalf("Update failed: %v", err)
+		}
+		got, _ = users.Get(anna.ID)
+		if got.Name != "Anna Schmidt" || got.Email != "anna@example.com" {
+			t.Errorf("Update was not stored: %+v", got)
+		}
+		if got.Balance != 0 {
+			t.Errorf("Update changed the balance to %.2f, only AdjustBalance may", got.Balance)
+		}
+		if err := users.Update(&components.User{ID: anna.ID + 100, CardNumber: "9999", Name: "X", Role: "customer"}); !errors.Is(err, repository.ErrNotFound) {
+			t.Errorf("Update of a missing user returned %v, want ErrNotFound", err)
+		}
+
+		list, err := users.List(repository.UserFilter{Search: "SCHMIDT"})
+		if err != nil || len(list) != 1 || list[0].ID != anna.ID {
+			t.Errorf("List searching SCHMIDT = %+v, %v, want Anna", list, err)
+		}
+		list, _ = users.List(repository.UserFilter{Role: "cashier"})
+		if len(list) != 1 || list[0].Name != "Bernd" {
+			t.Errorf("List of cashiers = %+v, want Bernd", list)
+		}
+		list, _ = users.List(repository.UserFilter{Sort: "balance"})
+		if len(list) != 2 || list[0].ID != anna.ID {
+			t.Errorf("List by balance = %+v, want Anna first", list)
+		}
+		list, _ = users.List(repository.UserFilter{Sort: "name"})
+		if len(list) != 2 || list[0].ID != anna.ID {
+			t.Errorf("List by name = %+v, want Anna first", list)
+		}
+	})
+}
+
+func TestAdjustBalance(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, b backend) {
+		users := b.stores.Users
+		user := createUser(t, b.stores, "2001", "Carla", "customer")
+
+		balance, err := users.AdjustBalance(user.ID, 10)
+		if err != nil || balance != 10 {
+			t.Fatalf("AdjustBalance(+10) = %v, %v, want 10", balance, err)
+		}
+		balance, err = users.AdjustBalance(user.ID, -4)
+		if err != nil || balance != 6 {
+			t.Fatalf("AdjustBalance(-4) = %v, %v, want 6", balance, err)
+		}
+		if _, err := users.AdjustBalance(user.ID, -7); !errors.Is(err, repository.ErrInsufficientBalance) {
+			t.Errorf("Debit beyond the balance returned %v, want ErrInsufficientBalance", err)
+		}
+		if _, err := users.AdjustBalance(user.ID+100, 1); !errors.Is(err, repository.ErrNotFound) {
+			t.Errorf("AdjustBalance of a missing user returned %v, want ErrNotFound", err)
+		}
+
+		got, _ := users.Get(user.ID)
+		if got.Balance != 6 {
+			t.Errorf("Balance = %v, want 6", got.Balance)
+		}
+	})
+}
+
+func TestProducts(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, b backend) {
+		products := b.stores.Products
+		cola := createProduct(t, b.stores, "4001", "Cola", 2.5)
+		createProduct(t, b.stores, "4002", "Apfelsaft", 1.8)
+
+		got, err := products.GetByBarcode("4001")
+		if err != nil || got.ID != cola.ID {
+			t.Errorf("GetByBarcode = %+v, %v, want Cola", got, err)
+		}
+		if err := products.Create(&components.Product{Barcode: "4001", Name: "Doppelt"}); !errors.Is(err, repository.ErrDuplicate) {
+			t.Errorf("Create with a taken barcode returned %v, want ErrDuplicate", err)
+		}
+
+		cola.Price = 2.7
+		if err := products.Update(cola); err != nil {
+			t.Fatalf("Update failed: %v", err)
+		}
+		got, _ = products.Get(cola.ID)
+		if got.Price != 2.7 {
+			t.Errorf("Price = %v, want 2.7", got.Price)
+		}
+
+		list, err := products.List(repository.ProductFilter{Search: "cOLa"})
+		if err != nil || len(list) != 1 || list[0].ID != cola.ID {
+			t.Errorf("List searching cOLa = %+v, %v, want Cola", list, err)
+		}
+		list, _ = products.List(repository.ProductFilter{Sort: "price"})
+		if len(list) != 2 || list[0].Name != "Apfelsaft" {
+			t.Errorf("List by price = %+v, want Apfelsaft first", list)
+		}
+		list, _ = products.List(repository.ProductFilter{Sort: "name"})
+		if len(list) != 2 || list[0].Name != "Apfelsaft" {
+			t.Errorf("List by name = %+v, want Apfelsaft first", list)
+		}
+	})
+}
+
+func TestDeleteReferencedRecords(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, b backend) {
+		customer := createUser(t, b.stores, "3001", "Dora", "customer")
+		cashier := createUser(t, b.stores, "3002", "Emil", "cashier")
+		unused := createUser(t, b.stores, "3003", "Frida", "customer")
+		sold := createProduct(t, b.stores, "5001", "Wasser", 1.5)
+		unsold := createProduct(t, b.stores, "5002", "Tee", 1.2)
+		b.addSale(t, customer.ID, cashier.ID, sold.ID)
+
+		if n, err := b.stores.Transactions.CountForUser(cashier.ID); err != nil || n != 1 {
+			t.Errorf("CountForUser(cashier) = %d, %v, want 1", n, err)
+		}
+		if n, err := b.stores.Transactions.CountForProduct(sold.ID); err != nil || n != 1 {
+			t.Errorf("CountForProduct = %d, %v, want 1", n, err)
+		}
+
+		if err := b.stores.Users.Delete(customer.ID); !errors.Is(err, repository.ErrInUse) {
+			t.Errorf("Deleting a customer with transactions returned %v, want ErrInUse", err)
+		}
+		if err := b.stores.Products.Delete(sold.ID); !errors.Is(err, repository.ErrInUse) {
+			t.Errorf("Deleting a sold product returned %v, want ErrInUse", err)
+		}
+		if err := b.stores.Users.Delete(unused.ID); err != nil {
+			t.Errorf("Deleting an unused user failed: %v", err)
+		}
+		if err := b.stores.Products.Delete(unsold.ID); err != nil {
+			t.Errorf("Deleting an unsold product failed: %v", err)
+		}
+		if err := b.stores.Products.Delete(unsold.ID); !errors.Is(err, repository.ErrNotFound) {
+			t.Errorf("Deleting a missing product returned %v, want ErrNotFound", err)
+		}
+	})
+}
+
+func TestTransactionsForUser(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, b backend) {
+		customer := createUser(t, b.stores, "6001", "Greta", "customer")
+		cashier := createUser(t, b.stores, "6002", "Hans", "cashier")
+		product := createProduct(t, b.stores, "7001", "Brezel", 1.5)
+		for i := 0; i < 3; i++ {
+			b.addSale(t, customer.ID, cashier.ID, product.ID)
+		}
+
+		transactions, err := b.stores.Transactions.ListForUser(customer.ID, 2)
+		if err != nil {
+			t.Fatalf("ListForUser failed: %v", err)
+		}
+		if len(transactions) != 2 {
+			t.Fatalf("Got %d transactions, want the limit of 2", len(transactions))
+		}
+		transaction := transactions[0]
+		if transaction.UserName != "Greta" || transaction.CashierName != "Hans" || transaction.Total != 1.5 {
+			t.Errorf("Unexpected transaction %+v", transaction)
+		}
+		if len(transaction.Items) != 1 || transaction.Items[0].ProductName != "Brezel" {
+			t.Errorf("Unexpected items %+v", transaction.Items)
+		}
+
+		if transactions, _ := b.stores.Transactions.ListForUser(cashier.ID, 10); len(transactions) != 0 {
+			t.Errorf("Cashier has %d transactions as customer, want none", len(transactions))
+		}
+	})
+}
+
+func TestRecordBooking(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, b backend) {
+		customer := createUser(t, b.stores, "6101", "Ida", "customer")
+		cashier := createUser(t, b.stores, "6102", "Jonas", "cashier")
+
+		err := b.stores.Atomic(func(tx repository.Stores) error {
+			balance, err := tx.Users.AdjustBalance(customer.ID, 20)
+			if err != nil {
+				return err
+			}
+			_, err = tx.Transactions.Record(repository.Booking{
+				UserID:       customer.ID,
+				CashierID:    cashier.ID,
+				Total:        20,
+				BalanceAfter: balance,
+				Kind:         repository.TransactionTopup,
+				Description:  "Guthaben aufgeladen",
+			})
+			return err
+		})
+		if err != nil {
+			t.Fatalf("Failed to record top-up: %v", err)
+		}
+
+		transactions, err := b.stores.Transactions.ListForUser(customer.ID, 10)
+		if err != nil {
+			t.Fatalf("ListForUser failed: %v", err)
+		}
+		if len(transactions) != 1 || transactions[0].Total != 20 || transactions[0].CashierName != "Jonas" || len(transactions[0].Items) != 0 {
+			t.Errorf("Unexpected transactions %+v", transactions)
+		}
+
+		// A booking for an unknown user is refused and leaves the balance untouched
+		err = b.stores.Atomic(func(tx repository.Stores) error {
+			if _, err := tx.Users.AdjustBalance(customer.ID, 5); err != nil {
+				return err
+			}
+			_, err := tx.Transactions.Record(repository.Booking{UserID: customer.ID + 100, CashierID: cashier.ID, Total: 5, Kind: repository.TransactionManual})
+			return err
+		})
+		if !errors.Is(err, repository.ErrNotFound) {
+			t.Errorf("Booking for a missing user returned %v, want ErrNotFound", err)
+		}
+		if got, _ := b.stores.Users.Get(customer.ID); got.Balance != 20 {
+			t.Errorf("Balance = %v after the refused booking, want 20", got.Balance)
+		}
+	})
+}
+
+func TestRecordSale(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, b backend) {
+		customer := createUser(t, b.stores, "6201", "Karla", "customer")
+		cashier := createUser(t, b.stores, "6202", "Lars", "cashier")
+		coffee := createProduct(t, b.stores, "6203", "Kaffee", 1.5)
+		pretzel := createProduct(t, b.stores, "6204", "Brezel", 0.8)
+
+		sale := repository.Sale{
+			UserID:         customer.ID,
+			CashierID:      cashier.ID,
+			Total:          3.8,
+			BalanceAfter:   16.2,
+			Items:          []repository.SaleItem{{ProductID: coffee.ID, Quantity: 2, Price: 1.5}, {ProductID: pretzel.ID, Quantity: 1, Price: 0.8}},
+			IdempotencyKey: "cart-1",
+		}
+		id, err := b.stores.Transactions.RecordSale(sale)
+		if err != nil {
+			t.Fatalf("RecordSale failed: %v", err)
+		}
+
+		transactions, _ := b.stores.Transactions.ListForUser(customer.ID, 10)
+		if len(transactions) != 1 || transactions[0].ID != id || len(transactions[0].Items) != 2 || transactions[0].Items[0].ProductName != "Brezel" {
+			t.Errorf("Unexpected transactions %+v", transactions)
+		}
+		if count, _ := b.stores.Transactions.CountForProduct(coffee.ID); count != 1 {
+			t.Errorf("CountForProduct = %d, want 1", count)
+		}
+
+		// The key finds the sale again, and cannot be used twice
+		gotID, got, err := b.stores.Transactions.SaleByKey("cart-1")
+		if err != nil || gotID != id || got.UserID != customer.ID || got.Total != 3.8 || got.BalanceAfter != 16.2 || len(got.Items) != 2 {
+			t.Errorf("SaleByKey = %d, %+v, %v, want the recorded sale", gotID, got, err)
+		}
+		if _, err := b.stores.Transactions.RecordSale(sale); !errors.Is(err, repository.ErrDuplicate) {
+			t.Errorf("RecordSale with a used key returned %v, want ErrDuplicate", err)
+		}
+		if _, _, err := b.stores.Transactions.SaleByKey("cart-2"); !errors.Is(err, repository.ErrNotFound) {
+			t.Errorf("SaleByKey of an unused key returned %v, want ErrNotFound", err)
+		}
+
+		// Sales without a key do not collide
+		sale.IdempotencyKey = ""
+		for i := 0; i < 2; i++ {
+			if _, err := b.stores.Transactions.RecordSale(sale); err != nil {
+				t.Errorf("RecordSale without a key failed: %v", err)
+			}
+		}
+		sale.Items = []repository.SaleItem{{ProductID: pretzel.ID + 100, Quantity: 1, Price: 1}}
+		if _, err := b.stores.Transactions.RecordSale(sale); !errors.Is(err, repository.ErrNotFound) {
+			t.Errorf("RecordSale of a missing product returned %v, want ErrNotFound", err)
+		}
+	})
+}
+
+func TestUserStatus(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, b backend) {
+		users := b.stores.Users
+		customer := createUser(t, b.stores, "9001", "Greta", "customer")
+		customer.Email = "greta@example.com"
+		if err := users.Update(customer); err != nil {
+			t.Fatalf("Update failed: %v", err)
+		}
+		cashier := createUser(t, b.stores, "9002", "Hans", "cashier")
+		product := createProduct(t, b.stores, "9100", "Brezel", 1.5)
+		b.addSale(t, customer.ID, cashier.ID, product.ID)
+
+		names := func(status string) []string {
+			list, err := users.List(repository.UserFilter{Status: status, Sort: "name"})
+			if err != nil {
+				t.Fatalf("List failed: %v", err)
+			}
+			var names []string
+			for _, user := range list {
+				names = append(names, user.Name)
+			}
+			return names
+		}
+
+		if err := users.Deactivate(customer.ID); err != nil {
+			t.Fatalf("Deactivate failed: %v", err)
+		}
+		stored, _ := users.Get(customer.ID)
+		if stored.Active() || stored.Anonymized() || stored.Name != "Greta" {
+			t.Errorf("Deactivated user = %+v, want inactive with its data", stored)
+		}
+		if got := names(repository.UserInactive); !slices.Equal(got, []string{"Greta"}) {
+			t.Errorf("Inactive users = %v, want Greta", got)
+		}
+		if got := names(repository.UserActive); slices.Contains(got, "Greta") || !slices.Contains(got, "Hans") {
+			t.Errorf("Active users = %v, want Hans without Greta", got)
+		}
+		if got := names(""); !slices.Contains(got, "Greta") || !slices.Contains(got, "Hans") {
+			t.Errorf("All users = %v, want Greta and Hans", got)
+		}
+
+		if err := users.Reactivate(customer.ID); err != nil {
+			t.Fatalf("Reactivate failed: %v", err)
+		}
+		if stored, _ := users.Get(customer.ID); !stored.Active() {
+			t.Error("Reactivated user is still inactive")
+		}
+
+		// Anonymizing erases the personal fields, the transactions keep the user
+		if err := users.Anonymize(customer.ID, "ANON-1"); err != nil {
+			t.Fatalf("Anonymize failed: %v", err)
+		}
+		stored, _ = users.Get(customer.ID)
+		if stored.Active() || !stored.Anonymized() || stored.Name != "ANON-1" || stored.CardNumber != "ANON-1" || stored.Email != "" {
+			t.Errorf("Anonymized user = %+v", stored)
+		}
+		if _, err := users.GetByCardNumber("9001"); !errors.Is(err, repository.ErrNotFound) {
+			t.Errorf("Old card number still finds the user: %v", err)
+		}
+		transactions, err := b.stores.Transactions.ListForUser(customer.ID, 10)
+		if err != nil || len(transactions) != 1 || transactions[0].UserName != "ANON-1" {
+			t.Errorf("Transactions of the anonymized user = %+v, %v, want one under the pseudonym", transactions, err)
+		}
+		if err := users.Reactivate(customer.ID); !errors.Is(err, repository.ErrAnonymized) {
+			t.Errorf("Reactivate of an anonymized user returned %v, want ErrAnonymized", err)
+		}
+		if err := users.Anonymize(cashier.ID, "ANON-1"); !errors.Is(err, repository.ErrDuplicate) {
+			t.Errorf("Anonymize with a taken pseudonym returned %v, want ErrDuplicate", err)
+		}
+		for name, err := range map[string]error{
+			"Deactivate": users.Deactivate(9999),
+			"Reactivate": users.Reactivate(9999),
+			"Anonymize":  users.Anonymize(9999, "ANON-2"),
+		} {
+			if !errors.Is(err, repository.ErrNotFound) {
+				t.Errorf("%s of an unknown user returned %v, want ErrNotFound", name, err)
+			}
+		}
+	})
+}
+
+func TestAuditLog(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, b backend) {
+		admin := createUser(t, b.stores, "8001", "Ida", "admin")
+		for _, action := range []string{"first", "second", "third"} {
+			if err := b.stores.Audit.Log(repository.AuditEvent{UserID: admin.ID, Action: action, Details: "Details " + action}); err != nil {
+				t.Fatalf("Log failed: %v", err)
+			}
+		}
+
+		count, err := b.stores.Audit.Count(repository.AuditFilter{})
+		if err != nil || count != 3 {
+			t.Errorf("Count = %d, %v, want 3", count, err)
+		}
+
+		page, err := b.stores.Audit.List(repository.AuditFilter{}, 1, 2)
+		if err != nil || len(page) != 2 {
+			t.Fatalf("List(1, 2) = %+v, %v, want 2 entries", page, err)
+		}
+		if page[0].Action != "third" || page[0].UserName != "Ida" {
+			t.Errorf("First entry = %+v, want the newest one by Ida", page[0])
+		}
+		page, _ = b.stores.Audit.List(repository.AuditFilter{}, 2, 2)
+		if len(page) != 1 || page[0].Action != "first" {
+			t.Errorf("List(2, 2) = %+v, want the oldest entry", page)
+		}
+	})
+}
+
+func TestAuditEvent(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, b backend) {
+		admin := createUser(t, b.stores, "8201", "Ida", "admin")
+		err := b.stores.Audit.Log(repository.AuditEvent{
+			UserID:     admin.ID,
+			Action:     "edit_product",
+			EntityType: "product",
+			EntityID:   7,
+			Details:    "Produkt bearbeitet",
+			Changes: map[string]components.AuditChange{
+				"name":  {Before: "Cola", After: "Cola Zero"},
+				"price": {Before: 1.5, After: 1.8},
+			},
+			IP:        "192.0.2.1",
+			UserAgent: "Scanner/1.0",
+		})
+		if err != nil {
+			t.Fatalf("Log failed: %v", err)
+		}
+		b.stores.Audit.Log(repository.AuditEvent{UserID: admin.ID, Action: "login", Details: "Login"})
+
+		entries, err := b.stores.Audit.List(repository.AuditFilter{}, 1, 0)
+		if err != nil || len(entries) != 2 {
+			t.Fatalf("List = %+v, %v, want 2 entries", entries, err)
+		}
+		entry := entries[1]
+		if entry.EntityType != "product" || entry.EntityID != 7 || entry.IP != "192.0.2.1" || entry.UserAgent != "Scanner/1.0" {
+			t.Errorf("Entry = %+v, want the product and client of the event", entry)
+		}
+		if change := entry.Changes["price"]; change.Before != 1.5 || change.After != 1.8 {
+			t.Errorf("Price change = %+v, want 1.5 to 1.8", change)
+		}
+		if change := entry.Changes["name"]; change.Before != "Cola" || change.After != "Cola Zero" {
+			t.Errorf("Name change = %+v, want Cola to Cola Zero", change)
+		}
+		if entries[0].EntityType != "" || entries[0].Changes != nil {
+			t.Errorf("Entry without record = %+v, want no entity or changes", entries[0])
+		}
+	})
+}
+
+func TestAuditChain(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, b backend) {
+		admin := createUser(t, b.stores, "8301", "Ida", "admin")
+		verification, err := b.stores.Audit.Verify()
+		if err != nil || !verification.Intact() || verification.Entries != 0 {
+			t.Fatalf("Verify of an empty log = %+v, %v, want an intact chain", verification, err)
+		}
+
+		for i := range 4 {
+			event := repository.AuditEvent{UserID: admin.ID, Action: "login", Details: fmt.Sprintf("Login %d", i)}
+			if i == 2 {
+				event.Changes = map[string]components.AuditChange{"balance": {Before: 1.0, After: 2.5}}
+			}
+			if err := b.stores.Audit.Log(event); err != nil {
+				t.Fatalf("Log failed: %v", err)
+			}
+		}
+
+		verification, err = b.stores.Audit.Verify()
+		if err != nil || !verification.Intact() || verification.Entries != 4 {
+			t.Fatalf("Verify = %+v, %v, want 4 intact entries", verification, err)
+		}
+		entries, _ := b.stores.Audit.List(repository.AuditFilter{}, 1, 0)
+		if entries[0].ID != verification.LastID || entries[0].Hash != verification.LastHash || entries[0].PrevHash != entries[1].Hash {
+			t.Errorf("Newest entry %+v is not the head of the chain %+v", entries[0], verification)
+		}
+		if hash, err := b.stores.Audit.Hash(verification.LastID); err != nil || hash != verification.LastHash {
+			t.Errorf("Hash(%d) = %q, %v, want %q", verification.LastID, hash, err, verification.LastHash)
+		}
+		if _, err := b.stores.Audit.Hash(9999); !errors.Is(err, repository.ErrNotFound) {
+			t.Errorf("Hash of an unknown entry returned %v, want ErrNotFound", err)
+		}
+		if b.db == nil {
+			return
+		}
+
+		// Changes made directly in the database break the chain
+		ids := []int{entries[3].ID, entries[2].ID, entries[1].ID, entries[0].ID}
+		if _, err := b.db.Exec("UPDATE audit_log SET details = 'Login X' WHERE id = ?", ids[1]); err != nil {
+			t.Fatal(err)
+		}
+		verification, _ = b.stores.Audit.Verify()
+		if verification.BrokenID != ids[1] || verification.Problem != repository.AuditModified || verification.Entries != 4 {
+			t.Errorf("Verify after modifying entry %d = %+v", ids[1], verification)
+		}
+		if _, err := b.db.Exec("DELETE FROM audit_log WHERE id IN (?, ?)", ids[0], ids[1]); err != nil {
+			t.Fatal(err)
+		}
+		verification, _ = b.stores.Audit.Verify()
+		if verification.BrokenID != ids[2] || verification.Problem != repository.AuditUnlinked {
+			t.Errorf("Verify after deleting the first entries = %+v, want entry %d unlinked", verification, ids[2])
+		}
+	})
+}
+
+func TestAuditArchive(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, b backend) {
+		admin := createUser(t, b.stores, "8401", "Ida", "admin")
+		for i := range 4 {
+			if err := b.stores.Audit.Log(repository.AuditEvent{UserID: admin.ID, Action: "login", Details: fmt.Sprintf("Login %d", i)}); err != nil {
+				t.Fatalf("Log failed: %v", err)
+			}
+		}
+
+		if rows, err := b.stores.Audit.Rows(time.Now().Add(-time.Hour)); err != nil || len(rows) != 0 {
+			t.Errorf("Rows before the first entry = %d rows, %v, want none", len(rows), err)
+		}
+		rows, err := b.stores.Audit.Rows(time.Now().Add(time.Hour))
+		if err != nil || len(rows) != 4 {
+			t.Fatalf("Rows = %d rows, %v, want 4", len(rows), err)
+		}
+		if rows[0].PrevHash != "" || rows[1].PrevHash != rows[0].Hash || rows[3].Details != "Login 3" ||
+			rows[2].AuditRecord.Hash(rows[2].PrevHash) != rows[2].Hash {
+			t.Errorf("Rows are not the chain, oldest first: %+v", rows)
+		}
+
+		archive := components.AuditArchive{
+			Name:          "audit-archive-1.jsonl.gz",
+			FirstID:       rows[0].ID,
+			LastID:        rows[1].ID,
+			Entries:       2,
+			FirstPrevHash: rows[0].PrevHash,
+			LastHash:      rows[1].Hash,
+			CreatedAt:     time.Now().UTC().Truncate(time.Second),
+		}
+		if err := b.stores.Audit.Archive(archive); err != nil {
+			t.Fatalf("Archive failed: %v", err)
+		}
+		archives, err := b.stores.Audit.Archives()
+		if err != nil || len(archives) != 1 || archives[0] != archive {
+			t.Errorf("Archives = %+v, %v, want %+v", archives, err, archive)
+		}
+
+		// The remaining entries and new ones continue the chain of the archive
+		if err := b.stores.Audit.Log(repository.AuditEvent{UserID: admin.ID, Action: "logout", Details: "Logout"}); err != nil {
+			t.Fatalf("Log after archiving failed: %v", err)
+		}
+		verification, err := b.stores.Audit.Verify()
+		if err != nil || !verification.Intact() || verification.Entries != 3 || verification.LastID <= rows[3].ID {
+			t.Errorf("Verify after archiving = %+v, %v, want 3 intact entries after entry %d", verification, err, rows[3].ID)
+		}
+		if _, err := b.stores.Audit.Hash(rows[0].ID); !errors.Is(err, repository.ErrNotFound) {
+			t.Errorf("Hash of an archived entry returned %v, want ErrNotFound", err)
+		}
+
+		// Only the oldest entries can be archived, and only all that were recorded
+		next := components.AuditArchive{Name: "audit-archive-2.jsonl.gz", FirstID: rows[3].ID, LastID: rows[3].ID, Entries: 1}
+		if err := b.stores.Audit.Archive(next); err == nil {
+			t.Error("Archive accepted a gap in the chain")
+		}
+		archiveAtomic := func(archive components.AuditArchive) error {
+			return b.stores.Atomic(func(tx repository.Stores) error {
+				return tx.Audit.Archive(archive)
+			})
+		}
+		next.FirstID, next.Entries = rows[2].ID, 5
+		if err := archiveAtomic(next); err == nil {
+			t.Error("Archive accepted a wrong number of entries")
+		}
+		next.Name, next.Entries = archive.Name, 2
+		if err := archiveAtomic(next); !errors.Is(err, repository.ErrDuplicate) {
+			t.Errorf("Archive with an existing name returned %v, want ErrDuplicate", err)
+		}
+		if verification, _ := b.stores.Audit.Verify(); verification.Entries != 3 {
+			t.Errorf("Failed archives deleted entries, %d left", verification.Entries)
+		}
+		if b.db == nil {
+			return
+		}
+
+		// A newer entry ends the entries to archive, even if older ones follow it
+		if _, err := b.db.Exec("UPDATE audit_log SET created_at = ? WHERE id = ?", database.FormatTime(time.Now().Add(2*time.Hour)), rows[3].ID); err != nil {
+			t.Fatal(err)
+		}
+		rows, err = b.stores.Audit.Rows(time.Now().Add(time.Hour))
+		if err != nil || len(rows) != 1 || rows[0].ID != next.FirstID {
+			t.Errorf("Rows up to a newer entry = %+v, %v, want only entry %d", rows, err, next.FirstID)
+		}
+	})
+}
+
+func TestAuditArchiveAll(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, b backend) {
+		admin := createUser(t, b.stores, "8501", "Jana", "admin")
+		for i := range 3 {
+			if err := b.stores.Audit.Log(repository.AuditEvent{UserID: admin.ID, Action: "login", Details: fmt.Sprintf("Login %d", i)}); err != nil {
+				t.Fatalf("Log failed: %v", err)
+			}
+		}
+		rows, err := b.stores.Audit.Rows(time.Now().Add(time.Hour))
+		if err != nil || len(rows) != 3 {
+			t.Fatalf("Rows = %d rows, %v, want 3", len(rows), err)
+		}
+		err = b.stores.Audit.Archive(components.AuditArchive{
+			Name:          "audit-archive-all.jsonl.gz",
+			FirstID:       rows[0].ID,
+			LastID:        rows[2].ID,
+			Entries:       3,
+			FirstPrevHash: rows[0].PrevHash,
+			LastHash:      rows[2].Hash,
+			CreatedAt:     time.Now().UTC().Truncate(time.Second),
+		})
+		if err != nil {
+			t.Fatalf("Archive failed: %v", err)
+		}
+
+		// The first entry of an empty log continues the chain of the archive
+		if err := b.stores.Audit.Log(repository.AuditEvent{UserID: admin.ID, Action: "logout", Details: "Logout"}); err != nil {
+			t.Fatalf("Log after archiving everything failed: %v", err)
+		}
+		verification, err := b.stores.Audit.Verify()
+		if err != nil || !verification.Intact() || verification.Entries != 1 {
+			t.Errorf("Verify after archiving everything = %+v, %v, want 1 intact entry", verification, err)
+		}
+		entries, _ := b.stores.Audit.List(repository.AuditFilter{}, 1, 0)
+		if len(entries) != 1 || entries[0].PrevHash != rows[2].Hash {
+			t.Errorf("New entry %+v does not follow the archived entry %s", entries, rows[2].Hash)
+		}
+	})
+}
+
+func TestAuditFilter(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, b backend) {
+		admin := createUser(t, b.stores, "8101", "Ida", "admin")
+		cashier := createUser(t, b.stores, "8102", "Kai", "cashier")
+		b.stores.Audit.Log(repository.AuditEvent{UserID: admin.ID, Action: "delete_user", Details: "Deleted user Olaf"})
+		b.stores.Audit.Log(repository.AuditEvent{UserID: cashier.ID, Action: "login", Details: "Login from 10.0.0.1"})
+		b.stores.Audit.Log(repository.AuditEvent{UserID: admin.ID, Action: "login", Details: "Login from 10.0.0.2"})
+
+		for _, tc := range []struct {
+			name   string
+			filter repository.AuditFilter
+			want   int
+		}{
+			{"user", repository.AuditFilter{UserID: admin.ID}, 2},
+			{"action", repository.AuditFilter{Action: "login"}, 2},
+			{"user and action", repository.AuditFilter{UserID: cashier.ID, Action: "login"}, 1},
+			{"search ignores case", repository.AuditFilter{Search: "olaf"}, 1},
+			{"from", repository.AuditFilter{From: time.Now().Add(-time.Hour)}, 3},
+			{"to", repository.AuditFilter{To: time.Now().Add(-time.Hour)}, 0},
+		} {
+			count, err := b.stores.Audit.Count(tc.filter)
+			if err != nil || count != tc.want {
+				t.Errorf("%s: Count = %d, %v, want %d", tc.name, count, err, tc.want)
+			}
+			entries, err := b.stores.Audit.List(tc.filter, 1, 0)
+			if err != nil || len(entries) != tc.want {
+				t.Errorf("%s: List = %d entries, %v, want %d", tc.name, len(entries), err, tc.want)
+			}
+		}
+
+		actions, err := b.stores.Audit.Actions()
+		if err != nil || !slices.Equal(actions, []string{"delete_user", "login"}) {
+			t.Errorf("Actions = %v, %v, want delete_user and login", actions, err)
+		}
+	})
+}
+
+func TestAtomic(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, b backend) {
+		user := createUser(t, b.stores, "9001", "Jan", "customer")
+		failure := errors.New("failure")
+
+		err := b.stores.Atomic(func(tx repository.Stores) error {
+			if _, err := tx.Users.AdjustBalance(user.ID, 5); err != nil {
+				return err
+			}
+			if err := tx.Audit.Log(repository.AuditEvent{UserID: user.ID, Action: "topup", Details: "5"}); err != nil {
+				return err
+			}
+			return failure
+		})
+		if err != failure {
+			t.Fatalf("Atomic returned %v, want the error of fn", err)
+		}
+		got, _ := b.stores.Users.Get(user.ID)
+		if got.Balance != 0 {
+			t.Errorf("Balance = %v after a failed Atomic, want 0", got.Balance)
+		}
+		if count, _ := b.stores.Audit.Count(repository.AuditFilter{}); count != 0 {
+			t.Errorf("Audit log has %d entries after a failed Atomic, want 0", count)
+		}
+
+		err = b.stores.Atomic(func(tx repository.Stores) error {
+			_, err := tx.Users.AdjustBalance(user.ID, 5)
+			return err
+		})
+		if err != nil {
+			t.Fatalf("Atomic failed: %v", err)
+		}
+		got, _ = b.stores.Users.Get(user.ID)
+		if got.Balance != 5 {
+			t.Errorf("Balance = %v, want 5", got.Balance)
+		}
+	})
+}
@@ -0,0 +1,204 @@
+package server_test
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"gopos/config"
+	"gopos/server"
+)
+
+// acmeStandIn is a minimal ACME server in the manner of Pebble. It accepts
+// every account, offers only the HTTP-01 challenge, validates it against
+// challengeAddr and issues certificates from the test CA. Signatures are not
+// checked.
+type acmeStandIn struct {
+	t             *testing.T
+	ca            *testCA
+	url           string
+	challengeAddr string
+
+	mu         sync.Mutex
+	domain     string
+	authzValid bool
+	cert       []byte
+}
+
+func newACMEStandIn(t *testing.T, ca *testCA) (*acmeStandIn, *httptest.Server) {
+	s := &acmeStandIn{t: t, ca: ca}
+	srv := httptest.NewTLSServer(http.HandlerFunc(s.serveHTTP))
+	t.Cleanup(srv.Close)
+	s.url = srv.URL
+	return s, srv
+}
+
+// payload returns the decoded payload of a JWS request
+func (s *acmeStandIn) payload(r *http.Request) []byte {
+	var jws struct{ Payload string }
+	json.NewDecoder(r.Body).Decode(&jws)
+	payload, _ := base64.RawURLEncoding.DecodeString(jws.Payload)
+	return payload
+}
+
+func (s *acmeStandIn) order() map[string]any {
+	order := map[string]any{
+		"status":         "pending",
+		"identifiers":    []map[string]string{{"type": "dns", "value": s.domain}},
+		"authorizations": []string{s.url + "/authz/1"},
+		"finalize":       s.url + "/finalize/1",
+	}
+	if s.authzValid {
+		order["status"] = "ready"
+	}
+	if s.cert != nil {
+		order["status"] = "valid"
+		order["certificate"] = s.url + "/cert/1"
+	}
+	return order
+}
+
+func (s *acmeStandIn) challenge() map[string]any {
+	status := "pending"
+	if s.authzValid {
+		status = "valid"
+	}
+	return map[string]any{"type": "http-01", "url": s.url + "/chall/1", "token": "token1", "status": status}
+}
+
+func (s *acmeStandIn) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	w.Header().Set("Replay-Nonce", fmt.Sprintf("nonce%d", len(r.URL.Path)))
+	reply := func(status int, v any) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(v)
+	}
+
+	switch r.URL.Path {
+	case "/dir":
+		reply(http.StatusOK, map[string]string{
+			"newNonce":   s.url + "/nonce",
+			"newAccount": s.url + "/account",
+			"newOrder":   s.url + "/order",
+		})
+	case "/nonce":
+		w.WriteHeader(http.StatusOK)
+	case "/account":
+		w.Header().Set("Location", s.url+"/account/1")
+		reply(http.StatusCreated, map[string]string{"status": "valid"})
+	case "/order":
+		var req struct {
+			Identifiers []struct{ Value string }
+		}
+		json.Unmarshal(s.payload(r), &req)
+		s.domain = req.Identifiers[0].Value
+		w.Header().Set("Location", s.url+"/order/1")
+		reply(http.StatusCreated, s.order())
+	case "/order/1":
+		w.Header().Set("Location", s.url+"/order/1")
+		reply(http.StatusOK, s.order())
+	case "/authz/1":
+		status := "pending"
+		if s.authzValid {
+			status = "valid"
+		}
+		reply(http.StatusOK, map[string]any{
+			"status":     status,
+			"identifier": map[string]string{"type": "dns", "value": s.domain},
+			"challenges": []map[string]any{s.challenge()},
+		})
+	case "/chall/1":
+		// Fetch the key authorization from the server like a CA would
+		req, _ := http.NewRequest("GET", "http://"+s.challengeAddr+"/.well-known/acme-challenge/token1", nil)
+		req.Host = s.domain
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			s.t.Errorf("Challenge request failed: %v", err)
+			reply(http.StatusOK, s.challenge())
+			return
+		}
+		body, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK || !strings.HasPrefix(string(body), "token1.") {
+			s.t.Errorf("Challenge answered with %d %q", res.StatusCode, body)
+		} else {
+			s.authzValid = true
+		}
+		reply(http.StatusOK, s.challenge())
+	case "/finalize/1":
+		var req struct{ CSR string }
+		json.Unmarshal(s.payload(r), &req)
+		der, _ := base64.RawURLEncoding.DecodeString(req.CSR)
+		csr, err := x509.ParseCertificateRequest(der)
+		if err != nil {
+			s.t.Errorf("Invalid CSR: %v", err)
+			reply(http.StatusBadRequest, map[string]string{"type": "urn:ietf:params:acme:error:badCSR"})
+			return
+		}
+		s.cert = append(s.ca.issue(s.t, 200, csr.PublicKey, csr.DNSNames...), s.ca.pem...)
+		w.Header().Set("Location", s.url+"/order/1")
+		reply(http.StatusOK, s.order())
+	case "/cert/1":
+		w.Header().Set("Content-Type", "application/pem-certificate-chain")
+		w.Write(s.cert)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestACMECertificate(t *testing.T) {
+	ca := newTestCA(t)
+	acmeServer, acmeHTTPS := newACMEStandIn(t, ca)
+
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "acme-ca.pem")
+	os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: acmeHTTPS.Certificate().Raw}), 0644)
+
+	cfg := config.Default()
+	cfg.Session.Key = "key"
+	cfg.TLS.RedirectListen = ":80"
+	cfg.TLS.ACME.Domains = []string{"pos.test"}
+	cfg.TLS.ACME.DirectoryURL = acmeServer.url + "/dir"
+	cfg.TLS.ACME.CAFile = caFile
+	cfg.TLS.ACME.CacheDir = filepath.Join(dir, "certs")
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Validate failed: %v", err)
+	}
+
+	tlsSetup, err := server.NewTLS(cfg)
+	if err != nil {
+		t.Fatalf("NewTLS failed: %v", err)
+	}
+	redirect := httptest.NewServer(tlsSetup.RedirectHandler())
+	t.Cleanup(redirect.Close)
+	acmeServer.challengeAddr = strings.TrimPrefix(redirect.URL, "http://")
+	addr := serveTLS(t, tlsSetup.Config, http.NotFoundHandler())
+
+	// The first connection obtains the certificate
+	if serial := serverCertificate(t, addr, ca.pool()).SerialNumber.Int64(); serial != 200 {
+		t.Errorf("Serial = %d, want the certificate issued over ACME", serial)
+	}
+
+	// It is kept in the cache directory for the next start
+	entries, _ := os.ReadDir(cfg.TLS.ACME.CacheDir)
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	if !strings.Contains(strings.Join(names, " "), "pos.test") {
+		t.Errorf("Cache directory holds %v, want the certificate for pos.test", names)
+	}
+}
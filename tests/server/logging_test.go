@@ -0,0 +1,64 @@
+package server_test
+
+import (
+	"bytes"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"gopos/logging"
+	"gopos/server"
+)
+
+func TestRequestLogger(t *testing.T) {
+	previous := slog.Default()
+	t.Cleanup(func() { slog.SetDefault(previous) })
+	var buf bytes.Buffer
+	if err := logging.Setup(&buf, "info", "text"); err != nil {
+		t.Fatal(err)
+	}
+
+	var handlerID string
+	handler := server.RequestLogger(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handlerID = logging.RequestID(r.Context())
+		w.WriteHeader(http.StatusTeapot)
+	}))
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/users", nil))
+	id := rr.Header().Get("X-Request-ID")
+	if id == "" || id != handlerID {
+		t.Errorf("X-Request-ID = %q, handler saw %q, want the same new ID", id, handlerID)
+	}
+	if line := buf.String(); !strings.Contains(line, "request_id="+id) || !strings.Contains(line, "status=418") || !strings.Contains(line, "path=/users") {
+		t.Errorf("Unexpected request log:\n%s", line)
+	}
+
+	// The ID of a proxy is kept, unless it is not a plain token
+	rr = httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("X-Request-ID", "proxy-42")
+	handler.ServeHTTP(rr, req)
+	if got := rr.Header().Get("X-Request-ID"); got != "proxy-42" {
+		t.Errorf("X-Request-ID = %q, want the ID of the proxy", got)
+	}
+
+	rr = httptest.NewRecorder()
+	req = httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("X-Request-ID", "bad id\nlevel=ERROR")
+	handler.ServeHTTP(rr, req)
+	if got := rr.Header().Get("X-Request-ID"); got == "" || strings.Contains(got, " ") {
+		t.Errorf("X-Request-ID = %q, want a new ID instead of the invalid one", got)
+	}
+
+	// Static files and health checks are only logged at debug level
+	for _, path := range []string{"/static/css/output.css", "/healthz", "/readyz"} {
+		buf.Reset()
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+		if buf.Len() != 0 {
+			t.Errorf("%s was logged at info level:\n%s", path, buf.String())
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package server_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gopos/config"
+	"gopos/server"
+)
+
+// testCA issues certificates for the tests
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "GoPOS Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue returns a PEM certificate for the key, valid for the given names
+func (ca *testCA) issue(t *testing.T, serial int64, pub any, names ...string) []byte {
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, pub, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+func (ca *testCA) pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	return pool
+}
+
+// writeKeyPair writes a certificate and its key to the files
+func writeKeyPair(t *testing.T, ca *testCA, serial int64, certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(certFile, ca.issue(t, serial, &key.PublicKey, "pos.test"), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// serveTLS serves handler with the TLS configuration and returns the address
+func serveTLS(t *testing.T, tlsConfig *tls.Config, handler http.Handler) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: handler, TLSConfig: tlsConfig}
+	go srv.ServeTLS(listener, "", "")
+	t.Cleanup(func() { srv.Close() })
+	return listener.Addr().String()
+}
+
+// serverCertificate connects to addr and returns the certificate the server presents
+func serverCertificate(t *testing.T, addr string, roots *x509.CertPool) *x509.Certificate {
+	conn, err := tls.Dial("tcp", addr, &tls.Config{ServerName: "pos.test", RootCAs: roots})
+	if err != nil {
+		t.Fatalf("TLS handshake failed: %v", err)
+	}
+	defer conn.Close()
+	return conn.ConnectionState().PeerCertificates[0]
+}
+
+func TestCertificateFilesAreReloaded(t *testing.T) {
+	ca := newTestCA(t)
+	dir := t.TempDir()
+	cfg := config.Default()
+	cfg.TLS.CertFile = filepath.Join(dir, "cert.pem")
+	cfg.TLS.KeyFile = filepath.Join(dir, "key.pem")
+	writeKeyPair(t, ca, 100, cfg.TLS.CertFile, cfg.TLS.KeyFile)
+
+	tlsSetup, err := server.NewTLS(cfg)
+	if err != nil {
+		t.Fatalf("NewTLS failed: %v", err)
+	}
+	addr := serveTLS(t, tlsSetup.Config, http.NotFoundHandler())
+
+	if serial := serverCertificate(t, addr, ca.pool()).SerialNumber.Int64(); serial != 100 {
+		t.Fatalf("Serial = %d, want the certificate from the files", serial)
+	}
+
+	// A renewed certificate is used without a restart
+	writeKeyPair(t, ca, 101, cfg.TLS.CertFile, cfg.TLS.KeyFile)
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(cfg.TLS.CertFile, future, future)
+	if serial := serverCertificate(t, addr, ca.pool()).SerialNumber.Int64(); serial != 101 {
+		t.Errorf("Serial = %d, want the renewed certificate", serial)
+	}
+
+	// A broken file keeps the last good certificate
+	os.WriteFile(cfg.TLS.CertFile, []byte("not a certificate"), 0644)
+	if serial := serverCertificate(t, addr, ca.pool()).SerialNumber.Int64(); serial != 101 {
+		t.Errorf("Serial = %d, want the last good certificate", serial)
+	}
+}
+
+func TestNewTLSWithoutConfiguration(t *testing.T) {
+	tlsSetup, err := server.NewTLS(config.Default())
+	if err != nil || tlsSetup != nil {
+		t.Errorf("NewTLS = %v, %v, want nothing without TLS settings", tlsSetup, err)
+	}
+}
+
+func TestRedirectAndHSTS(t *testing.T) {
+	ca := newTestCA(t)
+	dir := t.TempDir()
+	cfg := config.Default()
+	cfg.Server.Listen = ":8443"
+	cfg.TLS.CertFile = filepath.Join(dir, "cert.pem")
+	cfg.TLS.KeyFile = filepath.Join(dir, "key.pem")
+	cfg.TLS.HSTSMaxAge = 24 * time.Hour
+	writeKeyPair(t, ca, 1, cfg.TLS.CertFile, cfg.TLS.KeyFile)
+
+	tlsSetup, err := server.NewTLS(cfg)
+	if err != nil {
+		t.Fatalf("NewTLS failed: %v", err)
+	}
+
+	rr := httptest.NewRecorder()
+	tlsSetup.RedirectHandler().ServeHTTP(rr, httptest.NewRequest("GET", "http://pos.test/users?page=2", nil))
+	if rr.Code != http.StatusMovedPermanently || rr.Header().Get("Location") != "https://pos.test:8443/users?page=2" {
+		t.Errorf("Redirect = %d %q, want the same page over HTTPS", rr.Code, rr.Header().Get("Location"))
+	}
+
+	// Form posts are not redirected, the browser would send them again without the body
+	rr = httptest.NewRecorder()
+	tlsSetup.RedirectHandler().ServeHTTP(rr, httptest.NewRequest("POST", "http://pos.test/login", nil))
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("POST over HTTP = %d, want %d", rr.Code, http.StatusBadRequest)
+	}
+
+	rr = httptest.NewRecorder()
+	tlsSetup.HSTS(http.NotFoundHandler()).ServeHTTP(rr, httptest.NewRequest("GET", "https://pos.test/", nil))
+	if got := rr.Header().Get("Strict-Transport-Security"); got != "max-age=86400" {
+		t.Errorf("Strict-Transport-Security = %q, want max-age=86400", got)
+	}
+}
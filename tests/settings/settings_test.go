@@ -0,0 +1,141 @@
+package settings_test
+
+import (
+	"bytes"
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gopos/components"
+	"gopos/database"
+	"gopos/services"
+
+	_ "modernc.org/sqlite"
+)
+
+func setupTestDB(t *testing.T) *sql.DB {
+	db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Failed to open test database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	if err := database.InitDB(db); err != nil {
+		t.Fatalf("Failed to initialize test database: %v", err)
+	}
+	if err := services.LoadSettings(db); err != nil {
+		t.Fatalf("Failed to load settings: %v", err)
+	}
+	return db
+}
+
+func TestDefaultSettings(t *testing.T) {
+	setupTestDB(t)
+
+	if settings := services.GetSettings(); settings != components.DefaultSettings() {
+		t.Errorf("Settings of a new database = %+v, want the defaults", settings)
+	}
+	if money := services.FormatMoney(12.5); money != "12.50 €" {
+		t.Errorf("FormatMoney(12.5) = %q, want 12.50 €", money)
+	}
+}
+
+func TestSaveSettings(t *testing.T) {
+	db := setupTestDB(t)
+
+	saved := components.Settings{
+		StoreName:     "Kiosk am See",
+		Currency:      "CHF",
+		Timezone:      "Europe/Zurich",
+		ReceiptFooter: "Danke für Ihren Einkauf",
+	}
+	if err := services.SaveSettings(db, saved, nil); err != nil {
+		t.Fatalf("Failed to save settings: %v", err)
+	}
+	if settings := services.GetSettings(); settings != saved {
+		t.Errorf("Active settings = %+v, want %+v", settings, saved)
+	}
+
+	// Saving again updates the stored values instead of adding new ones
+	saved.StoreName = "Kiosk am Strand"
+	if err := services.SaveSettings(db, saved, nil); err != nil {
+		t.Fatalf("Failed to save settings again: %v", err)
+	}
+
+	// Another start reads them from the database
+	if err := services.LoadSettings(db); err != nil {
+		t.Fatalf("Failed to load settings: %v", err)
+	}
+	if settings := services.GetSettings(); settings != saved {
+		t.Errorf("Loaded settings = %+v, want %+v", settings, saved)
+	}
+	if location := services.GetSettings().Location(); location.String() != "Europe/Zurich" {
+		t.Errorf("Location = %s, want Europe/Zurich", location)
+	}
+	if money := services.FormatMoney(3); money != "3.00 CHF" {
+		t.Errorf("FormatMoney(3) = %q, want 3.00 CHF", money)
+	}
+}
+
+func TestLoadSettingsWithUnknownTimezone(t *testing.T) {
+	db := setupTestDB(t)
+
+	// A timezone the system does not know falls back to the server timezone
+	if _, err := db.Exec("INSERT INTO settings (key, value) VALUES ('timezone', 'Mars/Olympus')"); err != nil {
+		t.Fatalf("Failed to store timezone: %v", err)
+	}
+	if err := services.LoadSettings(db); err != nil {
+		t.Fatalf("Failed to load settings: %v", err)
+	}
+	if settings := services.GetSettings(); settings.Timezone != "Mars/Olympus" || settings.Location() != time.Local {
+		t.Errorf("Settings with an unknown timezone = %+v", settings)
+	}
+}
+
+func TestLogo(t *testing.T) {
+	db := setupTestDB(t)
+
+	if _, _, err := services.GetLogo(db); err != sql.ErrNoRows {
+		t.Errorf("GetLogo without a logo returned %v, want sql.ErrNoRows", err)
+	}
+
+	// The logo is saved together with the other settings
+	logo := []byte("\x89PNG\r\n\x1a\nlogo")
+	settings := services.GetSettings()
+	settings.StoreName = "Mit Logo"
+	if err := services.SaveSettings(db, settings, &services.Logo{Image: logo, ContentType: "image/png"}); err != nil {
+		t.Fatalf("Failed to save logo: %v", err)
+	}
+	image, contentType, err := services.GetLogo(db)
+	if err != nil || !bytes.Equal(image, logo) || contentType != "image/png" {
+		t.Errorf("GetLogo = %q, %q, %v, want the saved PNG", image, contentType, err)
+	}
+	if settings := services.GetSettings(); !settings.HasLogo || settings.StoreName != "Mit Logo" {
+		t.Errorf("Settings after saving a logo = %+v, want the new name and a logo", settings)
+	}
+
+	// Saving the other settings without a logo keeps the logo
+	settings = services.GetSettings()
+	settings.StoreName = "Noch mit Logo"
+	settings.HasLogo = false
+	if err := services.SaveSettings(db, settings, nil); err != nil {
+		t.Fatalf("Failed to save settings: %v", err)
+	}
+	if err := services.LoadSettings(db); err != nil {
+		t.Fatalf("Failed to load settings: %v", err)
+	}
+	if !services.GetSettings().HasLogo {
+		t.Error("Saving the settings removed the logo")
+	}
+
+	if err := services.SaveSettings(db, services.GetSettings(), &services.Logo{}); err != nil {
+		t.Fatalf("Failed to remove logo: %v", err)
+	}
+	if _, _, err := services.GetLogo(db); err != sql.ErrNoRows {
+		t.Errorf("GetLogo after removing the logo returned %v, want sql.ErrNoRows", err)
+	}
+	if services.GetSettings().HasLogo {
+		t.Error("Settings still have a logo after removing it")
+	}
+}